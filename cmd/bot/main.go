@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"tgwow/internal/config"
 	"tgwow/internal/handlers"
 	"tgwow/internal/logger"
+	"tgwow/internal/payment"
 	"tgwow/internal/storage"
 )
 
@@ -43,13 +45,99 @@ func waitForDB(databaseURL string, maxRetries int) (*storage.PostgresStorage, er
 	return nil, fmt.Errorf("failed to connect to database after %d attempts: %w", maxRetries, err)
 }
 
+// openStorage создает хранилище в зависимости от STORAGE_DRIVER
+func openStorage(cfg *config.Config) (storage.Store, error) {
+	if cfg.StorageDriver == "memory" {
+		log.Println("Using in-memory storage (data is lost on restart)")
+		mem := storage.NewMemoryStorage()
+		if err := mem.SeedDemoData(context.Background()); err != nil {
+			return nil, fmt.Errorf("failed to seed memory storage: %w", err)
+		}
+		return mem, nil
+	}
+
+	// Wait for database to be ready with retry logic
+	db, err := waitForDB(cfg.DatabaseURL, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	// Применяем новые миграции до начала обработки обновлений
+	if err := applyMigrations(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to apply migrations: %w", err)
+	}
+
+	return db, nil
+}
+
+// newPaymentRegistry создает способы оплаты, упомянутые в PAYMENT_METHODS и PAYMENT_METHODS_<РЕГИОН>.
+// Для каждого способа проверяются его собственные настройки
+func newPaymentRegistry(cfg *config.Config) (*payment.Registry, error) {
+	enabled := make(map[string]bool)
+	for _, code := range cfg.PaymentMethods {
+		enabled[code] = true
+	}
+	for _, codes := range cfg.RegionPaymentMethods {
+		for _, code := range codes {
+			enabled[code] = true
+		}
+	}
+
+	var methods []payment.Method
+	for code := range enabled {
+		switch code {
+		case payment.CodeCard:
+			if cfg.PaymentCardNumber == "" {
+				log.Println("PAYMENT_CARD_NUMBER is not set, card payments use only payout cards added in /cards")
+			}
+			methods = append(methods, payment.NewCard(cfg.PaymentCardNumber))
+
+		case payment.CodeTelegram:
+			if cfg.PaymentProviderToken == "" {
+				return nil, fmt.Errorf("PAYMENT_PROVIDER_TOKEN is required for payment method telegram")
+			}
+			methods = append(methods, payment.NewTelegram(cfg.PaymentProviderToken))
+
+		case payment.CodeStars:
+			rates, err := payment.ParseRates(cfg.StarsRates)
+			if err != nil {
+				return nil, fmt.Errorf("invalid STARS_RATES: %w", err)
+			}
+			methods = append(methods, payment.NewStars(rates))
+
+		case payment.CodeCrypto:
+			if cfg.CryptoWallet == "" {
+				return nil, fmt.Errorf("CRYPTO_WALLET is required for payment method crypto")
+			}
+			rates, err := payment.ParseRates(cfg.CryptoRates)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CRYPTO_RATES: %w", err)
+			}
+			methods = append(methods, payment.NewCrypto(cfg.CryptoWallet, cfg.CryptoAsset, rates))
+
+		case payment.CodeMock:
+			log.Println("Warning: mock payment method is enabled, orders can be paid without money")
+			methods = append(methods, payment.NewMock())
+
+		default:
+			return nil, fmt.Errorf("unknown payment method %q", code)
+		}
+	}
+
+	return payment.NewRegistry(methods, cfg.PaymentMethods, cfg.RegionPaymentMethods)
+}
+
 // setupBotCommands configures the bot command menu for users and admins
 func setupBotCommands(bot *tgbotapi.BotAPI, adminChatIDs []int64) error {
 	// Commands for all users
 	userCommands := []tgbotapi.BotCommand{
 		{Command: "start", Description: "Начать работу с ботом"},
 		{Command: "products", Description: "Посмотреть каталог подписок"},
+		{Command: "cart", Description: "Корзина"},
 		{Command: "my_orders", Description: "Мои заказы"},
+		{Command: "balance", Description: "Бонусный баланс"},
+		{Command: "referral", Description: "Пригласить друга"},
 	}
 
 	// Set commands for all users (default scope)
@@ -62,8 +150,18 @@ func setupBotCommands(bot *tgbotapi.BotAPI, adminChatIDs []int64) error {
 	adminCommands := []tgbotapi.BotCommand{
 		{Command: "start", Description: "Начать работу с ботом"},
 		{Command: "products", Description: "Посмотреть каталог подписок"},
+		{Command: "cart", Description: "Корзина"},
 		{Command: "my_orders", Description: "Мои заказы"},
+		{Command: "balance", Description: "Бонусный баланс"},
+		{Command: "referral", Description: "Пригласить друга"},
 		{Command: "admin", Description: "Админ-панель"},
+		{Command: "promos", Description: "Промокоды"},
+		{Command: "cards", Description: "Карты для оплаты"},
+		{Command: "reconcile", Description: "Сверка выписки банка"},
+		{Command: "balance_adjust", Description: "Изменить бонусный баланс"},
+		{Command: "support", Description: "Переписка по заказу"},
+		{Command: "order", Description: "Найти заказ по номеру"},
+		{Command: "orders", Description: "Все заказы с фильтрами"},
 	}
 
 	// Set commands for each admin
@@ -79,6 +177,14 @@ func setupBotCommands(bot *tgbotapi.BotAPI, adminChatIDs []int64) error {
 }
 
 func main() {
+	// Подкоманда: bot migrate up|down [N]|status
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
 	// Инициализируем логирование в файл + stdout
 	if err := logger.Init(); err != nil {
 		log.Printf("Warning: Failed to init file logging: %v", err)
@@ -98,10 +204,15 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	// Wait for database to be ready with retry logic
-	db, err := waitForDB(cfg.DatabaseURL, 5)
+	payments, err := newPaymentRegistry(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure payment methods: %v", err)
+	}
+	log.Printf("Payment methods: %s", strings.Join(payments.Codes(), ", "))
+
+	db, err := openStorage(cfg)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		log.Fatalf("Failed to open storage: %v", err)
 	}
 	defer db.Close()
 
@@ -120,7 +231,13 @@ func main() {
 		log.Println("Bot commands configured successfully")
 	}
 
-	h := handlers.NewHandler(bot, db, cfg.AdminChatIDs, cfg.PaymentCardNumber)
+	h := handlers.NewHandler(bot, db, cfg.AdminChatIDs, payments)
+	h.SetReferralBonus(cfg.ReferralBonusPercent)
+	h.SetOrderLimits(cfg.OrderDedupWindow, cfg.MaxPendingOrders)
+	h.SetPayoutCardRotation(cfg.PayoutCardRotation)
+	h.StartOrderExpiry(cfg.OrderExpiry)
+	h.StartRenewalReminders(cfg.RenewalReminderDays)
+	h.StartPreorderRelease()
 
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
@@ -157,6 +274,8 @@ func main() {
 			h.HandleMessage(update.Message)
 		} else if update.CallbackQuery != nil {
 			h.HandleCallback(update.CallbackQuery)
+		} else if update.PreCheckoutQuery != nil {
+			h.HandlePreCheckoutQuery(update.PreCheckoutQuery)
 		}
 	}
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"tgwow/internal/config"
+	"tgwow/internal/migrate"
+	"tgwow/internal/storage"
+	"tgwow/migrations"
+)
+
+// migrationTimeout - максимальное время на применение или откат миграций
+const migrationTimeout = 5 * time.Minute
+
+// applyMigrations применяет все новые миграции при старте бота
+func applyMigrations(db *storage.PostgresStorage) error {
+	migrator, err := migrate.New(db.Pool(), migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+
+	applied, err := migrator.Up(ctx)
+	for _, m := range applied {
+		log.Printf("Applied migration %03d_%s", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		log.Println("Database schema is up to date")
+	}
+
+	return nil
+}
+
+// runMigrateCommand выполняет `bot migrate up|down [N]|status`
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: bot migrate up|down [N]|status")
+	}
+
+	databaseURL, err := config.LoadDatabaseURL()
+	if err != nil {
+		return err
+	}
+
+	db, err := waitForDB(databaseURL, 5)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrate.New(db.Pool(), migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied  %03d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid number of steps '%s': %w", args[1], err)
+			}
+		}
+
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %03d_%s\n", m.Version, m.Name)
+		}
+		return err
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			if s.Applied {
+				fmt.Printf("[x] %03d_%s (applied %s)\n", s.Version, s.Name, s.AppliedAt.Format("2006-01-02 15:04:05"))
+			} else {
+				fmt.Printf("[ ] %03d_%s\n", s.Version, s.Name)
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown migrate command '%s': expected up, down or status", args[0])
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -12,9 +13,57 @@ import (
 type Config struct {
 	BotToken             string
 	AdminChatIDs         []int64 // Список ID администраторов
+	StorageDriver        string  // postgres (по умолчанию) или memory
 	DatabaseURL          string
-	PaymentProviderToken string // Опционально для Telegram Payments
-	PaymentCardNumber    string // Номер карты для оплаты
+	PaymentProviderToken string        // Опционально для Telegram Payments
+	PaymentCardNumber    string        // Номер карты для оплаты, если в пуле карт нет подходящей
+	PayoutCardRotation   string        // Политика выбора карты из пула: round_robin (по умолчанию) или priority
+	OrderExpiry          time.Duration // Через сколько отменять неоплаченные заказы, 0 - не отменять
+	ReferralBonusPercent int           // Бонус пригласившему в процентах от первого оплаченного заказа, 0 - без бонуса
+	OrderDedupWindow     time.Duration // Повторное «Купить» в этот срок возвращает уже созданный заказ, 0 - не проверять
+	MaxPendingOrders     int           // Сколько неоплаченных заказов может быть у покупателя одновременно, 0 - без ограничения
+	RenewalReminderDays  int           // За сколько дней до окончания подписки напоминать о продлении, 0 - не напоминать
+
+	// Способы оплаты (коды из пакета payment)
+	PaymentMethods       []string            // PAYMENT_METHODS: для всех регионов
+	RegionPaymentMethods map[string][]string // PAYMENT_METHODS_<КОД РЕГИОНА>: переопределение для региона
+	StarsRates           string              // STARS_RATES: звезд за единицу валюты, "RUB=0.75,KZT=0.16"
+	CryptoWallet         string              // CRYPTO_WALLET: адрес кошелька
+	CryptoAsset          string              // CRYPTO_ASSET: монета и сеть, по умолчанию USDT (TRC20)
+	CryptoRates          string              // CRYPTO_RATES: единиц монеты за единицу валюты
+}
+
+// DefaultOrderExpiry - срок оплаты заказа, если ORDER_EXPIRY не задан
+const DefaultOrderExpiry = 24 * time.Hour
+
+// DefaultReferralBonusPercent - бонус пригласившему, если REFERRAL_BONUS_PERCENT не задан
+const DefaultReferralBonusPercent = 10
+
+// DefaultOrderDedupWindow - срок защиты от повторного заказа, если ORDER_DEDUP_WINDOW не задан
+const DefaultOrderDedupWindow = 2 * time.Minute
+
+// DefaultMaxPendingOrders - лимит неоплаченных заказов, если MAX_PENDING_ORDERS не задан
+const DefaultMaxPendingOrders = 3
+
+// DefaultRenewalReminderDays - срок напоминания о продлении, если RENEWAL_REMINDER_DAYS не задан
+const DefaultRenewalReminderDays = 3
+
+// DefaultCryptoAsset - монета и сеть для оплаты криптовалютой, если CRYPTO_ASSET не задан
+const DefaultCryptoAsset = "USDT (TRC20)"
+
+// regionPaymentMethodsPrefix - префикс переменных со способами оплаты для отдельного региона
+const regionPaymentMethodsPrefix = "PAYMENT_METHODS_"
+
+// LoadDatabaseURL читает только DATABASE_URL (для команды migrate, которой не нужен токен бота)
+func LoadDatabaseURL() (string, error) {
+	_ = godotenv.Load()
+
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		return "", fmt.Errorf("DATABASE_URL is required")
+	}
+
+	return databaseURL, nil
 }
 
 func Load() (*Config, error) {
@@ -50,25 +99,143 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("at least one ADMIN_CHAT_ID is required")
 	}
 
+	// Хранилище: postgres (по умолчанию) или memory для локального запуска без БД
+	storageDriver := strings.ToLower(strings.TrimSpace(os.Getenv("STORAGE_DRIVER")))
+	if storageDriver == "" {
+		storageDriver = "postgres"
+	}
+	if storageDriver != "postgres" && storageDriver != "memory" {
+		return nil, fmt.Errorf("invalid STORAGE_DRIVER '%s': expected postgres or memory", storageDriver)
+	}
+
 	databaseURL := os.Getenv("DATABASE_URL")
-	if databaseURL == "" {
+	if databaseURL == "" && storageDriver == "postgres" {
 		return nil, fmt.Errorf("DATABASE_URL is required")
 	}
 
 	// Опциональный payment provider token
 	paymentToken := os.Getenv("PAYMENT_PROVIDER_TOKEN")
 
-	// Номер карты для оплаты (обязательно)
+	// Номер карты по умолчанию: на него переводят, если в пуле карт из админки нет подходящей
 	paymentCard := os.Getenv("PAYMENT_CARD_NUMBER")
-	if paymentCard == "" {
-		return nil, fmt.Errorf("PAYMENT_CARD_NUMBER is required")
+
+	// Как выбирать карту из пула: дольше всех не выдававшуюся или по порядку добавления до исчерпания лимита
+	payoutCardRotation := strings.ToLower(strings.TrimSpace(os.Getenv("PAYOUT_CARD_ROTATION")))
+	if payoutCardRotation == "" {
+		payoutCardRotation = "round_robin"
+	}
+	if payoutCardRotation != "round_robin" && payoutCardRotation != "priority" {
+		return nil, fmt.Errorf("invalid PAYOUT_CARD_ROTATION '%s': expected round_robin or priority", payoutCardRotation)
+	}
+
+	// Способы оплаты. По умолчанию - перевод на карту и Telegram Payments, если задан токен
+	paymentMethods := parseList(os.Getenv("PAYMENT_METHODS"))
+	if len(paymentMethods) == 0 {
+		paymentMethods = []string{"card"}
+		if paymentToken != "" {
+			paymentMethods = append(paymentMethods, "telegram")
+		}
+	}
+
+	regionPaymentMethods := make(map[string][]string)
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		region := strings.TrimPrefix(key, regionPaymentMethodsPrefix)
+		if region == key || region == "" {
+			continue
+		}
+		methods := parseList(value)
+		if len(methods) == 0 {
+			return nil, fmt.Errorf("%s must list at least one payment method", key)
+		}
+		regionPaymentMethods[strings.ToUpper(region)] = methods
+	}
+
+	cryptoAsset := strings.TrimSpace(os.Getenv("CRYPTO_ASSET"))
+	if cryptoAsset == "" {
+		cryptoAsset = DefaultCryptoAsset
+	}
+
+	// Срок оплаты заказа в формате Go duration (30m, 24h). 0 отключает автоотмену
+	orderExpiry := DefaultOrderExpiry
+	if raw := strings.TrimSpace(os.Getenv("ORDER_EXPIRY")); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid ORDER_EXPIRY '%s': expected duration like 30m or 24h", raw)
+		}
+		orderExpiry = parsed
+	}
+
+	// Бонус за приглашенного пользователя в процентах от его первого оплаченного заказа
+	referralBonus := DefaultReferralBonusPercent
+	if raw := strings.TrimSpace(os.Getenv("REFERRAL_BONUS_PERCENT")); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 || parsed > 100 {
+			return nil, fmt.Errorf("invalid REFERRAL_BONUS_PERCENT '%s': expected integer from 0 to 100", raw)
+		}
+		referralBonus = parsed
+	}
+
+	// Повторное нажатие «Купить» или повторная доставка callback в этот срок не создает второй заказ
+	orderDedupWindow := DefaultOrderDedupWindow
+	if raw := strings.TrimSpace(os.Getenv("ORDER_DEDUP_WINDOW")); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid ORDER_DEDUP_WINDOW '%s': expected duration like 30s or 2m", raw)
+		}
+		orderDedupWindow = parsed
+	}
+
+	// Лимит одновременных неоплаченных заказов одного покупателя
+	maxPendingOrders := DefaultMaxPendingOrders
+	if raw := strings.TrimSpace(os.Getenv("MAX_PENDING_ORDERS")); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid MAX_PENDING_ORDERS '%s': expected non-negative integer", raw)
+		}
+		maxPendingOrders = parsed
+	}
+
+	// Напоминание о продлении подписки за несколько дней до ее окончания
+	renewalReminderDays := DefaultRenewalReminderDays
+	if raw := strings.TrimSpace(os.Getenv("RENEWAL_REMINDER_DAYS")); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 || parsed > 60 {
+			return nil, fmt.Errorf("invalid RENEWAL_REMINDER_DAYS '%s': expected integer from 0 to 60", raw)
+		}
+		renewalReminderDays = parsed
 	}
 
 	return &Config{
 		BotToken:             botToken,
 		AdminChatIDs:         adminChatIDs,
+		StorageDriver:        storageDriver,
 		DatabaseURL:          databaseURL,
 		PaymentProviderToken: paymentToken,
 		PaymentCardNumber:    paymentCard,
+		PayoutCardRotation:   payoutCardRotation,
+		OrderExpiry:          orderExpiry,
+		ReferralBonusPercent: referralBonus,
+		OrderDedupWindow:     orderDedupWindow,
+		MaxPendingOrders:     maxPendingOrders,
+		RenewalReminderDays:  renewalReminderDays,
+		PaymentMethods:       paymentMethods,
+		RegionPaymentMethods: regionPaymentMethods,
+		StarsRates:           os.Getenv("STARS_RATES"),
+		CryptoWallet:         strings.TrimSpace(os.Getenv("CRYPTO_WALLET")),
+		CryptoAsset:          cryptoAsset,
+		CryptoRates:          os.Getenv("CRYPTO_RATES"),
 	}, nil
 }
+
+// parseList разбирает список через запятую: "card, telegram" -> [card telegram]
+func parseList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
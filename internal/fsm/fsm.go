@@ -13,6 +13,8 @@ const (
 	StateWaitingForPrice         State = "waiting_for_price"
 	StateWaitingForName          State = "waiting_for_name"
 	StateWaitingForDesc          State = "waiting_for_description"
+	StateWaitingForDuration      State = "waiting_for_duration"
+	StateWaitingForRelease       State = "waiting_for_release"
 	StateWaitingForCategoryName  State = "waiting_for_category_name"
 	StateWaitingForCategoryDesc  State = "waiting_for_category_description"
 	StateWaitingForWelcomeMsg    State = "waiting_for_welcome_message"
@@ -20,6 +22,23 @@ const (
 	StateWaitingForBroadcastText  State = "waiting_for_broadcast_text"
 	StateWaitingForBroadcastPhoto State = "waiting_for_broadcast_photo"
 	StateConfirmingBroadcast      State = "confirming_broadcast"
+	// Чек об оплате от покупателя
+	StateWaitingForReceipt        State = "waiting_for_receipt"
+	// Причина отклонения оплаты или отмены заказа админом
+	StateWaitingForRejectReason   State = "waiting_for_reject_reason"
+	StateWaitingForCancelReason   State = "waiting_for_cancel_reason"
+	// Загрузка ключей товара
+	StateWaitingForKeys           State = "waiting_for_keys"
+	// Сверка выписки банка: ожидание файла и подтверждение найденных оплат
+	StateWaitingForStatement      State = "waiting_for_statement"
+	StateConfirmingReconcile      State = "confirming_reconcile"
+	// Промокод покупателя перед созданием заказа
+	StateWaitingForPromoCode      State = "waiting_for_promo_code"
+	// Причина изменения бонусного баланса и возврата заказа на баланс
+	StateWaitingForBalanceReason  State = "waiting_for_balance_reason"
+	StateWaitingForRefundReason   State = "waiting_for_refund_reason"
+	// Переписка покупателя с админами по заказу
+	StateWritingSupport           State = "writing_support"
 )
 
 const (
@@ -166,3 +185,21 @@ func (m *Manager) SetBroadcastState(userID int64, state State, broadcastID int)
 		}
 	}
 }
+
+// SetOrderState устанавливает состояние, привязанное к заказу, с TTL
+func (m *Manager) SetOrderState(userID int64, state State, orderID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.states[userID] = &UserState{
+		State:     state,
+		Data:      map[string]interface{}{"order_id": orderID},
+		ExpiresAt: time.Now().Add(StateTTL),
+	}
+}
+
+// OrderID возвращает номер заказа из состояния, заданного SetOrderState
+func (s *UserState) OrderID() string {
+	orderID, _ := s.Data["order_id"].(string)
+	return orderID
+}
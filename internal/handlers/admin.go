@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"tgwow/internal/models"
+	"tgwow/internal/money"
 )
 
 // isAdmin проверяет, является ли пользователь администратором
@@ -46,22 +48,8 @@ func (h *Handler) handleAdmin(msg *tgbotapi.Message) {
 		recentOrders = []models.Order{}
 	}
 
-	// Собираем все ID товаров для batch-загрузки (решение N+1 проблемы)
-	productIDs := make([]int, 0, len(recentOrders))
-	for _, order := range recentOrders {
-		productIDs = append(productIDs, order.ProductID)
-	}
-
-	// Загружаем все товары одним запросом
-	products := make(map[int]*models.Product)
-	if len(productIDs) > 0 {
-		productsMap, err := h.storage.GetProductsByIDs(ctx, productIDs)
-		if err != nil {
-			log.Printf("Error fetching products: %v", err)
-		} else {
-			products = productsMap
-		}
-	}
+	// Состав всех заказов одним запросом (решение N+1 проблемы)
+	titles := h.orderTitles(ctx, recentOrders)
 
 	text := fmt.Sprintf(
 		"👨‍💼 <b>Админ-панель</b>\n\n"+
@@ -70,13 +58,16 @@ func (h *Handler) handleAdmin(msg *tgbotapi.Message) {
 			"⏳ Ожидают оплаты: %d\n"+
 			"✅ Оплачено: %d\n"+
 			"🎉 Завершено: %d\n"+
-			"💰 Общая выручка: %.2f руб.\n\n"+
+			"💰 Выручка: %s\n"+
+			"🎟 С промокодом: %d, скидки: %s\n\n"+
 			"📋 <b>Последние заказы:</b>\n\n",
 		stats["total_orders"],
 		stats["pending_orders"],
 		stats["paid_orders"],
 		stats["completed_orders"],
-		stats["total_revenue"],
+		formatRevenue(stats["revenue"]),
+		stats["promo_orders"],
+		formatRevenue(stats["discounts"]),
 	)
 
 	var keyboard [][]tgbotapi.InlineKeyboardButton
@@ -86,34 +77,47 @@ func (h *Handler) handleAdmin(msg *tgbotapi.Message) {
 			break
 		}
 
-		product, exists := products[order.ProductID]
-		productName := "Товар"
-		if exists {
-			productName = product.Name
-		}
-
 		text += fmt.Sprintf(
 			"%s <code>%s</code>\n"+
-				"   %s - %.2f руб.\n"+
+				"   %s - %s%s\n"+
 				"   User ID: %d\n\n",
 			StatusEmojis[order.Status],
 			order.OrderID,
-			productName,
+			titles[order.OrderID],
 			order.Price,
+			formatPromo(&order)+formatBalanceUsed(&order),
 			order.UserID,
 		)
 
 		// Добавляем кнопки для заказов в статусе "created"
-		if order.Status == "created" {
-			button := tgbotapi.NewInlineKeyboardButtonData(
-				fmt.Sprintf("✅ Подтвердить %s", order.OrderID),
-				fmt.Sprintf("%s:%s", CallbackActionConfirmPayment, order.OrderID),
-			)
-			keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{button})
+		if order.Status == models.OrderStatusCreated {
+			keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardButtonData(
+					fmt.Sprintf("✅ Подтвердить %s", order.OrderID),
+					fmt.Sprintf("%s:%s", CallbackActionConfirmPayment, order.OrderID),
+				),
+				tgbotapi.NewInlineKeyboardButtonData(
+					"🚫 Отменить",
+					fmt.Sprintf("%s:%s", CallbackActionCancelOrder, order.OrderID),
+				),
+			})
+		}
+
+		// Оплаченный заказ можно вернуть покупателю на бонусный баланс
+		if models.CanTransitionOrder(order.Status, models.OrderStatusRefunded) {
+			keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardButtonData(
+					fmt.Sprintf("↩️ Вернуть на баланс %s", order.OrderID),
+					fmt.Sprintf("%s:%s", CallbackActionRefundOrder, order.OrderID),
+				),
+			})
 		}
 	}
 
 	// Добавляем кнопки управления
+	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("📋 Все заказы", fmt.Sprintf("%s:0::0:::0", CallbackActionAdminOrders)),
+	})
 	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardButtonData("📢 Создать рассылку", "broadcast_menu:0"),
 	})
@@ -123,6 +127,18 @@ func (h *Handler) handleAdmin(msg *tgbotapi.Message) {
 	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardButtonData("📁 Управление категориями", CallbackActionAdminCategories+":0"),
 	})
+	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("💱 Валюты регионов", CallbackActionAdminRegions+":0"),
+	})
+	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("🎟 Промокоды", CallbackActionAdminPromos+":0"),
+	})
+	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("💳 Карты для оплаты", CallbackActionAdminCards+":0"),
+	})
+	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("🧾 Сверка выписки", CallbackActionAdminReconcile+":0"),
+	})
 	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardButtonData("✏️ Редактировать приветствие", CallbackActionAdminEditWelcome+":0"),
 	})
@@ -139,6 +155,24 @@ func (h *Handler) handleAdmin(msg *tgbotapi.Message) {
 	}
 }
 
+// formatRevenue выводит выручку по каждой валюте отдельной строкой
+func formatRevenue(value interface{}) string {
+	revenue, _ := value.([]money.Money)
+	if len(revenue) == 0 {
+		return "0"
+	}
+
+	if len(revenue) == 1 {
+		return revenue[0].String()
+	}
+
+	var lines []string
+	for _, total := range revenue {
+		lines = append(lines, "\n   • "+total.String())
+	}
+	return strings.Join(lines, "")
+}
+
 // handleAdminProducts показывает список товаров сгруппированных по регионам и категориям
 func (h *Handler) handleAdminProducts(query *tgbotapi.CallbackQuery) {
 	if !h.isAdmin(query.From.ID) {
@@ -217,8 +251,8 @@ func (h *Handler) handleAdminProducts(query *tgbotapi.CallbackQuery) {
 					visibilityEmoji = "❌"
 				}
 
-				priceText := fmt.Sprintf("%.0f₽", p.Price)
-				if p.Price == 0 {
+				priceText := p.Price.String()
+				if p.Price.IsZero() {
 					priceText = "не указана"
 				}
 
@@ -277,16 +311,27 @@ func (h *Handler) handleAdminEditProduct(query *tgbotapi.CallbackQuery, productI
 		visibilityStatus = "Скрытый ❌"
 	}
 
+	keysStatus := "выдаются вручную"
+	if stock, err := h.storage.GetProductKeyStock(ctx, product.ID); err != nil {
+		log.Printf("Error fetching key stock: %v", err)
+	} else if stock.Tracked() {
+		keysStatus = fmt.Sprintf("%d свободно, %d выдано", stock.Available, stock.Delivered)
+	}
+
 	text := fmt.Sprintf(
 		"📦 <b>Редактирование товара</b>\n\n"+
 			"%s <b>Регион:</b> %s\n"+
 			"📁 <b>Категория:</b> %s\n"+
 			"🏷 <b>Название:</b> %s\n"+
-			"💰 <b>Цена:</b> %.2f руб.\n"+
+			"💰 <b>Цена:</b> %s\n"+
+			"⏳ <b>Срок:</b> %s\n"+
+			"📅 <b>Выход:</b> %s\n"+
 			"👁 <b>Статус:</b> %s\n"+
+			"🔑 <b>Ключи:</b> %s\n"+
 			"🆔 <b>ID:</b> %d\n\n"+
 			"📝 <b>Описание:</b>\n%s",
-		getRegionFlag(region.Code), region.Name, category.Name, product.Name, product.Price, visibilityStatus, product.ID, product.Description,
+		getRegionFlag(region.Code), region.Name, category.Name, product.Name, product.Price,
+		formatDurationMonths(product.DurationMonths), formatReleaseDate(product.ReleaseAt), visibilityStatus, keysStatus, product.ID, product.Description,
 	)
 
 	toggleText := "Скрыть товар"
@@ -313,12 +358,30 @@ func (h *Handler) handleAdminEditProduct(query *tgbotapi.CallbackQuery, productI
 				fmt.Sprintf("admin_edit_desc:%d", product.ID),
 			),
 		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				"⏳ Срок подписки",
+				fmt.Sprintf("%s:%d", CallbackActionAdminEditDuration, product.ID),
+			),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				"📅 Дата выхода",
+				fmt.Sprintf("%s:%d", CallbackActionAdminEditRelease, product.ID),
+			),
+		),
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData(
 				fmt.Sprintf("👁 %s", toggleText),
 				fmt.Sprintf("admin_toggle_visibility:%d", product.ID),
 			),
 		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				"🔑 Ключи",
+				fmt.Sprintf("%s:%d", CallbackActionAdminKeys, product.ID),
+			),
+		),
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData(
 				"◀️ Назад к списку",
@@ -519,3 +582,130 @@ func (h *Handler) handleAdminEditCategory(query *tgbotapi.CallbackQuery, categor
 
 	h.bot.Request(tgbotapi.NewCallback(query.ID, ""))
 }
+
+// handleAdminRegions показывает регионы и их валюты
+func (h *Handler) handleAdminRegions(query *tgbotapi.CallbackQuery) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DBContextTimeout)
+	defer cancel()
+
+	regions, err := h.storage.ListRegions(ctx)
+	if err != nil {
+		log.Printf("Error fetching regions: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке регионов.")
+		return
+	}
+
+	text := "💱 <b>Валюты регионов</b>\n\n" +
+		"Цены товаров региона указываются и показываются в его валюте.\n\n"
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+
+	for _, region := range regions {
+		text += fmt.Sprintf("%s <b>%s</b> - %s %s\n", getRegionFlag(region.Code), region.Name, region.Currency, region.Currency.Symbol())
+
+		button := tgbotapi.NewInlineKeyboardButtonData(
+			fmt.Sprintf("%s %s (%s)", getRegionFlag(region.Code), region.Name, region.Currency),
+			fmt.Sprintf("%s:%d", CallbackActionAdminRegion, region.ID),
+		)
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{button})
+	}
+
+	text += "\nНажмите на регион, чтобы изменить валюту"
+
+	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("◀️ Назад к админке", CallbackActionBackToAdmin+":0"),
+	})
+
+	keyboardMarkup := tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ParseMode = "HTML"
+	edit.ReplyMarkup = &keyboardMarkup
+
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Error editing message: %v", err)
+	}
+
+	h.bot.Request(tgbotapi.NewCallback(query.ID, ""))
+}
+
+// handleAdminRegionCurrency показывает выбор валюты для региона
+func (h *Handler) handleAdminRegionCurrency(query *tgbotapi.CallbackQuery, regionID int) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DBContextTimeout)
+	defer cancel()
+
+	region, err := h.storage.GetRegionByID(ctx, regionID)
+	if err != nil {
+		log.Printf("Error fetching region: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Регион не найден.")
+		return
+	}
+
+	text := fmt.Sprintf(
+		"💱 <b>Валюта региона</b>\n\n"+
+			"%s <b>Регион:</b> %s\n"+
+			"💰 <b>Текущая валюта:</b> %s %s\n\n"+
+			"⚠️ Цены товаров при смене валюты не пересчитываются - проверьте их после изменения.\n\n"+
+			"Выберите валюту:",
+		getRegionFlag(region.Code), region.Name, region.Currency, region.Currency.Symbol(),
+	)
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, currency := range money.Currencies() {
+		label := fmt.Sprintf("%s %s", currency.Symbol(), currency)
+		if currency == region.Currency {
+			label = "✅ " + label
+		}
+		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("%s:%d:%s", CallbackActionAdminSetCurrency, region.ID, currency)),
+		})
+	}
+	keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("◀️ Назад к регионам", CallbackActionAdminRegions+":0"),
+	})
+
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ParseMode = "HTML"
+	edit.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Error editing message: %v", err)
+	}
+
+	h.bot.Request(tgbotapi.NewCallback(query.ID, ""))
+}
+
+// handleAdminSetCurrency сохраняет выбранную валюту региона
+func (h *Handler) handleAdminSetCurrency(query *tgbotapi.CallbackQuery, regionID int, code string) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	currency, err := money.ParseCurrency(code)
+	if err != nil {
+		log.Printf("Invalid currency: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DBContextTimeout)
+	defer cancel()
+
+	if err := h.storage.UpdateRegionCurrency(ctx, regionID, currency); err != nil {
+		log.Printf("Error updating region currency: %v", err)
+		callback := tgbotapi.NewCallback(query.ID, "❌ Ошибка при изменении валюты")
+		callback.ShowAlert = true
+		h.bot.Request(callback)
+		return
+	}
+
+	h.bot.Request(tgbotapi.NewCallback(query.ID, fmt.Sprintf("✅ Валюта региона: %s", currency)))
+
+	h.handleAdminRegionCurrency(query, regionID)
+}
@@ -0,0 +1,500 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/models"
+	"tgwow/internal/orderid"
+	"tgwow/internal/storage"
+)
+
+// orderFilterDateLayout - формат дат фильтра в данных кнопок: короче promoDateLayout,
+// чтобы данные уложились в 64 байта
+const orderFilterDateLayout = "060102"
+
+// ordersUsage - подсказка по команде /orders
+const ordersUsage = "Формат: <code>/orders [условия]</code>\n\n" +
+	"Условия (любые, через пробел):\n" +
+	"<code>status=paid</code> - статус: created, paid, completed, cancelled, refunded\n" +
+	"<code>region=KZ</code> - регион товаров заказа\n" +
+	"<code>from=2025-03-01</code>, <code>until=2025-03-31</code> - даты создания включительно (МСК)\n" +
+	"<code>user=ID</code> - заказы покупателя\n\n" +
+	"Пример: <code>/orders status=paid region=KZ from=2025-03-01</code>"
+
+// handleAdminOrder открывает карточку любого заказа: /order НОМЕР_ЗАКАЗА
+func (h *Handler) handleAdminOrder(msg *tgbotapi.Message) {
+	if !h.isAdmin(msg.From.ID) {
+		h.sendMessage(msg.Chat.ID, "❌ У вас нет доступа к этой команде.")
+		return
+	}
+
+	orderID := orderid.Normalize(msg.CommandArguments())
+	if orderID == "" {
+		h.sendMessage(msg.Chat.ID, "❌ Укажите номер заказа: /order WOW2412040012")
+		return
+	}
+	if err := orderid.Validate(orderID); err != nil {
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf("❌ %s - не номер заказа. Проверьте, нет ли опечатки.", orderID))
+		return
+	}
+
+	h.sendAdminOrderCard(msg.Chat.ID, orderID)
+}
+
+// handleAdminOrderCallback открывает карточку заказа из списка /orders отдельным сообщением,
+// чтобы список остался на месте
+func (h *Handler) handleAdminOrderCallback(query *tgbotapi.CallbackQuery, orderID string) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	h.sendAdminOrderCard(query.Message.Chat.ID, orderID)
+}
+
+// sendAdminOrderCard отправляет админу карточку заказа с кнопками смены статуса
+func (h *Handler) sendAdminOrderCard(chatID int64, orderID string) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if errors.Is(err, storage.ErrNotFound) {
+		h.sendMessage(chatID, fmt.Sprintf("❌ Заказ %s не найден.", orderID))
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching order %s: %v", orderID, err)
+		h.sendMessage(chatID, "❌ Ошибка при загрузке заказа.")
+		return
+	}
+
+	claim, err := h.storage.GetOrderClaim(ctx, order.OrderID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Error fetching claim of order %s: %v", order.OrderID, err)
+	}
+
+	response := tgbotapi.NewMessage(chatID, h.buildAdminOrderCard(ctx, order, claim))
+	response.ParseMode = "HTML"
+	if keyboard := adminOrderKeyboard(order, claim); len(keyboard) > 0 {
+		response.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	}
+
+	if _, err := h.bot.Send(response); err != nil {
+		log.Printf("Error sending order card: %v", err)
+	}
+}
+
+// buildAdminOrderCard формирует карточку заказа для админа: состав, оплату, покупателя, кто взял заказ
+// в работу (claim, nil - никто) и историю статусов
+func (h *Handler) buildAdminOrderCard(ctx context.Context, order *models.Order, claim *models.OrderClaim) string {
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+
+	methodTitle := order.PaymentMethod
+	if method, ok := h.payments.Get(order.PaymentMethod); ok {
+		methodTitle = method.Title()
+	}
+
+	text := fmt.Sprintf(
+		"%s <b>Заказ</b> <code>%s</code>\n\n"+
+			"🎮 %s\n"+
+			"💰 %s%s%s%s\n"+
+			"💳 Оплата: %s\n"+
+			"%s"+
+			"👤 User ID: <code>%d</code>\n"+
+			"📅 %s (МСК)\n"+
+			"📊 Статус: %s\n",
+		StatusEmojis[order.Status],
+		order.OrderID,
+		html.EscapeString(h.orderTitle(ctx, order)),
+		order.Price, formatPromo(order), formatBalanceUsed(order), formatTransferAmount(order),
+		html.EscapeString(methodTitle),
+		h.payoutCardLine(ctx, order.OrderID),
+		order.UserID,
+		order.CreatedAt.In(moscowLocation).Format("02.01.2006 15:04"),
+		StatusTexts[order.Status],
+	)
+	if claim != nil {
+		text += "🙋 В работе у: " + html.EscapeString(claim.AdminName) + "\n"
+	}
+	text += h.orderSubscriptionExpiry(ctx, order, moscowLocation)
+
+	history, err := h.storage.GetOrderStatusHistory(ctx, order.OrderID)
+	if err != nil {
+		log.Printf("Error fetching status history of order %s: %v", order.OrderID, err)
+	}
+	if len(history) > 0 {
+		text += "\n<b>История:</b>\n" + formatStatusTimeline(history, moscowLocation)
+	}
+
+	return text
+}
+
+// adminOrderKeyboard возвращает кнопки переходов, доступных из текущего статуса заказа.
+// Ничей заказ (claim == nil) можно взять в работу
+func adminOrderKeyboard(order *models.Order, claim *models.OrderClaim) [][]tgbotapi.InlineKeyboardButton {
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+
+	if claim == nil && (order.Status == models.OrderStatusCreated || order.Status == models.OrderStatusPreordered ||
+		order.Status == models.OrderStatusPaid) {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🙋 Взять в работу", fmt.Sprintf("%s:%s", CallbackActionClaimOrder, order.OrderID)),
+		))
+	}
+	if order.Status == models.OrderStatusCreated {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Подтвердить оплату", fmt.Sprintf("%s:%s", CallbackActionConfirmPayment, order.OrderID)),
+			tgbotapi.NewInlineKeyboardButtonData("🚫 Отменить", fmt.Sprintf("%s:%s", CallbackActionCancelOrder, order.OrderID)),
+		))
+	}
+	if models.CanTransitionOrder(order.Status, models.OrderStatusCompleted) {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🎉 Завершить", fmt.Sprintf("%s:%s", CallbackActionCompleteOrder, order.OrderID)),
+		))
+	}
+	if models.CanTransitionOrder(order.Status, models.OrderStatusRefunded) {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("↩️ Вернуть на баланс", fmt.Sprintf("%s:%s", CallbackActionRefundOrder, order.OrderID)),
+		))
+	}
+
+	return keyboard
+}
+
+// handleAdminCompleteOrder завершает оплаченный заказ, который админ выдал вручную
+func (h *Handler) handleAdminCompleteOrder(query *tgbotapi.CallbackQuery, orderID string) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil {
+		log.Printf("Error fetching order: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Заказ не найден.")
+		return
+	}
+
+	if !h.checkOrderClaim(ctx, query.Message.Chat.ID, query.From.ID, orderID) {
+		return
+	}
+
+	err = h.storage.UpdateOrderStatus(ctx, orderID, models.OrderStatusCompleted, query.From.ID, "")
+	if errors.Is(err, storage.ErrInvalidTransition) {
+		h.sendMessage(query.Message.Chat.ID, fmt.Sprintf(
+			"⚠️ Заказ %s нельзя завершить: текущий статус - %s.",
+			orderID, StatusTexts[order.Status],
+		))
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating order status: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при обновлении статуса.")
+		return
+	}
+
+	h.sendMessage(order.UserID, fmt.Sprintf("🎉 Заказ %s выполнен. Спасибо за покупку!", orderID))
+	h.sendMessage(query.Message.Chat.ID, fmt.Sprintf("🎉 Заказ %s завершен.", orderID))
+
+	log.Printf("Order %s completed by admin %d", orderID, query.From.ID)
+}
+
+// handleAdminOrders показывает первую страницу заказов по фильтру: /orders [условия]
+func (h *Handler) handleAdminOrders(msg *tgbotapi.Message) {
+	if !h.isAdmin(msg.From.ID) {
+		h.sendMessage(msg.Chat.ID, "❌ У вас нет доступа к этой команде.")
+		return
+	}
+
+	moscow, _ := time.LoadLocation("Europe/Moscow")
+	filter, regionCode, err := parseOrderFilterArgs(strings.Fields(msg.CommandArguments()), moscow)
+	if err != nil {
+		if err := h.sendHTML(msg.Chat.ID, fmt.Sprintf("❌ %s\n\n%s", err, ordersUsage)); err != nil {
+			log.Printf("Error sending message: %v", err)
+		}
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	if regionCode != "" {
+		regionID, err := h.findRegionID(ctx, regionCode)
+		if err != nil {
+			h.sendMessage(msg.Chat.ID, "❌ "+err.Error())
+			return
+		}
+		filter.RegionID = regionID
+	}
+
+	text, keyboard, err := h.buildAdminOrdersPage(ctx, filter, 0)
+	if err != nil {
+		log.Printf("Error fetching orders: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при загрузке заказов.")
+		return
+	}
+
+	response := tgbotapi.NewMessage(msg.Chat.ID, text)
+	response.ParseMode = "HTML"
+	response.ReplyMarkup = *keyboard
+
+	if _, err := h.bot.Send(response); err != nil {
+		log.Printf("Error sending orders: %v", err)
+	}
+}
+
+// handleAdminOrdersPage показывает страницу списка вместо сообщения с кнопкой.
+// args - данные кнопки после действия (см. encodeOrderFilter)
+func (h *Handler) handleAdminOrdersPage(query *tgbotapi.CallbackQuery, args []string) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	moscow, _ := time.LoadLocation("Europe/Moscow")
+	filter, page, err := decodeOrderFilter(args, moscow)
+	if err != nil {
+		log.Printf("Invalid orders filter %q: %v", strings.Join(args, ":"), err)
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	text, keyboard, err := h.buildAdminOrdersPage(ctx, filter, page)
+	if err != nil {
+		log.Printf("Error fetching orders: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке заказов.")
+		return
+	}
+
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ParseMode = "HTML"
+	edit.ReplyMarkup = keyboard
+
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Error editing orders message: %v", err)
+	}
+}
+
+// buildAdminOrdersPage формирует страницу заказов по фильтру: по кнопке на заказ и переход между страницами
+func (h *Handler) buildAdminOrdersPage(ctx context.Context, filter models.OrderFilter, page int) (string, *tgbotapi.InlineKeyboardMarkup, error) {
+	if page < 0 {
+		page = 0
+	}
+
+	// Лишний заказ показывает, есть ли следующая страница
+	orders, err := h.storage.ListOrders(ctx, filter, page*AdminOrdersPageSize, AdminOrdersPageSize+1)
+	if err != nil {
+		return "", nil, err
+	}
+
+	hasNext := len(orders) > AdminOrdersPageSize
+	if hasNext {
+		orders = orders[:AdminOrdersPageSize]
+	}
+
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+
+	text := "📋 <b>Заказы</b>"
+	if page > 0 || hasNext {
+		text += fmt.Sprintf(" (страница %d)", page+1)
+	}
+	text += "\n"
+	if conditions := h.describeOrderFilter(ctx, filter, moscowLocation); conditions != "" {
+		text += "🔎 " + conditions + "\n"
+	}
+	text += "\n"
+
+	backRow := tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⬅️ В админ-панель", CallbackActionBackToAdmin+":0"),
+	)
+
+	if len(orders) == 0 {
+		text += "Заказов не найдено."
+		markup := tgbotapi.NewInlineKeyboardMarkup(backRow)
+		return text, &markup, nil
+	}
+
+	// Состав всех заказов одним запросом (решение N+1 проблемы)
+	titles := h.orderTitles(ctx, orders)
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, order := range orders {
+		text += fmt.Sprintf(
+			"%s <code>%s</code>\n"+
+				"   %s - %s%s\n"+
+				"   User ID: %d, %s\n\n",
+			StatusEmojis[order.Status],
+			order.OrderID,
+			html.EscapeString(titles[order.OrderID]),
+			order.Price,
+			formatPromo(&order)+formatBalanceUsed(&order),
+			order.UserID,
+			order.CreatedAt.In(moscowLocation).Format("02.01 15:04"),
+		)
+
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("%s %s - %s", StatusEmojis[order.Status], order.OrderID, order.Price),
+				fmt.Sprintf("%s:%s", CallbackActionAdminOrder, order.OrderID),
+			),
+		))
+	}
+	text += "Нажмите на заказ, чтобы открыть карточку."
+
+	var nav []tgbotapi.InlineKeyboardButton
+	if page > 0 {
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("⬅️ Новее", encodeOrderFilter(filter, page-1, moscowLocation)))
+	}
+	if hasNext {
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("Старше ➡️", encodeOrderFilter(filter, page+1, moscowLocation)))
+	}
+	if len(nav) > 0 {
+		keyboard = append(keyboard, nav)
+	}
+	keyboard = append(keyboard, backRow)
+
+	markup := tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	return text, &markup, nil
+}
+
+// describeOrderFilter перечисляет условия фильтра для заголовка списка. Без условий - пустая строка
+func (h *Handler) describeOrderFilter(ctx context.Context, filter models.OrderFilter, loc *time.Location) string {
+	var conditions []string
+
+	if filter.Status != "" {
+		conditions = append(conditions, fmt.Sprintf("статус: %s %s", StatusEmojis[filter.Status], StatusTexts[filter.Status]))
+	}
+	if filter.RegionID != 0 {
+		regionName := fmt.Sprintf("#%d", filter.RegionID)
+		if region, err := h.storage.GetRegionByID(ctx, filter.RegionID); err == nil {
+			regionName = region.Name
+		}
+		conditions = append(conditions, "регион: "+html.EscapeString(regionName))
+	}
+	if filter.From != nil {
+		conditions = append(conditions, "с "+filter.From.In(loc).Format("02.01.2006"))
+	}
+	if filter.Until != nil {
+		conditions = append(conditions, "по "+filter.Until.In(loc).AddDate(0, 0, -1).Format("02.01.2006"))
+	}
+	if filter.UserID != 0 {
+		conditions = append(conditions, fmt.Sprintf("покупатель: %d", filter.UserID))
+	}
+
+	return strings.Join(conditions, ", ")
+}
+
+// parseOrderFilterArgs разбирает аргументы /orders. Регион возвращается кодом, его ID находит вызывающий
+func parseOrderFilterArgs(args []string, loc *time.Location) (models.OrderFilter, string, error) {
+	var filter models.OrderFilter
+	var regionCode string
+
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || value == "" {
+			return filter, "", fmt.Errorf("непонятное условие %q", arg)
+		}
+
+		switch key {
+		case "status":
+			status := strings.ToLower(value)
+			if _, known := StatusTexts[status]; !known {
+				return filter, "", fmt.Errorf("неизвестный статус %q", value)
+			}
+			filter.Status = status
+
+		case "region":
+			regionCode = strings.ToUpper(value)
+
+		case "from", "until":
+			day, err := time.ParseInLocation(promoDateLayout, value, loc)
+			if err != nil {
+				return filter, "", fmt.Errorf("дата %s должна быть в формате ГГГГ-ММ-ДД", key)
+			}
+			if key == "from" {
+				filter.From = &day
+			} else {
+				// until включительно: до конца указанного дня
+				end := day.AddDate(0, 0, 1)
+				filter.Until = &end
+			}
+
+		case "user":
+			userID, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || userID <= 0 {
+				return filter, "", errors.New("user должен быть ID пользователя")
+			}
+			filter.UserID = userID
+
+		default:
+			return filter, "", fmt.Errorf("непонятное условие %q", arg)
+		}
+	}
+
+	if filter.From != nil && filter.Until != nil && !filter.From.Before(*filter.Until) {
+		return filter, "", errors.New("дата from позже даты until")
+	}
+
+	return filter, regionCode, nil
+}
+
+// encodeOrderFilter упаковывает фильтр и страницу в данные кнопки:
+// admin_orders:PAGE:STATUS:REGION_ID:FROM:UNTIL:USER_ID, пустые условия - пустые поля или 0
+func encodeOrderFilter(filter models.OrderFilter, page int, loc *time.Location) string {
+	var from, until string
+	if filter.From != nil {
+		from = filter.From.In(loc).Format(orderFilterDateLayout)
+	}
+	if filter.Until != nil {
+		until = filter.Until.In(loc).Format(orderFilterDateLayout)
+	}
+
+	return fmt.Sprintf("%s:%d:%s:%d:%s:%s:%d",
+		CallbackActionAdminOrders, page, filter.Status, filter.RegionID, from, until, filter.UserID)
+}
+
+// decodeOrderFilter разбирает данные кнопки после действия, обратно encodeOrderFilter
+func decodeOrderFilter(args []string, loc *time.Location) (models.OrderFilter, int, error) {
+	var filter models.OrderFilter
+
+	if len(args) != 6 {
+		return filter, 0, fmt.Errorf("expected 6 fields, got %d", len(args))
+	}
+
+	page, err := strconv.Atoi(args[0])
+	if err != nil {
+		return filter, 0, fmt.Errorf("invalid page: %w", err)
+	}
+
+	filter.Status = args[1]
+	if filter.RegionID, err = strconv.Atoi(args[2]); err != nil {
+		return filter, 0, fmt.Errorf("invalid region: %w", err)
+	}
+
+	for i, bound := range []**time.Time{&filter.From, &filter.Until} {
+		value := args[3+i]
+		if value == "" {
+			continue
+		}
+		day, err := time.ParseInLocation(orderFilterDateLayout, value, loc)
+		if err != nil {
+			return filter, 0, fmt.Errorf("invalid date: %w", err)
+		}
+		*bound = &day
+	}
+
+	if filter.UserID, err = strconv.ParseInt(args[5], 10, 64); err != nil {
+		return filter, 0, fmt.Errorf("invalid user: %w", err)
+	}
+
+	return filter, page, nil
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/fsm"
+	"tgwow/internal/models"
+	"tgwow/internal/storage"
+)
+
+// Ключи данных FSM: чек, с которого админ начал отклонение, чтобы после ввода причины убрать с него кнопки
+const (
+	stateKeyReceiptChatID    = "receipt_chat_id"
+	stateKeyReceiptMessageID = "receipt_message_id"
+	stateKeyReceiptCaption   = "receipt_caption"
+)
+
+// handleAdminStartReject начинает отклонение оплаты: админ не нашел платеж по чеку
+func (h *Handler) handleAdminStartReject(query *tgbotapi.CallbackQuery, orderID string) {
+	h.startOrderReason(query, orderID, fsm.StateWaitingForRejectReason)
+}
+
+// handleAdminStartCancel начинает отмену неоплаченного заказа админом
+func (h *Handler) handleAdminStartCancel(query *tgbotapi.CallbackQuery, orderID string) {
+	h.startOrderReason(query, orderID, fsm.StateWaitingForCancelReason)
+}
+
+// startOrderReason проверяет, что заказ еще можно отменить, и просит админа указать причину
+func (h *Handler) startOrderReason(query *tgbotapi.CallbackQuery, orderID string, state fsm.State) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil {
+		log.Printf("Error fetching order: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Заказ не найден.")
+		return
+	}
+
+	if !models.CanTransitionOrder(order.Status, models.OrderStatusCancelled) {
+		h.sendMessage(query.Message.Chat.ID, fmt.Sprintf(
+			"⚠️ Заказ %s нельзя отменить: текущий статус - %s.",
+			order.OrderID, StatusTexts[order.Status],
+		))
+		return
+	}
+
+	if !h.checkOrderClaim(ctx, query.Message.Chat.ID, query.From.ID, order.OrderID) {
+		return
+	}
+
+	h.fsmManager.SetOrderState(query.From.ID, state, order.OrderID)
+
+	if isReceiptMessage(query.Message) {
+		if userState, ok := h.fsmManager.GetState(query.From.ID); ok {
+			userState.Data[stateKeyReceiptChatID] = query.Message.Chat.ID
+			userState.Data[stateKeyReceiptMessageID] = query.Message.MessageID
+			userState.Data[stateKeyReceiptCaption] = query.Message.Caption
+		}
+	}
+
+	title := "❌ <b>Отклонение оплаты</b>"
+	if state == fsm.StateWaitingForCancelReason {
+		title = "🚫 <b>Отмена заказа</b>"
+	}
+
+	text := fmt.Sprintf(
+		"%s\n\n"+
+			"📦 Заказ №: <code>%s</code>\n"+
+			"👤 User ID: %d\n"+
+			"💰 %s\n\n"+
+			"Введите причину. Она будет отправлена покупателю и сохранится в истории заказа.\n\n"+
+			"Для отмены используйте /cancel",
+		title,
+		order.OrderID,
+		order.UserID,
+		order.Price,
+	)
+
+	msg := tgbotapi.NewMessage(query.Message.Chat.ID, text)
+	msg.ParseMode = "HTML"
+	if _, err := h.bot.Send(msg); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
+
+// handleOrderReasonInput отменяет заказ с причиной, введенной админом, и сообщает об этом покупателю
+func (h *Handler) handleOrderReasonInput(msg *tgbotapi.Message, userState *fsm.UserState) {
+	if !h.isAdmin(msg.From.ID) {
+		return
+	}
+
+	reason, ok := h.readReason(msg)
+	if !ok {
+		return
+	}
+
+	reject := userState.State == fsm.StateWaitingForRejectReason
+	orderID := userState.OrderID()
+	h.fsmManager.ClearState(msg.From.ID)
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil {
+		log.Printf("Error fetching order: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Заказ не найден.")
+		return
+	}
+
+	historyReason := reason
+	if reject {
+		historyReason = "Оплата отклонена: " + reason
+	}
+
+	// Пока админ писал причину, заказ могли оплатить или отменить по таймауту
+	err = h.storage.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusCancelled, msg.From.ID, historyReason)
+	if errors.Is(err, storage.ErrInvalidTransition) {
+		current := order.Status
+		if fresh, err := h.storage.GetOrderByID(ctx, order.OrderID); err == nil {
+			current = fresh.Status
+		}
+		log.Printf("Rejected status change for order %s: %v", order.OrderID, err)
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf(
+			"⚠️ Заказ %s нельзя отменить: текущий статус - %s.",
+			order.OrderID, StatusTexts[current],
+		))
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating order status: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при обновлении статуса.")
+		return
+	}
+
+	verdict := "🚫 Заказ отменен"
+	if reject {
+		verdict = "❌ Оплата отклонена"
+	}
+
+	// Чеки, которые админ еще не проверил, отклоняются вместе с заказом
+	if err := h.storage.ReviewOrderReceipts(ctx, order.OrderID, models.ReceiptStatusRejected, msg.From.ID); err != nil {
+		log.Printf("Error rejecting receipts: %v", err)
+	}
+
+	if chatID, ok := userState.Data[stateKeyReceiptChatID].(int64); ok {
+		messageID, _ := userState.Data[stateKeyReceiptMessageID].(int)
+		caption, _ := userState.Data[stateKeyReceiptCaption].(string)
+		h.editReceiptCaption(chatID, messageID, caption, verdict, msg.From.UserName)
+	}
+
+	h.notifyOrderCancelled(order, reason, reject)
+
+	h.sendMessage(msg.Chat.ID, fmt.Sprintf("%s: заказ %s\nПричина: %s", verdict, order.OrderID, reason))
+
+	log.Printf("Order %s cancelled by admin %d (reject: %t): %s", order.OrderID, msg.From.ID, reject, reason)
+}
+
+// notifyOrderCancelled сообщает покупателю об отмене заказа админом и ее причине
+func (h *Handler) notifyOrderCancelled(order *models.Order, reason string, reject bool) {
+	title := "🚫 <b>Заказ отменен администратором</b>"
+	if reject {
+		title = "❌ <b>Оплата не подтверждена</b>"
+	}
+
+	text := fmt.Sprintf(
+		"%s\n\n"+
+			"📦 Заказ №: <code>%s</code>\n"+
+			"💰 %s\n\n"+
+			"<b>Причина:</b> %s\n\n"+
+			"Если вы считаете это ошибкой, свяжитесь с администратором.",
+		title,
+		order.OrderID,
+		order.Price,
+		html.EscapeString(reason),
+	)
+
+	userMsg := tgbotapi.NewMessage(order.UserID, text)
+	userMsg.ParseMode = "HTML"
+	if _, err := h.bot.Send(userMsg); err != nil {
+		log.Printf("Error notifying user: %v", err)
+	}
+}
@@ -0,0 +1,400 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+	"tgwow/internal/payment"
+	"tgwow/internal/storage"
+)
+
+// cartEntry - позиция корзины вместе с актуальными данными товара
+type cartEntry struct {
+	product  *models.Product
+	quantity int
+}
+
+// available сообщает, можно ли сейчас оформить товар позиции
+func (e cartEntry) available() bool {
+	return e.product.IsVisible && e.product.Price.IsPositive()
+}
+
+// loadCart возвращает корзину покупателя. Удаленные из каталога товары убираются из корзины
+func (h *Handler) loadCart(ctx context.Context, userID int64) ([]cartEntry, error) {
+	items, err := h.storage.GetCart(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]cartEntry, 0, len(items))
+	for _, item := range items {
+		product, err := h.storage.GetProductByID(ctx, item.ProductID)
+		if errors.Is(err, storage.ErrNotFound) {
+			if err := h.storage.SetCartItemQuantity(ctx, userID, item.ProductID, 0); err != nil {
+				log.Printf("Error removing deleted product %d from cart: %v", item.ProductID, err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, cartEntry{product: product, quantity: item.Quantity})
+	}
+
+	return entries, nil
+}
+
+// buildCartView строит текст и клавиатуру корзины
+func (h *Handler) buildCartView(ctx context.Context, userID int64) (string, tgbotapi.InlineKeyboardMarkup, error) {
+	entries, err := h.loadCart(ctx, userID)
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, err
+	}
+
+	catalogRow := tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🛍 Каталог", CallbackActionShowProducts),
+	)
+
+	if len(entries) == 0 {
+		text := "🛒 <b>Корзина пуста</b>\n\nДобавьте товары из каталога кнопкой «🛒 В корзину»."
+		return text, tgbotapi.NewInlineKeyboardMarkup(catalogRow), nil
+	}
+
+	text := "🛒 <b>Корзина</b>\n\n"
+	var rows [][]tgbotapi.InlineKeyboardButton
+	var total money.Money
+	mixed := false
+
+	for i, e := range entries {
+		line := e.product.Price.Mul(int64(e.quantity))
+
+		if e.available() {
+			text += fmt.Sprintf("%d. %s\n    %s × %d = %s\n", i+1, e.product.Name, e.product.Price, e.quantity, line)
+			if total.Currency != "" && total.Currency != line.Currency {
+				mixed = true
+			} else {
+				total = total.Add(line)
+			}
+		} else {
+			text += fmt.Sprintf("%d. %s\n    ⚠️ Товар недоступен, уберите его из корзины\n", i+1, e.product.Name)
+		}
+
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("➖", fmt.Sprintf("%s:%d", CallbackActionCartDec, e.product.ID)),
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("%d × %s", e.quantity, truncateRunes(e.product.Name, 20)),
+				fmt.Sprintf("%s:%d", CallbackActionProduct, e.product.ID),
+			),
+			tgbotapi.NewInlineKeyboardButtonData("➕", fmt.Sprintf("%s:%d", CallbackActionCartInc, e.product.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("❌", fmt.Sprintf("%s:%d", CallbackActionCartRemove, e.product.ID)),
+		))
+	}
+
+	if mixed {
+		text += "\n⚠️ В корзине товары в разных валютах. Оформите их отдельными заказами."
+	} else if total.IsPositive() {
+		text += fmt.Sprintf("\n💰 <b>Итого:</b> %s", total)
+	}
+
+	rows = append(rows,
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Оформить заказ", CallbackActionCartCheckout+":0"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🗑 Очистить", CallbackActionCartClear+":0"),
+			catalogRow[0],
+		),
+	)
+
+	return text, tgbotapi.NewInlineKeyboardMarkup(rows...), nil
+}
+
+// handleCart обрабатывает команду /cart
+func (h *Handler) handleCart(msg *tgbotapi.Message) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	text, keyboard, err := h.buildCartView(ctx, msg.From.ID)
+	if err != nil {
+		log.Printf("Error fetching cart: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при загрузке корзины.")
+		return
+	}
+
+	response := tgbotapi.NewMessage(msg.Chat.ID, text)
+	response.ParseMode = "HTML"
+	response.ReplyMarkup = keyboard
+
+	if _, err := h.bot.Send(response); err != nil {
+		log.Printf("Error sending cart: %v", err)
+	}
+}
+
+// handleShowCart показывает корзину на месте сообщения с кнопкой
+func (h *Handler) handleShowCart(query *tgbotapi.CallbackQuery) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	h.refreshCart(ctx, query)
+}
+
+// refreshCart перерисовывает корзину в сообщении callback'а
+func (h *Handler) refreshCart(ctx context.Context, query *tgbotapi.CallbackQuery) {
+	text, keyboard, err := h.buildCartView(ctx, query.From.ID)
+	if err != nil {
+		log.Printf("Error fetching cart: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке корзины.")
+		return
+	}
+
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ParseMode = "HTML"
+	edit.ReplyMarkup = &keyboard
+
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Error editing message: %v", err)
+	}
+}
+
+// handleAddToCart добавляет товар из карточки в корзину
+func (h *Handler) handleAddToCart(query *tgbotapi.CallbackQuery, productID int) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	product, err := h.storage.GetProductByID(ctx, productID)
+	if err != nil {
+		log.Printf("Error fetching product: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке товара.")
+		return
+	}
+	if !product.IsVisible || !product.Price.IsPositive() {
+		h.sendMessage(query.Message.Chat.ID, "❌ Этот товар сейчас недоступен.")
+		return
+	}
+
+	entries, err := h.loadCart(ctx, query.From.ID)
+	if err != nil {
+		log.Printf("Error fetching cart: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке корзины.")
+		return
+	}
+
+	quantity := 0
+	for _, e := range entries {
+		if e.product.ID == product.ID {
+			quantity = e.quantity
+			continue
+		}
+		// Заказ оплачивается одной суммой, поэтому корзина - в одной валюте
+		if e.product.Price.Currency != product.Price.Currency {
+			h.sendMessage(query.Message.Chat.ID, fmt.Sprintf(
+				"❌ В корзине уже есть товары в %s. Оформите их или очистите корзину, чтобы добавить товар в %s.",
+				e.product.Price.Currency, product.Price.Currency,
+			))
+			return
+		}
+	}
+
+	switch {
+	case quantity == 0 && len(entries) >= MaxCartItems:
+		h.sendMessage(query.Message.Chat.ID, fmt.Sprintf("❌ В корзине может быть не больше %d разных товаров.", MaxCartItems))
+		return
+	case quantity >= MaxCartQuantity:
+		h.sendMessage(query.Message.Chat.ID, fmt.Sprintf("❌ Можно заказать не больше %d шт. одного товара.", MaxCartQuantity))
+		return
+	case !h.inStock(ctx, product.ID, quantity+1):
+		h.sendMessage(query.Message.Chat.ID, "❌ Товара нет в таком количестве. Загляните позже.")
+		return
+	}
+
+	if err := h.storage.AddToCart(ctx, query.From.ID, product.ID, 1); err != nil {
+		log.Printf("Error adding to cart: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Не удалось добавить товар в корзину.")
+		return
+	}
+
+	msg := tgbotapi.NewMessage(query.Message.Chat.ID, fmt.Sprintf("✅ %s добавлен в корзину (%d шт.)", product.Name, quantity+1))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🛒 Перейти в корзину", CallbackActionCart+":0"),
+		),
+	)
+	if _, err := h.bot.Send(msg); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
+
+// handleCartChangeQuantity меняет количество товара в корзине на delta и перерисовывает корзину
+func (h *Handler) handleCartChangeQuantity(query *tgbotapi.CallbackQuery, productID int, delta int) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	items, err := h.storage.GetCart(ctx, query.From.ID)
+	if err != nil {
+		log.Printf("Error fetching cart: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке корзины.")
+		return
+	}
+
+	quantity := -1
+	for _, item := range items {
+		if item.ProductID == productID {
+			quantity = item.Quantity + delta
+		}
+	}
+
+	// Товара уже нет в корзине - просто показываем актуальное состояние
+	if quantity >= 0 {
+		if quantity > MaxCartQuantity {
+			h.sendMessage(query.Message.Chat.ID, fmt.Sprintf("❌ Можно заказать не больше %d шт. одного товара.", MaxCartQuantity))
+			return
+		}
+		if delta > 0 && !h.inStock(ctx, productID, quantity) {
+			h.sendMessage(query.Message.Chat.ID, "❌ Товара нет в таком количестве. Загляните позже.")
+			return
+		}
+		if err := h.storage.SetCartItemQuantity(ctx, query.From.ID, productID, quantity); err != nil {
+			log.Printf("Error updating cart: %v", err)
+			h.sendMessage(query.Message.Chat.ID, "❌ Не удалось изменить корзину.")
+			return
+		}
+	}
+
+	h.refreshCart(ctx, query)
+}
+
+// handleCartRemove убирает товар из корзины
+func (h *Handler) handleCartRemove(query *tgbotapi.CallbackQuery, productID int) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	if err := h.storage.SetCartItemQuantity(ctx, query.From.ID, productID, 0); err != nil {
+		log.Printf("Error updating cart: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Не удалось изменить корзину.")
+		return
+	}
+
+	h.refreshCart(ctx, query)
+}
+
+// handleCartClear очищает корзину
+func (h *Handler) handleCartClear(query *tgbotapi.CallbackQuery) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	if err := h.storage.ClearCart(ctx, query.From.ID); err != nil {
+		log.Printf("Error clearing cart: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Не удалось очистить корзину.")
+		return
+	}
+
+	h.refreshCart(ctx, query)
+}
+
+// handleCartCheckout проверяет корзину и предлагает способ оплаты
+// или сразу оформляет заказ, если подходит один способ
+func (h *Handler) handleCartCheckout(query *tgbotapi.CallbackQuery) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	methods, ok := h.cartPaymentMethods(ctx, query)
+	if !ok {
+		return
+	}
+
+	switch len(methods) {
+	case 0:
+		h.sendMessage(query.Message.Chat.ID, "❌ Для товаров в корзине нет общего способа оплаты. Оформите их отдельными заказами.")
+	case 1:
+		h.beginOrder(ctx, query, 0, methods[0])
+	default:
+		h.showCartPaymentMethods(query, methods)
+	}
+}
+
+// handleCartPay оформляет корзину с выбранным покупателем способом оплаты
+func (h *Handler) handleCartPay(query *tgbotapi.CallbackQuery, code string) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	methods, ok := h.cartPaymentMethods(ctx, query)
+	if !ok {
+		return
+	}
+
+	// Корзину или способы оплаты могли изменить, пока покупатель выбирал
+	for _, method := range methods {
+		if method.Code() == code {
+			h.beginOrder(ctx, query, 0, method)
+			return
+		}
+	}
+
+	h.sendMessage(query.Message.Chat.ID, "❌ Этот способ оплаты больше недоступен. Выберите другой.")
+}
+
+// cartPaymentMethods проверяет, что корзину можно оформить, и возвращает общие для всех товаров способы оплаты.
+// Если оформить нельзя, покупатель получает объяснение и ok = false
+func (h *Handler) cartPaymentMethods(ctx context.Context, query *tgbotapi.CallbackQuery) ([]payment.Method, bool) {
+	entries, err := h.loadCart(ctx, query.From.ID)
+	if err != nil {
+		log.Printf("Error fetching cart: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке корзины.")
+		return nil, false
+	}
+	if len(entries) == 0 {
+		h.sendMessage(query.Message.Chat.ID, "🛒 Корзина пуста.")
+		return nil, false
+	}
+
+	products := make([]*models.Product, 0, len(entries))
+	for _, e := range entries {
+		if !e.available() {
+			h.sendMessage(query.Message.Chat.ID, fmt.Sprintf("❌ Товар «%s» больше недоступен. Уберите его из корзины.", e.product.Name))
+			return nil, false
+		}
+		if !h.inStock(ctx, e.product.ID, e.quantity) {
+			h.sendMessage(query.Message.Chat.ID, fmt.Sprintf("❌ Товара «%s» нет в нужном количестве. Уменьшите количество или загляните позже.", e.product.Name))
+			return nil, false
+		}
+		products = append(products, e.product)
+	}
+
+	methods, err := h.paymentMethodsForAll(ctx, products)
+	if err != nil {
+		log.Printf("Error fetching payment methods: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке корзины.")
+		return nil, false
+	}
+
+	return methods, true
+}
+
+// showCartPaymentMethods заменяет корзину выбором способа оплаты
+func (h *Handler) showCartPaymentMethods(query *tgbotapi.CallbackQuery, methods []payment.Method) {
+	text := "🛒 <b>Оформление заказа</b>\n\nВыберите способ оплаты:"
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, method := range methods {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(method.Title(), fmt.Sprintf("%s:%s", CallbackActionCartPay, method.Code())),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("◀️ Назад", CallbackActionCart+":0"),
+	))
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ParseMode = "HTML"
+	edit.ReplyMarkup = &keyboard
+
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Error editing message: %v", err)
+	}
+}
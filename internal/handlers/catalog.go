@@ -150,8 +150,8 @@ func (h *Handler) handleCategorySelection(query *tgbotapi.CallbackQuery, categor
 
 	for _, p := range products {
 		priceText := ""
-		if p.Price > 0 {
-			priceText = fmt.Sprintf(" - %.2f руб.", p.Price)
+		if p.Price.IsPositive() {
+			priceText = fmt.Sprintf(" - %s", p.Price)
 		} else {
 			priceText = " - цена уточняется"
 		}
@@ -198,26 +198,31 @@ func (h *Handler) handleProductSelection(query *tgbotapi.CallbackQuery, productI
 	}
 
 	priceText := ""
-	if product.Price > 0 {
-		priceText = fmt.Sprintf("💰 <b>Цена:</b> %.2f руб.\n\n", product.Price)
+	if product.Price.IsPositive() {
+		priceText = fmt.Sprintf("💰 <b>Цена:</b> %s\n\n", product.Price)
 	} else {
 		priceText = "💰 <b>Цена:</b> уточняется\n\n"
 	}
 
 	text := fmt.Sprintf(
 		"🎮 <b>%s</b>\n\n"+
-			"%s"+
+			"%s%s"+
 			"📝 <b>Описание:</b>\n%s",
-		product.Name, priceText, product.Description,
+		product.Name, priceText, formatPreorder(product, time.Now()), product.Description,
 	)
 
+	buyText := "✅ Купить"
+	if product.IsPreorder(time.Now()) {
+		buyText = "🕒 Оформить предзаказ"
+	}
+
 	var keyboard tgbotapi.InlineKeyboardMarkup
 
-	if product.Price > 0 {
+	if product.Price.IsPositive() {
 		keyboard = tgbotapi.NewInlineKeyboardMarkup(
 			tgbotapi.NewInlineKeyboardRow(
 				tgbotapi.NewInlineKeyboardButtonData(
-					"✅ Купить",
+					buyText,
 					fmt.Sprintf("buy:%d", product.ID),
 				),
 			),
@@ -265,8 +270,8 @@ func (h *Handler) handleChangeRegion(query *tgbotapi.CallbackQuery) {
 	}
 
 	priceText := ""
-	if product.Price > 0 {
-		priceText = fmt.Sprintf("💰 <b>Цена:</b> %.2f руб.\n\n", product.Price)
+	if product.Price.IsPositive() {
+		priceText = fmt.Sprintf("💰 <b>Цена:</b> %s\n\n", product.Price)
 	} else {
 		priceText = "💰 <b>Цена:</b> уточняется\n\n"
 	}
@@ -280,7 +285,7 @@ func (h *Handler) handleChangeRegion(query *tgbotapi.CallbackQuery) {
 
 	var keyboard tgbotapi.InlineKeyboardMarkup
 
-	if product.Price > 0 {
+	if product.Price.IsPositive() {
 		keyboard = tgbotapi.NewInlineKeyboardMarkup(
 			tgbotapi.NewInlineKeyboardRow(
 				tgbotapi.NewInlineKeyboardButtonData(
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/models"
+	"tgwow/internal/storage"
+)
+
+// notifyAdminsNewOrder отправляет всем админам уведомление о заказе с кнопкой «Взять в работу»
+// и запоминает копии, чтобы после взятия показать в них, кто взял заказ
+func (h *Handler) notifyAdminsNewOrder(ctx context.Context, orderID, text string) {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🙋 Взять в работу", fmt.Sprintf("%s:%s", CallbackActionClaimOrder, orderID)),
+		),
+	)
+
+	for _, adminID := range h.adminChatIDs {
+		adminMsg := tgbotapi.NewMessage(adminID, text)
+		adminMsg.ParseMode = "HTML"
+		adminMsg.ReplyMarkup = keyboard
+
+		sent, err := h.bot.Send(adminMsg)
+		if err != nil {
+			log.Printf("Error sending admin notification to %d: %v", adminID, err)
+			continue
+		}
+
+		notification := models.AdminNotification{OrderID: orderID, ChatID: adminID, MessageID: sent.MessageID, Text: text}
+		if err := h.storage.SaveAdminNotification(ctx, notification); err != nil {
+			log.Printf("Error saving admin notification: %v", err)
+		}
+	}
+}
+
+// handleClaimOrder закрепляет заказ за нажавшим админом и правит уведомления остальных админов
+func (h *Handler) handleClaimOrder(query *tgbotapi.CallbackQuery, orderID string) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	claim, err := h.storage.ClaimOrder(ctx, models.OrderClaim{
+		OrderID:   orderID,
+		AdminID:   query.From.ID,
+		AdminName: getUserDisplayName(query.From),
+	})
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		h.sendMessage(query.Message.Chat.ID, "❌ Заказ не найден.")
+		return
+	case errors.Is(err, storage.ErrInvalidTransition):
+		h.sendMessage(query.Message.Chat.ID, fmt.Sprintf("⚠️ Заказ %s уже выполнен или отменен.", orderID))
+		return
+	case err != nil:
+		log.Printf("Error claiming order %s: %v", orderID, err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при взятии заказа. Попробуйте позже.")
+		return
+	}
+
+	if claim.AdminID != query.From.ID {
+		h.sendMessage(query.Message.Chat.ID, fmt.Sprintf("🔒 Заказ %s уже взял в работу %s.", orderID, claim.AdminName))
+		return
+	}
+
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil {
+		log.Printf("Error fetching order %s: %v", orderID, err)
+		return
+	}
+	h.updateClaimNotifications(ctx, order, claim)
+
+	log.Printf("Order %s claimed by admin %d", orderID, query.From.ID)
+}
+
+// updateClaimNotifications показывает во всех уведомлениях о заказе, кто его взял. Взявший админ
+// получает кнопки смены статуса, у остальных кнопки убираются
+func (h *Handler) updateClaimNotifications(ctx context.Context, order *models.Order, claim *models.OrderClaim) {
+	notifications, err := h.storage.GetAdminNotifications(ctx, order.OrderID)
+	if err != nil {
+		log.Printf("Error fetching admin notifications for order %s: %v", order.OrderID, err)
+		return
+	}
+
+	for _, n := range notifications {
+		var edit tgbotapi.EditMessageTextConfig
+		if n.ChatID == claim.AdminID {
+			edit = tgbotapi.NewEditMessageText(n.ChatID, n.MessageID, n.Text+"\n\n🙋 <b>Вы взяли заказ в работу</b>")
+			if keyboard := adminOrderKeyboard(order, claim); len(keyboard) > 0 {
+				markup := tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+				edit.ReplyMarkup = &markup
+			}
+		} else {
+			edit = tgbotapi.NewEditMessageText(n.ChatID, n.MessageID,
+				n.Text+"\n\n🔒 <b>Взял в работу:</b> "+html.EscapeString(claim.AdminName))
+		}
+		edit.ParseMode = "HTML"
+
+		if _, err := h.bot.Send(edit); err != nil {
+			log.Printf("Error editing admin notification in %d: %v", n.ChatID, err)
+		}
+	}
+}
+
+// checkOrderClaim не дает админу менять статус заказа, который взял в работу другой админ.
+// Возвращает false и объясняет причину, если действие запрещено
+func (h *Handler) checkOrderClaim(ctx context.Context, chatID, adminID int64, orderID string) bool {
+	if claim := h.foreignClaim(ctx, adminID, orderID); claim != nil {
+		h.sendMessage(chatID, fmt.Sprintf("🔒 Заказ %s в работе у %s. Изменить его может только он.", orderID, claim.AdminName))
+		return false
+	}
+	return true
+}
+
+// foreignClaim возвращает закрепление заказа за другим админом. nil - заказ свободен или в работе у adminID
+func (h *Handler) foreignClaim(ctx context.Context, adminID int64, orderID string) *models.OrderClaim {
+	claim, err := h.storage.GetOrderClaim(ctx, orderID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		// Без закрепления заказ остается доступным всем админам, как до взятия
+		log.Printf("Error fetching claim of order %s: %v", orderID, err)
+		return nil
+	}
+
+	if claim.AdminID != adminID {
+		return claim
+	}
+	return nil
+}
@@ -25,7 +25,10 @@ func (h *Handler) handleStart(msg *tgbotapi.Message) {
 				"🎮 Я бот для продажи игровых подписок World of Warcraft.\n\n"+
 				"📋 Доступные команды:\n"+
 				"/products - Посмотреть каталог подписок\n"+
-				"/my_orders - Просмотреть мои заказы",
+				"/cart - Корзина\n"+
+				"/my_orders - Просмотреть мои заказы\n"+
+				"/balance - Бонусный баланс\n"+
+				"/referral - Пригласить друга",
 			msg.From.FirstName,
 		)
 		h.sendMessage(msg.Chat.ID, text)
@@ -97,77 +100,6 @@ func (h *Handler) handleProducts(msg *tgbotapi.Message) {
 	}
 }
 
-// handleMyOrders обрабатывает команду /my_orders
-func (h *Handler) handleMyOrders(msg *tgbotapi.Message) {
-	ctx, cancel := h.newDBContext()
-	defer cancel()
-
-	orders, err := h.storage.GetUserOrders(ctx, msg.From.ID)
-	if err != nil {
-		log.Printf("Error fetching user orders: %v", err)
-		h.sendMessage(msg.Chat.ID, "❌ Ошибка при загрузке заказов.")
-		return
-	}
-
-	if len(orders) == 0 {
-		h.sendMessage(msg.Chat.ID, "📦 У вас пока нет заказов.\n\nИспользуйте /products чтобы посмотреть каталог подписок.")
-		return
-	}
-
-	// Собираем все ID товаров для batch-загрузки (решение N+1 проблемы)
-	productIDs := make([]int, 0, len(orders))
-	for _, order := range orders {
-		productIDs = append(productIDs, order.ProductID)
-	}
-
-	// Загружаем все товары одним запросом
-	products, err := h.storage.GetProductsByIDs(ctx, productIDs)
-	if err != nil {
-		log.Printf("Error fetching products: %v", err)
-		h.sendMessage(msg.Chat.ID, "❌ Ошибка при загрузке информации о товарах.")
-		return
-	}
-
-	text := "📋 <b>Ваши заказы:</b>\n\n"
-
-	// Load Moscow timezone once for all orders
-	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
-
-	for i, order := range orders {
-		product, exists := products[order.ProductID]
-		if !exists {
-			continue
-		}
-
-		// Convert time to Moscow timezone
-		moscowTime := order.CreatedAt.In(moscowLocation)
-
-		text += fmt.Sprintf(
-			"%s <b>Заказ №%d</b>\n"+
-				"🆔 <code>%s</code>\n"+
-				"🎮 %s\n"+
-				"💰 %.2f руб.\n"+
-				"📊 Статус: %s %s\n"+
-				"📅 %s (МСК)\n\n",
-			StatusEmojis[order.Status],
-			i+1,
-			order.OrderID,
-			product.Name,
-			order.Price,
-			StatusEmojis[order.Status],
-			StatusTexts[order.Status],
-			moscowTime.Format("02.01.2006 15:04"),
-		)
-	}
-
-	response := tgbotapi.NewMessage(msg.Chat.ID, text)
-	response.ParseMode = "HTML"
-
-	if _, err := h.bot.Send(response); err != nil {
-		log.Printf("Error sending my orders: %v", err)
-	}
-}
-
 // handleCancel обрабатывает команду /cancel
 func (h *Handler) handleCancel(msg *tgbotapi.Message) {
 	h.fsmManager.ClearState(msg.From.ID)
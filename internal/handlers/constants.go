@@ -1,26 +1,121 @@
 package handlers
 
-import "time"
+import (
+	"time"
+
+	"tgwow/internal/models"
+)
 
 // Timeouts and limits
 const (
 	DBContextTimeout     = 5 * time.Second
 	RecentOrdersLimit    = 10
 	DisplayedOrdersLimit = 5
+	MaxMessageLength     = 4000 // Запас до лимита Telegram в 4096 символов
+
+	// Автоотмена неоплаченных заказов
+	OrderExpiryCheckInterval = time.Minute
+	OrderExpiryTimeout       = 30 * time.Second
+	OrderExpiryBatchSize     = 100
+
+	// Напоминания о продлении подписок
+	RenewalCheckInterval     = time.Hour
+	RenewalReminderTimeout   = 30 * time.Second
+	RenewalReminderBatchSize = 100
+	MaxDurationMonths        = 36 // Срок подписки товара, который может задать админ
+
+	// Передача предзаказов в выполнение после выхода товара
+	PreorderReleaseCheckInterval = 5 * time.Minute
+	PreorderReleaseTimeout       = 30 * time.Second
+	PreorderReleaseBatchSize     = 100
+
+	// Максимальная длина причины отклонения или отмены заказа
+	MaxOrderReasonLength = 500
+
+	// Склад ключей товаров
+	LowStockThreshold = 5       // Остаток, при котором админы получают предупреждение
+	MaxKeysPerUpload  = 1000    // Ключей за одну загрузку
+	MaxKeysFileSize   = 1 << 20 // Размер файла с ключами, байт
+	MaxKeyLength      = 255
+
+	// Скачивание файлов, присланных админом
+	DocumentDownloadTimeout = 30 * time.Second
+
+	// Сверка выписки банка с заказами, ожидающими перевода
+	MaxStatementFileSize      = 2 << 20        // Размер файла выписки, байт
+	ReconcileWindow           = 72 * time.Hour // Перевод учитывается, если сделан не позже этого срока после заказа, в том числе после автоотмены
+	ReconcileOrdersLimit      = 1000           // Заказов, ожидающих перевода, в одной сверке
+	DisplayedReconcileEntries = 30             // Строк каждого раздела в отчете сверки
+
+	// Корзина
+	MaxCartItems    = 20 // Разных товаров в корзине
+	MaxCartQuantity = 10 // Штук одного товара
+
+	// Промокодов в списке админа
+	DisplayedPromoCodesLimit = 20
+
+	// Реквизиты карты для оплаты
+	MaxPayoutBankLength   = 64
+	MaxPayoutHolderLength = 128
+
+	// Операций в истории бонусного баланса
+	LedgerHistoryLimit = 10
+
+	// Заказов на одной странице /my_orders и /orders
+	MyOrdersPageSize    = 5
+	AdminOrdersPageSize = 10
+
+	// Переписка по заказу
+	MaxSupportMessageLength = 2000 // Символов в одном сообщении покупателя или админа
+	SupportThreadLimit      = 20   // Последних сообщений в /support
+	SupportPreviewLength    = 300  // Символов сообщения в /support
 )
 
+// ReferralPayloadPrefix - префикс параметра /start в реферальной ссылке: t.me/bot?start=ref_<user_id>
+const ReferralPayloadPrefix = "ref_"
+
 // Callback action constants
 const (
 	CallbackActionRegion           = "region"
 	CallbackActionCategory         = "category"
 	CallbackActionProduct          = "product"
 	CallbackActionBuy              = "buy"
+	CallbackActionPay              = "pay"
+	CallbackActionMockPay          = "mock_pay"
+	CallbackActionCart             = "cart"
+	CallbackActionCartAdd          = "cart_add"
+	CallbackActionCartInc          = "cart_inc"
+	CallbackActionCartDec          = "cart_dec"
+	CallbackActionCartRemove       = "cart_remove"
+	CallbackActionCartClear        = "cart_clear"
+	CallbackActionCartCheckout     = "cart_checkout"
+	CallbackActionCartPay          = "cart_pay"
+	CallbackActionPromoSkip        = "promo_skip"
+	CallbackActionBalanceUse       = "balance_use"
+	CallbackActionBalanceSkip      = "balance_skip"
+	CallbackActionMyOrders         = "my_orders"
+	CallbackActionMyOrder          = "my_order"
+	CallbackActionOrderPay         = "order_pay"
+	CallbackActionUserCancelOrder  = "user_cancel_order"
+	CallbackActionSupport          = "support"
+	CallbackActionRenew            = "renew"
 	CallbackActionBack             = "back"
 	CallbackActionConfirmPayment   = "confirm_payment"
+	CallbackActionAttachReceipt    = "attach_receipt"
+	CallbackActionRejectPayment    = "reject_payment"
+	CallbackActionCancelOrder      = "cancel_order"
+	CallbackActionRefundOrder      = "refund_order"
+	CallbackActionCompleteOrder    = "complete_order"
+	CallbackActionClaimOrder       = "claim_order"
+	CallbackActionAdminOrder       = "admin_order"
+	CallbackActionAdminOrders      = "admin_orders"
 	CallbackActionAdminEditPrice   = "admin_edit_price"
 	CallbackActionAdminEditName    = "admin_edit_name"
 	CallbackActionAdminEditDesc    = "admin_edit_desc"
+	CallbackActionAdminEditDuration = "admin_edit_duration"
+	CallbackActionAdminEditRelease  = "admin_edit_release"
 	CallbackActionAdminToggleVis   = "admin_toggle_visibility"
+	CallbackActionAdminKeys        = "admin_keys"
 	CallbackActionAdminProducts    = "admin_products"
 	CallbackActionAdminEditProduct = "admin_edit_product"
 	CallbackActionAdminEditWelcome  = "admin_edit_welcome"
@@ -35,21 +130,44 @@ const (
 	CallbackActionAdminEditCategory = "admin_edit_category"
 	CallbackActionAdminEditCatName  = "admin_edit_cat_name"
 	CallbackActionAdminEditCatDesc  = "admin_edit_cat_desc"
+	CallbackActionAdminRegions      = "admin_regions"
+	CallbackActionAdminRegion       = "admin_region"
+	CallbackActionAdminSetCurrency  = "admin_set_currency"
+	CallbackActionAdminPromos       = "admin_promos"
+	CallbackActionAdminPromoToggle  = "admin_promo_toggle"
+	CallbackActionAdminCards        = "admin_cards"
+	CallbackActionAdminCardToggle   = "admin_card_toggle"
+	CallbackActionAdminCardDelete   = "admin_card_delete"
+	CallbackActionAdminReconcile    = "admin_reconcile"
+	CallbackActionReconcileConfirm  = "reconcile_confirm"
+	CallbackActionReconcileCancel   = "reconcile_cancel"
 )
 
 // Status emoji and text maps
 var (
 	StatusEmojis = map[string]string{
-		"created":   "⏳",
-		"paid":      "✅",
-		"completed": "🎉",
-		"cancelled": "❌",
+		models.OrderStatusCreated:    "⏳",
+		models.OrderStatusPreordered: "🕒",
+		models.OrderStatusPaid:      "✅",
+		models.OrderStatusCompleted: "🎉",
+		models.OrderStatusCancelled: "❌",
+		models.OrderStatusRefunded:  "↩️",
 	}
 
 	StatusTexts = map[string]string{
-		"created":   "Ожидает оплаты",
-		"paid":      "Оплачен",
-		"completed": "Завершен",
-		"cancelled": "Отменён",
+		models.OrderStatusCreated:    "Ожидает оплаты",
+		models.OrderStatusPreordered: "Предзаказ, ждет выхода",
+		models.OrderStatusPaid:      "Оплачен",
+		models.OrderStatusCompleted: "Завершен",
+		models.OrderStatusCancelled: "Отменён",
+		models.OrderStatusRefunded:  "Возвращён",
+	}
+
+	LedgerKindTexts = map[string]string{
+		models.LedgerKindReferral:         "Бонус за приглашенного друга",
+		models.LedgerKindRefund:           "Возврат заказа",
+		models.LedgerKindAdjustment:       "Изменение администратором",
+		models.LedgerKindCheckout:         "Оплата заказа",
+		models.LedgerKindCheckoutReversal: "Возврат за отмененный заказ",
 	}
 )
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/models"
+	"tgwow/internal/storage"
+)
+
+// StartOrderExpiry запускает фоновую отмену заказов, не оплаченных за window.
+// Вызывается до начала обработки обновлений, останавливается вместе с Handler в Shutdown
+func (h *Handler) StartOrderExpiry(window time.Duration) {
+	if window <= 0 {
+		return
+	}
+
+	h.orderExpiry = window
+
+	log.Printf("Unpaid orders will be cancelled after %v", window)
+
+	go func() {
+		ticker := time.NewTicker(OrderExpiryCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), OrderExpiryTimeout)
+				h.expireOrders(ctx, time.Now().Add(-window), window)
+				cancel()
+			case <-h.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// expireOrders отменяет заказы в статусе created, созданные раньше cutoff, и уведомляет покупателей и админов.
+// Заказы с чеком, который ждет проверки, не отменяются
+func (h *Handler) expireOrders(ctx context.Context, cutoff time.Time, window time.Duration) {
+	orders, err := h.storage.ListUnpaidOrdersBefore(ctx, cutoff, OrderExpiryBatchSize)
+	if err != nil {
+		log.Printf("Error fetching unpaid orders: %v", err)
+		return
+	}
+	if len(orders) == 0 {
+		return
+	}
+
+	titles := h.orderTitles(ctx, orders)
+
+	productIDs := make([]int, 0, len(orders))
+	for _, order := range orders {
+		if order.ProductID != 0 {
+			productIDs = append(productIDs, order.ProductID)
+		}
+	}
+
+	products, err := h.storage.GetProductsByIDs(ctx, productIDs)
+	if err != nil {
+		log.Printf("Error fetching products: %v", err)
+		products = make(map[int]*models.Product)
+	}
+
+	reason := fmt.Sprintf("Не оплачен за %s", formatDuration(window))
+
+	for _, order := range orders {
+		err := h.storage.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusCancelled, 0, reason)
+		if errors.Is(err, storage.ErrInvalidTransition) {
+			// Заказ успели оплатить между выборкой и отменой
+			continue
+		}
+		if err != nil {
+			log.Printf("Error expiring order %s: %v", order.OrderID, err)
+			continue
+		}
+
+		log.Printf("Order %s expired after %v", order.OrderID, window)
+
+		// Купить снова можно только заказ на один товар, который еще есть в каталоге
+		product, ok := products[order.ProductID]
+		canRebuy := ok && product.IsVisible
+
+		h.notifyOrderExpired(order, titles[order.OrderID], canRebuy, reason)
+	}
+}
+
+// notifyOrderExpired сообщает покупателю об отмене с кнопкой повторной покупки и дублирует админам
+func (h *Handler) notifyOrderExpired(order models.Order, productName string, canRebuy bool, reason string) {
+	userText := fmt.Sprintf(
+		"%s <b>Заказ отменён</b>\n\n"+
+			"📦 Заказ №: <code>%s</code>\n"+
+			"🎮 %s\n"+
+			"💰 %s\n\n"+
+			"Оплата не поступила вовремя, поэтому заказ переведен в статус «%s».\n"+
+			"Если вы все еще хотите купить товар, оформите заказ заново.",
+		StatusEmojis[models.OrderStatusCancelled],
+		order.OrderID,
+		productName,
+		order.Price,
+		StatusTexts[models.OrderStatusCancelled],
+	)
+
+	userMsg := tgbotapi.NewMessage(order.UserID, userText)
+	userMsg.ParseMode = "HTML"
+	if canRebuy {
+		userMsg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔁 Купить снова", fmt.Sprintf("%s:%d", CallbackActionBuy, order.ProductID)),
+			),
+		)
+	}
+	if _, err := h.bot.Send(userMsg); err != nil {
+		log.Printf("Error notifying user %d about expired order: %v", order.UserID, err)
+	}
+
+	adminText := fmt.Sprintf(
+		"%s <b>Заказ автоматически отменён</b>\n\n"+
+			"📦 <b>Заказ №:</b> <code>%s</code>\n"+
+			"👤 <b>Пользователь:</b> ID %d\n"+
+			"🎮 <b>Товар:</b> %s\n"+
+			"💰 <b>Сумма:</b> %s\n"+
+			"📝 <b>Причина:</b> %s",
+		StatusEmojis[models.OrderStatusCancelled],
+		order.OrderID,
+		order.UserID,
+		productName,
+		order.Price,
+		reason,
+	)
+	h.notifyAdmins(adminText)
+}
+
+// formatDuration выводит срок для пользователя: "24 ч", "30 мин", "1 ч 30 мин"
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	hours := int(d / time.Hour)
+	minutes := int((d % time.Hour) / time.Minute)
+
+	switch {
+	case hours > 0 && minutes > 0:
+		return fmt.Sprintf("%d ч %d мин", hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%d ч", hours)
+	default:
+		return fmt.Sprintf("%d мин", minutes)
+	}
+}
@@ -2,13 +2,16 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"tgwow/internal/fsm"
+	"tgwow/internal/money"
 	"tgwow/internal/validation"
 )
 
@@ -21,6 +24,10 @@ func (h *Handler) handleFSMState(msg *tgbotapi.Message, userState *fsm.UserState
 		h.handleNameInput(msg, userState.ProductID)
 	case fsm.StateWaitingForDesc:
 		h.handleDescInput(msg, userState.ProductID)
+	case fsm.StateWaitingForDuration:
+		h.handleDurationInput(msg, userState.ProductID)
+	case fsm.StateWaitingForRelease:
+		h.handleReleaseInput(msg, userState.ProductID)
 	case fsm.StateWaitingForCategoryName:
 		h.handleCategoryNameInput(msg, userState.CategoryID)
 	case fsm.StateWaitingForCategoryDesc:
@@ -31,6 +38,23 @@ func (h *Handler) handleFSMState(msg *tgbotapi.Message, userState *fsm.UserState
 		h.handleBroadcastTextInput(msg, userState)
 	case fsm.StateWaitingForBroadcastPhoto:
 		h.handleBroadcastPhotoInput(msg, userState)
+	case fsm.StateWaitingForReceipt:
+		h.handleReceiptInput(msg, userState)
+	case fsm.StateWaitingForRejectReason, fsm.StateWaitingForCancelReason:
+		h.handleOrderReasonInput(msg, userState)
+	case fsm.StateWaitingForKeys:
+		h.handleKeysInput(msg, userState.ProductID)
+	case fsm.StateWaitingForStatement, fsm.StateConfirmingReconcile:
+		// Новая выписка во время подтверждения заменяет предыдущую сверку
+		h.handleStatementInput(msg)
+	case fsm.StateWaitingForPromoCode:
+		h.handlePromoCodeInput(msg, userState)
+	case fsm.StateWaitingForBalanceReason:
+		h.handleBalanceReasonInput(msg, userState)
+	case fsm.StateWaitingForRefundReason:
+		h.handleRefundReasonInput(msg, userState)
+	case fsm.StateWritingSupport:
+		h.handleSupportInput(msg, userState)
 	}
 }
 
@@ -55,10 +79,10 @@ func (h *Handler) handleAdminStartEditPrice(query *tgbotapi.CallbackQuery, produ
 	text := fmt.Sprintf(
 		"💰 <b>Изменение цены товара</b>\n\n"+
 			"Товар: <b>%s</b>\n"+
-			"Текущая цена: %.2f руб.\n\n"+
-			"Введите новую цену в рублях (например: 2500 или 2500.50)\n\n"+
+			"Текущая цена: %s\n\n"+
+			"Введите новую цену в валюте региона, %s %s (например: 2500 или 2500.50)\n\n"+
 			"Для отмены используйте /cancel",
-		product.Name, product.Price,
+		product.Name, product.Price, product.Price.Currency, product.Price.Currency.Symbol(),
 	)
 
 	msg := tgbotapi.NewMessage(query.Message.Chat.ID, text)
@@ -129,6 +153,73 @@ func (h *Handler) handleAdminStartEditDesc(query *tgbotapi.CallbackQuery, produc
 	h.bot.Send(msg)
 }
 
+// handleAdminStartEditDuration начинает диалог изменения срока подписки
+func (h *Handler) handleAdminStartEditDuration(query *tgbotapi.CallbackQuery, productID int) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DBContextTimeout)
+	defer cancel()
+
+	product, err := h.storage.GetProductByID(ctx, productID)
+	if err != nil {
+		log.Printf("Error fetching product: %v", err)
+		return
+	}
+
+	// Устанавливаем состояние FSM
+	h.fsmManager.SetState(query.From.ID, fsm.StateWaitingForDuration, productID)
+
+	text := fmt.Sprintf(
+		"⏳ <b>Изменение срока подписки</b>\n\n"+
+			"Товар: <b>%s</b>\n"+
+			"Текущий срок: %s\n\n"+
+			"Введите срок в месяцах (от 1 до %d) или 0, если товар не подписка.\n"+
+			"По сроку считается окончание подписки в выполненных заказах и напоминание о продлении.\n\n"+
+			"Для отмены используйте /cancel",
+		product.Name, formatDurationMonths(product.DurationMonths), MaxDurationMonths,
+	)
+
+	msg := tgbotapi.NewMessage(query.Message.Chat.ID, text)
+	msg.ParseMode = "HTML"
+	h.bot.Send(msg)
+}
+
+// handleAdminStartEditRelease начинает диалог изменения даты выхода товара предзаказа
+func (h *Handler) handleAdminStartEditRelease(query *tgbotapi.CallbackQuery, productID int) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DBContextTimeout)
+	defer cancel()
+
+	product, err := h.storage.GetProductByID(ctx, productID)
+	if err != nil {
+		log.Printf("Error fetching product: %v", err)
+		return
+	}
+
+	// Устанавливаем состояние FSM
+	h.fsmManager.SetState(query.From.ID, fsm.StateWaitingForRelease, productID)
+
+	text := fmt.Sprintf(
+		"📅 <b>Дата выхода товара</b>\n\n"+
+			"Товар: <b>%s</b>\n"+
+			"Текущая дата: %s\n\n"+
+			"Введите дату выхода по московскому времени: 26.02.2026 или 26.02.2026 19:00.\n"+
+			"До этой даты товар продается по предзаказу, оплаченные заказы ждут выхода.\n"+
+			"Введите 0, чтобы снять предзаказ.\n\n"+
+			"Для отмены используйте /cancel",
+		product.Name, formatReleaseDate(product.ReleaseAt),
+	)
+
+	msg := tgbotapi.NewMessage(query.Message.Chat.ID, text)
+	msg.ParseMode = "HTML"
+	h.bot.Send(msg)
+}
+
 // handleAdminStartEditWelcome начинает диалог редактирования приветственного сообщения
 func (h *Handler) handleAdminStartEditWelcome(query *tgbotapi.CallbackQuery) {
 	if !h.isAdmin(query.From.ID) {
@@ -170,8 +261,22 @@ func (h *Handler) handlePriceInput(msg *tgbotapi.Message, productID int) {
 		return
 	}
 
-	// Парсим цену
-	newPrice, err := strconv.ParseFloat(strings.TrimSpace(msg.Text), 64)
+	ctx, cancel := context.WithTimeout(context.Background(), DBContextTimeout)
+	defer cancel()
+
+	product, err := h.storage.GetProductByID(ctx, productID)
+	if err != nil {
+		log.Printf("Error fetching product: %v", err)
+		h.fsmManager.ClearState(msg.From.ID)
+		return
+	}
+
+	// Парсим цену в валюте региона товара
+	newPrice, err := money.Parse(msg.Text, product.Price.Currency)
+	if errors.Is(err, money.ErrTooPrecise) {
+		h.sendMessage(msg.Chat.ID, "❌ Цена указывается с точностью до сотых (например: 2500.50)")
+		return
+	}
 	if err != nil {
 		h.sendMessage(msg.Chat.ID, "❌ Неверный формат цены. Введите число (например: 2500 или 2500.50)")
 		return
@@ -183,9 +288,6 @@ func (h *Handler) handlePriceInput(msg *tgbotapi.Message, productID int) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), DBContextTimeout)
-	defer cancel()
-
 	// Обновляем цену
 	if err := h.storage.UpdateProductPrice(ctx, productID, newPrice); err != nil {
 		log.Printf("Error updating price: %v", err)
@@ -194,9 +296,7 @@ func (h *Handler) handlePriceInput(msg *tgbotapi.Message, productID int) {
 		return
 	}
 
-	product, _ := h.storage.GetProductByID(ctx, productID)
-
-	h.sendMessage(msg.Chat.ID, fmt.Sprintf("✅ Цена товара \"%s\" обновлена на %.2f руб.", product.Name, newPrice))
+	h.sendMessage(msg.Chat.ID, fmt.Sprintf("✅ Цена товара \"%s\" обновлена на %s", product.Name, newPrice))
 	h.fsmManager.ClearState(msg.From.ID)
 }
 
@@ -268,6 +368,80 @@ func (h *Handler) handleDescInput(msg *tgbotapi.Message, productID int) {
 	h.fsmManager.ClearState(msg.From.ID)
 }
 
+// handleDurationInput обрабатывает ввод срока подписки в месяцах
+func (h *Handler) handleDurationInput(msg *tgbotapi.Message, productID int) {
+	if !h.isAdmin(msg.From.ID) {
+		return
+	}
+
+	months, err := strconv.Atoi(strings.TrimSpace(msg.Text))
+	if err != nil || months < 0 || months > MaxDurationMonths {
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf("❌ Введите целое число месяцев от 0 до %d\n\nПопробуйте еще раз или используйте /cancel для отмены.", MaxDurationMonths))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DBContextTimeout)
+	defer cancel()
+
+	product, err := h.storage.GetProductByID(ctx, productID)
+	if err != nil {
+		log.Printf("Error fetching product: %v", err)
+		h.fsmManager.ClearState(msg.From.ID)
+		return
+	}
+
+	if err := h.storage.UpdateProductDuration(ctx, productID, months); err != nil {
+		log.Printf("Error updating duration: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при обновлении срока подписки")
+		h.fsmManager.ClearState(msg.From.ID)
+		return
+	}
+
+	h.sendMessage(msg.Chat.ID, fmt.Sprintf("✅ Срок подписки товара \"%s\": %s", product.Name, formatDurationMonths(months)))
+	h.fsmManager.ClearState(msg.From.ID)
+}
+
+// handleReleaseInput обрабатывает ввод даты выхода товара
+func (h *Handler) handleReleaseInput(msg *tgbotapi.Message, productID int) {
+	if !h.isAdmin(msg.From.ID) {
+		return
+	}
+
+	var releaseAt *time.Time
+	if input := strings.TrimSpace(msg.Text); input != "0" {
+		parsed, err := parseReleaseDate(input)
+		if err != nil {
+			h.sendMessage(msg.Chat.ID, "❌ Неверный формат даты. Введите дату как 26.02.2026 или 26.02.2026 19:00\n\nПопробуйте еще раз или используйте /cancel для отмены.")
+			return
+		}
+		if !parsed.After(time.Now()) {
+			h.sendMessage(msg.Chat.ID, "❌ Дата выхода должна быть в будущем\n\nПопробуйте еще раз или используйте /cancel для отмены.")
+			return
+		}
+		releaseAt = &parsed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DBContextTimeout)
+	defer cancel()
+
+	product, err := h.storage.GetProductByID(ctx, productID)
+	if err != nil {
+		log.Printf("Error fetching product: %v", err)
+		h.fsmManager.ClearState(msg.From.ID)
+		return
+	}
+
+	if err := h.storage.UpdateProductRelease(ctx, productID, releaseAt); err != nil {
+		log.Printf("Error updating release date: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при обновлении даты выхода")
+		h.fsmManager.ClearState(msg.From.ID)
+		return
+	}
+
+	h.sendMessage(msg.Chat.ID, fmt.Sprintf("✅ Дата выхода товара \"%s\": %s", product.Name, formatReleaseDate(releaseAt)))
+	h.fsmManager.ClearState(msg.From.ID)
+}
+
 // handleWelcomeMsgInput обрабатывает ввод нового приветственного сообщения
 func (h *Handler) handleWelcomeMsgInput(msg *tgbotapi.Message) {
 	if !h.isAdmin(msg.From.ID) {
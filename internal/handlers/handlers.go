@@ -9,31 +9,39 @@ import (
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"tgwow/internal/fsm"
+	"tgwow/internal/payment"
 	"tgwow/internal/ratelimit"
 	"tgwow/internal/storage"
 )
 
 // Handler управляет обработкой сообщений и callback'ов Telegram бота
 type Handler struct {
-	bot               *tgbotapi.BotAPI
-	storage           *storage.PostgresStorage
-	adminChatIDs      []int64            // Список ID администраторов
-	fsmManager        *fsm.Manager       // Менеджер FSM состояний
-	paymentCardNumber string             // Номер карты для оплаты
-	userLimiter       *ratelimit.Limiter // Rate limiter для пользователей
-	adminLimiter      *ratelimit.Limiter // Rate limiter для админов
+	bot           *tgbotapi.BotAPI
+	storage       storage.Store
+	adminChatIDs  []int64            // Список ID администраторов
+	fsmManager    *fsm.Manager       // Менеджер FSM состояний
+	payments      *payment.Registry  // Включенные способы оплаты
+	userLimiter   *ratelimit.Limiter // Rate limiter для пользователей
+	adminLimiter  *ratelimit.Limiter // Rate limiter для админов
+	orderExpiry   time.Duration      // Срок оплаты заказа, 0 - без автоотмены
+	referralBonus int                // Бонус пригласившему в процентах от первого заказа, 0 - без бонуса
+	dedupWindow   time.Duration      // Повторное «Купить» в этот срок возвращает созданный заказ, 0 - не проверять
+	maxPending    int                // Лимит неоплаченных заказов покупателя, 0 - без ограничения
+	cardRotation  string             // Политика выбора карты для перевода (models.PayoutRotation*)
+	stopCh        chan struct{}      // Останавливает фоновые задачи Handler
 }
 
 // NewHandler создает новый Handler
-func NewHandler(bot *tgbotapi.BotAPI, storage *storage.PostgresStorage, adminChatIDs []int64, paymentCardNumber string) *Handler {
+func NewHandler(bot *tgbotapi.BotAPI, storage storage.Store, adminChatIDs []int64, payments *payment.Registry) *Handler {
 	return &Handler{
-		bot:               bot,
-		storage:           storage,
-		adminChatIDs:      adminChatIDs,
-		fsmManager:        fsm.NewManager(),
-		paymentCardNumber: paymentCardNumber,
-		userLimiter:       ratelimit.NewLimiter(ratelimit.DefaultConfig()),
-		adminLimiter:      ratelimit.NewLimiter(ratelimit.AdminConfig()),
+		bot:          bot,
+		storage:      storage,
+		adminChatIDs: adminChatIDs,
+		fsmManager:   fsm.NewManager(),
+		payments:     payments,
+		userLimiter:  ratelimit.NewLimiter(ratelimit.DefaultConfig()),
+		adminLimiter: ratelimit.NewLimiter(ratelimit.AdminConfig()),
+		stopCh:       make(chan struct{}),
 	}
 }
 
@@ -54,6 +62,9 @@ func (h *Handler) Shutdown() {
 		h.adminLimiter.Stop()
 	}
 
+	// Останавливаем фоновые задачи (автоотмена заказов)
+	close(h.stopCh)
+
 	log.Println("Handler resources stopped")
 }
 
@@ -61,11 +72,22 @@ func (h *Handler) Shutdown() {
 func (h *Handler) HandleMessage(msg *tgbotapi.Message) {
 	log.Printf("Message from %s: %s", msg.From.UserName, msg.Text)
 
+	// Деньги уже списаны: платеж обрабатываем без rate limit и FSM
+	if msg.SuccessfulPayment != nil {
+		h.handleSuccessfulPayment(msg)
+		return
+	}
+
 	// Проверка rate limit
 	if !h.checkRateLimit(msg.From.ID, msg.Chat.ID) {
 		return
 	}
 
+	// Реферальная ссылка учитывается только при первом обращении, поэтому до UpsertUser
+	if msg.Command() == "start" {
+		h.registerReferral(msg)
+	}
+
 	// Сохраняем/обновляем пользователя в БД для рассылок
 	go func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
@@ -81,6 +103,17 @@ func (h *Handler) HandleMessage(msg *tgbotapi.Message) {
 		}
 	}()
 
+	// /cancel выходит из любого диалога, поэтому проверяется до FSM
+	if msg.Command() == "cancel" {
+		h.handleCancel(msg)
+		return
+	}
+
+	// Ответ (reply) на сообщение переписки продолжает переписку по заказу
+	if msg.ReplyToMessage != nil && !msg.IsCommand() && h.handleSupportReply(msg) {
+		return
+	}
+
 	// Проверяем, находится ли пользователь в состоянии FSM
 	if userState, exists := h.fsmManager.GetState(msg.From.ID); exists {
 		h.handleFSMState(msg, userState)
@@ -95,13 +128,37 @@ func (h *Handler) HandleMessage(msg *tgbotapi.Message) {
 		h.handleProducts(msg)
 	case "my_orders":
 		h.handleMyOrders(msg)
+	case "cart":
+		h.handleCart(msg)
+	case "referral":
+		h.handleReferral(msg)
+	case "balance":
+		h.handleBalance(msg)
+	case "balance_adjust":
+		h.handleAdminBalanceAdjust(msg)
 	case "admin":
 		h.handleAdmin(msg)
+	case "promo_new":
+		h.handleAdminPromoNew(msg)
+	case "promos":
+		h.handleAdminPromos(msg)
+	case "card_new":
+		h.handleAdminPayoutCardNew(msg)
+	case "cards":
+		h.handleAdminPayoutCards(msg)
+	case "reconcile":
+		h.handleAdminReconcile(msg)
+	case "support":
+		h.handleAdminSupportThread(msg)
+	case "order":
+		h.handleAdminOrder(msg)
+	case "orders":
+		h.handleAdminOrders(msg)
 	case "cancel":
 		h.handleCancel(msg)
 	default:
 		if msg.Command() != "" {
-			h.sendMessage(msg.Chat.ID, "Неизвестная команда. Используйте /start, /products, /my_orders")
+			h.sendMessage(msg.Chat.ID, "Неизвестная команда. Используйте /start, /products, /cart, /my_orders, /balance, /referral")
 		}
 	}
 }
@@ -195,6 +252,95 @@ func (h *Handler) HandleCallback(query *tgbotapi.CallbackQuery) {
 		}
 		h.handleBuyProduct(query, productID)
 
+	case "pay":
+		// Данные в формате pay:productID:method
+		productID, err := strconv.Atoi(value)
+		if err != nil || len(parts) < 3 {
+			log.Printf("Invalid pay callback: %s", query.Data)
+			return
+		}
+		h.handlePayWithMethod(query, productID, parts[2])
+
+	case "mock_pay":
+		h.handleMockPay(query, value)
+
+	case "cart":
+		h.handleShowCart(query)
+
+	case "cart_add", "cart_inc", "cart_dec", "cart_remove":
+		productID, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid product ID: %v", err)
+			return
+		}
+		switch action {
+		case "cart_add":
+			h.handleAddToCart(query, productID)
+		case "cart_inc":
+			h.handleCartChangeQuantity(query, productID, 1)
+		case "cart_dec":
+			h.handleCartChangeQuantity(query, productID, -1)
+		case "cart_remove":
+			h.handleCartRemove(query, productID)
+		}
+
+	case "cart_clear":
+		h.handleCartClear(query)
+
+	case "cart_checkout":
+		h.handleCartCheckout(query)
+
+	case "cart_pay":
+		h.handleCartPay(query, value)
+
+	case "promo_skip":
+		h.handlePromoSkip(query)
+
+	case "balance_use":
+		h.handleBalanceUse(query, value)
+
+	case "balance_skip":
+		h.handleBalanceSkip(query, value)
+
+	case "my_orders":
+		page, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid orders page: %v", err)
+			return
+		}
+		h.handleMyOrdersPage(query, page)
+
+	case "my_order", "user_cancel_order":
+		// Данные в формате action:orderID:page, page - страница списка для кнопки «Назад»
+		var page int
+		if len(parts) >= 3 {
+			page, _ = strconv.Atoi(parts[2])
+		}
+		if action == "my_order" {
+			h.handleMyOrder(query, value, page)
+		} else {
+			h.handleUserCancelOrder(query, value, page)
+		}
+
+	case "order_pay":
+		h.handleOrderPay(query, value)
+
+	case "support":
+		h.handleStartSupport(query, value)
+
+	case "renew":
+		// Данные в формате renew:orderID:productID
+		if len(parts) < 3 {
+			log.Printf("Invalid renew callback: %s", query.Data)
+			return
+		}
+		productID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			log.Printf("Invalid product ID: %v", err)
+			return
+		}
+		h.handleRenew(query, value, productID)
+
 	case "back":
 		// Для back данные в формате back:type:id
 		if len(parts) >= 3 {
@@ -216,6 +362,31 @@ func (h *Handler) HandleCallback(query *tgbotapi.CallbackQuery) {
 	case "confirm_payment":
 		h.handleConfirmPayment(query, value)
 
+	case "attach_receipt":
+		h.handleAttachReceipt(query, value)
+
+	case "reject_payment":
+		h.handleAdminStartReject(query, value)
+
+	case "cancel_order":
+		h.handleAdminStartCancel(query, value)
+
+	case "refund_order":
+		h.handleAdminStartRefund(query, value)
+
+	case "complete_order":
+		h.handleAdminCompleteOrder(query, value)
+
+	case "claim_order":
+		h.handleClaimOrder(query, value)
+
+	case "admin_order":
+		h.handleAdminOrderCallback(query, value)
+
+	case "admin_orders":
+		// Данные в формате admin_orders:page:status:regionID:from:until:userID (см. encodeOrderFilter)
+		h.handleAdminOrdersPage(query, parts[1:])
+
 	case "admin_edit_price":
 		productID, err := strconv.Atoi(value)
 		if err != nil {
@@ -240,9 +411,33 @@ func (h *Handler) HandleCallback(query *tgbotapi.CallbackQuery) {
 		}
 		h.handleAdminStartEditDesc(query, productID)
 
+	case "admin_edit_duration":
+		productID, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid product ID: %v", err)
+			return
+		}
+		h.handleAdminStartEditDuration(query, productID)
+
+	case "admin_edit_release":
+		productID, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid product ID: %v", err)
+			return
+		}
+		h.handleAdminStartEditRelease(query, productID)
+
 	case "admin_toggle_visibility":
 		h.handleAdminToggleVisibility(query, value)
 
+	case "admin_keys":
+		productID, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid product ID: %v", err)
+			return
+		}
+		h.handleAdminKeys(query, productID)
+
 	case "admin_products":
 		h.handleAdminProducts(query)
 
@@ -300,6 +495,65 @@ func (h *Handler) HandleCallback(query *tgbotapi.CallbackQuery) {
 		}
 		h.handleAdminStartEditCatDesc(query, categoryID)
 
+	case "admin_regions":
+		h.handleAdminRegions(query)
+
+	case "admin_region":
+		regionID, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid region ID: %v", err)
+			return
+		}
+		h.handleAdminRegionCurrency(query, regionID)
+
+	case "admin_set_currency":
+		// Формат admin_set_currency:regionID:CODE
+		if len(parts) < 3 {
+			log.Printf("Invalid callback data: %s", query.Data)
+			return
+		}
+		regionID, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid region ID: %v", err)
+			return
+		}
+		h.handleAdminSetCurrency(query, regionID, parts[2])
+
+	case "admin_promos":
+		h.handleAdminPromosCallback(query)
+
+	case "admin_promo_toggle":
+		promoCodeID, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid promo code ID: %v", err)
+			return
+		}
+		h.handleAdminPromoToggle(query, promoCodeID)
+
+	case "admin_cards":
+		h.handleAdminPayoutCardsCallback(query)
+
+	case "admin_card_toggle", "admin_card_delete":
+		cardID, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid payout card ID: %v", err)
+			return
+		}
+		if action == CallbackActionAdminCardToggle {
+			h.handleAdminPayoutCardToggle(query, cardID)
+		} else {
+			h.handleAdminPayoutCardDelete(query, cardID)
+		}
+
+	case "admin_reconcile":
+		h.handleAdminReconcileCallback(query)
+
+	case "reconcile_confirm":
+		h.handleReconcileConfirm(query)
+
+	case "reconcile_cancel":
+		h.handleReconcileCancel(query)
+
 	case "back_to_admin":
 		fakeMsg := &tgbotapi.Message{
 			Chat: &tgbotapi.Chat{ID: query.Message.Chat.ID},
@@ -0,0 +1,1826 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/fsm"
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+	"tgwow/internal/payment"
+	"tgwow/internal/storage"
+)
+
+const testAdminID int64 = 1000
+
+// apiCall - один запрос бота к фейковому Telegram Bot API
+type apiCall struct {
+	Method    string
+	Params    map[string]string
+	MessageID int // message_id, который фейк вернул боту
+}
+
+// fakeTelegram - минимальный Telegram Bot API на httptest, записывающий все запросы
+type fakeTelegram struct {
+	server *httptest.Server
+
+	mu        sync.Mutex
+	calls     []apiCall
+	messageID int
+}
+
+func newFakeTelegram(t *testing.T) *fakeTelegram {
+	t.Helper()
+
+	f := &fakeTelegram{}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakeTelegram) serve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	params := make(map[string]string, len(r.PostForm))
+	for key := range r.PostForm {
+		params[key] = r.PostForm.Get(key)
+	}
+
+	f.mu.Lock()
+	f.messageID++
+	messageID := f.messageID
+	f.calls = append(f.calls, apiCall{Method: method, Params: params, MessageID: messageID})
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case method == "getMe":
+		fmt.Fprint(w, `{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"Test","username":"test_bot"}}`)
+	case strings.HasPrefix(method, "send") || strings.HasPrefix(method, "edit"):
+		chatID := params["chat_id"]
+		if chatID == "" {
+			chatID = "0"
+		}
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"date":0,"chat":{"id":%s,"type":"private"}}}`, messageID, chatID)
+	default:
+		fmt.Fprint(w, `{"ok":true,"result":true}`)
+	}
+}
+
+// Calls возвращает все вызовы указанного метода
+func (f *fakeTelegram) Calls(method string) []apiCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var result []apiCall
+	for _, c := range f.calls {
+		if c.Method == method {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// MessagesTo возвращает тексты сообщений, отправленных в указанный чат
+func (f *fakeTelegram) MessagesTo(chatID int64) []string {
+	var texts []string
+	for _, c := range f.Calls("sendMessage") {
+		if c.Params["chat_id"] == fmt.Sprint(chatID) {
+			texts = append(texts, c.Params["text"])
+		}
+	}
+	return texts
+}
+
+// newTestHandler создает Handler поверх in-memory хранилища и фейкового Bot API.
+// Без methods включен только перевод на карту
+func newTestHandler(t *testing.T, methods ...payment.Method) (*Handler, *storage.MemoryStorage, *fakeTelegram) {
+	t.Helper()
+
+	tg := newFakeTelegram(t)
+	bot, err := tgbotapi.NewBotAPIWithClient("test-token", tg.server.URL+"/bot%s/%s", tg.server.Client())
+	if err != nil {
+		t.Fatalf("failed to create bot: %v", err)
+	}
+
+	store := storage.NewMemoryStorage()
+	if err := store.SeedDemoData(context.Background()); err != nil {
+		t.Fatalf("failed to seed storage: %v", err)
+	}
+
+	if len(methods) == 0 {
+		methods = []payment.Method{payment.NewCard("0000 1111 2222 3333")}
+	}
+	var codes []string
+	for _, m := range methods {
+		codes = append(codes, m.Code())
+	}
+	payments, err := payment.NewRegistry(methods, codes, nil)
+	if err != nil {
+		t.Fatalf("failed to create payment registry: %v", err)
+	}
+
+	h := NewHandler(bot, store, []int64{testAdminID}, payments)
+	t.Cleanup(h.Shutdown)
+
+	return h, store, tg
+}
+
+// newTestCallback создает callback-запрос от пользователя из его личного чата
+func newTestCallback(userID int64, data string) *tgbotapi.CallbackQuery {
+	return &tgbotapi.CallbackQuery{
+		ID:   "cb",
+		From: &tgbotapi.User{ID: userID, UserName: "buyer", FirstName: "Buyer"},
+		Message: &tgbotapi.Message{
+			MessageID: 1,
+			Chat:      &tgbotapi.Chat{ID: userID},
+		},
+		Data: data,
+	}
+}
+
+// newTestCommand создает сообщение с командой от пользователя
+func newTestCommand(userID int64, text string) *tgbotapi.Message {
+	command := strings.Fields(text)[0]
+	return &tgbotapi.Message{
+		MessageID: 1,
+		From:      &tgbotapi.User{ID: userID, UserName: "buyer", FirstName: "Buyer"},
+		Chat:      &tgbotapi.Chat{ID: userID},
+		Text:      text,
+		Entities: []tgbotapi.MessageEntity{
+			{Type: "bot_command", Offset: 0, Length: len(command)},
+		},
+	}
+}
+
+// newTestMessage создает обычное текстовое сообщение от пользователя
+func newTestMessage(userID int64, text string) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		MessageID: 1,
+		From:      &tgbotapi.User{ID: userID, UserName: "buyer", FirstName: "Buyer"},
+		Chat:      &tgbotapi.Chat{ID: userID},
+		Text:      text,
+	}
+}
+
+// firstProduct возвращает первый товар из демо-каталога
+func firstProduct(t *testing.T, store *storage.MemoryStorage) (int, money.Money) {
+	t.Helper()
+
+	products, err := store.ListProducts(context.Background())
+	if err != nil || len(products) == 0 {
+		t.Fatalf("no products in demo catalog: %v", err)
+	}
+	return products[0].ID, products[0].Price
+}
+
+func TestHandleBuyProduct_CreatesOrderAndNotifiesAdmins(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	const userID int64 = 42
+
+	productID, price := firstProduct(t, store)
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+
+	orders, err := store.GetUserOrders(context.Background(), userID, 0, 0)
+	if err != nil {
+		t.Fatalf("GetUserOrders() error = %v", err)
+	}
+	if len(orders) != 1 {
+		t.Fatalf("got %d orders, want 1", len(orders))
+	}
+	if orders[0].Price != price || orders[0].Status != "created" {
+		t.Errorf("order = %+v", orders[0])
+	}
+
+	userMessages := tg.MessagesTo(userID)
+	if len(userMessages) != 1 || !strings.Contains(userMessages[0], orders[0].OrderID) {
+		t.Errorf("user messages = %q, want payment instructions with order ID", userMessages)
+	}
+
+	adminMessages := tg.MessagesTo(testAdminID)
+	if len(adminMessages) != 1 || !strings.Contains(adminMessages[0], "Новый заказ") {
+		t.Errorf("admin messages = %q, want new order notification", adminMessages)
+	}
+}
+
+func TestHandleBuyProduct_DeduplicatesAndLimitsPendingOrders(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	h.SetOrderLimits(time.Minute, 2)
+	ctx := context.Background()
+	const userID int64 = 42
+
+	// Двойное нажатие «Купить» возвращает уже созданный заказ
+	productID, _ := firstProduct(t, store)
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+
+	orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+	if len(orders) != 1 {
+		t.Fatalf("got %d orders after double tap, want 1", len(orders))
+	}
+	msgs := tg.MessagesTo(userID)
+	if !containsText(msgs, "только что оформили заказ "+orders[0].OrderID) || !strings.Contains(msgs[len(msgs)-1], orders[0].OrderID) {
+		t.Errorf("user messages = %q, want existing order and its instructions again", msgs)
+	}
+
+	// Другой товар - новый заказ, дальше срабатывает лимит неоплаченных
+	products, _ := store.ListAllProducts(ctx)
+	var others []int
+	for _, p := range products {
+		if p.ID != productID && p.IsVisible && p.Price.IsPositive() {
+			others = append(others, p.ID)
+		}
+	}
+	if len(others) < 2 {
+		t.Fatal("demo data has fewer than 3 products for sale")
+	}
+
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", others[0])))
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", others[1])))
+	if pending, _ := store.GetPendingOrders(ctx, userID); len(pending) != 2 {
+		t.Fatalf("got %d pending orders, want limit 2", len(pending))
+	}
+	if msgs := tg.MessagesTo(userID); !strings.Contains(msgs[len(msgs)-1], "2 неоплаченных заказов") {
+		t.Errorf("last message = %q, want pending orders limit notice", msgs[len(msgs)-1])
+	}
+}
+
+func TestHandleConfirmPayment_OnlyAdmins(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	const userID int64 = 42
+
+	productID, price := firstProduct(t, store)
+	order, err := store.CreateOrder(context.Background(), userID, productID, price, payment.CodeCard, "")
+	if err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+
+	// Обычный пользователь не может подтвердить оплату
+	h.HandleCallback(newTestCallback(userID, "confirm_payment:"+order.OrderID))
+	got, _ := store.GetOrderByID(context.Background(), order.OrderID)
+	if got.Status != "created" {
+		t.Fatalf("status after non-admin confirm = %q, want created", got.Status)
+	}
+
+	h.HandleCallback(newTestCallback(testAdminID, "confirm_payment:"+order.OrderID))
+	got, _ = store.GetOrderByID(context.Background(), order.OrderID)
+	if got.Status != "paid" {
+		t.Errorf("status after admin confirm = %q, want paid", got.Status)
+	}
+
+	if msgs := tg.MessagesTo(userID); len(msgs) != 1 || !strings.Contains(msgs[0], "Оплата подтверждена") {
+		t.Errorf("user messages = %q, want payment confirmation", msgs)
+	}
+
+	// Повторное подтверждение не уведомляет пользователя второй раз
+	h.HandleCallback(newTestCallback(testAdminID, "confirm_payment:"+order.OrderID))
+	if msgs := tg.MessagesTo(userID); len(msgs) != 1 {
+		t.Errorf("user got %d messages after double confirm, want 1", len(msgs))
+	}
+	adminMsgs := tg.MessagesTo(testAdminID)
+	if len(adminMsgs) == 0 || !strings.Contains(adminMsgs[len(adminMsgs)-1], "нельзя подтвердить") {
+		t.Errorf("admin messages = %q, want rejection notice", adminMsgs)
+	}
+}
+
+func TestHandleConfirmPayment_RejectsExpiredOrder(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID int64 = 42
+
+	productID, price := firstProduct(t, store)
+	order, _ := store.CreateOrder(ctx, userID, productID, price, payment.CodeCard, "")
+	h.expireOrders(ctx, time.Now().Add(time.Second), 24*time.Hour)
+
+	// Заказ, отмененный по сроку, подтверждает только сверка выписки
+	if err := h.confirmOrderPayment(ctx, order, testAdminID, ""); !errors.Is(err, storage.ErrInvalidTransition) {
+		t.Errorf("confirmOrderPayment() for expired order error = %v, want ErrInvalidTransition", err)
+	}
+
+	h.HandleCallback(newTestCallback(testAdminID, "confirm_payment:"+order.OrderID))
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusCancelled {
+		t.Errorf("status after admin confirm = %q, want cancelled", got.Status)
+	}
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], "нельзя подтвердить") {
+		t.Errorf("admin messages = %q, want rejection notice", msgs)
+	}
+	if containsText(tg.MessagesTo(userID), "Оплата подтверждена") {
+		t.Errorf("user messages = %q, want no payment confirmation", tg.MessagesTo(userID))
+	}
+}
+
+func TestClaimOrder_AssignsAndBlocksOtherAdmins(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID, secondAdminID int64 = 42, 1001
+	h.adminChatIDs = []int64{testAdminID, secondAdminID}
+
+	productID, _ := firstProduct(t, store)
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+	order := orders[0]
+
+	for _, c := range tg.Calls("sendMessage") {
+		if c.Params["chat_id"] == fmt.Sprint(testAdminID) && !strings.Contains(c.Params["reply_markup"], "claim_order:"+order.OrderID) {
+			t.Fatalf("admin notification markup = %s, want claim button", c.Params["reply_markup"])
+		}
+	}
+
+	claim := newTestCallback(secondAdminID, "claim_order:"+order.OrderID)
+	claim.From.UserName = "second_admin"
+	h.HandleCallback(claim)
+
+	edited := make(map[string]apiCall)
+	for _, c := range tg.Calls("editMessageText") {
+		edited[c.Params["chat_id"]] = c
+	}
+	if text := edited[fmt.Sprint(testAdminID)].Params["text"]; !strings.Contains(text, "Взял в работу:</b> @second_admin") {
+		t.Errorf("other admin's notification = %q, want claimer name", text)
+	}
+	if own := edited[fmt.Sprint(secondAdminID)].Params; !strings.Contains(own["text"], "Вы взяли заказ") ||
+		!strings.Contains(own["reply_markup"], "confirm_payment:"+order.OrderID) {
+		t.Errorf("claimer's notification = %q %s, want status buttons", own["text"], own["reply_markup"])
+	}
+
+	// Первый админ не может ни взять заказ, ни изменить его статус
+	h.HandleCallback(newTestCallback(testAdminID, "claim_order:"+order.OrderID))
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], "уже взял в работу @second_admin") {
+		t.Errorf("last message = %q, want already claimed", msgs[len(msgs)-1])
+	}
+	h.HandleCallback(newTestCallback(testAdminID, "confirm_payment:"+order.OrderID))
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusCreated {
+		t.Fatalf("order status = %q after other admin's confirm, want created", got.Status)
+	}
+	h.HandleCallback(newTestCallback(testAdminID, "cancel_order:"+order.OrderID))
+	if _, ok := h.fsmManager.GetState(testAdminID); ok {
+		t.Error("other admin started cancelling a claimed order")
+	}
+
+	h.HandleCallback(newTestCallback(secondAdminID, "confirm_payment:"+order.OrderID))
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusPaid {
+		t.Errorf("order status = %q after claimer's confirm, want paid", got.Status)
+	}
+}
+
+func TestRenewalReminder_RenewCreatesSameOrder(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID, otherID int64 = 42, 43
+
+	productID, price := firstProduct(t, store)
+	order, _ := store.CreateOrder(ctx, userID, productID, price, payment.CodeCard, "")
+	store.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusPaid, testAdminID, "")
+	store.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusCompleted, testAdminID, "")
+
+	items, _ := store.GetOrderItems(ctx, order.OrderID)
+	if items[0].ExpiresAt == nil {
+		t.Fatal("completed subscription has no expiry")
+	}
+	expiresAt := *items[0].ExpiresAt
+
+	// Подписка, которая закончится позже окна, напоминание не получает
+	h.remindExpiringSubscriptions(ctx, expiresAt.Add(-72*time.Hour), expiresAt.Add(-time.Hour))
+	if msgs := tg.MessagesTo(userID); len(msgs) != 0 {
+		t.Fatalf("messages = %q before the reminder window", msgs)
+	}
+
+	h.remindExpiringSubscriptions(ctx, expiresAt.Add(-72*time.Hour), expiresAt)
+	sent := tg.Calls("sendMessage")
+	reminder := sent[len(sent)-1].Params
+	renew := fmt.Sprintf("renew:%s:%d", order.OrderID, productID)
+	if reminder["chat_id"] != fmt.Sprint(userID) || !strings.Contains(reminder["text"], "Подписка скоро закончится") ||
+		!strings.Contains(reminder["reply_markup"], renew) {
+		t.Fatalf("reminder = %v, want renew button", reminder)
+	}
+
+	// Напоминание отправляется один раз
+	h.remindExpiringSubscriptions(ctx, expiresAt.Add(-72*time.Hour), expiresAt)
+	if got := len(tg.Calls("sendMessage")); got != len(sent) {
+		t.Errorf("sendMessage calls = %d after repeated check, want %d", got, len(sent))
+	}
+
+	// Чужой заказ продлить нельзя
+	h.HandleCallback(newTestCallback(otherID, renew))
+	if orders, _ := store.GetUserOrders(ctx, otherID, 0, 0); len(orders) != 0 {
+		t.Errorf("other user renewed someone else's order: %+v", orders)
+	}
+
+	h.HandleCallback(newTestCallback(userID, renew))
+	orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+	if len(orders) != 2 || orders[0].ProductID != productID || orders[0].PaymentMethod != payment.CodeCard ||
+		orders[0].Status != models.OrderStatusCreated {
+		t.Fatalf("orders after renew = %+v, want a new order for the same product", orders)
+	}
+	if msgs := tg.MessagesTo(userID); !containsText(msgs, orders[0].OrderID) {
+		t.Errorf("messages = %q, want checkout of the renewal order", msgs)
+	}
+}
+
+func TestAdminEditDuration(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+
+	productID, _ := firstProduct(t, store)
+	h.HandleCallback(newTestCallback(testAdminID, fmt.Sprintf("admin_edit_duration:%d", productID)))
+
+	h.HandleMessage(newTestMessage(testAdminID, "100"))
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], "от 0 до") {
+		t.Errorf("last message = %q, want range error", msgs[len(msgs)-1])
+	}
+
+	h.HandleMessage(newTestMessage(testAdminID, "2"))
+	if product, _ := store.GetProductByID(ctx, productID); product.DurationMonths != 2 {
+		t.Errorf("DurationMonths = %d, want 2", product.DurationMonths)
+	}
+	if _, ok := h.fsmManager.GetState(testAdminID); ok {
+		t.Error("state not cleared after duration update")
+	}
+}
+
+func TestPreorder_PaidWaitsForReleaseThenFulfilled(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID int64 = 42
+
+	productID, _ := firstProduct(t, store)
+	releaseAt := time.Now().Add(50 * time.Hour)
+	store.UpdateProductRelease(ctx, productID, &releaseAt)
+
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("product:%d", productID)))
+	edits := tg.Calls("editMessageText")
+	card := edits[len(edits)-1].Params
+	if !strings.Contains(card["text"], "Предзаказ:</b> выход") || !strings.Contains(card["text"], "осталось 2 дн. 1 ч") ||
+		!strings.Contains(card["reply_markup"], "Оформить предзаказ") {
+		t.Fatalf("product card = %v, want preorder countdown", card)
+	}
+
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+	order := orders[0]
+
+	h.HandleCallback(newTestCallback(testAdminID, "confirm_payment:"+order.OrderID))
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusPreordered {
+		t.Fatalf("status after payment = %q, want preordered", got.Status)
+	}
+	if msgs := tg.MessagesTo(userID); !strings.Contains(msgs[len(msgs)-1], "Предзаказ оплачен") {
+		t.Errorf("last message = %q, want preorder confirmation", msgs[len(msgs)-1])
+	}
+
+	// До выхода предзаказ ждет
+	h.releasePreorders(ctx, time.Now())
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusPreordered {
+		t.Fatalf("status before release = %q, want preordered", got.Status)
+	}
+
+	h.releasePreorders(ctx, releaseAt.Add(time.Minute))
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusPaid {
+		t.Fatalf("status after release = %q, want paid", got.Status)
+	}
+	if msgs := tg.MessagesTo(userID); !containsText(msgs, "уже вышел") {
+		t.Errorf("messages = %q, want release notice", msgs)
+	}
+	sent := tg.Calls("sendMessage")
+	if admin := sent[len(sent)-1].Params; admin["chat_id"] != fmt.Sprint(testAdminID) ||
+		!strings.Contains(admin["text"], "Предзаказ передан в выполнение") ||
+		!strings.Contains(admin["reply_markup"], "claim_order:"+order.OrderID) {
+		t.Errorf("admin notification = %v, want claim button", admin)
+	}
+}
+
+func TestParseReleaseDate(t *testing.T) {
+	moscow, _ := time.LoadLocation("Europe/Moscow")
+
+	got, err := parseReleaseDate(" 26.02.2026 19:00 ")
+	if err != nil || !got.Equal(time.Date(2026, 2, 26, 19, 0, 0, 0, moscow)) {
+		t.Errorf("parseReleaseDate(with time) = %v, %v", got, err)
+	}
+	if got, err := parseReleaseDate("26.02.2026"); err != nil || !got.Equal(time.Date(2026, 2, 26, 0, 0, 0, 0, moscow)) {
+		t.Errorf("parseReleaseDate(date) = %v, %v", got, err)
+	}
+	if _, err := parseReleaseDate("2026-02-26"); err == nil {
+		t.Error("parseReleaseDate(ISO) error = nil, want error")
+	}
+}
+
+func TestHandleMyOrders_Empty(t *testing.T) {
+	h, _, tg := newTestHandler(t)
+	const userID int64 = 42
+
+	h.HandleMessage(newTestCommand(userID, "/my_orders"))
+
+	if msgs := tg.MessagesTo(userID); len(msgs) != 1 || !strings.Contains(msgs[0], "нет заказов") {
+		t.Errorf("messages = %q, want empty orders notice", msgs)
+	}
+}
+
+func TestMyOrders_PaginatedWithCardAndUserCancel(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID, otherID int64 = 42, 43
+
+	productID, price := firstProduct(t, store)
+	var created []*models.Order
+	for i := 0; i < MyOrdersPageSize+2; i++ {
+		order, _ := store.CreateOrder(ctx, userID, productID, price, payment.CodeCard, "")
+		created = append(created, order)
+	}
+
+	h.HandleMessage(newTestCommand(userID, "/my_orders"))
+	sent := tg.Calls("sendMessage")
+	markup := sent[len(sent)-1].Params["reply_markup"]
+	if !strings.Contains(markup, "my_orders:1") || strings.Contains(markup, created[0].OrderID) {
+		t.Fatalf("first page markup = %s, want next page and no oldest order", markup)
+	}
+
+	// На второй странице - два самых старых заказа
+	h.HandleCallback(newTestCallback(userID, "my_orders:1"))
+	edits := tg.Calls("editMessageText")
+	page := edits[len(edits)-1].Params
+	if !strings.Contains(page["text"], created[0].OrderID) || !strings.Contains(page["text"], created[1].OrderID) ||
+		strings.Contains(page["reply_markup"], "my_orders:2") {
+		t.Fatalf("second page = %q, want two oldest orders and no next page", page["text"])
+	}
+
+	order := created[0]
+	h.HandleCallback(newTestCallback(userID, "my_order:"+order.OrderID+":1"))
+	edits = tg.Calls("editMessageText")
+	card := edits[len(edits)-1].Params
+	if !strings.Contains(card["text"], "История:") || !strings.Contains(card["reply_markup"], "user_cancel_order:"+order.OrderID) ||
+		!strings.Contains(card["reply_markup"], "my_orders:1") {
+		t.Fatalf("order card = %q %s, want timeline, cancel and back buttons", card["text"], card["reply_markup"])
+	}
+
+	h.HandleCallback(newTestCallback(userID, "order_pay:"+order.OrderID))
+	if msgs := tg.MessagesTo(userID); !strings.Contains(msgs[len(msgs)-1], order.OrderID) {
+		t.Errorf("last message = %q, want payment instructions again", msgs[len(msgs)-1])
+	}
+
+	// Чужой заказ отменить нельзя
+	h.HandleCallback(newTestCallback(otherID, "user_cancel_order:"+order.OrderID+":0"))
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusCreated {
+		t.Fatalf("order status after foreign cancel = %q, want created", got.Status)
+	}
+
+	h.HandleCallback(newTestCallback(userID, "user_cancel_order:"+order.OrderID+":1"))
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusCancelled {
+		t.Fatalf("order status = %q, want cancelled", got.Status)
+	}
+	edits = tg.Calls("editMessageText")
+	if card := edits[len(edits)-1].Params; !strings.Contains(card["text"], "Отменен покупателем") ||
+		strings.Contains(card["reply_markup"], "user_cancel_order") {
+		t.Errorf("card after cancel = %q %s, want reason and no cancel button", card["text"], card["reply_markup"])
+	}
+	if !containsText(tg.MessagesTo(testAdminID), "Покупатель отменил заказ") {
+		t.Error("admins were not notified about the cancellation")
+	}
+}
+
+func TestSupport_RelaysUserMessagesAndAdminReplies(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID int64 = 42
+
+	productID, price := firstProduct(t, store)
+	order, _ := store.CreateOrder(ctx, userID, productID, price, payment.CodeCard, "")
+
+	// Чужой заказ обсуждать нельзя
+	h.HandleCallback(newTestCallback(43, "support:"+order.OrderID))
+	if _, ok := h.fsmManager.GetState(43); ok {
+		t.Fatal("support thread opened for someone else's order")
+	}
+
+	h.HandleCallback(newTestCallback(userID, "support:"+order.OrderID))
+	h.HandleMessage(newTestMessage(userID, "Когда придет ключ?"))
+
+	var relayed *apiCall
+	for _, c := range tg.Calls("sendMessage") {
+		if c.Params["chat_id"] == fmt.Sprint(testAdminID) && strings.Contains(c.Params["text"], order.OrderID) {
+			relayed = &c
+		}
+	}
+	if relayed == nil || !strings.Contains(relayed.Params["text"], "Когда придет ключ?") {
+		t.Fatalf("admin messages = %q, want user question tagged with order ID", tg.MessagesTo(testAdminID))
+	}
+
+	// Ответ админа на пересланное сообщение уходит покупателю
+	reply := newTestMessage(testAdminID, "Через 5 минут")
+	reply.ReplyToMessage = &tgbotapi.Message{MessageID: relayed.MessageID}
+	h.HandleMessage(reply)
+
+	var answer *apiCall
+	for _, c := range tg.Calls("sendMessage") {
+		if c.Params["chat_id"] == fmt.Sprint(userID) && strings.Contains(c.Params["text"], "Через 5 минут") {
+			answer = &c
+		}
+	}
+	if answer == nil {
+		t.Fatalf("user messages = %q, want admin reply", tg.MessagesTo(userID))
+	}
+
+	// Покупатель вышел из переписки, но может ответить на ответ админа
+	h.HandleMessage(newTestCommand(userID, "/cancel"))
+	followUp := newTestMessage(userID, "Спасибо!")
+	followUp.ReplyToMessage = &tgbotapi.Message{MessageID: answer.MessageID}
+	h.HandleMessage(followUp)
+
+	thread, _ := store.GetSupportThread(ctx, order.OrderID)
+	if len(thread) != 3 || thread[0].AdminID != 0 || thread[1].AdminID != testAdminID || thread[2].Text != "Спасибо!" {
+		t.Fatalf("support thread = %+v, want question, admin reply and follow-up", thread)
+	}
+
+	h.HandleMessage(newTestCommand(testAdminID, "/support "+strings.ToLower(order.OrderID)))
+	msgs := tg.MessagesTo(testAdminID)
+	if last := msgs[len(msgs)-1]; !strings.Contains(last, "Когда придет ключ?") || !strings.Contains(last, "Спасибо!") {
+		t.Errorf("support thread view = %q, want whole conversation", last)
+	}
+}
+
+func TestAdminOrders_LookupFilterAndComplete(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID int64 = 42
+
+	productID, price := firstProduct(t, store)
+	var created []*models.Order
+	for i := 0; i < AdminOrdersPageSize+1; i++ {
+		order, _ := store.CreateOrder(ctx, userID, productID, price, payment.CodeCard, "")
+		created = append(created, order)
+	}
+	paid := created[0]
+	store.UpdateOrderStatus(ctx, paid.OrderID, models.OrderStatusPaid, testAdminID, "")
+
+	// Покупатель не видит чужие заказы
+	h.HandleMessage(newTestCommand(userID, "/order "+paid.OrderID))
+	if msgs := tg.MessagesTo(userID); !strings.Contains(msgs[len(msgs)-1], "нет доступа") {
+		t.Fatalf("last message = %q, want access denied", msgs[len(msgs)-1])
+	}
+
+	// Номер можно ввести в нижнем регистре и с пробелами
+	h.HandleMessage(newTestCommand(testAdminID, "/order "+strings.ToLower(paid.OrderID[:7])+" "+paid.OrderID[7:]))
+	sent := tg.Calls("sendMessage")
+	card := sent[len(sent)-1].Params
+	if !strings.Contains(card["text"], "История:") || !strings.Contains(card["reply_markup"], "complete_order:"+paid.OrderID) ||
+		!strings.Contains(card["reply_markup"], "refund_order:"+paid.OrderID) {
+		t.Fatalf("order card = %q %s, want timeline, complete and refund buttons", card["text"], card["reply_markup"])
+	}
+
+	h.HandleMessage(newTestCommand(testAdminID, "/order WOW0000000001"))
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], "не номер заказа") {
+		t.Errorf("last message = %q, want invalid number", msgs[len(msgs)-1])
+	}
+
+	h.HandleMessage(newTestCommand(testAdminID, "/orders status=paid"))
+	sent = tg.Calls("sendMessage")
+	list := sent[len(sent)-1].Params
+	if !strings.Contains(list["text"], paid.OrderID) || strings.Contains(list["text"], created[1].OrderID) ||
+		!strings.Contains(list["reply_markup"], "admin_order:"+paid.OrderID) {
+		t.Fatalf("filtered list = %q, want only the paid order", list["text"])
+	}
+
+	// Без фильтра заказов больше страницы: самый старый - на второй
+	h.HandleMessage(newTestCommand(testAdminID, "/orders user=42"))
+	sent = tg.Calls("sendMessage")
+	list = sent[len(sent)-1].Params
+	next := encodeOrderFilter(models.OrderFilter{UserID: userID}, 1, time.UTC)
+	if strings.Contains(list["text"], paid.OrderID) || !strings.Contains(list["reply_markup"], next) {
+		t.Fatalf("first page = %q %s, want next page %s", list["text"], list["reply_markup"], next)
+	}
+	h.HandleCallback(newTestCallback(testAdminID, next))
+	edits := tg.Calls("editMessageText")
+	if page := edits[len(edits)-1].Params; !strings.Contains(page["text"], paid.OrderID) {
+		t.Fatalf("second page = %q, want the oldest order", page["text"])
+	}
+
+	h.HandleMessage(newTestCommand(testAdminID, "/orders region=XX"))
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], "регион XX не найден") {
+		t.Errorf("last message = %q, want unknown region", msgs[len(msgs)-1])
+	}
+
+	h.HandleCallback(newTestCallback(testAdminID, "complete_order:"+paid.OrderID))
+	if got, _ := store.GetOrderByID(ctx, paid.OrderID); got.Status != models.OrderStatusCompleted {
+		t.Fatalf("order status = %q, want completed", got.Status)
+	}
+	if !containsText(tg.MessagesTo(userID), "выполнен") {
+		t.Error("buyer was not notified about the completed order")
+	}
+
+	// Неоплаченный заказ завершить нельзя
+	h.HandleCallback(newTestCallback(testAdminID, "complete_order:"+created[1].OrderID))
+	if got, _ := store.GetOrderByID(ctx, created[1].OrderID); got.Status != models.OrderStatusCreated {
+		t.Errorf("unpaid order status = %q, want created", got.Status)
+	}
+}
+
+func TestHandlePriceInput_KeepsKopecks(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+
+	productID, _ := firstProduct(t, store)
+	h.fsmManager.SetState(testAdminID, fsm.StateWaitingForPrice, productID)
+
+	// Слишком точная цена отклоняется, состояние сохраняется для повторного ввода
+	h.HandleMessage(newTestMessage(testAdminID, "10.999"))
+	if _, ok := h.fsmManager.GetState(testAdminID); !ok {
+		t.Fatal("FSM state was cleared after invalid price")
+	}
+
+	h.HandleMessage(newTestMessage(testAdminID, "2 500,50"))
+
+	want := money.New(250050, money.RUB)
+	product, _ := store.GetProductByID(context.Background(), productID)
+	if product.Price != want {
+		t.Errorf("price = %+v, want 2500.50 RUB", product.Price)
+	}
+
+	msgs := tg.MessagesTo(testAdminID)
+	if len(msgs) != 2 || !strings.Contains(msgs[1], want.String()) {
+		t.Errorf("admin messages = %q, want confirmation with new price", msgs)
+	}
+
+	// Предел цены зависит от валюты: 150 000 ₸ - обычная цена, а 150 000 ₽ - опечатка
+	h.fsmManager.SetState(testAdminID, fsm.StateWaitingForPrice, productID)
+	h.HandleMessage(newTestMessage(testAdminID, "150000"))
+	if product, _ := store.GetProductByID(context.Background(), productID); product.Price != want {
+		t.Errorf("price = %+v, want too large RUB price rejected", product.Price)
+	}
+	h.fsmManager.ClearState(testAdminID)
+
+	category, _ := store.GetCategoryByID(context.Background(), product.CategoryID)
+	if err := store.UpdateRegionCurrency(context.Background(), category.RegionID, money.KZT); err != nil {
+		t.Fatalf("UpdateRegionCurrency() error = %v", err)
+	}
+	h.fsmManager.SetState(testAdminID, fsm.StateWaitingForPrice, productID)
+	h.HandleMessage(newTestMessage(testAdminID, "150000"))
+	if product, _ := store.GetProductByID(context.Background(), productID); product.Price != money.FromMajor(150000, money.KZT) {
+		t.Errorf("price = %+v, want 150 000 KZT", product.Price)
+	}
+}
+
+func TestHandleAdminSetCurrency(t *testing.T) {
+	h, store, _ := newTestHandler(t)
+	ctx := context.Background()
+
+	regions, _ := store.ListRegions(ctx)
+	region := regions[0]
+
+	// Обычный пользователь не может менять валюту
+	h.HandleCallback(newTestCallback(42, fmt.Sprintf("admin_set_currency:%d:KZT", region.ID)))
+	if got, _ := store.GetRegionByID(ctx, region.ID); got.Currency != region.Currency {
+		t.Fatalf("currency after non-admin request = %s, want %s", got.Currency, region.Currency)
+	}
+
+	h.HandleCallback(newTestCallback(testAdminID, fmt.Sprintf("admin_set_currency:%d:KZT", region.ID)))
+	if got, _ := store.GetRegionByID(ctx, region.ID); got.Currency != money.KZT {
+		t.Errorf("currency = %s, want KZT", got.Currency)
+	}
+
+	// Неизвестная валюта игнорируется
+	h.HandleCallback(newTestCallback(testAdminID, fmt.Sprintf("admin_set_currency:%d:USD", region.ID)))
+	if got, _ := store.GetRegionByID(ctx, region.ID); got.Currency != money.KZT {
+		t.Errorf("currency after unknown code = %s, want KZT", got.Currency)
+	}
+}
+
+func TestExpireOrders_CancelsUnpaidAndOffersRebuy(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID int64 = 42
+
+	productID, price := firstProduct(t, store)
+	unpaid, _ := store.CreateOrder(ctx, userID, productID, price, payment.CodeCard, "")
+	paid, _ := store.CreateOrder(ctx, userID, productID, price, payment.CodeCard, "")
+	if err := store.UpdateOrderStatus(ctx, paid.OrderID, models.OrderStatusPaid, testAdminID, ""); err != nil {
+		t.Fatalf("UpdateOrderStatus() error = %v", err)
+	}
+	withReceipt, _ := store.CreateOrder(ctx, userID, productID, price, payment.CodeCard, "")
+	if _, err := store.AddOrderReceipt(ctx, withReceipt.OrderID, userID, "file", "photo"); err != nil {
+		t.Fatalf("AddOrderReceipt() error = %v", err)
+	}
+
+	// Товар, скрытый из каталога (например, кончились ключи), купить снова нельзя
+	const otherUserID int64 = 43
+	products, _ := store.ListProducts(ctx)
+	hidden := products[1]
+	hiddenOrder, _ := store.CreateOrder(ctx, otherUserID, hidden.ID, hidden.Price, payment.CodeCard, "")
+	if err := store.UpdateProductVisibility(ctx, hidden.ID, false); err != nil {
+		t.Fatalf("UpdateProductVisibility() error = %v", err)
+	}
+
+	// Отсечка в будущем: все неоплаченные заказы считаются просроченными
+	h.expireOrders(ctx, time.Now().Add(time.Second), 24*time.Hour)
+
+	if got, _ := store.GetOrderByID(ctx, unpaid.OrderID); got.Status != models.OrderStatusCancelled {
+		t.Errorf("unpaid order status = %q, want cancelled", got.Status)
+	}
+	if got, _ := store.GetOrderByID(ctx, paid.OrderID); got.Status != models.OrderStatusPaid {
+		t.Errorf("paid order status = %q, want paid", got.Status)
+	}
+	// Чек ждет проверки админом - заказ не отменяется
+	if got, _ := store.GetOrderByID(ctx, withReceipt.OrderID); got.Status != models.OrderStatusCreated {
+		t.Errorf("order with pending receipt status = %q, want created", got.Status)
+	}
+
+	history, _ := store.GetOrderStatusHistory(ctx, unpaid.OrderID)
+	if last := history[len(history)-1]; last.ActorID != 0 || last.Reason != "Не оплачен за 24 ч" {
+		t.Errorf("last history entry = %+v, want system cancellation with reason", last)
+	}
+
+	var userCalls []apiCall
+	for _, c := range tg.Calls("sendMessage") {
+		if c.Params["chat_id"] == fmt.Sprint(userID) {
+			userCalls = append(userCalls, c)
+		}
+	}
+	if len(userCalls) != 1 || !strings.Contains(userCalls[0].Params["reply_markup"], fmt.Sprintf("buy:%d", productID)) {
+		t.Errorf("user messages = %+v, want one cancellation notice with rebuy button", userCalls)
+	}
+
+	if got, _ := store.GetOrderByID(ctx, hiddenOrder.OrderID); got.Status != models.OrderStatusCancelled {
+		t.Errorf("hidden product order status = %q, want cancelled", got.Status)
+	}
+	var hiddenCalls []apiCall
+	for _, c := range tg.Calls("sendMessage") {
+		if c.Params["chat_id"] == fmt.Sprint(otherUserID) {
+			hiddenCalls = append(hiddenCalls, c)
+		}
+	}
+	if len(hiddenCalls) != 1 || strings.Contains(hiddenCalls[0].Params["reply_markup"], "buy:") {
+		t.Errorf("user messages = %+v, want cancellation notice without rebuy button for hidden product", hiddenCalls)
+	}
+
+	if msgs := tg.MessagesTo(testAdminID); len(msgs) != 2 || !containsText(msgs, unpaid.OrderID) || !containsText(msgs, hiddenOrder.OrderID) {
+		t.Errorf("admin messages = %q, want expiry notices", msgs)
+	}
+
+	// Повторный проход ничего не делает
+	h.expireOrders(ctx, time.Now().Add(time.Second), 24*time.Hour)
+	if msgs := tg.MessagesTo(testAdminID); len(msgs) != 2 {
+		t.Errorf("admin got %d messages after second pass, want 2", len(msgs))
+	}
+}
+
+func TestHandleBuyProduct_SendsInvoiceWithProviderToken(t *testing.T) {
+	h, store, tg := newTestHandler(t, payment.NewTelegram("provider-token"))
+	const userID int64 = 42
+
+	productID, price := firstProduct(t, store)
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+
+	orders, _ := store.GetUserOrders(context.Background(), userID, 0, 0)
+	if len(orders) != 1 {
+		t.Fatalf("got %d orders, want 1", len(orders))
+	}
+
+	invoices := tg.Calls("sendInvoice")
+	if len(invoices) != 1 {
+		t.Fatalf("got %d invoices, want 1", len(invoices))
+	}
+	params := invoices[0].Params
+	if params["payload"] != orders[0].OrderID || params["currency"] != string(price.Currency) || params["provider_token"] != "provider-token" {
+		t.Errorf("invoice params = %v", params)
+	}
+	if !strings.Contains(params["prices"], fmt.Sprintf(`"amount":%d`, price.Amount)) {
+		t.Errorf("invoice prices = %s, want amount %d", params["prices"], price.Amount)
+	}
+
+	// Инструкция с картой не отправляется, админ получает уведомление о заказе
+	if msgs := tg.MessagesTo(userID); len(msgs) != 0 {
+		t.Errorf("user messages = %q, want only invoice", msgs)
+	}
+	if msgs := tg.MessagesTo(testAdminID); len(msgs) != 1 || !strings.Contains(msgs[0], "Картой в Telegram") {
+		t.Errorf("admin messages = %q, want new order notification", msgs)
+	}
+}
+
+func TestHandlePreCheckoutQuery(t *testing.T) {
+	h, store, tg := newTestHandler(t, payment.NewTelegram("provider-token"))
+	ctx := context.Background()
+	const userID int64 = 42
+
+	productID, price := firstProduct(t, store)
+	order, _ := store.CreateOrder(ctx, userID, productID, price, payment.CodeTelegram, "")
+
+	preCheckout := func(fromID int64, amount int64) apiCall {
+		t.Helper()
+		h.HandlePreCheckoutQuery(&tgbotapi.PreCheckoutQuery{
+			ID:             "pcq",
+			From:           &tgbotapi.User{ID: fromID},
+			Currency:       string(price.Currency),
+			TotalAmount:    int(amount),
+			InvoicePayload: order.OrderID,
+		})
+		calls := tg.Calls("answerPreCheckoutQuery")
+		if len(calls) == 0 {
+			t.Fatal("pre-checkout query was not answered")
+		}
+		return calls[len(calls)-1]
+	}
+
+	if answer := preCheckout(userID, price.Amount); answer.Params["ok"] != "true" {
+		t.Errorf("answer = %v, want ok", answer.Params)
+	}
+	if answer := preCheckout(userID, price.Amount+1); answer.Params["ok"] == "true" || answer.Params["error_message"] == "" {
+		t.Errorf("answer for wrong amount = %v, want rejection", answer.Params)
+	}
+	if answer := preCheckout(userID+1, price.Amount); answer.Params["ok"] == "true" {
+		t.Errorf("answer for another user = %v, want rejection", answer.Params)
+	}
+
+	// Цена изменилась после оформления заказа
+	if err := store.UpdateProductPrice(ctx, productID, price.Add(money.New(100, price.Currency))); err != nil {
+		t.Fatalf("UpdateProductPrice() error = %v", err)
+	}
+	if answer := preCheckout(userID, price.Amount); answer.Params["ok"] == "true" || !strings.Contains(answer.Params["error_message"], "Цена") {
+		t.Errorf("answer after price change = %v, want rejection", answer.Params)
+	}
+
+	// Товар скрыт из каталога
+	if err := store.UpdateProductPrice(ctx, productID, price); err != nil {
+		t.Fatalf("UpdateProductPrice() error = %v", err)
+	}
+	if err := store.UpdateProductVisibility(ctx, productID, false); err != nil {
+		t.Fatalf("UpdateProductVisibility() error = %v", err)
+	}
+	if answer := preCheckout(userID, price.Amount); answer.Params["ok"] == "true" || !strings.Contains(answer.Params["error_message"], "недоступен") {
+		t.Errorf("answer for hidden product = %v, want rejection", answer.Params)
+	}
+}
+
+func TestHandleSuccessfulPayment_MarksOrderPaid(t *testing.T) {
+	h, store, tg := newTestHandler(t, payment.NewTelegram("provider-token"))
+	ctx := context.Background()
+	const userID int64 = 42
+
+	productID, price := firstProduct(t, store)
+	order, _ := store.CreateOrder(ctx, userID, productID, price, payment.CodeTelegram, "")
+
+	msg := newTestMessage(userID, "")
+	msg.SuccessfulPayment = &tgbotapi.SuccessfulPayment{
+		Currency:                string(price.Currency),
+		TotalAmount:             int(price.Amount),
+		InvoicePayload:          order.OrderID,
+		TelegramPaymentChargeID: "tg-charge-1",
+		ProviderPaymentChargeID: "provider-charge-1",
+	}
+	h.HandleMessage(msg)
+
+	got, _ := store.GetOrderByID(ctx, order.OrderID)
+	if got.Status != models.OrderStatusPaid {
+		t.Fatalf("status = %q, want paid", got.Status)
+	}
+
+	history, _ := store.GetOrderStatusHistory(ctx, order.OrderID)
+	if last := history[len(history)-1]; last.ActorID != 0 || !strings.Contains(last.Reason, "tg-charge-1") {
+		t.Errorf("last history entry = %+v, want system change with charge id", last)
+	}
+
+	if msgs := tg.MessagesTo(userID); len(msgs) != 1 || !strings.Contains(msgs[0], "Оплата подтверждена") {
+		t.Errorf("user messages = %q, want payment confirmation", msgs)
+	}
+	if msgs := tg.MessagesTo(testAdminID); len(msgs) != 1 || !strings.Contains(msgs[0], "tg-charge-1") {
+		t.Errorf("admin messages = %q, want payment notification", msgs)
+	}
+
+	// Повторная доставка того же платежа не меняет заказ и уходит админам на проверку
+	h.HandleMessage(msg)
+	if msgs := tg.MessagesTo(testAdminID); len(msgs) != 2 || !strings.Contains(msgs[1], "ручной проверки") {
+		t.Errorf("admin messages = %q, want manual review notice", msgs)
+	}
+}
+
+func TestCheckout_ChooseMethodAndPayWithMock(t *testing.T) {
+	h, store, tg := newTestHandler(t, payment.NewCard("0000 1111 2222 3333"), payment.NewMock())
+	ctx := context.Background()
+	const userID int64 = 42
+
+	productID, price := firstProduct(t, store)
+
+	// Несколько способов - сначала выбор, заказ еще не создан
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	if orders, _ := store.GetUserOrders(ctx, userID, 0, 0); len(orders) != 0 {
+		t.Fatalf("got %d orders before choosing payment method, want 0", len(orders))
+	}
+	edits := tg.Calls("editMessageText")
+	if len(edits) != 1 || !strings.Contains(edits[0].Params["reply_markup"], fmt.Sprintf("pay:%d:mock", productID)) {
+		t.Fatalf("edits = %+v, want payment method choice", edits)
+	}
+
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("pay:%d:mock", productID)))
+	orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+	if len(orders) != 1 || orders[0].PaymentMethod != payment.CodeMock || orders[0].Price != price {
+		t.Fatalf("orders = %+v, want one mock order", orders)
+	}
+	order := orders[0]
+
+	// Чужой заказ тестовой кнопкой не оплатить
+	h.HandleCallback(newTestCallback(userID+1, "mock_pay:"+order.OrderID))
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusCreated {
+		t.Fatalf("status after foreign mock pay = %q, want created", got.Status)
+	}
+
+	h.HandleCallback(newTestCallback(userID, "mock_pay:"+order.OrderID))
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusPaid {
+		t.Errorf("status after mock pay = %q, want paid", got.Status)
+	}
+
+	msgs := tg.MessagesTo(userID)
+	if len(msgs) != 2 || !strings.Contains(msgs[0], "Тестовый заказ") || !strings.Contains(msgs[1], "Оплата подтверждена") {
+		t.Errorf("user messages = %q, want mock instructions and confirmation", msgs)
+	}
+}
+
+func TestCheckout_StarsInvoiceAndDisabledMethod(t *testing.T) {
+	rates, _ := payment.ParseRates("RUB=1.5")
+	h, store, tg := newTestHandler(t, payment.NewCard("0000 1111 2222 3333"), payment.NewStars(rates))
+	const userID int64 = 42
+
+	productID, price := firstProduct(t, store)
+
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("pay:%d:stars", productID)))
+	invoices := tg.Calls("sendInvoice")
+	if len(invoices) != 1 {
+		t.Fatalf("got %d invoices, want 1", len(invoices))
+	}
+	wantStars, _ := rates.Convert(price, 0)
+	params := invoices[0].Params
+	if params["currency"] != payment.StarsCurrency || !strings.Contains(params["prices"], fmt.Sprintf(`"amount":%d`, wantStars)) {
+		t.Errorf("invoice params = %v, want %d XTR", params, wantStars)
+	}
+
+	// Выключенный способ не создает заказ
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("pay:%d:crypto", productID)))
+	if orders, _ := store.GetUserOrders(context.Background(), userID, 0, 0); len(orders) != 1 {
+		t.Errorf("got %d orders, want only the stars order", len(orders))
+	}
+}
+
+func TestReceiptUpload_ForwardedToAdminsAndReviewed(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID int64 = 42
+
+	productID, _ := firstProduct(t, store)
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+	if len(orders) != 1 {
+		t.Fatalf("got %d orders, want 1", len(orders))
+	}
+	order := orders[0]
+
+	checkout := tg.Calls("sendMessage")[0]
+	if !strings.Contains(checkout.Params["reply_markup"], "attach_receipt:"+order.OrderID) {
+		t.Fatalf("checkout markup = %s, want attach receipt button", checkout.Params["reply_markup"])
+	}
+
+	h.HandleCallback(newTestCallback(userID, "attach_receipt:"+order.OrderID))
+
+	// Текст и документ не-PDF чеком не считаются
+	h.HandleMessage(newTestMessage(userID, "оплатил"))
+	doc := newTestMessage(userID, "")
+	doc.Document = &tgbotapi.Document{FileID: "zip-file", MimeType: "application/zip"}
+	h.HandleMessage(doc)
+	if receipts, _ := store.GetOrderReceipts(ctx, order.OrderID); len(receipts) != 0 {
+		t.Fatalf("got %d receipts after invalid input, want 0", len(receipts))
+	}
+
+	photo := newTestMessage(userID, "")
+	photo.Photo = []tgbotapi.PhotoSize{{FileID: "small"}, {FileID: "large"}}
+	h.HandleMessage(photo)
+
+	receipts, _ := store.GetOrderReceipts(ctx, order.OrderID)
+	if len(receipts) != 1 || receipts[0].FileID != "large" || receipts[0].FileType != models.ReceiptFilePhoto {
+		t.Fatalf("receipts = %+v, want the largest photo", receipts)
+	}
+
+	forwarded := tg.Calls("sendPhoto")
+	if len(forwarded) != 1 || forwarded[0].Params["chat_id"] != fmt.Sprint(testAdminID) ||
+		!strings.Contains(forwarded[0].Params["reply_markup"], "confirm_payment:"+order.OrderID) ||
+		!strings.Contains(forwarded[0].Params["reply_markup"], "reject_payment:"+order.OrderID) {
+		t.Fatalf("forwarded receipts = %+v, want photo with confirm/reject buttons", forwarded)
+	}
+
+	// Второй чек к тому же заказу тоже уходит админам
+	h.HandleCallback(newTestCallback(userID, "attach_receipt:"+order.OrderID))
+	pdf := newTestMessage(userID, "")
+	pdf.Document = &tgbotapi.Document{FileID: "receipt-pdf", MimeType: "application/pdf"}
+	h.HandleMessage(pdf)
+	if docs := tg.Calls("sendDocument"); len(docs) != 1 {
+		t.Fatalf("got %d forwarded documents, want 1", len(docs))
+	}
+
+	// Подтверждение с сообщения-чека переиспользует handleConfirmPayment
+	confirm := newTestCallback(testAdminID, "confirm_payment:"+order.OrderID)
+	confirm.Message.Document = &tgbotapi.Document{FileID: "receipt-pdf"}
+	confirm.Message.Caption = "Чек об оплате"
+	h.HandleCallback(confirm)
+
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusPaid {
+		t.Errorf("order status = %q, want paid", got.Status)
+	}
+	receipts, _ = store.GetOrderReceipts(ctx, order.OrderID)
+	if len(receipts) != 2 || receipts[0].Status != models.ReceiptStatusAccepted || receipts[1].Status != models.ReceiptStatusAccepted {
+		t.Errorf("receipts = %+v, want both receipts accepted", receipts)
+	}
+	if edits := tg.Calls("editMessageCaption"); len(edits) != 1 {
+		t.Errorf("got %d caption edits, want verdict on the confirmed receipt", len(edits))
+	}
+}
+
+func TestRejectPayment_AsksReasonAndCancelsOrder(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID int64 = 42
+
+	productID, _ := firstProduct(t, store)
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+	order := orders[0]
+
+	h.HandleCallback(newTestCallback(userID, "attach_receipt:"+order.OrderID))
+	photo := newTestMessage(userID, "")
+	photo.Photo = []tgbotapi.PhotoSize{{FileID: "fake"}}
+	h.HandleMessage(photo)
+
+	// Покупатель не может отклонять оплату
+	h.HandleCallback(newTestCallback(userID, "reject_payment:"+order.OrderID))
+	if _, ok := h.fsmManager.GetState(userID); ok {
+		t.Fatal("non-admin got a reject reason prompt")
+	}
+
+	reject := newTestCallback(testAdminID, "reject_payment:"+order.OrderID)
+	reject.Message.Photo = []tgbotapi.PhotoSize{{FileID: "fake"}}
+	reject.Message.Caption = "Чек об оплате"
+	h.HandleCallback(reject)
+
+	// Пустая причина не принимается, заказ остается в ожидании оплаты
+	h.HandleMessage(newTestMessage(testAdminID, "   "))
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusCreated {
+		t.Fatalf("order status after empty reason = %q, want created", got.Status)
+	}
+
+	h.HandleMessage(newTestMessage(testAdminID, "Платеж <не найден>"))
+
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusCancelled {
+		t.Fatalf("order status = %q, want cancelled", got.Status)
+	}
+
+	history, _ := store.GetOrderStatusHistory(ctx, order.OrderID)
+	last := history[len(history)-1]
+	if last.ToStatus != models.OrderStatusCancelled || last.ActorID != testAdminID || last.Reason != "Оплата отклонена: Платеж <не найден>" {
+		t.Errorf("last history entry = %+v, want cancellation by admin with reason", last)
+	}
+
+	receipts, _ := store.GetOrderReceipts(ctx, order.OrderID)
+	if len(receipts) != 1 || receipts[0].Status != models.ReceiptStatusRejected {
+		t.Errorf("receipts = %+v, want rejected receipt", receipts)
+	}
+
+	notified := false
+	for _, text := range tg.MessagesTo(userID) {
+		if strings.Contains(text, "Платеж &lt;не найден&gt;") {
+			notified = true
+		}
+	}
+	if !notified {
+		t.Error("buyer was not notified with the escaped reason")
+	}
+
+	if edits := tg.Calls("editMessageCaption"); len(edits) != 1 || !strings.Contains(edits[0].Params["caption"], "Оплата отклонена") {
+		t.Errorf("caption edits = %+v, want verdict on the rejected receipt", edits)
+	}
+}
+
+func TestCancelOrder_FromAdminListWithReason(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID int64 = 42
+
+	productID, _ := firstProduct(t, store)
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+	order := orders[0]
+
+	h.HandleMessage(newTestCommand(testAdminID, "/admin"))
+	panel := tg.Calls("sendMessage")
+	if len(panel) == 0 || !strings.Contains(panel[len(panel)-1].Params["reply_markup"], "cancel_order:"+order.OrderID) {
+		t.Fatal("admin panel has no cancel button for the created order")
+	}
+
+	// /cancel прерывает ввод причины, заказ не меняется
+	h.HandleCallback(newTestCallback(testAdminID, "cancel_order:"+order.OrderID))
+	h.HandleMessage(newTestCommand(testAdminID, "/cancel"))
+	h.HandleMessage(newTestMessage(testAdminID, "Передумал"))
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusCreated {
+		t.Fatalf("order status after /cancel = %q, want created", got.Status)
+	}
+
+	h.HandleCallback(newTestCallback(testAdminID, "cancel_order:"+order.OrderID))
+	h.HandleMessage(newTestMessage(testAdminID, "Товар закончился"))
+
+	if got, _ := store.GetOrderByID(ctx, order.OrderID); got.Status != models.OrderStatusCancelled {
+		t.Fatalf("order status = %q, want cancelled", got.Status)
+	}
+	history, _ := store.GetOrderStatusHistory(ctx, order.OrderID)
+	if last := history[len(history)-1]; last.Reason != "Товар закончился" {
+		t.Errorf("history reason = %q, want admin reason", last.Reason)
+	}
+
+	// Отмененный заказ нельзя отменить повторно
+	h.HandleCallback(newTestCallback(testAdminID, "cancel_order:"+order.OrderID))
+	if _, ok := h.fsmManager.GetState(testAdminID); ok {
+		t.Error("cancelled order should not prompt for a reason again")
+	}
+}
+
+func TestProductKeys_DeliveredOnPaymentAndAutoHidden(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+
+	productID, _ := firstProduct(t, store)
+
+	h.HandleCallback(newTestCallback(testAdminID, fmt.Sprintf("admin_keys:%d", productID)))
+	h.HandleMessage(newTestMessage(testAdminID, "KEY-1\nKEY-2\n\nKEY-1\nKEY-3\nKEY-4\nKEY-5\nKEY-<6>"))
+
+	stock, _ := store.GetProductKeyStock(ctx, productID)
+	if stock.Available != 6 {
+		t.Fatalf("stock after upload = %+v, want 6 available", stock)
+	}
+
+	buyAndConfirm := func(userID int64) *models.Order {
+		t.Helper()
+		h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+		orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+		if len(orders) != 1 {
+			t.Fatalf("user %d has %d orders, want 1", userID, len(orders))
+		}
+		h.HandleCallback(newTestCallback(testAdminID, "confirm_payment:"+orders[0].OrderID))
+		order, _ := store.GetOrderByID(ctx, orders[0].OrderID)
+		return order
+	}
+
+	order := buyAndConfirm(100)
+	if order.Status != models.OrderStatusCompleted {
+		t.Errorf("order status after key delivery = %q, want completed", order.Status)
+	}
+
+	var delivered string
+	for _, call := range tg.Calls("sendMessage") {
+		if call.Params["chat_id"] == "100" && strings.Contains(call.Params["text"], "<tg-spoiler>") {
+			delivered = call.Params["text"]
+		}
+	}
+	if !strings.Contains(delivered, "<tg-spoiler><code>KEY-1</code></tg-spoiler>") {
+		t.Errorf("key message = %q, want first key in spoiler", delivered)
+	}
+
+	// Остаток 5 - предупреждение админам
+	if !containsText(tg.MessagesTo(testAdminID), "Ключи заканчиваются") {
+		t.Error("admins did not get low stock alert")
+	}
+
+	for userID := int64(101); userID <= 105; userID++ {
+		buyAndConfirm(userID)
+	}
+
+	product, _ := store.GetProductByID(ctx, productID)
+	if product.IsVisible {
+		t.Error("product without keys should be hidden")
+	}
+	if !containsText(tg.MessagesTo(testAdminID), "Ключи закончились") {
+		t.Error("admins did not get out of stock alert")
+	}
+	if !containsText(tg.MessagesTo(105), "KEY-&lt;6&gt;") {
+		t.Error("last key was not escaped in the delivery message")
+	}
+
+	// Новый заказ на товар без ключей не создается
+	h.HandleCallback(newTestCallback(106, fmt.Sprintf("buy:%d", productID)))
+	if orders, _ := store.GetUserOrders(ctx, 106, 0, 0); len(orders) != 0 {
+		t.Errorf("got %d orders for product out of stock, want 0", len(orders))
+	}
+}
+
+func TestCart_CheckoutCreatesOneOrderWithItems(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID int64 = 42
+
+	products, _ := store.ListProducts(ctx)
+	first, second := products[0], products[1]
+
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("cart_add:%d", first.ID)))
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("cart_add:%d", second.ID)))
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("cart_inc:%d", second.ID)))
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("cart_inc:%d", first.ID)))
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("cart_dec:%d", first.ID)))
+
+	// Товар в другой валюте в ту же корзину не попадает
+	eu := store.AddRegion("EU test", "EUT", money.EUR)
+	category := store.AddCategory(eu.ID, "EU", "", 1)
+	foreign, _ := store.CreateProduct(ctx, "EU 1 месяц", category.ID, money.FromMajor(15, money.EUR), "")
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("cart_add:%d", foreign.ID)))
+	if !containsText(tg.MessagesTo(userID), "уже есть товары в RUB") {
+		t.Errorf("user messages = %q, want currency mismatch notice", tg.MessagesTo(userID))
+	}
+
+	h.HandleMessage(newTestCommand(userID, "/cart"))
+	total := second.Price.Mul(2).Add(first.Price)
+	if msgs := tg.MessagesTo(userID); !strings.Contains(msgs[len(msgs)-1], "Итого:</b> "+total.String()) {
+		t.Fatalf("cart view = %q, want total %s", msgs[len(msgs)-1], total)
+	}
+
+	h.HandleCallback(newTestCallback(userID, "cart_checkout:0"))
+
+	orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+	if len(orders) != 1 || orders[0].Price != total || orders[0].ProductID != 0 {
+		t.Fatalf("orders = %+v, want one cart order for %s", orders, total)
+	}
+	items, _ := store.GetOrderItems(ctx, orders[0].OrderID)
+	if len(items) != 2 || items[1].ProductID != second.ID || items[1].Quantity != 2 {
+		t.Errorf("order items = %+v, want 1 x first and 2 x second", items)
+	}
+	if cart, _ := store.GetCart(ctx, userID); len(cart) != 0 {
+		t.Errorf("cart after checkout = %+v, want empty", cart)
+	}
+
+	title := fmt.Sprintf("%s, %s ×2", first.Name, second.Name)
+	if !containsText(tg.MessagesTo(testAdminID), title) {
+		t.Errorf("admin messages = %q, want order composition %q", tg.MessagesTo(testAdminID), title)
+	}
+
+	// Обычный заказ на один товар показывается рядом с заказом из корзины
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", first.ID)))
+	h.HandleMessage(newTestCommand(userID, "/my_orders"))
+	msgs := tg.MessagesTo(userID)
+	if last := msgs[len(msgs)-1]; !strings.Contains(last, title) || strings.Count(last, first.Name) != 2 {
+		t.Errorf("my orders = %q, want cart order and single-item order", last)
+	}
+}
+
+func TestPromoCode_AskedAtCheckoutAndApplied(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID int64 = 42
+	productID, price := firstProduct(t, store)
+
+	h.HandleMessage(newTestCommand(testAdminID, "/promo_new spring10 10% per_user=1"))
+	if !containsText(tg.MessagesTo(testAdminID), "Промокод создан") {
+		t.Fatalf("admin messages = %q, want promo code created", tg.MessagesTo(testAdminID))
+	}
+
+	// Пока есть действующие промокоды, перед заказом бот спрашивает код
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	if orders, _ := store.GetUserOrders(ctx, userID, 0, 0); len(orders) != 0 {
+		t.Fatalf("orders = %+v, want none before promo code answer", orders)
+	}
+	if !containsText(tg.MessagesTo(userID), "Есть промокод?") {
+		t.Fatalf("user messages = %q, want promo code prompt", tg.MessagesTo(userID))
+	}
+
+	h.HandleMessage(newTestMessage(userID, "WINTER"))
+	if !containsText(tg.MessagesTo(userID), "Промокод не найден") {
+		t.Errorf("user messages = %q, want unknown code notice", tg.MessagesTo(userID))
+	}
+
+	h.HandleMessage(newTestMessage(userID, "spring10"))
+	orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+	discount := money.New(price.Amount/10, price.Currency)
+	if len(orders) != 1 || orders[0].PromoCode != "SPRING10" || orders[0].Price != price.Sub(discount) {
+		t.Fatalf("orders = %+v, want one order with SPRING10 discount", orders)
+	}
+	if !containsText(tg.MessagesTo(testAdminID), "🎟 SPRING10, −"+discount.String()) {
+		t.Errorf("admin messages = %q, want promo code in order notification", tg.MessagesTo(testAdminID))
+	}
+
+	// Лимит на покупателя исчерпан - можно оформить без промокода
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	h.HandleMessage(newTestMessage(userID, "SPRING10"))
+	if !containsText(tg.MessagesTo(userID), "больше нельзя использовать") {
+		t.Errorf("user messages = %q, want usage limit notice", tg.MessagesTo(userID))
+	}
+	h.HandleCallback(newTestCallback(userID, "promo_skip:0"))
+	orders, _ = store.GetUserOrders(ctx, userID, 0, 0)
+	if len(orders) != 2 || orders[0].PromoCode != "" || orders[0].Price != price {
+		t.Errorf("orders = %+v, want second order at full price", orders)
+	}
+}
+
+func TestPayoutCards_RotatedWithinRegionAndDailyLimit(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	productID, _ := firstProduct(t, store)
+
+	h.HandleMessage(newTestCommand(testAdminID, "/card_new 2200000000000001; Т-Банк; Иван И.; region=KZ; limit=1000RUB"))
+	h.HandleMessage(newTestCommand(testAdminID, "/card_new 2200 0000 0000 0002; Сбер; Петр П."))
+	h.HandleMessage(newTestCommand(testAdminID, "/card_new 2200 0000 0000 0003; Сбер; Петр П.; region=EU; limit=1000RUB"))
+	if msgs := tg.MessagesTo(testAdminID); !containsText(msgs, "валюте региона EU") {
+		t.Fatalf("admin messages = %q, want currency mismatch for EU card", msgs)
+	}
+	if cards, _ := store.ListPayoutCards(ctx, time.Now()); len(cards) != 2 || cards[0].Number != "2200 0000 0000 0001" {
+		t.Fatalf("payout cards = %+v, want two cards with normalized number", cards)
+	}
+
+	buy := func(userID int64) string {
+		h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+		msgs := tg.MessagesTo(userID)
+		return msgs[len(msgs)-1]
+	}
+
+	// По кругу: каждый заказ получает карту, которую дольше всех не выдавали, пока она влезает в лимит
+	if got := buy(41); !strings.Contains(got, "2200 0000 0000 0001") || !strings.Contains(got, "Т-Банк, получатель Иван И.") {
+		t.Errorf("first checkout = %q, want KZ card", got)
+	}
+	if got := buy(42); !strings.Contains(got, "2200 0000 0000 0002") {
+		t.Errorf("second checkout = %q, want card for all regions", got)
+	}
+	if got := buy(43); !strings.Contains(got, "2200 0000 0000 0002") {
+		t.Errorf("third checkout = %q, want card without limit: KZ card is over its daily limit", got)
+	}
+
+	h.HandleCallback(newTestCallback(testAdminID, "admin_card_toggle:2"))
+	if got := buy(44); !strings.Contains(got, "0000 1111 2222 3333") {
+		t.Errorf("checkout without free cards = %q, want default card", got)
+	}
+
+	orders, _ := store.GetUserOrders(ctx, 41, 0, 0)
+	h.HandleMessage(newTestCommand(testAdminID, "/order "+orders[0].OrderID))
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], "Карта: Т-Банк •0001") {
+		t.Errorf("admin order card = %q, want payout card", msgs[len(msgs)-1])
+	}
+
+	h.HandleMessage(newTestCommand(testAdminID, "/cards"))
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], "Сегодня: 670") ||
+		!strings.Contains(msgs[len(msgs)-1], "⏸ выключена") {
+		t.Errorf("cards list = %q, want usage and disabled card", msgs[len(msgs)-1])
+	}
+}
+
+func TestReconcile_StatementConfirmsOrdersByUniqueAmount(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	productID, price := firstProduct(t, store)
+
+	// Два заказа на одну цену получают разные копейки в сумме перевода
+	for _, userID := range []int64{41, 42} {
+		h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	}
+	first, second := price.Add(money.New(1, price.Currency)), price.Add(money.New(2, price.Currency))
+	if msgs := tg.MessagesTo(42); !strings.Contains(msgs[len(msgs)-1], "Переведите "+second.String()) {
+		t.Fatalf("checkout = %q, want transfer amount %s", msgs[len(msgs)-1], second)
+	}
+	if !containsText(tg.MessagesTo(testAdminID), "перевод "+first.String()) {
+		t.Errorf("admin messages = %q, want transfer amount in new order notification", tg.MessagesTo(testAdminID))
+	}
+
+	h.HandleMessage(newTestCommand(testAdminID, "/reconcile"))
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], "Ожидают оплаты переводом: 2") {
+		t.Fatalf("reconcile prompt = %q, want two awaiting orders", msgs[len(msgs)-1])
+	}
+
+	// В выписке - перевод второго покупателя без номера заказа и постороннее списание
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+	paidAt := time.Now().Add(time.Minute).In(moscowLocation).Format("02.01.2006 15:04:05")
+	statement := "Дата операции;Сумма операции;Валюта операции;Описание\n" +
+		paidAt + ";+" + strings.Replace(second.Decimal(), ".", ",", 1) + ";RUB;Перевод от Петр П.\n" +
+		paidAt + ";-150,00;RUB;Кофе\n"
+	h.reconcileStatement(testAdminID, testAdminID, []byte(statement))
+
+	orders41, _ := store.GetUserOrders(ctx, 41, 0, 0)
+	orders42, _ := store.GetUserOrders(ctx, 42, 0, 0)
+	report := tg.MessagesTo(testAdminID)
+	if got := report[len(report)-1]; !strings.Contains(got, orders42[0].OrderID) || strings.Contains(got, orders41[0].OrderID) ||
+		!strings.Contains(got, "Найдены оплаты (1)") {
+		t.Fatalf("reconcile report = %q, want only the second order", got)
+	}
+
+	h.HandleCallback(newTestCallback(testAdminID, "reconcile_confirm:0"))
+	if got, _ := store.GetOrderByID(ctx, orders42[0].OrderID); got.Status != models.OrderStatusPaid {
+		t.Errorf("reconciled order status = %s, want paid", got.Status)
+	}
+	if got, _ := store.GetOrderByID(ctx, orders41[0].OrderID); got.Status != models.OrderStatusCreated {
+		t.Errorf("unmatched order status = %s, want created", got.Status)
+	}
+	if !containsText(tg.MessagesTo(42), "Оплата подтверждена") {
+		t.Errorf("buyer messages = %q, want payment confirmation", tg.MessagesTo(42))
+	}
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], "Оплата подтверждена: 1") {
+		t.Errorf("admin messages = %q, want bulk confirmation summary", msgs)
+	}
+
+	// Повторное нажатие после подтверждения ничего не меняет
+	h.HandleCallback(newTestCallback(testAdminID, "reconcile_confirm:0"))
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], "Сверка устарела") {
+		t.Errorf("repeated confirm = %q, want stale reconcile notice", msgs[len(msgs)-1])
+	}
+}
+
+func TestReconcile_ConfirmsTransferToExpiredOrder(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	productID, price := firstProduct(t, store)
+
+	// Покупатель перевел деньги, но заказ отменился по сроку раньше, чем админ загрузил выписку
+	h.HandleCallback(newTestCallback(41, fmt.Sprintf("buy:%d", productID)))
+	h.expireOrders(ctx, time.Now().Add(time.Second), 24*time.Hour)
+	expired, _ := store.GetUserOrders(ctx, 41, 0, 0)
+	if expired[0].Status != models.OrderStatusCancelled {
+		t.Fatalf("order status = %s, want cancelled", expired[0].Status)
+	}
+
+	// Копейки отмененного заказа не достаются новому заказу на ту же цену
+	h.HandleCallback(newTestCallback(42, fmt.Sprintf("buy:%d", productID)))
+	if msgs := tg.MessagesTo(42); !strings.Contains(msgs[len(msgs)-1], "Переведите "+price.Add(money.New(2, price.Currency)).String()) {
+		t.Fatalf("checkout = %q, want the next free transfer amount", msgs[len(msgs)-1])
+	}
+
+	h.HandleMessage(newTestCommand(testAdminID, "/reconcile"))
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], "Отменены по сроку за 72 ч: 1") {
+		t.Fatalf("reconcile prompt = %q, want the expired order", msgs[len(msgs)-1])
+	}
+
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+	paidAt := time.Now().Add(time.Minute).In(moscowLocation).Format("02.01.2006 15:04:05")
+	amount := price.Add(money.New(1, price.Currency))
+	statement := "Дата операции;Сумма операции;Описание\n" +
+		paidAt + ";" + strings.Replace(amount.Decimal(), ".", ",", 1) + ";Перевод от Иван И.\n"
+	h.reconcileStatement(testAdminID, testAdminID, []byte(statement))
+
+	if msgs := tg.MessagesTo(testAdminID); !strings.Contains(msgs[len(msgs)-1], expired[0].OrderID+"</code> - "+amount.String()) ||
+		!strings.Contains(msgs[len(msgs)-1], "(отменен по сроку)") {
+		t.Fatalf("reconcile report = %q, want the expired order", msgs[len(msgs)-1])
+	}
+
+	h.HandleCallback(newTestCallback(testAdminID, "reconcile_confirm:0"))
+	if got, _ := store.GetOrderByID(ctx, expired[0].OrderID); got.Status != models.OrderStatusPaid {
+		t.Errorf("expired order status = %s, want paid", got.Status)
+	}
+	if !containsText(tg.MessagesTo(41), "Оплата подтверждена") {
+		t.Errorf("buyer messages = %q, want payment confirmation", tg.MessagesTo(41))
+	}
+}
+
+func TestReferral_LinkRecordsReferrerAndRewardsFirstPaidOrder(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	h.SetReferralBonus(10)
+	ctx := context.Background()
+	const referrerID, userID int64 = 7, 42
+
+	store.UpsertUser(ctx, referrerID, "friend", "Friend", "")
+
+	h.HandleMessage(newTestCommand(userID, "/start ref_7"))
+	if !containsText(tg.MessagesTo(referrerID), "пришел новый пользователь") {
+		t.Errorf("referrer messages = %q, want new referral notice", tg.MessagesTo(referrerID))
+	}
+
+	// Повторный переход и ссылка на самого себя ничего не меняют
+	h.HandleMessage(newTestCommand(userID, "/start ref_7"))
+	h.HandleMessage(newTestCommand(referrerID, "/start ref_7"))
+	if stats, _ := store.GetReferralStats(ctx, referrerID); stats.Invited != 1 || stats.Referrer != nil {
+		t.Fatalf("referrer stats = %+v, want 1 invited and no own referrer", stats)
+	}
+
+	productID, price := firstProduct(t, store)
+	for i := 0; i < 2; i++ {
+		order, _ := store.CreateOrder(ctx, userID, productID, price, payment.CodeCard, "")
+		h.HandleCallback(newTestCallback(testAdminID, "confirm_payment:"+order.OrderID))
+	}
+
+	bonus := money.New(price.Amount/10, price.Currency)
+	var rewards int
+	for _, text := range tg.MessagesTo(referrerID) {
+		if strings.Contains(text, "Ваш бонус: "+bonus.String()) {
+			rewards++
+		}
+	}
+	if rewards != 1 {
+		t.Errorf("referrer messages = %q, want one bonus %s for the first paid order", tg.MessagesTo(referrerID), bonus)
+	}
+
+	h.HandleMessage(newTestCommand(referrerID, "/referral"))
+	msgs := tg.MessagesTo(referrerID)
+	if last := msgs[len(msgs)-1]; !strings.Contains(last, "https://t.me/test_bot?start=ref_7") ||
+		!strings.Contains(last, "Оплатили заказ: 1") || !strings.Contains(last, bonus.String()) {
+		t.Errorf("referral stats = %q, want link, 1 paid referral and bonus %s", last, bonus)
+	}
+
+	h.HandleMessage(newTestCommand(userID, "/referral"))
+	msgs = tg.MessagesTo(userID)
+	if last := msgs[len(msgs)-1]; !strings.Contains(last, "Вас пригласил:") {
+		t.Errorf("referral stats = %q, want referrer name", last)
+	}
+}
+
+func TestBalance_AdjustedByAdminAndSpentAtCheckout(t *testing.T) {
+	h, store, tg := newTestHandler(t)
+	ctx := context.Background()
+	const userID int64 = 42
+
+	store.UpsertUser(ctx, userID, "buyer", "Buyer", "")
+	productID, price := firstProduct(t, store)
+	half := money.New(price.Amount/2, price.Currency)
+
+	h.HandleMessage(newTestCommand(userID, "/balance_adjust 42 100RUB"))
+	if _, ok := h.fsmManager.GetState(userID); ok {
+		t.Fatal("non-admin should not adjust balances")
+	}
+
+	h.HandleMessage(newTestCommand(testAdminID, "/balance_adjust 42 500"))
+	if _, ok := h.fsmManager.GetState(testAdminID); ok {
+		t.Fatal("amount without currency should not start the adjustment")
+	}
+
+	h.HandleMessage(newTestCommand(testAdminID, fmt.Sprintf("/balance_adjust 42 %s%s", half.Decimal(), half.Currency)))
+	h.HandleMessage(newTestMessage(testAdminID, "Компенсация за задержку"))
+	if !containsText(tg.MessagesTo(userID), "Компенсация за задержку") {
+		t.Errorf("user messages = %q, want adjustment reason", tg.MessagesTo(userID))
+	}
+
+	// Баланса хватает на половину заказа: остаток оплачивается картой
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	orders, _ := store.GetUserOrders(ctx, userID, 0, 0)
+	partial := orders[0]
+	if msgs := tg.MessagesTo(userID); !strings.Contains(msgs[len(msgs)-1], "На бонусном балансе "+half.String()) {
+		t.Fatalf("user messages = %q, want balance offer", msgs)
+	}
+
+	h.HandleCallback(newTestCallback(userID, "balance_use:"+partial.OrderID))
+	got, _ := store.GetOrderByID(ctx, partial.OrderID)
+	if got.Status != models.OrderStatusCreated || got.BalanceUsed != half || got.Price != price.Sub(half) {
+		t.Fatalf("order after partial balance = %s, price %s, used %s", got.Status, got.Price, got.BalanceUsed)
+	}
+	if msgs := tg.MessagesTo(userID); !strings.Contains(msgs[len(msgs)-1], got.Price.String()) {
+		t.Errorf("last user message = %q, want payment instructions for %s", msgs[len(msgs)-1], got.Price)
+	}
+
+	// Админ подтверждает оплату остатка и возвращает заказ на баланс
+	h.HandleCallback(newTestCallback(testAdminID, "confirm_payment:"+partial.OrderID))
+	h.HandleCallback(newTestCallback(testAdminID, "refund_order:"+partial.OrderID))
+	h.HandleMessage(newTestMessage(testAdminID, "Не подошел регион"))
+	if got, _ := store.GetOrderByID(ctx, partial.OrderID); got.Status != models.OrderStatusRefunded {
+		t.Fatalf("order status after refund = %q, want refunded", got.Status)
+	}
+	if balance, _ := store.GetBalance(ctx, userID); len(balance) != 1 || balance[0] != price {
+		t.Fatalf("balance after refund = %v, want %s", balance, price)
+	}
+
+	// Теперь баланса хватает на весь заказ: он оплачен без инструкции
+	h.HandleCallback(newTestCallback(userID, fmt.Sprintf("buy:%d", productID)))
+	orders, _ = store.GetUserOrders(ctx, userID, 0, 0)
+	var full models.Order
+	for _, o := range orders {
+		if o.Status == models.OrderStatusCreated {
+			full = o
+		}
+	}
+	h.HandleCallback(newTestCallback(userID, "balance_use:"+full.OrderID))
+	if got, _ := store.GetOrderByID(ctx, full.OrderID); got.Status != models.OrderStatusPaid || got.BalanceUsed != price {
+		t.Fatalf("order after full balance = %s, used %s, want paid with %s", got.Status, got.BalanceUsed, price)
+	}
+	if !containsText(tg.MessagesTo(testAdminID), "оплачен с бонусного баланса") {
+		t.Error("admins were not notified about the order paid from balance")
+	}
+
+	h.HandleMessage(newTestCommand(userID, "/balance"))
+	msgs := tg.MessagesTo(userID)
+	if last := msgs[len(msgs)-1]; !strings.Contains(last, "Оплата заказа") || !strings.Contains(last, "Возврат заказа") {
+		t.Errorf("balance = %q, want checkout and refund in history", last)
+	}
+}
+
+func TestParseBalanceAdjustArgs(t *testing.T) {
+	userID, amount, err := parseBalanceAdjustArgs("42 -150.50kzt")
+	if err != nil || userID != 42 || amount != money.New(-15050, money.KZT) {
+		t.Errorf("parseBalanceAdjustArgs() = %d, %s, %v", userID, amount, err)
+	}
+
+	for _, args := range []string{"", "42", "42 100", "abc 100RUB", "42 0RUB", "42 100RUB extra"} {
+		if _, _, err := parseBalanceAdjustArgs(args); err == nil {
+			t.Errorf("parseBalanceAdjustArgs(%q) error = nil", args)
+		}
+	}
+}
+
+func TestParseReferralPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    int64
+		ok      bool
+	}{
+		{payload: "ref_123", want: 123, ok: true},
+		{payload: "", ok: false},
+		{payload: "ref_", ok: false},
+		{payload: "ref_-5", ok: false},
+		{payload: "promo_123", ok: false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseReferralPayload(tt.payload)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseReferralPayload(%q) = %d, %t, want %d, %t", tt.payload, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParsePromoArgs(t *testing.T) {
+	code, region, err := parsePromoArgs([]string{"NEW", "500RUB", "region=kz", "until=2025-03-31", "uses=100", "first"}, time.UTC)
+	if err != nil || code.Code != "NEW" || code.Amount != money.FromMajor(500, money.RUB) || region != "KZ" ||
+		code.MaxUses != 100 || !code.FirstPurchaseOnly || !code.ValidUntil.Equal(time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("parsePromoArgs() = %+v, %q, %v", code, region, err)
+	}
+
+	for _, args := range [][]string{{"NEW"}, {"NEW", "100%"}, {"NEW", "10%", "per_user=0"}, {"NEW", "10%", "from=2025-04-01", "until=2025-03-01"}} {
+		if _, _, err := parsePromoArgs(args, time.UTC); err == nil {
+			t.Errorf("parsePromoArgs(%q) error = nil", args)
+		}
+	}
+}
+
+func TestParseOrderFilterArgs(t *testing.T) {
+	filter, region, err := parseOrderFilterArgs([]string{"status=PAID", "region=kz", "from=2025-03-01", "until=2025-03-31", "user=42"}, time.UTC)
+	if err != nil || filter.Status != models.OrderStatusPaid || region != "KZ" || filter.UserID != 42 ||
+		!filter.From.Equal(time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)) || !filter.Until.Equal(time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("parseOrderFilterArgs() = %+v, %q, %v", filter, region, err)
+	}
+
+	for _, args := range [][]string{{"status=lost"}, {"user=abc"}, {"paid"}, {"from=01.03.2025"}, {"from=2025-04-01", "until=2025-03-01"}} {
+		if _, _, err := parseOrderFilterArgs(args, time.UTC); err == nil {
+			t.Errorf("parseOrderFilterArgs(%q) error = nil", args)
+		}
+	}
+}
+
+func TestEncodeOrderFilter_RoundTripFitsCallbackData(t *testing.T) {
+	moscow, _ := time.LoadLocation("Europe/Moscow")
+	from := time.Date(2025, 3, 1, 0, 0, 0, 0, moscow)
+	until := time.Date(2025, 4, 1, 0, 0, 0, 0, moscow)
+	filter := models.OrderFilter{Status: models.OrderStatusCancelled, RegionID: 999, From: &from, Until: &until, UserID: 9999999999}
+
+	data := encodeOrderFilter(filter, 999, moscow)
+	if len(data) > 64 {
+		t.Fatalf("callback data %q is %d bytes, Telegram allows 64", data, len(data))
+	}
+
+	parts := strings.Split(data, ":")
+	got, page, err := decodeOrderFilter(parts[1:], moscow)
+	if err != nil || page != 999 || got.Status != filter.Status || got.RegionID != filter.RegionID || got.UserID != filter.UserID ||
+		!got.From.Equal(from) || !got.Until.Equal(until) {
+		t.Errorf("decodeOrderFilter(%q) = %+v, %d, %v", data, got, page, err)
+	}
+
+	if empty, _, err := decodeOrderFilter(strings.Split(CallbackActionAdminOrders+":0::0:::0", ":")[1:], moscow); err != nil ||
+		empty.From != nil || empty.Until != nil || empty.Status != "" {
+		t.Errorf("decodeOrderFilter(empty) = %+v, %v", empty, err)
+	}
+}
+
+func TestParseKeyCodes(t *testing.T) {
+	codes, err := parseKeyCodes(strings.NewReader("\ufeffAAA\r\n BBB \n\nAAA\n"), false)
+	if err != nil || strings.Join(codes, ",") != "AAA,BBB" {
+		t.Errorf("parseKeyCodes(text) = %v, %v, want AAA,BBB", codes, err)
+	}
+
+	codes, err = parseKeyCodes(strings.NewReader("code,comment\n\"CC,1\",first\nDDD\n"), true)
+	if err != nil || strings.Join(codes, "|") != "CC,1|DDD" {
+		t.Errorf("parseKeyCodes(csv) = %v, %v, want CC,1|DDD", codes, err)
+	}
+
+	if _, err := parseKeyCodes(strings.NewReader(strings.Repeat("x", MaxKeyLength+1)), false); err == nil {
+		t.Error("parseKeyCodes() with too long key should fail")
+	}
+}
+
+func TestWithoutURL(t *testing.T) {
+	err := fmt.Errorf("failed to get file: %w", &url.Error{
+		Op:  "Get",
+		URL: "https://api.telegram.org/file/bot123:secret/documents/keys.txt",
+		Err: context.DeadlineExceeded,
+	})
+
+	if got := withoutURL(err); got != context.DeadlineExceeded {
+		t.Errorf("withoutURL() = %v, want the error without request URL", got)
+	}
+}
+
+// containsText сообщает, что хотя бы одно сообщение содержит подстроку
+func containsText(texts []string, substr string) bool {
+	for _, text := range texts {
+		if strings.Contains(text, substr) {
+			return true
+		}
+	}
+	return false
+}
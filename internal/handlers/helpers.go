@@ -3,9 +3,13 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"log"
+	"strings"
+	"unicode"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"tgwow/internal/models"
+	"tgwow/internal/money"
 )
 
 // newDBContext creates a context with standard timeout for database operations
@@ -42,8 +46,8 @@ func (h *Handler) buildRegionsKeyboard(ctx context.Context) (string, [][]tgbotap
 // buildProductCard creates product card with price, description and buy/back buttons
 func (h *Handler) buildProductCard(product *models.Product, backCallback string) (string, tgbotapi.InlineKeyboardMarkup) {
 	priceText := ""
-	if product.Price > 0 {
-		priceText = fmt.Sprintf("💰 <b>Цена:</b> %.2f руб.\n\n", product.Price)
+	if product.Price.IsPositive() {
+		priceText = fmt.Sprintf("💰 <b>Цена:</b> %s\n\n", product.Price)
 	} else {
 		priceText = "💰 <b>Цена:</b> уточняется\n\n"
 	}
@@ -54,10 +58,11 @@ func (h *Handler) buildProductCard(product *models.Product, backCallback string)
 	)
 
 	var keyboard tgbotapi.InlineKeyboardMarkup
-	if product.Price > 0 {
+	if product.Price.IsPositive() {
 		keyboard = tgbotapi.NewInlineKeyboardMarkup(
 			tgbotapi.NewInlineKeyboardRow(
 				tgbotapi.NewInlineKeyboardButtonData("✅ Купить", fmt.Sprintf("%s:%d", CallbackActionBuy, product.ID)),
+				tgbotapi.NewInlineKeyboardButtonData("🛒 В корзину", fmt.Sprintf("%s:%d", CallbackActionCartAdd, product.ID)),
 			),
 			tgbotapi.NewInlineKeyboardRow(
 				tgbotapi.NewInlineKeyboardButtonData("◀️ Назад", backCallback),
@@ -139,3 +144,36 @@ func (h *Handler) checkRateLimit(userID int64, chatID int64) bool {
 
 	return true
 }
+
+// notifyAdmins отправляет HTML-сообщение всем администраторам
+func (h *Handler) notifyAdmins(text string) {
+	for _, adminID := range h.adminChatIDs {
+		adminMsg := tgbotapi.NewMessage(adminID, text)
+		adminMsg.ParseMode = "HTML"
+		if _, err := h.bot.Send(adminMsg); err != nil {
+			log.Printf("Error sending admin notification to %d: %v", adminID, err)
+		}
+	}
+}
+
+// truncateRunes обрезает строку до max символов, не разрывая UTF-8
+func truncateRunes(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+// parseAmountWithCurrency разбирает сумму с кодом валюты в конце: "500RUB", "-150.50 kzt"
+func parseAmountWithCurrency(s string) (money.Money, error) {
+	s = strings.TrimSpace(s)
+	split := strings.LastIndexFunc(s, unicode.IsDigit) + 1
+
+	currency, err := money.ParseCurrency(s[split:])
+	if err != nil {
+		return money.Money{}, err
+	}
+
+	return money.Parse(s[:split], currency)
+}
@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/fsm"
+	"tgwow/internal/models"
+)
+
+// errDocumentDownload - файл не удалось получить из Telegram. Причина пишется только в лог
+var errDocumentDownload = errors.New("не удалось скачать файл из Telegram, отправьте его еще раз")
+
+// handleAdminKeys показывает остаток ключей товара и просит прислать новые
+func (h *Handler) handleAdminKeys(query *tgbotapi.CallbackQuery, productID int) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	product, err := h.storage.GetProductByID(ctx, productID)
+	if err != nil {
+		log.Printf("Error fetching product: %v", err)
+		return
+	}
+
+	stock, err := h.storage.GetProductKeyStock(ctx, productID)
+	if err != nil {
+		log.Printf("Error fetching key stock: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Не удалось получить остаток ключей.")
+		return
+	}
+
+	h.fsmManager.SetState(query.From.ID, fsm.StateWaitingForKeys, productID)
+
+	text := fmt.Sprintf(
+		"🔑 <b>Ключи товара</b>\n\n"+
+			"Товар: <b>%s</b>\n"+
+			"Свободно: %d, выдано: %d\n\n"+
+			"Отправьте ключи сообщением (по одному в строке) или файлом .txt / .csv "+
+			"(ключ в первой колонке). Уже загруженные ключи пропускаются.\n\n"+
+			"После оплаты покупатель сразу получает ключ, а заказ завершается.\n\n"+
+			"Для отмены используйте /cancel",
+		product.Name, stock.Available, stock.Delivered,
+	)
+
+	msg := tgbotapi.NewMessage(query.Message.Chat.ID, text)
+	msg.ParseMode = "HTML"
+	if _, err := h.bot.Send(msg); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
+
+// handleKeysInput загружает ключи из текста сообщения или присланного файла
+func (h *Handler) handleKeysInput(msg *tgbotapi.Message, productID int) {
+	if !h.isAdmin(msg.From.ID) {
+		return
+	}
+
+	var codes []string
+	var err error
+	if msg.Document != nil {
+		codes, err = h.readKeysDocument(msg.Document)
+	} else {
+		codes, err = parseKeyCodes(strings.NewReader(msg.Text), false)
+	}
+	if err != nil {
+		log.Printf("Error reading keys from admin %d: %v", msg.From.ID, err)
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf("❌ Не удалось прочитать ключи: %v\n\nДля отмены используйте /cancel", err))
+		return
+	}
+	if len(codes) == 0 {
+		h.sendMessage(msg.Chat.ID, "❌ Ключи не найдены. Отправьте ключи по одному в строке или файл .txt / .csv\n\nДля отмены используйте /cancel")
+		return
+	}
+	if len(codes) > MaxKeysPerUpload {
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf("❌ Слишком много ключей за раз (максимум %d)\n\nДля отмены используйте /cancel", MaxKeysPerUpload))
+		return
+	}
+
+	h.fsmManager.ClearState(msg.From.ID)
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	added, err := h.storage.AddProductKeys(ctx, productID, codes)
+	if err != nil {
+		log.Printf("Error adding product keys: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при сохранении ключей")
+		return
+	}
+
+	log.Printf("Admin %d uploaded %d keys for product %d (%d duplicates)", msg.From.ID, added, productID, len(codes)-added)
+
+	text := fmt.Sprintf("✅ Добавлено ключей: %d", added)
+	if skipped := len(codes) - added; skipped > 0 {
+		text += fmt.Sprintf("\nПропущено дубликатов: %d", skipped)
+	}
+
+	if stock, err := h.storage.GetProductKeyStock(ctx, productID); err == nil {
+		text += fmt.Sprintf("\n\n🔑 Свободно: %d, выдано: %d", stock.Available, stock.Delivered)
+	}
+
+	// Товар мог быть скрыт автоматически, когда ключи закончились
+	if product, err := h.storage.GetProductByID(ctx, productID); err == nil && !product.IsVisible {
+		text += "\n\n👁 Товар скрыт из каталога - включите его в карточке товара."
+	}
+
+	h.sendMessage(msg.Chat.ID, text)
+}
+
+// readKeysDocument скачивает присланный админом файл с ключами
+func (h *Handler) readKeysDocument(doc *tgbotapi.Document) ([]string, error) {
+	ext := strings.ToLower(filepath.Ext(doc.FileName))
+	if ext != ".txt" && ext != ".csv" {
+		return nil, fmt.Errorf("поддерживаются только файлы .txt и .csv")
+	}
+	data, err := h.downloadDocument(doc, MaxKeysFileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKeyCodes(bytes.NewReader(data), ext == ".csv")
+}
+
+// downloadDocument скачивает присланный админом файл размером не больше maxSize байт.
+// Ошибки скачивания возвращаются как errDocumentDownload: их текст уходит в чат админа
+func (h *Handler) downloadDocument(doc *tgbotapi.Document, maxSize int) ([]byte, error) {
+	if doc.FileSize > maxSize {
+		return nil, fmt.Errorf("файл больше %d КБ", maxSize/1024)
+	}
+
+	fileURL, err := h.bot.GetFileDirectURL(doc.FileID)
+	if err != nil {
+		log.Printf("Error getting file %s: %v", doc.FileID, withoutURL(err))
+		return nil, errDocumentDownload
+	}
+
+	client := &http.Client{Timeout: DocumentDownloadTimeout}
+	resp, err := client.Get(fileURL)
+	if err != nil {
+		log.Printf("Error downloading file %s: %v", doc.FileID, withoutURL(err))
+		return nil, errDocumentDownload
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Error downloading file %s: status %d", doc.FileID, resp.StatusCode)
+		return nil, errDocumentDownload
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxSize)+1))
+	if err != nil {
+		log.Printf("Error reading file %s: %v", doc.FileID, withoutURL(err))
+		return nil, errDocumentDownload
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("файл больше %d КБ", maxSize/1024)
+	}
+
+	return data, nil
+}
+
+// withoutURL убирает из ошибки HTTP-клиента адрес запроса: в адресах Bot API и файлов Telegram есть токен бота
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+// parseKeyCodes читает ключи: по одному в строке или из первой колонки CSV.
+// Пустые строки, повторы и строка заголовка CSV (code / key / ключ) пропускаются
+func parseKeyCodes(r io.Reader, isCSV bool) ([]string, error) {
+	var lines []string
+
+	if isCSV {
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("некорректный CSV: %w", err)
+		}
+		for i, record := range records {
+			if len(record) == 0 {
+				continue
+			}
+			if i == 0 && isKeysHeader(record[0]) {
+				continue
+			}
+			lines = append(lines, record[0])
+		}
+	} else {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		lines = strings.Split(string(data), "\n")
+	}
+
+	seen := make(map[string]bool)
+	var codes []string
+	for _, line := range lines {
+		code := strings.TrimSpace(strings.TrimPrefix(line, "\ufeff"))
+		if code == "" || seen[code] {
+			continue
+		}
+		if len(code) > MaxKeyLength {
+			return nil, fmt.Errorf("ключ длиннее %d символов: %s", MaxKeyLength, truncateRunes(code, 20))
+		}
+		seen[code] = true
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+// isKeysHeader сообщает, что ячейка - заголовок колонки с ключами
+func isKeysHeader(cell string) bool {
+	switch strings.ToLower(strings.TrimSpace(strings.TrimPrefix(cell, "\ufeff"))) {
+	case "code", "key", "ключ", "код":
+		return true
+	}
+	return false
+}
+
+// keyDelivery - ключи, закрепленные за позицией заказа
+type keyDelivery struct {
+	item models.OrderItem
+	keys []models.ProductKey
+}
+
+// fulfillOrder выдает оплаченный заказ. Для позиций с товарами со склада ключей покупатель
+// сразу получает ключи; если весь заказ выдан ключами, он завершается. Остальные товары
+// админ выдает вручную
+func (h *Handler) fulfillOrder(ctx context.Context, order *models.Order) {
+	items, err := h.storage.GetOrderItems(ctx, order.OrderID)
+	if err != nil {
+		log.Printf("Error fetching items of order %s: %v", order.OrderID, err)
+	}
+
+	var deliveries []keyDelivery
+	var manual, missing []models.OrderItem
+	for _, item := range items {
+		stock, err := h.storage.GetProductKeyStock(ctx, item.ProductID)
+		if err != nil {
+			log.Printf("Error fetching key stock for product %d: %v", item.ProductID, err)
+		}
+		if item.ProductID == 0 || err != nil || !stock.Tracked() {
+			manual = append(manual, item)
+			continue
+		}
+
+		keys, err := h.storage.ReserveProductKeys(ctx, order.OrderID, item.ProductID, item.Quantity)
+		if err != nil {
+			log.Printf("Error reserving keys for order %s: %v", order.OrderID, err)
+			missing = append(missing, item)
+			continue
+		}
+		deliveries = append(deliveries, keyDelivery{item: item, keys: keys})
+	}
+
+	if len(deliveries) == 0 && len(missing) == 0 {
+		h.notifyOrderPaid(ctx, order)
+		return
+	}
+
+	if len(missing) > 0 {
+		h.notifyAdmins(fmt.Sprintf(
+			"⚠️ <b>Нет ключей для заказа</b> <code>%s</code>\n\n"+
+				"🎮 %s\n"+
+				"👤 User ID: %d\n\n"+
+				"Заказ оплачен, но свободных ключей не хватает. Загрузите ключи и выдайте их вручную.",
+			order.OrderID, formatOrderItems(missing), order.UserID,
+		))
+	}
+
+	if len(deliveries) == 0 {
+		h.sendMessage(order.UserID, fmt.Sprintf(
+			"✅ Оплата заказа %s получена!\n\nКлюч будет выдан администратором в ближайшее время.",
+			order.OrderID,
+		))
+		return
+	}
+
+	if err := h.sendKeys(order, deliveries, len(manual)+len(missing) > 0); err != nil {
+		// Ключи остаются закрепленными за заказом, заказ - оплаченным: админ отправит ключи сам
+		log.Printf("Error delivering keys for order %s: %v", order.OrderID, err)
+		h.notifyAdmins(fmt.Sprintf(
+			"⚠️ <b>Ключ не доставлен</b>\n\n"+
+				"📦 Заказ №: <code>%s</code>\n"+
+				"👤 User ID: %d\n\n"+
+				"Ключи закреплены за заказом, но отправить их покупателю не удалось.",
+			order.OrderID, order.UserID,
+		))
+		return
+	}
+
+	log.Printf("Keys delivered for order %s", order.OrderID)
+
+	if len(manual) == 0 && len(missing) == 0 {
+		if err := h.storage.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusCompleted, 0, "Ключ выдан автоматически"); err != nil {
+			log.Printf("Error completing order %s: %v", order.OrderID, err)
+		}
+	}
+
+	for _, d := range deliveries {
+		h.checkKeyStock(ctx, d.item.ProductID, d.item.ProductName, len(d.keys))
+	}
+}
+
+// sendKeys отправляет покупателю ключи под спойлером. Длинный список делится на несколько сообщений
+func (h *Handler) sendKeys(order *models.Order, deliveries []keyDelivery, partial bool) error {
+	header := fmt.Sprintf("✅ <b>Оплата подтверждена!</b>\n\n📦 Заказ №: <code>%s</code>\n", order.OrderID)
+
+	var blocks []string
+	for _, d := range deliveries {
+		block := fmt.Sprintf("\n🎮 <b>%s</b>\n", d.item.ProductName)
+		for _, key := range d.keys {
+			block += fmt.Sprintf("<tg-spoiler><code>%s</code></tg-spoiler>\n", html.EscapeString(key.Code))
+		}
+		blocks = append(blocks, block)
+	}
+
+	footer := "\nНажмите на ключ, чтобы открыть его.\n\nСпасибо за покупку! 🎉"
+	if partial {
+		footer = "\nНажмите на ключ, чтобы открыть его.\n\nОстальные товары заказа выдаст администратор."
+	}
+
+	text := header
+	for _, block := range blocks {
+		if utf8.RuneCountInString(text)+utf8.RuneCountInString(block) > MaxMessageLength {
+			if err := h.sendHTML(order.UserID, text); err != nil {
+				return err
+			}
+			text = ""
+		}
+		text += block
+	}
+
+	return h.sendHTML(order.UserID, text+footer)
+}
+
+// sendHTML отправляет HTML-сообщение и возвращает ошибку отправки
+func (h *Handler) sendHTML(chatID int64, text string) error {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "HTML"
+	_, err := h.bot.Send(msg)
+	return err
+}
+
+// checkKeyStock предупреждает админов о заканчивающихся ключах и скрывает товар, когда ключей
+// не осталось. reserved - сколько ключей только что выдано: предупреждение о малом остатке
+// приходит один раз, когда остаток опускается до LowStockThreshold
+func (h *Handler) checkKeyStock(ctx context.Context, productID int, productName string, reserved int) {
+	stock, err := h.storage.GetProductKeyStock(ctx, productID)
+	if err != nil {
+		log.Printf("Error fetching key stock for product %d: %v", productID, err)
+		return
+	}
+
+	switch {
+	case stock.Available == 0:
+		if err := h.storage.UpdateProductVisibility(ctx, productID, false); err != nil {
+			log.Printf("Error hiding product %d: %v", productID, err)
+		}
+		log.Printf("Product %d is out of keys and hidden", productID)
+		h.notifyAdmins(fmt.Sprintf(
+			"🚫 <b>Ключи закончились</b>\n\n"+
+				"🎮 %s (ID: %d)\n\n"+
+				"Товар скрыт из каталога. Загрузите ключи и включите его в карточке товара.",
+			productName, productID,
+		))
+	case stock.Available <= LowStockThreshold && stock.Available+reserved > LowStockThreshold:
+		h.notifyAdmins(fmt.Sprintf(
+			"⚠️ <b>Ключи заканчиваются</b>\n\n"+
+				"🎮 %s (ID: %d)\n"+
+				"Осталось ключей: %d",
+			productName, productID, stock.Available,
+		))
+	}
+}
+
+// inStock сообщает, хватает ли ключей на quantity единиц товара. Товары без склада ключей есть всегда
+func (h *Handler) inStock(ctx context.Context, productID int, quantity int) bool {
+	stock, err := h.storage.GetProductKeyStock(ctx, productID)
+	if err != nil {
+		log.Printf("Error fetching key stock for product %d: %v", productID, err)
+		return true
+	}
+	return !stock.Tracked() || stock.Available >= quantity
+}
@@ -2,14 +2,20 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/models"
+	"tgwow/internal/payment"
+	"tgwow/internal/storage"
 )
 
-// handleBuyProduct обрабатывает покупку товара
+// handleBuyProduct обрабатывает покупку товара: предлагает выбрать способ оплаты
+// или сразу оформляет заказ, если для региона доступен один способ
 func (h *Handler) handleBuyProduct(query *tgbotapi.CallbackQuery, productID int) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -21,36 +27,195 @@ func (h *Handler) handleBuyProduct(query *tgbotapi.CallbackQuery, productID int)
 		return
 	}
 
-	// Create order
-	order, err := h.storage.CreateOrder(ctx, query.From.ID, product.ID, product.Price)
+	methods, err := h.paymentMethodsFor(ctx, product)
 	if err != nil {
-		log.Printf("Error creating order: %v", err)
-		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при создании заказа. Попробуйте позже.")
+		log.Printf("Error fetching payment methods: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке товара.")
+		return
+	}
+
+	switch len(methods) {
+	case 0:
+		h.sendMessage(query.Message.Chat.ID, "❌ Для этого товара сейчас нет доступных способов оплаты. Обратитесь к администратору.")
+	case 1:
+		h.createOrder(ctx, query, product, methods[0])
+	default:
+		h.showPaymentMethods(query, product, methods)
+	}
+}
+
+// handlePayWithMethod оформляет заказ с выбранным покупателем способом оплаты
+func (h *Handler) handlePayWithMethod(query *tgbotapi.CallbackQuery, productID int, code string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	product, err := h.storage.GetProductByID(ctx, productID)
+	if err != nil {
+		log.Printf("Error fetching product: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке товара.")
 		return
 	}
 
+	methods, err := h.paymentMethodsFor(ctx, product)
+	if err != nil {
+		log.Printf("Error fetching payment methods: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке товара.")
+		return
+	}
+
+	// Способ могли отключить, пока покупатель выбирал
+	for _, method := range methods {
+		if method.Code() == code {
+			h.createOrder(ctx, query, product, method)
+			return
+		}
+	}
+
+	h.sendMessage(query.Message.Chat.ID, "❌ Этот способ оплаты больше недоступен. Выберите другой.")
+}
+
+// createOrder проверяет остаток товара и начинает оформление заказа на один товар
+func (h *Handler) createOrder(ctx context.Context, query *tgbotapi.CallbackQuery, product *models.Product, method payment.Method) {
+	if !h.inStock(ctx, product.ID, 1) {
+		h.sendMessage(query.Message.Chat.ID, "❌ Товар закончился. Загляните позже.")
+		return
+	}
+
+	h.beginOrder(ctx, query, product.ID, method)
+}
+
+// SetOrderLimits задает защиту от двойных заказов: срок, в который повторное «Купить» того же товара
+// возвращает уже созданный заказ, и лимит неоплаченных заказов покупателя. 0 отключает проверку.
+// Вызывается до начала обработки обновлений
+func (h *Handler) SetOrderLimits(dedupWindow time.Duration, maxPending int) {
+	h.dedupWindow = dedupWindow
+	h.maxPending = maxPending
+}
+
+// beginOrder спрашивает промокод, если сейчас действует хотя бы один, иначе сразу оформляет заказ.
+// productID = 0 - заказ из корзины
+func (h *Handler) beginOrder(ctx context.Context, query *tgbotapi.CallbackQuery, productID int, method payment.Method) {
+	if !h.checkPendingOrders(ctx, query.Message.Chat.ID, query.From.ID, productID, method) {
+		return
+	}
+
+	hasPromos, err := h.storage.HasActivePromoCodes(ctx)
+	if err != nil {
+		log.Printf("Error checking promo codes: %v", err)
+	}
+	if hasPromos {
+		h.askPromoCode(query, productID, method)
+		return
+	}
+
+	if err := h.placeOrder(ctx, query.Message.Chat.ID, query.From, productID, method, ""); err != nil {
+		h.sendOrderError(query.Message.Chat.ID, err)
+	}
+}
+
+// checkPendingOrders не дает создать лишний заказ. Если покупатель только что заказал этот же товар
+// тем же способом оплаты (двойное нажатие или повторная доставка callback), повторно отправляет
+// инструкцию по существующему заказу. Если неоплаченных заказов уже слишком много, просит сначала
+// разобраться с ними. Возвращает false, если новый заказ создавать не нужно
+func (h *Handler) checkPendingOrders(ctx context.Context, chatID, userID int64, productID int, method payment.Method) bool {
+	if h.dedupWindow <= 0 && h.maxPending <= 0 {
+		return true
+	}
+
+	pending, err := h.storage.GetPendingOrders(ctx, userID)
+	if err != nil {
+		// Проверка защитная: при ошибке не мешаем покупке
+		log.Printf("Error fetching pending orders of user %d: %v", userID, err)
+		return true
+	}
+
+	if h.dedupWindow > 0 && productID != 0 {
+		since := time.Now().Add(-h.dedupWindow)
+		for i := range pending {
+			order := &pending[i]
+			if order.ProductID == productID && order.PaymentMethod == method.Code() && order.CreatedAt.After(since) {
+				log.Printf("Duplicate buy of product %d by user %d, returning order %s", productID, userID, order.OrderID)
+				h.sendMessage(chatID, fmt.Sprintf("⏳ Вы только что оформили заказ %s на этот товар. Повторяем инструкцию по оплате.", order.OrderID))
+				h.resendCheckout(ctx, chatID, order)
+				return false
+			}
+		}
+	}
+
+	if h.maxPending > 0 && len(pending) >= h.maxPending {
+		h.sendMessage(chatID, fmt.Sprintf(
+			"⚠️ У вас уже %d неоплаченных заказов. Оплатите или отмените их в /my_orders, чтобы оформить новый.",
+			len(pending),
+		))
+		return false
+	}
+
+	return true
+}
+
+// placeOrder создает заказ на товар или на всю корзину (productID = 0) и отправляет инструкцию по оплате.
+// Ошибку создания заказа, в том числе ошибку промокода, показывает вызывающий код
+func (h *Handler) placeOrder(ctx context.Context, chatID int64, user *tgbotapi.User, productID int, method payment.Method, promoCode string) error {
+	var order *models.Order
+	var err error
+
+	if productID == 0 {
+		order, err = h.storage.CheckoutCart(ctx, user.ID, method.Code(), promoCode)
+	} else {
+		var product *models.Product
+		product, err = h.storage.GetProductByID(ctx, productID)
+		switch {
+		case err != nil:
+		case !product.IsVisible || !product.Price.IsPositive():
+			// Пока покупатель вводил промокод, товар могли скрыть
+			err = storage.ErrProductUnavailable
+		default:
+			order, err = h.storage.CreateOrder(ctx, user.ID, product.ID, product.Price, method.Code(), promoCode)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
 	log.Printf("Order created: %+v", order)
 
-	// Send payment instructions to user
-	userText := fmt.Sprintf(
-		"✅ <b>Заказ успешно создан!</b>\n\n"+
-			"📦 <b>Заказ №:</b> <code>%s</code>\n"+
-			"🎮 <b>Товар:</b> %s\n"+
-			"💰 <b>Сумма:</b> %.2f руб.\n\n"+
-			"💳 <b>Инструкция по оплате:</b>\n"+
-			"1. Переведите %.2f руб. на карту: <code>%s</code>\n"+
-			"2. В комментарии к переводу укажите номер заказа: <code>%s</code>\n"+
-			"3. Отправьте скриншот оплаты администратору\n\n"+
-			"После проверки оплаты вы получите доступ к подписке.\n\n"+
-			"По всем вопросам обращайтесь к администратору.",
-		order.OrderID, product.Name, product.Price,
-		product.Price, h.paymentCardNumber, order.OrderID,
-	)
+	h.startCheckout(ctx, chatID, user, order, h.orderTitle(ctx, order), method)
+	return nil
+}
+
+// sendOrderError объясняет покупателю, почему заказ не удалось создать
+func (h *Handler) sendOrderError(chatID int64, err error) {
+	if text, ok := promoErrorText(err); ok {
+		h.sendMessage(chatID, text)
+		return
+	}
 
-	msg := tgbotapi.NewMessage(query.Message.Chat.ID, userText)
-	msg.ParseMode = "HTML"
-	if _, err := h.bot.Send(msg); err != nil {
-		log.Printf("Error sending order confirmation: %v", err)
+	switch {
+	case errors.Is(err, storage.ErrCartEmpty):
+		h.sendMessage(chatID, "🛒 Корзина пуста.")
+	case errors.Is(err, storage.ErrProductUnavailable):
+		h.sendMessage(chatID, "❌ Товар больше недоступен. Откройте каталог или /cart и выберите другой.")
+	case errors.Is(err, storage.ErrCartMixedCurrency):
+		h.sendMessage(chatID, "❌ В корзине товары в разных валютах. Оформите их отдельными заказами.")
+	default:
+		log.Printf("Error creating order: %v", err)
+		h.sendMessage(chatID, "❌ Ошибка при создании заказа. Попробуйте позже.")
+	}
+}
+
+// startCheckout отправляет покупателю инструкцию или счет по новому заказу и уведомляет админов.
+// title - название товара или состав корзины
+func (h *Handler) startCheckout(ctx context.Context, chatID int64, user *tgbotapi.User, order *models.Order, title string, method payment.Method) {
+	if order.PromoCode != "" {
+		h.sendMessage(chatID, fmt.Sprintf(
+			"🎟 Промокод %s применен: скидка %s, к оплате %s",
+			order.PromoCode, order.Discount, order.Price,
+		))
+	}
+
+	// Покупателю с бонусным балансом сначала предлагаем списать его, инструкцию - после выбора
+	if !h.offerBalance(ctx, chatID, order) && !h.sendCheckoutOrCancel(ctx, chatID, order, title, method) {
+		return
 	}
 
 	// Notify all admins
@@ -63,22 +228,44 @@ func (h *Handler) handleBuyProduct(query *tgbotapi.CallbackQuery, productID int)
 			"📦 <b>Заказ №:</b> <code>%s</code>\n"+
 			"👤 <b>Пользователь:</b> @%s (ID: %d)\n"+
 			"🎮 <b>Товар:</b> %s\n"+
-			"💰 <b>Сумма:</b> %.2f руб.\n"+
+			"💰 <b>Сумма:</b> %s%s%s\n"+
+			"💳 <b>Оплата:</b> %s\n"+
+			"%s"+
 			"📅 <b>Дата:</b> %s (МСК)\n\n"+
 			"Ожидает оплаты.",
 		order.OrderID,
-		query.From.UserName, query.From.ID,
-		product.Name, product.Price,
+		user.UserName, user.ID,
+		title, order.Price, formatPromo(order), formatTransferAmount(order),
+		method.Title(),
+		h.payoutCardLine(ctx, order.OrderID),
 		moscowTime.Format("02.01.2006 15:04"),
 	)
+	h.notifyAdminsNewOrder(ctx, order.OrderID, adminText)
+}
 
-	for _, adminID := range h.adminChatIDs {
-		adminMsg := tgbotapi.NewMessage(adminID, adminText)
-		adminMsg.ParseMode = "HTML"
-		if _, err := h.bot.Send(adminMsg); err != nil {
-			log.Printf("Error sending admin notification to %d: %v", adminID, err)
+// sendCheckoutOrCancel отправляет инструкцию или счет по заказу. Если это не удалось, отменяет заказ
+// и возвращает false
+func (h *Handler) sendCheckoutOrCancel(ctx context.Context, chatID int64, order *models.Order, title string, method payment.Method) bool {
+	if err := h.sendCheckout(ctx, chatID, order, title, method); err != nil {
+		log.Printf("Error sending checkout for order %s: %v", order.OrderID, err)
+		h.sendMessage(chatID, "❌ Не удалось подготовить оплату. Попробуйте другой способ или обратитесь к администратору.")
+
+		// Заказ без инструкции оплатить нельзя - сразу отменяем
+		if err := h.storage.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusCancelled, 0, "Не удалось подготовить оплату"); err != nil {
+			log.Printf("Error cancelling order %s: %v", order.OrderID, err)
 		}
+		return false
+	}
+
+	return true
+}
+
+// formatPromo дописывает к сумме заказа примененный промокод и скидку
+func formatPromo(order *models.Order) string {
+	if order.PromoCode == "" {
+		return ""
 	}
+	return fmt.Sprintf(" (🎟 %s, −%s)", order.PromoCode, order.Discount)
 }
 
 // handleConfirmPayment подтверждает оплату заказа
@@ -99,30 +286,75 @@ func (h *Handler) handleConfirmPayment(query *tgbotapi.CallbackQuery, orderIDStr
 		return
 	}
 
-	// Обновляем статус
-	if err := h.storage.UpdateOrderStatus(ctx, orderIDStr, "paid"); err != nil {
+	if !h.checkOrderClaim(ctx, query.Message.Chat.ID, query.From.ID, order.OrderID) {
+		return
+	}
+
+	// Обновляем статус. Повторное подтверждение или оплата отмененного заказа отклоняются хранилищем
+	err = h.confirmOrderPayment(ctx, order, query.From.ID, "")
+	if errors.Is(err, storage.ErrInvalidTransition) {
+		log.Printf("Rejected status change for order %s: %v", orderIDStr, err)
+		h.sendMessage(query.Message.Chat.ID, fmt.Sprintf(
+			"⚠️ Заказ %s нельзя подтвердить: текущий статус - %s.",
+			orderIDStr, StatusTexts[order.Status],
+		))
+		return
+	}
+	if err != nil {
 		log.Printf("Error updating order status: %v", err)
 		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при обновлении статуса.")
 		return
 	}
 
-	// Получаем информацию о товаре
-	product, err := h.storage.GetProductByID(ctx, order.ProductID)
-	if err != nil {
-		log.Printf("Error fetching product: %v", err)
+	h.closeReceiptMessage(query, "✅ Оплата подтверждена")
+
+	// Подтверждаем админу
+	h.sendMessage(query.Message.Chat.ID, fmt.Sprintf("✅ Оплата подтверждена для заказа %s", orderIDStr))
+
+	log.Printf("Payment confirmed for order %s by admin %d", orderIDStr, query.From.ID)
+}
+
+// confirmOrderPayment переводит заказ в paid от имени админа, принимает чеки покупателя и выдает заказ.
+// ErrInvalidTransition - заказ уже оплачен или отменен
+func (h *Handler) confirmOrderPayment(ctx context.Context, order *models.Order, adminID int64, reason string) error {
+	if err := h.storage.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusPaid, adminID, reason); err != nil {
+		return err
+	}
+
+	// Чеки, присланные покупателем, считаются принятыми
+	if err := h.storage.ReviewOrderReceipts(ctx, order.OrderID, models.ReceiptStatusAccepted, adminID); err != nil {
+		log.Printf("Error accepting receipts: %v", err)
+	}
+
+	h.onOrderPaid(ctx, order)
+	return nil
+}
+
+// onOrderPaid выдает оплаченный заказ и начисляет бонус пригласившему покупателя.
+// Оплаченный предзаказ ждет выхода товара: выдача и бонус - после передачи в выполнение
+func (h *Handler) onOrderPaid(ctx context.Context, order *models.Order) {
+	if current, err := h.storage.GetOrderByID(ctx, order.OrderID); err != nil {
+		log.Printf("Error fetching order %s: %v", order.OrderID, err)
+	} else if current.Status == models.OrderStatusPreordered {
+		h.notifyOrderPreordered(ctx, current)
 		return
 	}
 
-	// Уведомляем пользователя
+	h.fulfillOrder(ctx, order)
+	h.rewardReferrer(ctx, order)
+}
+
+// notifyOrderPaid сообщает покупателю, что оплата заказа получена
+func (h *Handler) notifyOrderPaid(ctx context.Context, order *models.Order) {
 	userText := fmt.Sprintf(
 		"✅ <b>Оплата подтверждена!</b>\n\n"+
 			"📦 Заказ №: <code>%s</code>\n"+
 			"🎮 %s\n"+
-			"💰 %.2f руб.\n\n"+
+			"💰 %s%s\n\n"+
 			"Ваша подписка активирована! Спасибо за покупку! 🎉",
 		order.OrderID,
-		product.Name,
-		order.Price,
+		h.orderTitle(ctx, order),
+		order.Price, formatBalanceUsed(order),
 	)
 
 	userMsg := tgbotapi.NewMessage(order.UserID, userText)
@@ -130,9 +362,45 @@ func (h *Handler) handleConfirmPayment(query *tgbotapi.CallbackQuery, orderIDStr
 	if _, err := h.bot.Send(userMsg); err != nil {
 		log.Printf("Error notifying user: %v", err)
 	}
+}
 
-	// Подтверждаем админу
-	h.sendMessage(query.Message.Chat.ID, fmt.Sprintf("✅ Оплата подтверждена для заказа %s", orderIDStr))
+// orderTitle возвращает состав заказа для уведомлений: название товара или позиции корзины
+func (h *Handler) orderTitle(ctx context.Context, order *models.Order) string {
+	return h.orderTitles(ctx, []models.Order{*order})[order.OrderID]
+}
 
-	log.Printf("Payment confirmed for order %s by admin %d", orderIDStr, query.From.ID)
+// orderTitles возвращает состав нескольких заказов одним запросом (для списков заказов)
+func (h *Handler) orderTitles(ctx context.Context, orders []models.Order) map[string]string {
+	orderIDs := make([]string, 0, len(orders))
+	for _, order := range orders {
+		orderIDs = append(orderIDs, order.OrderID)
+	}
+
+	items, err := h.storage.GetOrderItemsByOrderIDs(ctx, orderIDs)
+	if err != nil {
+		log.Printf("Error fetching order items: %v", err)
+	}
+
+	titles := make(map[string]string, len(orders))
+	for _, order := range orders {
+		titles[order.OrderID] = formatOrderItems(items[order.OrderID])
+	}
+	return titles
+}
+
+// formatOrderItems перечисляет позиции заказа в одну строку: "WoW Classic ×2, Смена региона"
+func formatOrderItems(items []models.OrderItem) string {
+	if len(items) == 0 {
+		return "Товар"
+	}
+
+	parts := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.Quantity > 1 {
+			parts = append(parts, fmt.Sprintf("%s ×%d", item.ProductName, item.Quantity))
+		} else {
+			parts = append(parts, item.ProductName)
+		}
+	}
+	return strings.Join(parts, ", ")
 }
@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+	"tgwow/internal/payment"
+	"tgwow/internal/storage"
+)
+
+// Ограничения Bot API для sendInvoice
+const (
+	invoiceTitleMaxLen       = 32
+	invoiceDescriptionMaxLen = 255
+)
+
+// paymentReviewText получает покупатель, если списанный платеж не удалось применить к заказу автоматически
+const paymentReviewText = "✅ Оплата получена. Администратор проверит заказ и свяжется с вами."
+
+// paymentMethodsFor возвращает способы оплаты, включенные для региона товара и его валюты
+func (h *Handler) paymentMethodsFor(ctx context.Context, product *models.Product) ([]payment.Method, error) {
+	category, err := h.storage.GetCategoryByID(ctx, product.CategoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	region, err := h.storage.GetRegionByID(ctx, category.RegionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.payments.ForRegion(region.Code, product.Price.Currency), nil
+}
+
+// paymentMethodsForAll возвращает способы оплаты, подходящие сразу всем товарам заказа
+func (h *Handler) paymentMethodsForAll(ctx context.Context, products []*models.Product) ([]payment.Method, error) {
+	var result []payment.Method
+	for i, product := range products {
+		methods, err := h.paymentMethodsFor(ctx, product)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			result = methods
+			continue
+		}
+
+		allowed := make(map[string]bool, len(methods))
+		for _, m := range methods {
+			allowed[m.Code()] = true
+		}
+		common := result[:0:0]
+		for _, m := range result {
+			if allowed[m.Code()] {
+				common = append(common, m)
+			}
+		}
+		result = common
+	}
+	return result, nil
+}
+
+// showPaymentMethods заменяет карточку товара выбором способа оплаты
+func (h *Handler) showPaymentMethods(query *tgbotapi.CallbackQuery, product *models.Product, methods []payment.Method) {
+	text := fmt.Sprintf(
+		"🎮 <b>%s</b>\n"+
+			"💰 <b>Сумма:</b> %s\n\n"+
+			"Выберите способ оплаты:",
+		product.Name, product.Price,
+	)
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, method := range methods {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(method.Title(), fmt.Sprintf("%s:%d:%s", CallbackActionPay, product.ID, method.Code())),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("◀️ Назад", fmt.Sprintf("%s:%d", CallbackActionProduct, product.ID)),
+	))
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ParseMode = "HTML"
+	edit.ReplyMarkup = &keyboard
+
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Error editing message: %v", err)
+	}
+}
+
+// sendCheckout отправляет покупателю инструкцию или счет выбранного способа оплаты
+func (h *Handler) sendCheckout(ctx context.Context, chatID int64, order *models.Order, title string, method payment.Method) error {
+	var checkout payment.Checkout
+	var err error
+	if card, ok := method.(*payment.Card); ok {
+		checkout, err = h.cardCheckout(ctx, order, title, card)
+	} else {
+		checkout, err = method.Checkout(*order, title)
+	}
+	if err != nil {
+		return err
+	}
+
+	if checkout.Invoice != nil {
+		return h.sendInvoice(chatID, order, title, checkout)
+	}
+
+	text := checkout.Text
+	if h.orderExpiry > 0 {
+		text += fmt.Sprintf("\n\n⏳ Неоплаченный заказ будет автоматически отменён через %s.", formatDuration(h.orderExpiry))
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "HTML"
+	switch method.Confirmation() {
+	case payment.ConfirmManual:
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(receiptButton(order.OrderID)))
+	case payment.ConfirmInstant:
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("✅ Оплатить", fmt.Sprintf("%s:%s", CallbackActionMockPay, order.OrderID)),
+			),
+		)
+	}
+
+	_, err = h.bot.Send(msg)
+	return err
+}
+
+// sendInvoice отправляет счет Telegram Payments или Telegram Stars
+func (h *Handler) sendInvoice(chatID int64, order *models.Order, title string, checkout payment.Checkout) error {
+	description := checkout.Text
+	if h.orderExpiry > 0 {
+		description += fmt.Sprintf(". Счет действителен %s", formatDuration(h.orderExpiry))
+	}
+
+	invoice := tgbotapi.NewInvoice(
+		chatID,
+		truncateRunes(title, invoiceTitleMaxLen),
+		truncateRunes(description, invoiceDescriptionMaxLen),
+		order.OrderID,
+		checkout.Invoice.ProviderToken,
+		"",
+		checkout.Invoice.Currency,
+		[]tgbotapi.LabeledPrice{{Label: truncateRunes(title, invoiceTitleMaxLen), Amount: int(checkout.Invoice.Amount)}},
+	)
+
+	_, err := h.bot.Send(invoice)
+	return err
+}
+
+// expectedInvoice пересчитывает счет заказа его способом оплаты, чтобы сверить с платежом Telegram
+func (h *Handler) expectedInvoice(order *models.Order) (*payment.Invoice, error) {
+	method, ok := h.payments.Get(order.PaymentMethod)
+	if !ok || method.Confirmation() != payment.ConfirmInvoice {
+		return nil, fmt.Errorf("order %s is not paid by invoice (method %q)", order.OrderID, order.PaymentMethod)
+	}
+
+	checkout, err := method.Checkout(*order, "")
+	if err != nil {
+		return nil, err
+	}
+	if checkout.Invoice == nil {
+		return nil, fmt.Errorf("payment method %s returned no invoice", method.Code())
+	}
+
+	return checkout.Invoice, nil
+}
+
+// HandlePreCheckoutQuery подтверждает или отклоняет платеж перед списанием.
+// Telegram ждет ответа не дольше 10 секунд, поэтому проверки идут только по хранилищу
+func (h *Handler) HandlePreCheckoutQuery(query *tgbotapi.PreCheckoutQuery) {
+	log.Printf("Pre-checkout from %d for order %s: %d %s", query.From.ID, query.InvoicePayload, query.TotalAmount, query.Currency)
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	answer := tgbotapi.PreCheckoutConfig{PreCheckoutQueryID: query.ID, OK: true}
+	if reason := h.checkPreCheckout(ctx, query); reason != "" {
+		log.Printf("Pre-checkout for order %s rejected: %s", query.InvoicePayload, reason)
+		answer.OK = false
+		answer.ErrorMessage = reason
+	}
+
+	if _, err := h.bot.Request(answer); err != nil {
+		log.Printf("Error answering pre-checkout query: %v", err)
+	}
+}
+
+// checkPreCheckout заново проверяет заказ, товар и сумму счета.
+// Возвращает причину отказа для покупателя или пустую строку, если платеж можно принять
+func (h *Handler) checkPreCheckout(ctx context.Context, query *tgbotapi.PreCheckoutQuery) string {
+	order, err := h.storage.GetOrderByID(ctx, query.InvoicePayload)
+	if err != nil {
+		log.Printf("Error fetching order: %v", err)
+		return "Заказ не найден. Оформите заказ заново."
+	}
+
+	if order.UserID != query.From.ID {
+		return "Этот счет выставлен другому пользователю."
+	}
+	if order.Status != models.OrderStatusCreated {
+		return fmt.Sprintf("Заказ нельзя оплатить: статус «%s».", StatusTexts[order.Status])
+	}
+	if h.orderExpiry > 0 && time.Since(order.CreatedAt) > h.orderExpiry {
+		return "Срок оплаты заказа истек. Оформите заказ заново."
+	}
+
+	items, err := h.storage.GetOrderItems(ctx, order.OrderID)
+	if err != nil || len(items) == 0 {
+		log.Printf("Error fetching order items: %v", err)
+		return "Заказ не найден. Оформите заказ заново."
+	}
+	for _, item := range items {
+		product, err := h.storage.GetProductByID(ctx, item.ProductID)
+		if err != nil || !product.IsVisible {
+			return fmt.Sprintf("Товар «%s» больше недоступен для покупки.", item.ProductName)
+		}
+		if product.Price != item.Price {
+			return fmt.Sprintf("Цена товара «%s» изменилась. Оформите заказ заново.", item.ProductName)
+		}
+	}
+
+	invoice, err := h.expectedInvoice(order)
+	if err != nil {
+		log.Printf("Error checking invoice: %v", err)
+		return "Этот способ оплаты больше недоступен. Оформите заказ заново."
+	}
+	if query.Currency != invoice.Currency || int64(query.TotalAmount) != invoice.Amount {
+		return "Сумма счета не совпадает с суммой заказа."
+	}
+
+	return ""
+}
+
+// handleSuccessfulPayment переводит заказ в paid после списания денег по счету
+func (h *Handler) handleSuccessfulPayment(msg *tgbotapi.Message) {
+	paid := msg.SuccessfulPayment
+	orderID := paid.InvoicePayload
+
+	log.Printf("Successful payment from %d for order %s: %d %s, charge %s",
+		msg.From.ID, orderID, paid.TotalAmount, paid.Currency, paid.TelegramPaymentChargeID)
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil {
+		log.Printf("Error fetching paid order %s: %v", orderID, err)
+		h.sendMessage(msg.Chat.ID, paymentReviewText)
+		h.notifyAdminsPaymentIssue(orderID, paid, "заказ не найден")
+		return
+	}
+
+	// Идентификаторы платежа сохраняем до смены статуса: деньги уже списаны
+	if err := h.storage.SaveOrderPayment(ctx, orderID, paid.TelegramPaymentChargeID, paid.ProviderPaymentChargeID); err != nil {
+		log.Printf("Error saving payment for order %s: %v", orderID, err)
+	}
+
+	invoice, err := h.expectedInvoice(order)
+	if err != nil || paid.Currency != invoice.Currency || int64(paid.TotalAmount) != invoice.Amount {
+		h.sendMessage(msg.Chat.ID, paymentReviewText)
+		h.notifyAdminsPaymentIssue(orderID, paid, fmt.Sprintf("сумма заказа %s", order.Price))
+		return
+	}
+
+	reason := fmt.Sprintf("Оплата %s, платеж %s", order.PaymentMethod, paid.TelegramPaymentChargeID)
+	err = h.storage.UpdateOrderStatus(ctx, orderID, models.OrderStatusPaid, 0, reason)
+	if errors.Is(err, storage.ErrInvalidTransition) {
+		log.Printf("Rejected status change for order %s: %v", orderID, err)
+		h.sendMessage(msg.Chat.ID, paymentReviewText)
+		h.notifyAdminsPaymentIssue(orderID, paid, fmt.Sprintf("статус заказа «%s»", StatusTexts[order.Status]))
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating order status: %v", err)
+		h.sendMessage(msg.Chat.ID, paymentReviewText)
+		h.notifyAdminsPaymentIssue(orderID, paid, "ошибка при обновлении статуса")
+		return
+	}
+
+	h.onOrderPaid(ctx, order)
+
+	adminText := fmt.Sprintf(
+		"💳 <b>Заказ оплачен через Telegram</b>\n\n"+
+			"📦 <b>Заказ №:</b> <code>%s</code>\n"+
+			"👤 <b>Пользователь:</b> @%s (ID: %d)\n"+
+			"💰 <b>Сумма:</b> %s\n"+
+			"🧾 <b>Платеж:</b> <code>%s</code>",
+		order.OrderID,
+		msg.From.UserName, msg.From.ID,
+		formatInvoiceAmount(paid.Currency, paid.TotalAmount),
+		paid.TelegramPaymentChargeID,
+	)
+	h.notifyAdmins(adminText)
+
+	log.Printf("Order %s paid via %s", orderID, order.PaymentMethod)
+}
+
+// handleMockPay имитирует успешную оплату заказа тестовым способом
+func (h *Handler) handleMockPay(query *tgbotapi.CallbackQuery, orderID string) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil {
+		log.Printf("Error fetching order: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Заказ не найден.")
+		return
+	}
+
+	// Кнопка работает только у покупателя и только пока mock включен
+	method, ok := h.payments.Get(order.PaymentMethod)
+	if order.UserID != query.From.ID || !ok || method.Confirmation() != payment.ConfirmInstant {
+		log.Printf("Mock payment for order %s rejected for user %d", orderID, query.From.ID)
+		return
+	}
+
+	err = h.storage.UpdateOrderStatus(ctx, orderID, models.OrderStatusPaid, 0, "Тестовая оплата")
+	if errors.Is(err, storage.ErrInvalidTransition) {
+		h.sendMessage(query.Message.Chat.ID, fmt.Sprintf("⚠️ Заказ %s нельзя оплатить: текущий статус - %s.", orderID, StatusTexts[order.Status]))
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating order status: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при обновлении статуса.")
+		return
+	}
+
+	h.onOrderPaid(ctx, order)
+	h.notifyAdmins(fmt.Sprintf("🧪 Заказ <code>%s</code> оплачен тестовым способом (%s)", order.OrderID, order.Price))
+
+	log.Printf("Order %s paid via mock", orderID)
+}
+
+// notifyAdminsPaymentIssue просит админов вручную проверить платеж, который не удалось применить к заказу
+func (h *Handler) notifyAdminsPaymentIssue(orderID string, paid *tgbotapi.SuccessfulPayment, issue string) {
+	adminText := fmt.Sprintf(
+		"⚠️ <b>Платеж требует ручной проверки</b>\n\n"+
+			"📦 <b>Заказ №:</b> <code>%s</code>\n"+
+			"💰 <b>Оплачено:</b> %s\n"+
+			"🧾 <b>Telegram:</b> <code>%s</code>\n"+
+			"🏦 <b>Провайдер:</b> <code>%s</code>\n"+
+			"📝 <b>Проблема:</b> %s",
+		orderID,
+		formatInvoiceAmount(paid.Currency, paid.TotalAmount),
+		paid.TelegramPaymentChargeID,
+		paid.ProviderPaymentChargeID,
+		issue,
+	)
+	h.notifyAdmins(adminText)
+}
+
+// formatInvoiceAmount выводит сумму платежа Telegram: звезды целым числом, валюту - через money
+func formatInvoiceAmount(currency string, amount int) string {
+	if currency == payment.StarsCurrency {
+		return fmt.Sprintf("%d ⭐", amount)
+	}
+	return money.New(int64(amount), money.Currency(currency)).String()
+}
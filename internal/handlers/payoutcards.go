@@ -0,0 +1,404 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+	"tgwow/internal/payment"
+	"tgwow/internal/storage"
+)
+
+// payoutCardUsage - подсказка по команде /card_new
+const payoutCardUsage = "Формат: <code>/card_new НОМЕР; БАНК; ПОЛУЧАТЕЛЬ [; условия]</code>\n\n" +
+	"Условия (любые, через точку с запятой):\n" +
+	"<code>region=KZ</code> - только для заказов региона, без него - для всех регионов\n" +
+	"<code>limit=150000RUB</code> - сумма заказов на карту за день (МСК)\n\n" +
+	"Пример: <code>/card_new 2200 7009 7729 7505; Т-Банк; Иван И.; region=KZ; limit=150000RUB</code>"
+
+// SetPayoutCardRotation задает политику выбора карты для перевода (models.PayoutRotation*).
+// Вызывается до начала обработки обновлений
+func (h *Handler) SetPayoutCardRotation(rotation string) {
+	h.cardRotation = rotation
+}
+
+// cardCheckout готовит инструкцию по переводу на карту, выбранную для заказа из пула. Если подходящей
+// карты нет, инструкция - с картой по умолчанию, а без нее оформить заказ нельзя и админы получают предупреждение.
+// Заказ получает уникальную надбавку к сумме перевода (order.AmountOffset)
+func (h *Handler) cardCheckout(ctx context.Context, order *models.Order, title string, method *payment.Card) (payment.Checkout, error) {
+	// Уникальные копейки находят перевод в выписке банка, даже если покупатель не указал номер заказа.
+	// Копейки отмененных заказов не выдаются повторно, пока сверка может найти их перевод
+	tagged, err := h.storage.AssignAmountOffset(ctx, order.OrderID, time.Now().Add(-ReconcileWindow))
+	if err != nil {
+		return payment.Checkout{}, err
+	}
+	order.AmountOffset = tagged.AmountOffset
+
+	card, err := h.storage.AssignPayoutCard(ctx, order.OrderID, h.cardRotation, moscowDayStart(time.Now()))
+	if err == nil {
+		return method.CheckoutTo(*order, title, *card), nil
+	}
+	if !errors.Is(err, storage.ErrNoPayoutCard) {
+		return payment.Checkout{}, err
+	}
+
+	checkout, err := method.Checkout(*order, title)
+	if errors.Is(err, payment.ErrNoCardNumber) {
+		h.notifyAdmins(fmt.Sprintf(
+			"⚠️ <b>Нет карты для оплаты заказа</b> <code>%s</code> на %s\n\n"+
+				"Все подходящие карты выключены или исчерпали дневной лимит. Добавьте карту: /cards",
+			order.OrderID, order.Price,
+		))
+	}
+	return checkout, err
+}
+
+// payoutCardLine возвращает строку с картой, выданной по заказу, для уведомлений админов.
+// Пустая строка - карта не выдавалась или удалена
+func (h *Handler) payoutCardLine(ctx context.Context, orderID string) string {
+	card, err := h.storage.GetOrderPayoutCard(ctx, orderID)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Error fetching payout card of order %s: %v", orderID, err)
+		}
+		return ""
+	}
+	return fmt.Sprintf("🏦 Карта: %s\n", html.EscapeString(formatPayoutCardShort(card)))
+}
+
+// moscowDayStart возвращает начало текущих суток по Москве: с него считается дневной лимит карт
+func moscowDayStart(now time.Time) time.Time {
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+	y, m, d := now.In(moscowLocation).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, moscowLocation)
+}
+
+// handleAdminPayoutCardNew добавляет карту командой /card_new
+func (h *Handler) handleAdminPayoutCardNew(msg *tgbotapi.Message) {
+	if !h.isAdmin(msg.From.ID) {
+		h.sendMessage(msg.Chat.ID, "❌ У вас нет доступа к этой команде.")
+		return
+	}
+
+	card, regionCode, err := parsePayoutCardArgs(msg.CommandArguments())
+	if err != nil {
+		if err := h.sendHTML(msg.Chat.ID, fmt.Sprintf("❌ %s\n\n%s", err, payoutCardUsage)); err != nil {
+			log.Printf("Error sending message: %v", err)
+		}
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	if err := h.resolvePayoutCardRegion(ctx, &card, regionCode); err != nil {
+		h.sendMessage(msg.Chat.ID, "❌ "+err.Error())
+		return
+	}
+
+	created, err := h.storage.CreatePayoutCard(ctx, card)
+	if err != nil {
+		log.Printf("Error creating payout card: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при добавлении карты.")
+		return
+	}
+
+	if err := h.sendHTML(msg.Chat.ID, "✅ Карта добавлена\n\n"+h.describePayoutCard(ctx, created)+"\n\nВсе карты: /cards"); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+
+	log.Printf("Payout card %d added by admin %d", created.ID, msg.From.ID)
+}
+
+// resolvePayoutCardRegion находит регион карты по коду и проверяет, что лимит задан в его валюте
+func (h *Handler) resolvePayoutCardRegion(ctx context.Context, card *models.PayoutCard, regionCode string) error {
+	if regionCode == "" {
+		return nil
+	}
+
+	regionID, err := h.findRegionID(ctx, regionCode)
+	if err != nil {
+		return err
+	}
+
+	region, err := h.storage.GetRegionByID(ctx, regionID)
+	if err != nil {
+		return errors.New("не удалось загрузить регион")
+	}
+	if !card.DailyLimit.IsZero() && card.DailyLimit.Currency != region.Currency {
+		return fmt.Errorf("лимит должен быть в валюте региона %s (%s)", region.Code, region.Currency)
+	}
+
+	card.RegionID = regionID
+	return nil
+}
+
+// parsePayoutCardArgs разбирает аргументы /card_new. Регион возвращается кодом, его ID находит вызывающий
+func parsePayoutCardArgs(args string) (models.PayoutCard, string, error) {
+	var card models.PayoutCard
+	var regionCode string
+
+	parts := strings.Split(args, ";")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return card, "", errors.New("укажите номер карты, банк и получателя")
+	}
+
+	number, err := normalizeCardNumber(parts[0])
+	if err != nil {
+		return card, "", err
+	}
+	card.Number = number
+
+	card.BankName = parts[1]
+	card.Holder = parts[2]
+	if len([]rune(card.BankName)) > MaxPayoutBankLength || len([]rune(card.Holder)) > MaxPayoutHolderLength {
+		return card, "", fmt.Errorf("банк - до %d символов, получатель - до %d", MaxPayoutBankLength, MaxPayoutHolderLength)
+	}
+
+	for _, arg := range parts[3:] {
+		if arg == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(arg, "=")
+		value = strings.TrimSpace(value)
+		if !ok || value == "" {
+			return card, "", fmt.Errorf("непонятное условие %q", arg)
+		}
+
+		switch strings.TrimSpace(key) {
+		case "region":
+			regionCode = strings.ToUpper(value)
+
+		case "limit":
+			limit, err := parseAmountWithCurrency(value)
+			if errors.Is(err, money.ErrUnknownCurrency) {
+				return card, "", errors.New("укажите лимит суммой с валютой (150000RUB)")
+			}
+			if err != nil || !limit.IsPositive() {
+				return card, "", errors.New("лимит должен быть положительной суммой")
+			}
+			card.DailyLimit = limit
+
+		default:
+			return card, "", fmt.Errorf("непонятное условие %q", arg)
+		}
+	}
+
+	return card, regionCode, nil
+}
+
+// normalizeCardNumber проверяет номер карты и разбивает его на группы по 4 цифры
+func normalizeCardNumber(s string) (string, error) {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(s)
+	if len(digits) < 16 || len(digits) > 19 || strings.Trim(digits, "0123456789") != "" {
+		return "", errors.New("номер карты - от 16 до 19 цифр")
+	}
+
+	var groups []string
+	for len(digits) > 4 {
+		groups = append(groups, digits[:4])
+		digits = digits[4:]
+	}
+	groups = append(groups, digits)
+	return strings.Join(groups, " "), nil
+}
+
+// formatPayoutCardShort показывает карту одной строкой: банк и последние цифры номера
+func formatPayoutCardShort(card *models.PayoutCard) string {
+	number := strings.ReplaceAll(card.Number, " ", "")
+	if len(number) > 4 {
+		number = number[len(number)-4:]
+	}
+	return fmt.Sprintf("%s •%s", card.BankName, number)
+}
+
+// describePayoutCard описывает карту одной карточкой для админа
+func (h *Handler) describePayoutCard(ctx context.Context, card *models.PayoutCard) string {
+	status := "✅ включена"
+	if !card.IsActive {
+		status = "⏸ выключена"
+	}
+
+	lines := []string{
+		fmt.Sprintf("💳 <code>%s</code> - %s", card.Number, status),
+		fmt.Sprintf("   %s, получатель %s", html.EscapeString(card.BankName), html.EscapeString(card.Holder)),
+	}
+
+	region := "все регионы"
+	if card.RegionID != 0 {
+		region = fmt.Sprintf("#%d", card.RegionID)
+		if r, err := h.storage.GetRegionByID(ctx, card.RegionID); err == nil {
+			region = html.EscapeString(r.Name)
+		}
+	}
+	lines = append(lines, "   Регион: "+region)
+
+	if card.DailyLimit.IsZero() {
+		lines = append(lines, "   Без дневного лимита")
+	} else {
+		lines = append(lines, fmt.Sprintf("   Сегодня: %s из %s", card.UsedToday, card.DailyLimit))
+	}
+
+	if card.LastUsedAt != nil {
+		moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+		lines = append(lines, "   Последняя выдача: "+card.LastUsedAt.In(moscowLocation).Format("02.01.2006 15:04"))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// buildPayoutCardsView строит список карт с кнопками включения, выключения и удаления
+func (h *Handler) buildPayoutCardsView(ctx context.Context) (string, tgbotapi.InlineKeyboardMarkup, error) {
+	cards, err := h.storage.ListPayoutCards(ctx, moscowDayStart(time.Now()))
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, err
+	}
+
+	text := "💳 <b>Карты для оплаты</b>\n\n"
+	if len(cards) == 0 {
+		text += "Карт пока нет: переводы идут на карту из PAYMENT_CARD_NUMBER, если она задана.\n\n"
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i := range cards {
+		card := &cards[i]
+		text += h.describePayoutCard(ctx, card) + "\n\n"
+
+		label := "⏸ Выключить " + formatPayoutCardShort(card)
+		if !card.IsActive {
+			label = "▶️ Включить " + formatPayoutCardShort(card)
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("%s:%d", CallbackActionAdminCardToggle, card.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("🗑 Удалить", fmt.Sprintf("%s:%d", CallbackActionAdminCardDelete, card.ID)),
+		))
+	}
+
+	text += "Новая карта: /card_new"
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("◀️ Назад в админ-панель", CallbackActionBackToAdmin+":0"),
+	))
+
+	return text, tgbotapi.NewInlineKeyboardMarkup(rows...), nil
+}
+
+// handleAdminPayoutCards показывает карты командой /cards
+func (h *Handler) handleAdminPayoutCards(msg *tgbotapi.Message) {
+	if !h.isAdmin(msg.From.ID) {
+		h.sendMessage(msg.Chat.ID, "❌ У вас нет доступа к этой команде.")
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	text, keyboard, err := h.buildPayoutCardsView(ctx)
+	if err != nil {
+		log.Printf("Error fetching payout cards: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при загрузке карт.")
+		return
+	}
+
+	response := tgbotapi.NewMessage(msg.Chat.ID, text)
+	response.ParseMode = "HTML"
+	response.ReplyMarkup = keyboard
+
+	if _, err := h.bot.Send(response); err != nil {
+		log.Printf("Error sending payout cards: %v", err)
+	}
+}
+
+// handleAdminPayoutCardsCallback показывает карты из админ-панели
+func (h *Handler) handleAdminPayoutCardsCallback(query *tgbotapi.CallbackQuery) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	h.refreshPayoutCards(ctx, query)
+}
+
+// handleAdminPayoutCardToggle включает или выключает карту
+func (h *Handler) handleAdminPayoutCardToggle(query *tgbotapi.CallbackQuery, cardID int) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	cards, err := h.storage.ListPayoutCards(ctx, moscowDayStart(time.Now()))
+	if err != nil {
+		log.Printf("Error fetching payout cards: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке карт.")
+		return
+	}
+
+	for _, card := range cards {
+		if card.ID != cardID {
+			continue
+		}
+		if err := h.storage.SetPayoutCardActive(ctx, card.ID, !card.IsActive); err != nil {
+			log.Printf("Error updating payout card: %v", err)
+			h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при обновлении карты.")
+			return
+		}
+		log.Printf("Payout card %d active=%t by admin %d", card.ID, !card.IsActive, query.From.ID)
+	}
+
+	h.refreshPayoutCards(ctx, query)
+}
+
+// handleAdminPayoutCardDelete удаляет карту. Покупатели, уже получившие ее реквизиты, при повторном
+// запросе инструкции получат другую карту
+func (h *Handler) handleAdminPayoutCardDelete(query *tgbotapi.CallbackQuery, cardID int) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	err := h.storage.DeletePayoutCard(ctx, cardID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Error deleting payout card: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при удалении карты.")
+		return
+	}
+	if err == nil {
+		log.Printf("Payout card %d deleted by admin %d", cardID, query.From.ID)
+	}
+
+	h.refreshPayoutCards(ctx, query)
+}
+
+// refreshPayoutCards перерисовывает список карт в сообщении callback'а
+func (h *Handler) refreshPayoutCards(ctx context.Context, query *tgbotapi.CallbackQuery) {
+	text, keyboard, err := h.buildPayoutCardsView(ctx)
+	if err != nil {
+		log.Printf("Error fetching payout cards: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке карт.")
+		return
+	}
+
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ParseMode = "HTML"
+	edit.ReplyMarkup = &keyboard
+
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Error editing message: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"tgwow/internal/models"
+	"tgwow/internal/storage"
+)
+
+// releaseDateLayouts - форматы даты выхода, которые принимает админ (время московское)
+var releaseDateLayouts = []string{"02.01.2006 15:04", "02.01.2006"}
+
+// StartPreorderRelease запускает фоновую передачу предзаказов в выполнение после выхода товара.
+// Вызывается до начала обработки обновлений, останавливается вместе с Handler в Shutdown
+func (h *Handler) StartPreorderRelease() {
+	go func() {
+		ticker := time.NewTicker(PreorderReleaseCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), PreorderReleaseTimeout)
+				h.releasePreorders(ctx, time.Now())
+				cancel()
+			case <-h.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// releasePreorders переводит предзаказы, товары которых вышли к now, в paid: покупатель получает
+// уведомление о выходе, заказ выдается как обычный оплаченный, админы - уведомление с кнопкой «Взять в работу»
+func (h *Handler) releasePreorders(ctx context.Context, now time.Time) {
+	orders, err := h.storage.ListReleasedPreorders(ctx, now, PreorderReleaseBatchSize)
+	if err != nil {
+		log.Printf("Error fetching released preorders: %v", err)
+		return
+	}
+	if len(orders) == 0 {
+		return
+	}
+
+	titles := h.orderTitles(ctx, orders)
+
+	for i := range orders {
+		order := &orders[i]
+
+		err := h.storage.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusPaid, 0, "Товар вышел")
+		if errors.Is(err, storage.ErrInvalidTransition) {
+			// Предзаказ успели вернуть между выборкой и выпуском
+			continue
+		}
+		if err != nil {
+			log.Printf("Error releasing preorder %s: %v", order.OrderID, err)
+			continue
+		}
+
+		title := titles[order.OrderID]
+		h.sendMessage(order.UserID, fmt.Sprintf(
+			"🎉 %s уже вышел!\n\n"+
+				"📦 Ваш предзаказ %s передан в выполнение.",
+			title, order.OrderID,
+		))
+
+		order.Status = models.OrderStatusPaid
+		h.onOrderPaid(ctx, order)
+
+		h.notifyAdminsNewOrder(ctx, order.OrderID, fmt.Sprintf(
+			"🎉 <b>Предзаказ передан в выполнение</b>\n\n"+
+				"📦 <b>Заказ №:</b> <code>%s</code>\n"+
+				"👤 <b>Пользователь:</b> ID %d\n"+
+				"🎮 <b>Товар:</b> %s\n"+
+				"💰 <b>Сумма:</b> %s%s\n\n"+
+				"Товар вышел, заказ ожидает выдачи.",
+			order.OrderID, order.UserID, html.EscapeString(title), order.Price, formatBalanceUsed(order),
+		))
+
+		log.Printf("Preorder %s released", order.OrderID)
+	}
+}
+
+// notifyOrderPreordered сообщает покупателю, что предзаказ оплачен и будет выдан после выхода товара
+func (h *Handler) notifyOrderPreordered(ctx context.Context, order *models.Order) {
+	text := fmt.Sprintf(
+		"%s <b>Предзаказ оплачен!</b>\n\n"+
+			"📦 Заказ №: <code>%s</code>\n"+
+			"🎮 %s\n"+
+			"💰 %s%s\n\n",
+		StatusEmojis[models.OrderStatusPreordered],
+		order.OrderID,
+		html.EscapeString(h.orderTitle(ctx, order)),
+		order.Price, formatBalanceUsed(order),
+	)
+	if releaseAt := h.orderReleaseAt(ctx, order.OrderID); releaseAt != nil {
+		moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+		text += fmt.Sprintf("📅 Выход: %s (МСК)\n", releaseAt.In(moscowLocation).Format("02.01.2006 15:04"))
+	}
+	text += "В день выхода мы пришлем уведомление и выдадим заказ. Спасибо за предзаказ! 🎉"
+
+	if err := h.sendHTML(order.UserID, text); err != nil {
+		log.Printf("Error notifying user %d about preorder: %v", order.UserID, err)
+	}
+}
+
+// orderReleaseAt возвращает самую позднюю дату выхода товаров заказа. nil - в заказе нет предзаказанных товаров
+func (h *Handler) orderReleaseAt(ctx context.Context, orderID string) *time.Time {
+	items, err := h.storage.GetOrderItems(ctx, orderID)
+	if err != nil {
+		log.Printf("Error fetching items of order %s: %v", orderID, err)
+		return nil
+	}
+
+	productIDs := make([]int, 0, len(items))
+	for _, item := range items {
+		productIDs = append(productIDs, item.ProductID)
+	}
+
+	products, err := h.storage.GetProductsByIDs(ctx, productIDs)
+	if err != nil {
+		log.Printf("Error fetching products: %v", err)
+		return nil
+	}
+
+	var latest *time.Time
+	for _, p := range products {
+		if p.ReleaseAt != nil && (latest == nil || p.ReleaseAt.After(*latest)) {
+			latest = p.ReleaseAt
+		}
+	}
+	return latest
+}
+
+// formatPreorder описывает предзаказ в карточке товара: дату выхода и сколько до нее осталось
+func formatPreorder(product *models.Product, now time.Time) string {
+	if !product.IsPreorder(now) {
+		return ""
+	}
+
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+	return fmt.Sprintf(
+		"%s <b>Предзаказ:</b> выход %s (МСК), осталось %s\n\n",
+		StatusEmojis[models.OrderStatusPreordered],
+		product.ReleaseAt.In(moscowLocation).Format("02.01.2006 15:04"),
+		formatCountdown(product.ReleaseAt.Sub(now)),
+	)
+}
+
+// formatCountdown показывает время до выхода: дни и часы, а в последний день - часы и минуты
+func formatCountdown(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	hours := int((d % (24 * time.Hour)) / time.Hour)
+
+	switch {
+	case days > 0 && hours > 0:
+		return fmt.Sprintf("%d дн. %d ч", days, hours)
+	case days > 0:
+		return fmt.Sprintf("%d дн.", days)
+	default:
+		return formatDuration(d)
+	}
+}
+
+// parseReleaseDate разбирает дату выхода, введенную админом по московскому времени
+func parseReleaseDate(input string) (time.Time, error) {
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+
+	input = strings.TrimSpace(input)
+	for _, layout := range releaseDateLayouts {
+		if t, err := time.ParseInLocation(layout, input, moscowLocation); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid release date %q", input)
+}
+
+// formatReleaseDate показывает дату выхода товара для админа
+func formatReleaseDate(releaseAt *time.Time) string {
+	if releaseAt == nil {
+		return "не предзаказ"
+	}
+
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+	text := releaseAt.In(moscowLocation).Format("02.01.2006 15:04") + " (МСК)"
+	if !releaseAt.After(time.Now()) {
+		text += ", уже вышел"
+	}
+	return text
+}
@@ -0,0 +1,520 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/fsm"
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+	"tgwow/internal/payment"
+	"tgwow/internal/promo"
+	"tgwow/internal/storage"
+)
+
+// stateKeyPaymentMethod - ключ данных FSM: способ оплаты заказа, ожидающего промокод
+const stateKeyPaymentMethod = "payment_method"
+
+// promoDateLayout - формат дат в /promo_new, даты считаются по Москве
+const promoDateLayout = "2006-01-02"
+
+// promoUsage - подсказка по команде /promo_new
+const promoUsage = "Формат: <code>/promo_new КОД СКИДКА [условия]</code>\n\n" +
+	"СКИДКА - процент (<code>10%</code>) или сумма с валютой (<code>500RUB</code>)\n" +
+	"Условия (любые, через пробел):\n" +
+	"<code>product=ID</code>, <code>category=ID</code>, <code>region=KZ</code> - на что действует\n" +
+	"<code>from=2025-03-01</code>, <code>until=2025-03-31</code> - даты действия включительно (МСК)\n" +
+	"<code>uses=100</code> - всего использований, <code>per_user=1</code> - на покупателя\n" +
+	"<code>first</code> - только на первый заказ\n\n" +
+	"Пример: <code>/promo_new SPRING10 10% category=1 until=2025-03-31 per_user=1</code>"
+
+// askPromoCode переводит покупателя в ожидание промокода перед созданием заказа
+func (h *Handler) askPromoCode(query *tgbotapi.CallbackQuery, productID int, method payment.Method) {
+	h.fsmManager.SetState(query.From.ID, fsm.StateWaitingForPromoCode, productID)
+	if userState, ok := h.fsmManager.GetState(query.From.ID); ok {
+		userState.Data[stateKeyPaymentMethod] = method.Code()
+	}
+
+	msg := tgbotapi.NewMessage(query.Message.Chat.ID,
+		"🎟 <b>Есть промокод?</b>\n\n"+
+			"Отправьте его сообщением или нажмите «Без промокода».\n\n"+
+			"Для отмены используйте /cancel")
+	msg.ParseMode = "HTML"
+	msg.ReplyMarkup = promoSkipKeyboard()
+
+	if _, err := h.bot.Send(msg); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
+
+// promoSkipKeyboard - кнопка оформления заказа без промокода
+func promoSkipKeyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("➡️ Без промокода", CallbackActionPromoSkip+":0"),
+		),
+	)
+}
+
+// handlePromoCodeInput оформляет заказ с промокодом, введенным покупателем.
+// Если промокод не подошел, покупатель может ввести другой или продолжить без него
+func (h *Handler) handlePromoCodeInput(msg *tgbotapi.Message, userState *fsm.UserState) {
+	code, err := promo.Normalize(msg.Text)
+	if err != nil {
+		h.sendPromoRetry(msg.Chat.ID, "❌ Неверный промокод: "+err.Error()+".")
+		return
+	}
+
+	method, ok := h.pendingPaymentMethod(msg.Chat.ID, msg.From.ID, userState)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	err = h.placeOrder(ctx, msg.Chat.ID, msg.From, userState.ProductID, method, code)
+	if text, ok := promoErrorText(err); ok {
+		h.sendPromoRetry(msg.Chat.ID, text)
+		return
+	}
+
+	h.fsmManager.ClearState(msg.From.ID)
+	if err != nil {
+		h.sendOrderError(msg.Chat.ID, err)
+	}
+}
+
+// handlePromoSkip оформляет ожидающий промокода заказ без скидки
+func (h *Handler) handlePromoSkip(query *tgbotapi.CallbackQuery) {
+	userState, ok := h.fsmManager.GetState(query.From.ID)
+	if !ok || userState.State != fsm.StateWaitingForPromoCode {
+		h.sendMessage(query.Message.Chat.ID, "⚠️ Оформление уже завершено или отменено.")
+		return
+	}
+
+	method, ok := h.pendingPaymentMethod(query.Message.Chat.ID, query.From.ID, userState)
+	if !ok {
+		return
+	}
+	h.fsmManager.ClearState(query.From.ID)
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	if err := h.placeOrder(ctx, query.Message.Chat.ID, query.From, userState.ProductID, method, ""); err != nil {
+		h.sendOrderError(query.Message.Chat.ID, err)
+	}
+}
+
+// pendingPaymentMethod возвращает способ оплаты, выбранный до запроса промокода.
+// Если способ успели отключить, оформление прерывается
+func (h *Handler) pendingPaymentMethod(chatID, userID int64, userState *fsm.UserState) (payment.Method, bool) {
+	code, _ := userState.Data[stateKeyPaymentMethod].(string)
+	method, ok := h.payments.Get(code)
+	if !ok {
+		h.fsmManager.ClearState(userID)
+		h.sendMessage(chatID, "❌ Этот способ оплаты больше недоступен. Оформите заказ заново.")
+	}
+	return method, ok
+}
+
+// sendPromoRetry сообщает, что промокод не подошел, и предлагает ввести другой
+func (h *Handler) sendPromoRetry(chatID int64, text string) {
+	msg := tgbotapi.NewMessage(chatID, text+"\n\nОтправьте другой промокод или нажмите «Без промокода».")
+	msg.ReplyMarkup = promoSkipKeyboard()
+
+	if _, err := h.bot.Send(msg); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
+
+// promoErrorText возвращает текст для покупателя, если заказ не создан из-за промокода
+func promoErrorText(err error) (string, bool) {
+	switch {
+	case errors.Is(err, promo.ErrUnknown):
+		return "❌ Промокод не найден. Проверьте написание.", true
+	case errors.Is(err, promo.ErrInactive):
+		return "❌ Промокод сейчас не действует.", true
+	case errors.Is(err, promo.ErrNotApplicable):
+		return "❌ Промокод не подходит к товарам заказа.", true
+	case errors.Is(err, promo.ErrUsageLimit):
+		return "❌ Промокод больше нельзя использовать.", true
+	case errors.Is(err, promo.ErrFirstPurchaseOnly):
+		return "❌ Промокод действует только на первый заказ.", true
+	}
+	return "", false
+}
+
+// handleAdminPromoNew создает промокод командой /promo_new
+func (h *Handler) handleAdminPromoNew(msg *tgbotapi.Message) {
+	if !h.isAdmin(msg.From.ID) {
+		h.sendMessage(msg.Chat.ID, "❌ У вас нет доступа к этой команде.")
+		return
+	}
+
+	moscow, _ := time.LoadLocation("Europe/Moscow")
+	code, regionCode, err := parsePromoArgs(strings.Fields(msg.CommandArguments()), moscow)
+	if err != nil {
+		if err := h.sendHTML(msg.Chat.ID, fmt.Sprintf("❌ %s\n\n%s", err, promoUsage)); err != nil {
+			log.Printf("Error sending message: %v", err)
+		}
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	if err := h.resolvePromoScope(ctx, &code, regionCode); err != nil {
+		h.sendMessage(msg.Chat.ID, "❌ "+err.Error())
+		return
+	}
+
+	created, err := h.storage.CreatePromoCode(ctx, code)
+	if errors.Is(err, storage.ErrAlreadyExists) {
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf("❌ Промокод %s уже существует.", code.Code))
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating promo code: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при создании промокода.")
+		return
+	}
+
+	if err := h.sendHTML(msg.Chat.ID, "✅ Промокод создан\n\n"+h.describePromoCode(ctx, created)); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+
+	log.Printf("Promo code %s created by admin %d", created.Code, msg.From.ID)
+}
+
+// resolvePromoScope проверяет товар и категорию промокода и находит регион по коду
+func (h *Handler) resolvePromoScope(ctx context.Context, code *models.PromoCode, regionCode string) error {
+	if code.ProductID != 0 {
+		if _, err := h.storage.GetProductByID(ctx, code.ProductID); err != nil {
+			return fmt.Errorf("товар #%d не найден", code.ProductID)
+		}
+	}
+	if code.CategoryID != 0 {
+		if _, err := h.storage.GetCategoryByID(ctx, code.CategoryID); err != nil {
+			return fmt.Errorf("категория #%d не найдена", code.CategoryID)
+		}
+	}
+	if regionCode == "" {
+		return nil
+	}
+
+	regionID, err := h.findRegionID(ctx, regionCode)
+	if err != nil {
+		return err
+	}
+	code.RegionID = regionID
+	return nil
+}
+
+// findRegionID находит регион по коду (KZ, RU), без учета регистра
+func (h *Handler) findRegionID(ctx context.Context, regionCode string) (int, error) {
+	regions, err := h.storage.ListRegions(ctx)
+	if err != nil {
+		return 0, errors.New("не удалось загрузить регионы")
+	}
+	for _, r := range regions {
+		if strings.EqualFold(r.Code, regionCode) {
+			return r.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("регион %s не найден", regionCode)
+}
+
+// parsePromoArgs разбирает аргументы /promo_new. Регион возвращается кодом, его ID находит вызывающий
+func parsePromoArgs(args []string, loc *time.Location) (models.PromoCode, string, error) {
+	var code models.PromoCode
+	var regionCode string
+
+	if len(args) < 2 {
+		return code, "", errors.New("укажите код и скидку")
+	}
+
+	var err error
+	if code.Code, err = promo.Normalize(args[0]); err != nil {
+		return code, "", err
+	}
+
+	if err := parsePromoDiscount(args[1], &code); err != nil {
+		return code, "", err
+	}
+
+	for _, arg := range args[2:] {
+		if arg == "first" {
+			code.FirstPurchaseOnly = true
+			continue
+		}
+
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || value == "" {
+			return code, "", fmt.Errorf("непонятное условие %q", arg)
+		}
+
+		switch key {
+		case "product", "category", "uses", "per_user":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return code, "", fmt.Errorf("%s должно быть положительным числом", key)
+			}
+			switch key {
+			case "product":
+				code.ProductID = n
+			case "category":
+				code.CategoryID = n
+			case "uses":
+				code.MaxUses = n
+			case "per_user":
+				code.MaxUsesPerUser = n
+			}
+
+		case "region":
+			regionCode = strings.ToUpper(value)
+
+		case "from", "until":
+			day, err := time.ParseInLocation(promoDateLayout, value, loc)
+			if err != nil {
+				return code, "", fmt.Errorf("дата %s должна быть в формате ГГГГ-ММ-ДД", key)
+			}
+			if key == "from" {
+				code.ValidFrom = &day
+			} else {
+				// until включительно: промокод действует до конца указанного дня
+				end := day.AddDate(0, 0, 1)
+				code.ValidUntil = &end
+			}
+
+		default:
+			return code, "", fmt.Errorf("непонятное условие %q", arg)
+		}
+	}
+
+	if code.ValidFrom != nil && code.ValidUntil != nil && !code.ValidFrom.Before(*code.ValidUntil) {
+		return code, "", errors.New("дата from позже даты until")
+	}
+
+	return code, regionCode, nil
+}
+
+// parsePromoDiscount разбирает скидку: "10%" или "500RUB"
+func parsePromoDiscount(s string, code *models.PromoCode) error {
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		n, err := strconv.Atoi(percent)
+		if err != nil || n < 1 || n > 99 {
+			return errors.New("процент скидки - целое число от 1 до 99")
+		}
+		code.Percent = n
+		return nil
+	}
+
+	amount, err := parseAmountWithCurrency(s)
+	if errors.Is(err, money.ErrUnknownCurrency) {
+		return errors.New("укажите скидку в процентах (10%) или суммой с валютой (500RUB)")
+	}
+	if err != nil || !amount.IsPositive() {
+		return errors.New("сумма скидки должна быть положительной")
+	}
+	code.Amount = amount
+	return nil
+}
+
+// describePromoCode описывает промокод одной карточкой для админа
+func (h *Handler) describePromoCode(ctx context.Context, code *models.PromoCode) string {
+	status := "✅ действует"
+	if !code.IsActive {
+		status = "⏸ выключен"
+	}
+
+	discount := fmt.Sprintf("%d%%", code.Percent)
+	if code.Percent == 0 {
+		discount = code.Amount.String()
+	}
+
+	lines := []string{fmt.Sprintf("🎟 <code>%s</code> - скидка %s, %s", code.Code, discount, status)}
+
+	var scope []string
+	if code.ProductID != 0 {
+		name := fmt.Sprintf("#%d", code.ProductID)
+		if p, err := h.storage.GetProductByID(ctx, code.ProductID); err == nil {
+			name = html.EscapeString(p.Name)
+		}
+		scope = append(scope, "товар "+name)
+	}
+	if code.CategoryID != 0 {
+		name := fmt.Sprintf("#%d", code.CategoryID)
+		if c, err := h.storage.GetCategoryByID(ctx, code.CategoryID); err == nil {
+			name = html.EscapeString(c.Name)
+		}
+		scope = append(scope, "категория "+name)
+	}
+	if code.RegionID != 0 {
+		name := fmt.Sprintf("#%d", code.RegionID)
+		if r, err := h.storage.GetRegionByID(ctx, code.RegionID); err == nil {
+			name = html.EscapeString(r.Name)
+		}
+		scope = append(scope, "регион "+name)
+	}
+	if len(scope) > 0 {
+		lines = append(lines, "   На: "+strings.Join(scope, ", "))
+	}
+
+	moscow, _ := time.LoadLocation("Europe/Moscow")
+	if code.ValidFrom != nil {
+		lines = append(lines, "   С "+code.ValidFrom.In(moscow).Format("02.01.2006"))
+	}
+	if code.ValidUntil != nil {
+		lines = append(lines, "   По "+code.ValidUntil.In(moscow).AddDate(0, 0, -1).Format("02.01.2006"))
+	}
+
+	uses := fmt.Sprintf("   Использован: %d", code.Uses)
+	if code.MaxUses > 0 {
+		uses += fmt.Sprintf(" из %d", code.MaxUses)
+	}
+	if code.MaxUsesPerUser > 0 {
+		uses += fmt.Sprintf(", не больше %d на покупателя", code.MaxUsesPerUser)
+	}
+	lines = append(lines, uses)
+
+	if code.FirstPurchaseOnly {
+		lines = append(lines, "   Только на первый заказ")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// buildPromoCodesView строит список промокодов с кнопками включения и выключения
+func (h *Handler) buildPromoCodesView(ctx context.Context) (string, tgbotapi.InlineKeyboardMarkup, error) {
+	codes, err := h.storage.ListPromoCodes(ctx)
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, err
+	}
+
+	text := "🎟 <b>Промокоды</b>\n\n"
+	if len(codes) == 0 {
+		text += "Промокодов пока нет.\n\n"
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i := range codes {
+		if i >= DisplayedPromoCodesLimit {
+			text += fmt.Sprintf("…и еще %d\n\n", len(codes)-i)
+			break
+		}
+
+		code := &codes[i]
+		text += h.describePromoCode(ctx, code) + "\n\n"
+
+		label := "⏸ Выключить " + code.Code
+		if !code.IsActive {
+			label = "▶️ Включить " + code.Code
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("%s:%d", CallbackActionAdminPromoToggle, code.ID)),
+		))
+	}
+
+	text += "Новый промокод: /promo_new"
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("◀️ Назад в админ-панель", CallbackActionBackToAdmin+":0"),
+	))
+
+	return text, tgbotapi.NewInlineKeyboardMarkup(rows...), nil
+}
+
+// handleAdminPromos показывает промокоды командой /promos
+func (h *Handler) handleAdminPromos(msg *tgbotapi.Message) {
+	if !h.isAdmin(msg.From.ID) {
+		h.sendMessage(msg.Chat.ID, "❌ У вас нет доступа к этой команде.")
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	text, keyboard, err := h.buildPromoCodesView(ctx)
+	if err != nil {
+		log.Printf("Error fetching promo codes: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при загрузке промокодов.")
+		return
+	}
+
+	response := tgbotapi.NewMessage(msg.Chat.ID, text)
+	response.ParseMode = "HTML"
+	response.ReplyMarkup = keyboard
+
+	if _, err := h.bot.Send(response); err != nil {
+		log.Printf("Error sending promo codes: %v", err)
+	}
+}
+
+// handleAdminPromosCallback показывает промокоды из админ-панели
+func (h *Handler) handleAdminPromosCallback(query *tgbotapi.CallbackQuery) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	h.refreshPromoCodes(ctx, query)
+}
+
+// handleAdminPromoToggle включает или выключает промокод
+func (h *Handler) handleAdminPromoToggle(query *tgbotapi.CallbackQuery, promoCodeID int) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	codes, err := h.storage.ListPromoCodes(ctx)
+	if err != nil {
+		log.Printf("Error fetching promo codes: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке промокодов.")
+		return
+	}
+
+	for _, code := range codes {
+		if code.ID != promoCodeID {
+			continue
+		}
+		if err := h.storage.SetPromoCodeActive(ctx, code.ID, !code.IsActive); err != nil {
+			log.Printf("Error updating promo code: %v", err)
+			h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при обновлении промокода.")
+			return
+		}
+		log.Printf("Promo code %s active=%t by admin %d", code.Code, !code.IsActive, query.From.ID)
+	}
+
+	h.refreshPromoCodes(ctx, query)
+}
+
+// refreshPromoCodes перерисовывает список промокодов в сообщении callback'а
+func (h *Handler) refreshPromoCodes(ctx context.Context, query *tgbotapi.CallbackQuery) {
+	text, keyboard, err := h.buildPromoCodesView(ctx)
+	if err != nil {
+		log.Printf("Error fetching promo codes: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке промокодов.")
+		return
+	}
+
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ParseMode = "HTML"
+	edit.ReplyMarkup = &keyboard
+
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Error editing message: %v", err)
+	}
+}
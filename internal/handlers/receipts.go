@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/fsm"
+	"tgwow/internal/models"
+)
+
+// receiptButton - кнопка «Прикрепить чек» для заказа с ручной проверкой оплаты
+func receiptButton(orderID string) tgbotapi.InlineKeyboardButton {
+	return tgbotapi.NewInlineKeyboardButtonData("📎 Прикрепить чек", fmt.Sprintf("%s:%s", CallbackActionAttachReceipt, orderID))
+}
+
+// handleAttachReceipt просит покупателя прислать фото или PDF чека по заказу
+func (h *Handler) handleAttachReceipt(query *tgbotapi.CallbackQuery, orderID string) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil || order.UserID != query.From.ID {
+		log.Printf("Receipt for order %s requested by user %d: %v", orderID, query.From.ID, err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Заказ не найден.")
+		return
+	}
+
+	if order.Status != models.OrderStatusCreated {
+		h.sendMessage(query.Message.Chat.ID, fmt.Sprintf(
+			"ℹ️ Чек не нужен: заказ %s в статусе «%s».",
+			order.OrderID, StatusTexts[order.Status],
+		))
+		return
+	}
+
+	h.fsmManager.SetOrderState(query.From.ID, fsm.StateWaitingForReceipt, order.OrderID)
+
+	text := fmt.Sprintf(
+		"📎 <b>Чек по заказу</b> <code>%s</code>\n\n"+
+			"Отправьте скриншот или PDF-файл чека одним сообщением.\n\n"+
+			"Для отмены используйте /cancel",
+		order.OrderID,
+	)
+
+	msg := tgbotapi.NewMessage(query.Message.Chat.ID, text)
+	msg.ParseMode = "HTML"
+	if _, err := h.bot.Send(msg); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
+
+// handleReceiptInput сохраняет присланный чек и пересылает его админам на проверку
+func (h *Handler) handleReceiptInput(msg *tgbotapi.Message, userState *fsm.UserState) {
+	fileID, fileType := receiptFile(msg)
+	if fileID == "" {
+		h.sendMessage(msg.Chat.ID, "❌ Пришлите фото или PDF-файл чека.\n\nДля отмены используйте /cancel")
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	orderID := userState.OrderID()
+	h.fsmManager.ClearState(msg.From.ID)
+
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil {
+		log.Printf("Error fetching order: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Заказ не найден.")
+		return
+	}
+
+	// Пока покупатель искал чек, заказ могли оплатить или отменить
+	if order.Status != models.OrderStatusCreated {
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf(
+			"ℹ️ Чек не нужен: заказ %s в статусе «%s».",
+			order.OrderID, StatusTexts[order.Status],
+		))
+		return
+	}
+
+	receipt, err := h.storage.AddOrderReceipt(ctx, order.OrderID, msg.From.ID, fileID, fileType)
+	if err != nil {
+		log.Printf("Error saving receipt: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Не удалось сохранить чек. Попробуйте позже.")
+		return
+	}
+
+	log.Printf("Receipt %d attached to order %s by user %d", receipt.ID, order.OrderID, msg.From.ID)
+
+	h.sendMessage(msg.Chat.ID, fmt.Sprintf(
+		"✅ Чек по заказу %s получен. Администратор проверит оплату и пришлет уведомление.",
+		order.OrderID,
+	))
+
+	methodTitle := order.PaymentMethod
+	if method, ok := h.payments.Get(order.PaymentMethod); ok {
+		methodTitle = method.Title()
+	}
+
+	caption := fmt.Sprintf(
+		"🧾 <b>Чек об оплате</b>\n\n"+
+			"📦 <b>Заказ №:</b> <code>%s</code>\n"+
+			"👤 <b>Пользователь:</b> @%s (ID: %d)\n"+
+			"🎮 <b>Товар:</b> %s\n"+
+			"💰 <b>Сумма:</b> %s\n"+
+			"💳 <b>Оплата:</b> %s",
+		order.OrderID,
+		msg.From.UserName, msg.From.ID,
+		h.orderTitle(ctx, order),
+		order.Price,
+		methodTitle,
+	)
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Подтвердить", fmt.Sprintf("%s:%s", CallbackActionConfirmPayment, order.OrderID)),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Отклонить", fmt.Sprintf("%s:%s", CallbackActionRejectPayment, order.OrderID)),
+		),
+	)
+
+	for _, adminID := range h.adminChatIDs {
+		var receiptMsg tgbotapi.Chattable
+		if receipt.FileType == models.ReceiptFilePhoto {
+			photo := tgbotapi.NewPhoto(adminID, tgbotapi.FileID(receipt.FileID))
+			photo.Caption = caption
+			photo.ParseMode = "HTML"
+			photo.ReplyMarkup = keyboard
+			receiptMsg = photo
+		} else {
+			doc := tgbotapi.NewDocument(adminID, tgbotapi.FileID(receipt.FileID))
+			doc.Caption = caption
+			doc.ParseMode = "HTML"
+			doc.ReplyMarkup = keyboard
+			receiptMsg = doc
+		}
+
+		if _, err := h.bot.Send(receiptMsg); err != nil {
+			log.Printf("Error forwarding receipt to admin %d: %v", adminID, err)
+		}
+	}
+}
+
+// receiptFile достает file_id чека из сообщения: самое большое фото или PDF/изображение документом
+func receiptFile(msg *tgbotapi.Message) (fileID, fileType string) {
+	if len(msg.Photo) > 0 {
+		return msg.Photo[len(msg.Photo)-1].FileID, models.ReceiptFilePhoto
+	}
+
+	if doc := msg.Document; doc != nil {
+		if doc.MimeType == "application/pdf" || strings.HasPrefix(doc.MimeType, "image/") {
+			return doc.FileID, models.ReceiptFileDocument
+		}
+	}
+
+	return "", ""
+}
+
+// closeReceiptMessage убирает кнопки с пересланного чека и дописывает решение в подпись.
+// Для обычных сообщений (список заказов в админке) ничего не делает
+func (h *Handler) closeReceiptMessage(query *tgbotapi.CallbackQuery, verdict string) {
+	if !isReceiptMessage(query.Message) {
+		return
+	}
+
+	h.editReceiptCaption(query.Message.Chat.ID, query.Message.MessageID, query.Message.Caption, verdict, query.From.UserName)
+}
+
+// isReceiptMessage сообщает, что сообщение - пересланный админу чек (фото или документ)
+func isReceiptMessage(msg *tgbotapi.Message) bool {
+	return msg != nil && (len(msg.Photo) > 0 || msg.Document != nil)
+}
+
+// editReceiptCaption дописывает решение админа в подпись чека, заодно убирая кнопки
+func (h *Handler) editReceiptCaption(chatID int64, messageID int, caption, verdict, adminName string) {
+	edit := tgbotapi.NewEditMessageCaption(chatID, messageID, fmt.Sprintf("%s\n\n%s (@%s)", caption, verdict, adminName))
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Error editing receipt message: %v", err)
+	}
+}
@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/fsm"
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+	"tgwow/internal/payment"
+	"tgwow/internal/reconcile"
+	"tgwow/internal/storage"
+)
+
+// stateKeyReconcileOrders - номера заказов, оплату которых нашла сверка, до подтверждения админом
+const stateKeyReconcileOrders = "reconcile_orders"
+
+// errOrderClaimed - заказ в работе у другого админа
+var errOrderClaimed = errors.New("order is claimed by another admin")
+
+// handleAdminReconcile начинает сверку выписки командой /reconcile
+func (h *Handler) handleAdminReconcile(msg *tgbotapi.Message) {
+	if !h.isAdmin(msg.From.ID) {
+		h.sendMessage(msg.Chat.ID, "❌ У вас нет доступа к этой команде.")
+		return
+	}
+
+	h.startReconcile(msg.Chat.ID, msg.From.ID)
+}
+
+// handleAdminReconcileCallback начинает сверку выписки из админ-панели
+func (h *Handler) handleAdminReconcileCallback(query *tgbotapi.CallbackQuery) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	h.startReconcile(query.Message.Chat.ID, query.From.ID)
+}
+
+// startReconcile показывает, сколько заказов ждут перевода, и просит прислать выписку банка
+func (h *Handler) startReconcile(chatID, adminID int64) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	orders, err := h.storage.ListAwaitingTransfers(ctx, payment.CodeCard, time.Now().Add(-ReconcileWindow), ReconcileOrdersLimit)
+	if err != nil {
+		log.Printf("Error fetching orders awaiting transfer: %v", err)
+		h.sendMessage(chatID, "❌ Ошибка при загрузке заказов.")
+		return
+	}
+	if len(orders) == 0 {
+		h.sendMessage(chatID, "🧾 Нет заказов, ожидающих оплаты переводом на карту.")
+		return
+	}
+
+	h.fsmManager.SetState(adminID, fsm.StateWaitingForStatement, 0)
+
+	text := fmt.Sprintf(
+		"🧾 <b>Сверка выписки</b>\n\n"+
+			"%s\n"+
+			"Отправьте выписку банка файлом .csv (до %d КБ). Бот найдет поступления по сумме перевода "+
+			"(у каждого заказа свои копейки) и времени, а затем предложит подтвердить оплату найденных заказов.\n\n"+
+			"Для отмены используйте /cancel",
+		formatAwaitingTransfers(orders), MaxStatementFileSize/1024,
+	)
+	if err := h.sendHTML(chatID, text); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
+
+// handleStatementInput скачивает присланную админом выписку и сверяет ее с заказами
+func (h *Handler) handleStatementInput(msg *tgbotapi.Message) {
+	if !h.isAdmin(msg.From.ID) {
+		return
+	}
+
+	if msg.Document == nil || strings.ToLower(filepath.Ext(msg.Document.FileName)) != ".csv" {
+		h.sendMessage(msg.Chat.ID, "❌ Отправьте выписку файлом .csv\n\nДля отмены используйте /cancel")
+		return
+	}
+
+	data, err := h.downloadDocument(msg.Document, MaxStatementFileSize)
+	if err != nil {
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf("❌ Выписка не загружена: %v\n\nДля отмены используйте /cancel", err))
+		return
+	}
+
+	h.reconcileStatement(msg.Chat.ID, msg.From.ID, data)
+}
+
+// reconcileStatement сопоставляет поступления из выписки с заказами, ожидающими перевода, и отправляет
+// админу отчет. Найденные заказы запоминаются в состоянии админа до подтверждения
+func (h *Handler) reconcileStatement(chatID, adminID int64, statement []byte) {
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+	transfers, err := reconcile.Parse(bytes.NewReader(statement), money.DefaultCurrency, moscowLocation)
+	if err != nil {
+		log.Printf("Error parsing statement from admin %d: %v", adminID, err)
+		reason := "файл не похож на CSV-выписку"
+		if errors.Is(err, reconcile.ErrNoHeader) {
+			reason = err.Error()
+		}
+		h.sendMessage(chatID, fmt.Sprintf("❌ Не удалось прочитать выписку: %s\n\nДля отмены используйте /cancel", reason))
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	orders, err := h.storage.ListAwaitingTransfers(ctx, payment.CodeCard, time.Now().Add(-ReconcileWindow), ReconcileOrdersLimit)
+	if err != nil {
+		log.Printf("Error fetching orders awaiting transfer: %v", err)
+		h.sendMessage(chatID, "❌ Ошибка при загрузке заказов.")
+		return
+	}
+
+	result := reconcile.MatchOrders(transfers, orders, ReconcileWindow)
+
+	log.Printf("Admin %d reconciled statement: %d transfers, %d matched, %d ambiguous",
+		adminID, len(transfers), len(result.Matches), len(result.Ambiguous))
+
+	response := tgbotapi.NewMessage(chatID, formatReconcileReport(transfers, orders, result, moscowLocation))
+	response.ParseMode = "HTML"
+
+	if len(result.Matches) == 0 {
+		h.fsmManager.ClearState(adminID)
+	} else {
+		orderIDs := make([]string, 0, len(result.Matches))
+		for _, m := range result.Matches {
+			orderIDs = append(orderIDs, m.Order.OrderID)
+		}
+
+		h.fsmManager.SetState(adminID, fsm.StateConfirmingReconcile, 0)
+		if userState, ok := h.fsmManager.GetState(adminID); ok {
+			userState.Data[stateKeyReconcileOrders] = orderIDs
+		}
+
+		response.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(
+					fmt.Sprintf("✅ Подтвердить все (%d)", len(orderIDs)), CallbackActionReconcileConfirm+":0",
+				),
+				tgbotapi.NewInlineKeyboardButtonData("❌ Отмена", CallbackActionReconcileCancel+":0"),
+			),
+		)
+	}
+
+	if _, err := h.bot.Send(response); err != nil {
+		log.Printf("Error sending reconcile report: %v", err)
+	}
+}
+
+// formatReconcileReport описывает итог сверки: найденные оплаты и поступления, которые нужно проверить вручную
+func formatReconcileReport(transfers []reconcile.Transfer, orders []models.Order, result reconcile.Result, loc *time.Location) string {
+	var b strings.Builder
+	fmt.Fprintf(&b,
+		"🧾 <b>Сверка выписки</b>\n\n"+
+			"Поступлений в выписке: %d\n"+
+			"%s",
+		len(transfers), formatAwaitingTransfers(orders),
+	)
+
+	if len(result.Matches) > 0 {
+		fmt.Fprintf(&b, "\n✅ <b>Найдены оплаты (%d):</b>\n", len(result.Matches))
+		for i, m := range result.Matches {
+			if i == DisplayedReconcileEntries {
+				fmt.Fprintf(&b, "…и еще %d\n", len(result.Matches)-i)
+				break
+			}
+			fmt.Fprintf(&b, "<code>%s</code> - %s, %s", m.Order.OrderID, m.Transfer.Amount, formatTransferTime(m.Transfer, loc))
+			if m.Order.Status == models.OrderStatusCancelled {
+				b.WriteString(" (отменен по сроку)")
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	if len(result.Ambiguous) > 0 {
+		fmt.Fprintf(&b, "\n❓ <b>Подходит несколько заказов (%d)</b> - проверьте вручную:\n", len(result.Ambiguous))
+		for i, t := range result.Ambiguous {
+			if i == DisplayedReconcileEntries {
+				fmt.Fprintf(&b, "…и еще %d\n", len(result.Ambiguous)-i)
+				break
+			}
+			fmt.Fprintf(&b, "стр. %d: %s, %s", t.Line, t.Amount, formatTransferTime(t, loc))
+			if t.Description != "" {
+				b.WriteString(" - " + html.EscapeString(truncateRunes(t.Description, 40)))
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	if len(result.Unmatched) > 0 {
+		fmt.Fprintf(&b, "\nБез подходящего заказа: %d поступлений\n", len(result.Unmatched))
+	}
+
+	if len(result.Matches) > 0 {
+		b.WriteString("\nПодтвердите оплату найденных заказов кнопкой ниже.")
+	} else {
+		b.WriteString("\nОплаты заказов в выписке не найдены.")
+	}
+	return b.String()
+}
+
+// formatAwaitingTransfers показывает, сколько заказов ждут перевода и сколько отменены по сроку,
+// но еще могут быть оплачены переводом из выписки
+func formatAwaitingTransfers(orders []models.Order) string {
+	var expired int
+	for _, o := range orders {
+		if o.Status == models.OrderStatusCancelled {
+			expired++
+		}
+	}
+
+	text := fmt.Sprintf("Ожидают оплаты переводом: %d\n", len(orders)-expired)
+	if expired > 0 {
+		text += fmt.Sprintf("Отменены по сроку за %s: %d\n", formatDuration(ReconcileWindow), expired)
+	}
+	return text
+}
+
+// formatTransferTime показывает время поступления по Москве, для выписок без времени - только дату
+func formatTransferTime(t reconcile.Transfer, loc *time.Location) string {
+	if t.DateOnly {
+		return t.Time.Format("02.01")
+	}
+	return t.Time.In(loc).Format("02.01 15:04")
+}
+
+// handleReconcileConfirm подтверждает оплату заказов, найденных сверкой. Заказы, которые успели оплатить,
+// отменить или взять в работу другие админы, пропускаются
+func (h *Handler) handleReconcileConfirm(query *tgbotapi.CallbackQuery) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	chatID := query.Message.Chat.ID
+
+	userState, ok := h.fsmManager.GetState(query.From.ID)
+	if !ok || userState.State != fsm.StateConfirmingReconcile {
+		h.sendMessage(chatID, "⚠️ Сверка устарела. Загрузите выписку заново: /reconcile")
+		return
+	}
+	orderIDs, _ := userState.Data[stateKeyReconcileOrders].([]string)
+	h.fsmManager.ClearState(query.From.ID)
+
+	h.removeReconcileButtons(query)
+
+	var confirmed, skipped, failed int
+	for _, orderID := range orderIDs {
+		switch err := h.confirmReconciledOrder(orderID, query.From.ID); {
+		case err == nil:
+			confirmed++
+		case errors.Is(err, storage.ErrInvalidTransition), errors.Is(err, errOrderClaimed):
+			skipped++
+		default:
+			log.Printf("Error confirming reconciled order %s: %v", orderID, err)
+			failed++
+		}
+	}
+
+	log.Printf("Admin %d confirmed %d orders from statement (%d skipped, %d failed)", query.From.ID, confirmed, skipped, failed)
+
+	text := fmt.Sprintf("✅ Оплата подтверждена: %d", confirmed)
+	if skipped > 0 {
+		text += fmt.Sprintf("\n⏭ Пропущено: %d (уже оплачены, отменены или в работе у другого админа)", skipped)
+	}
+	if failed > 0 {
+		text += fmt.Sprintf("\n❌ Ошибки: %d - подтвердите эти заказы вручную", failed)
+	}
+	h.sendMessage(chatID, text)
+}
+
+// confirmReconciledOrder подтверждает оплату заказа, найденного в выписке. Заказ, отмененный по сроку,
+// подтверждается отдельным методом хранилища: обычное подтверждение оплаты отмененный заказ не принимает
+func (h *Handler) confirmReconciledOrder(orderID string, adminID int64) error {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if h.foreignClaim(ctx, adminID, orderID) != nil {
+		return errOrderClaimed
+	}
+
+	const reason = "Перевод найден в выписке банка"
+	if order.Status != models.OrderStatusCancelled {
+		return h.confirmOrderPayment(ctx, order, adminID, reason)
+	}
+
+	if err := h.storage.ConfirmLateTransfer(ctx, orderID, adminID, reason+", заказ был отменен по сроку"); err != nil {
+		return err
+	}
+	if err := h.storage.ReviewOrderReceipts(ctx, orderID, models.ReceiptStatusAccepted, adminID); err != nil {
+		log.Printf("Error accepting receipts: %v", err)
+	}
+
+	h.onOrderPaid(ctx, order)
+	return nil
+}
+
+// handleReconcileCancel отменяет подтверждение найденных оплат
+func (h *Handler) handleReconcileCancel(query *tgbotapi.CallbackQuery) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	if userState, ok := h.fsmManager.GetState(query.From.ID); ok && userState.State == fsm.StateConfirmingReconcile {
+		h.fsmManager.ClearState(query.From.ID)
+	}
+
+	h.removeReconcileButtons(query)
+	h.sendMessage(query.Message.Chat.ID, "❌ Сверка отменена, заказы не изменены.")
+}
+
+// removeReconcileButtons убирает кнопки из отчета сверки, чтобы его нельзя было подтвердить повторно
+func (h *Handler) removeReconcileButtons(query *tgbotapi.CallbackQuery) {
+	edit := tgbotapi.NewEditMessageReplyMarkup(query.Message.Chat.ID, query.Message.MessageID, tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
+	})
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Error removing reconcile buttons: %v", err)
+	}
+}
+
+// formatTransferAmount показывает сумму перевода заказа, если она отличается от цены уникальными копейками
+func formatTransferAmount(order *models.Order) string {
+	if !order.AmountOffset.IsPositive() {
+		return ""
+	}
+	return fmt.Sprintf(", перевод %s", order.TransferAmount())
+}
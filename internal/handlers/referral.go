@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/models"
+)
+
+// SetReferralBonus задает бонус пригласившему в процентах от первого оплаченного заказа приглашенного.
+// Вызывается до начала обработки обновлений, 0 отключает бонус
+func (h *Handler) SetReferralBonus(percent int) {
+	h.referralBonus = percent
+}
+
+// parseReferralPayload достает ID пригласившего из параметра /start вида ref_<user_id>
+func parseReferralPayload(payload string) (int64, bool) {
+	raw, ok := strings.CutPrefix(strings.TrimSpace(payload), ReferralPayloadPrefix)
+	if !ok {
+		return 0, false
+	}
+
+	referrerID, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || referrerID <= 0 {
+		return 0, false
+	}
+
+	return referrerID, true
+}
+
+// referralLink возвращает персональную реферальную ссылку пользователя
+func (h *Handler) referralLink(userID int64) string {
+	return fmt.Sprintf("https://t.me/%s?start=%s%d", h.bot.Self.UserName, ReferralPayloadPrefix, userID)
+}
+
+// registerReferral записывает пригласившего, если пользователь пришел по реферальной ссылке впервые,
+// и сообщает пригласившему о новом пользователе
+func (h *Handler) registerReferral(msg *tgbotapi.Message) {
+	referrerID, ok := parseReferralPayload(msg.CommandArguments())
+	if !ok {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	username := msg.From.UserName
+	if username == "" {
+		username = msg.From.FirstName
+	}
+
+	added, err := h.storage.AddReferredUser(ctx, msg.From.ID, referrerID, username, msg.From.FirstName, msg.From.LastName)
+	if err != nil {
+		log.Printf("Error registering referral %d -> %d: %v", referrerID, msg.From.ID, err)
+		return
+	}
+	if !added {
+		return
+	}
+
+	log.Printf("User %d joined by referral link of %d", msg.From.ID, referrerID)
+
+	h.sendMessage(referrerID, fmt.Sprintf(
+		"👥 По вашей ссылке пришел новый пользователь: %s\n\n"+
+			"Бонус начислится, когда он оплатит первый заказ.",
+		getUserDisplayName(msg.From),
+	))
+}
+
+// rewardReferrer начисляет бонус пригласившему, если это первый оплаченный заказ приглашенного
+func (h *Handler) rewardReferrer(ctx context.Context, order *models.Order) {
+	if h.referralBonus <= 0 {
+		return
+	}
+
+	reward, err := h.storage.CreateReferralReward(ctx, order.OrderID, h.referralBonus)
+	if err != nil {
+		log.Printf("Error creating referral reward for order %s: %v", order.OrderID, err)
+		return
+	}
+	if reward == nil {
+		return
+	}
+
+	log.Printf("Referral reward %s for user %d (order %s)", reward.Amount, reward.ReferrerID, order.OrderID)
+
+	h.sendMessage(reward.ReferrerID, fmt.Sprintf(
+		"🎁 Приглашенный вами пользователь оплатил первый заказ!\n\nВаш бонус: %s",
+		reward.Amount,
+	))
+}
+
+// handleReferral обрабатывает команду /referral: ссылка для приглашения и статистика
+func (h *Handler) handleReferral(msg *tgbotapi.Message) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	stats, err := h.storage.GetReferralStats(ctx, msg.From.ID)
+	if err != nil {
+		log.Printf("Error fetching referral stats: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при загрузке реферальной статистики.")
+		return
+	}
+
+	text := "👥 <b>Пригласите друга</b>\n\n"
+	if h.referralBonus > 0 {
+		text += fmt.Sprintf("Когда друг оплатит первый заказ, вы получите бонус %d%% от его суммы.\n\n", h.referralBonus)
+	}
+	text += fmt.Sprintf("🔗 Ваша ссылка:\n%s\n\n", h.referralLink(msg.From.ID))
+
+	text += fmt.Sprintf(
+		"📊 Приглашено: %d\n"+
+			"🛒 Оплатили заказ: %d\n"+
+			"🎁 Бонусы: %s",
+		stats.Invited, stats.Rewarded, formatRevenue(stats.Rewards),
+	)
+
+	if stats.Referrer != nil {
+		text += "\n\n🤝 Вас пригласил: " + html.EscapeString(stats.Referrer.FirstName)
+	}
+
+	if err := h.sendHTML(msg.Chat.ID, text); err != nil {
+		log.Printf("Error sending referral stats: %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/models"
+	"tgwow/internal/payment"
+	"tgwow/internal/storage"
+)
+
+// StartRenewalReminders запускает фоновые напоминания о продлении подписок, которые заканчиваются
+// в ближайшие days дней. Вызывается до начала обработки обновлений, останавливается вместе с Handler в Shutdown
+func (h *Handler) StartRenewalReminders(days int) {
+	if days <= 0 {
+		return
+	}
+
+	window := time.Duration(days) * 24 * time.Hour
+
+	log.Printf("Renewal reminders will be sent %d days before subscription expiry", days)
+
+	go func() {
+		ticker := time.NewTicker(RenewalCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), RenewalReminderTimeout)
+				now := time.Now()
+				h.remindExpiringSubscriptions(ctx, now, now.Add(window))
+				cancel()
+			case <-h.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// remindExpiringSubscriptions напоминает покупателям о подписках, которые заканчиваются в (from, until],
+// и отмечает отправленные напоминания, чтобы не повторять их
+func (h *Handler) remindExpiringSubscriptions(ctx context.Context, from, until time.Time) {
+	subscriptions, err := h.storage.ListExpiringSubscriptions(ctx, from, until, RenewalReminderBatchSize)
+	if err != nil {
+		log.Printf("Error fetching expiring subscriptions: %v", err)
+		return
+	}
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	productIDs := make([]int, 0, len(subscriptions))
+	for _, sub := range subscriptions {
+		if sub.ProductID != 0 {
+			productIDs = append(productIDs, sub.ProductID)
+		}
+	}
+
+	products, err := h.storage.GetProductsByIDs(ctx, productIDs)
+	if err != nil {
+		log.Printf("Error fetching products: %v", err)
+		products = make(map[int]*models.Product)
+	}
+
+	for _, sub := range subscriptions {
+		// Продлить в один клик можно, только если товар все еще продается
+		product, ok := products[sub.ProductID]
+		canRenew := ok && product.IsVisible && product.Price.IsPositive()
+
+		if !h.sendRenewalReminder(sub, canRenew) {
+			continue
+		}
+
+		if err := h.storage.MarkSubscriptionReminded(ctx, sub.ItemID); err != nil {
+			log.Printf("Error marking subscription %d reminded: %v", sub.ItemID, err)
+			continue
+		}
+
+		log.Printf("Renewal reminder sent to user %d for order %s", sub.UserID, sub.OrderID)
+	}
+}
+
+// sendRenewalReminder отправляет покупателю напоминание о продлении. Возвращает false, если не удалось
+func (h *Handler) sendRenewalReminder(sub models.Subscription, canRenew bool) bool {
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+
+	text := fmt.Sprintf(
+		"⏳ <b>Подписка скоро закончится</b>\n\n"+
+			"🎮 %s\n"+
+			"📦 Заказ №: <code>%s</code>\n"+
+			"📅 Действует до: %s (МСК)\n\n",
+		html.EscapeString(sub.ProductName),
+		sub.OrderID,
+		sub.ExpiresAt.In(moscowLocation).Format("02.01.2006 15:04"),
+	)
+	if canRenew {
+		text += "Продлите заранее, чтобы не прерывать игру: кнопка ниже оформит такой же заказ."
+	} else {
+		text += "Этот товар больше не продается. Выберите подписку в каталоге: /start"
+	}
+
+	msg := tgbotapi.NewMessage(sub.UserID, text)
+	msg.ParseMode = "HTML"
+	if canRenew {
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔁 Продлить", fmt.Sprintf("%s:%s:%d", CallbackActionRenew, sub.OrderID, sub.ProductID)),
+			),
+		)
+	}
+
+	if _, err := h.bot.Send(msg); err != nil {
+		log.Printf("Error sending renewal reminder to %d: %v", sub.UserID, err)
+		return false
+	}
+	return true
+}
+
+// handleRenew оформляет продление: такой же заказ на товар подписки тем же способом оплаты.
+// Если прежний способ больше недоступен, предлагает выбрать другой
+func (h *Handler) handleRenew(query *tgbotapi.CallbackQuery, orderID string, productID int) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	chatID := query.Message.Chat.ID
+
+	previous, ok := h.userOrder(ctx, query, orderID)
+	if !ok {
+		return
+	}
+
+	items, err := h.storage.GetOrderItems(ctx, previous.OrderID)
+	if err != nil {
+		log.Printf("Error fetching items of order %s: %v", previous.OrderID, err)
+		h.sendMessage(chatID, "❌ Ошибка при загрузке заказа.")
+		return
+	}
+	if !orderHasProduct(items, productID) {
+		h.sendMessage(chatID, "❌ Заказ не найден.")
+		return
+	}
+
+	product, err := h.storage.GetProductByID(ctx, productID)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		h.sendOrderError(chatID, storage.ErrProductUnavailable)
+		return
+	case err != nil:
+		log.Printf("Error fetching product: %v", err)
+		h.sendMessage(chatID, "❌ Ошибка при загрузке товара.")
+		return
+	case !product.IsVisible || !product.Price.IsPositive():
+		h.sendOrderError(chatID, storage.ErrProductUnavailable)
+		return
+	}
+
+	methods, err := h.paymentMethodsFor(ctx, product)
+	if err != nil {
+		log.Printf("Error fetching payment methods: %v", err)
+		h.sendMessage(chatID, "❌ Ошибка при загрузке товара.")
+		return
+	}
+
+	method, ok := renewalMethod(methods, previous.PaymentMethod)
+	if !ok {
+		if len(methods) == 0 {
+			h.sendMessage(chatID, "❌ Для этого товара сейчас нет доступных способов оплаты. Обратитесь к администратору.")
+			return
+		}
+		h.showPaymentMethods(query, product, methods)
+		return
+	}
+
+	if !h.inStock(ctx, product.ID, 1) {
+		h.sendMessage(chatID, "❌ Товар закончился. Загляните позже.")
+		return
+	}
+	if !h.checkPendingOrders(ctx, chatID, query.From.ID, product.ID, method) {
+		return
+	}
+
+	// Продление оформляется сразу, без вопроса о промокоде
+	if err := h.placeOrder(ctx, chatID, query.From, product.ID, method, ""); err != nil {
+		h.sendOrderError(chatID, err)
+	}
+}
+
+// renewalMethod выбирает способ оплаты продления: прежний, если он еще доступен, или единственный доступный
+func renewalMethod(methods []payment.Method, previous string) (payment.Method, bool) {
+	for _, method := range methods {
+		if method.Code() == previous {
+			return method, true
+		}
+	}
+	if len(methods) == 1 {
+		return methods[0], true
+	}
+	return nil, false
+}
+
+// orderHasProduct сообщает, есть ли товар среди позиций заказа
+func orderHasProduct(items []models.OrderItem, productID int) bool {
+	for _, item := range items {
+		if item.ProductID == productID {
+			return true
+		}
+	}
+	return false
+}
+
+// orderSubscriptionExpiry возвращает строки с окончанием подписок выполненного заказа для карточки заказа
+func (h *Handler) orderSubscriptionExpiry(ctx context.Context, order *models.Order, loc *time.Location) string {
+	if order.Status != models.OrderStatusCompleted {
+		return ""
+	}
+
+	items, err := h.storage.GetOrderItems(ctx, order.OrderID)
+	if err != nil {
+		log.Printf("Error fetching items of order %s: %v", order.OrderID, err)
+		return ""
+	}
+	return formatSubscriptionExpiry(items, loc)
+}
+
+// formatSubscriptionExpiry перечисляет окончание подписок заказа по одной на строку.
+// Пустая строка - в заказе нет подписок с известным сроком
+func formatSubscriptionExpiry(items []models.OrderItem, loc *time.Location) string {
+	var withExpiry []models.OrderItem
+	for _, item := range items {
+		if item.ExpiresAt != nil {
+			withExpiry = append(withExpiry, item)
+		}
+	}
+
+	var b strings.Builder
+	for _, item := range withExpiry {
+		b.WriteString("📅 Подписка до: " + item.ExpiresAt.In(loc).Format("02.01.2006"))
+		if len(withExpiry) > 1 {
+			b.WriteString(" - " + html.EscapeString(item.ProductName))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// formatDurationMonths показывает срок подписки товара для админа
+func formatDurationMonths(months int) string {
+	if months == 0 {
+		return "не подписка"
+	}
+	return fmt.Sprintf("%d мес.", months)
+}
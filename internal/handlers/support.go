@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/fsm"
+	"tgwow/internal/models"
+	"tgwow/internal/storage"
+)
+
+// handleStartSupport открывает переписку покупателя с админами по заказу: следующие сообщения
+// покупателя пересылаются админам, пока он не выйдет командой /cancel
+func (h *Handler) handleStartSupport(query *tgbotapi.CallbackQuery, orderID string) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, ok := h.userOrder(ctx, query, orderID)
+	if !ok {
+		return
+	}
+
+	h.fsmManager.SetOrderState(query.From.ID, fsm.StateWritingSupport, order.OrderID)
+
+	if err := h.sendHTML(query.Message.Chat.ID, fmt.Sprintf(
+		"💬 <b>Переписка по заказу</b> <code>%s</code>\n\n"+
+			"Напишите вопрос одним или несколькими сообщениями - администратор ответит здесь же.\n\n"+
+			"Чтобы выйти из переписки, используйте /cancel",
+		order.OrderID,
+	)); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
+
+// handleSupportInput пересылает админам сообщение покупателя из открытой переписки
+func (h *Handler) handleSupportInput(msg *tgbotapi.Message, userState *fsm.UserState) {
+	orderID := userState.OrderID()
+
+	if msg.IsCommand() {
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf(
+			"💬 Сейчас открыта переписка по заказу %s.\n\nЧтобы выйти из нее, используйте /cancel",
+			orderID,
+		))
+		return
+	}
+
+	text, ok := h.readSupportText(msg)
+	if !ok {
+		return
+	}
+
+	// Переписка остается открытой, пока покупатель пишет
+	h.fsmManager.SetOrderState(msg.From.ID, fsm.StateWritingSupport, orderID)
+
+	if h.relayToAdmins(msg.From, orderID, text) {
+		h.sendMessage(msg.Chat.ID, "✅ Сообщение отправлено администратору. Ответ придет в этот чат.\n\nЧтобы выйти из переписки, используйте /cancel")
+	}
+}
+
+// handleSupportReply продолжает переписку, если msg - ответ (reply) на сообщение переписки:
+// ответ админа уходит покупателю, ответ покупателя - админам. Возвращает false, если это не переписка
+func (h *Handler) handleSupportReply(msg *tgbotapi.Message) bool {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	original, err := h.storage.GetSupportMessageByRelay(ctx, msg.Chat.ID, msg.ReplyToMessage.MessageID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Error fetching support relay: %v", err)
+		return false
+	}
+
+	text, ok := h.readSupportText(msg)
+	if !ok {
+		return true
+	}
+
+	switch {
+	case h.isAdmin(msg.From.ID):
+		h.replyToUser(msg.From, original, text)
+	case msg.From.ID == original.UserID:
+		if h.relayToAdmins(msg.From, original.OrderID, text) {
+			h.sendMessage(msg.Chat.ID, "✅ Сообщение отправлено администратору.")
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+// readSupportText проверяет текст сообщения переписки. При ошибке объясняет, что не так
+func (h *Handler) readSupportText(msg *tgbotapi.Message) (string, bool) {
+	text := strings.TrimSpace(msg.Text)
+	if text == "" {
+		h.sendMessage(msg.Chat.ID, "❌ В переписке можно отправлять только текст.")
+		return "", false
+	}
+	if utf8.RuneCountInString(text) > MaxSupportMessageLength {
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf("❌ Сообщение слишком длинное (максимум %d символов).", MaxSupportMessageLength))
+		return "", false
+	}
+	return text, true
+}
+
+// relayToAdmins сохраняет сообщение покупателя и пересылает его всем админам с номером заказа
+func (h *Handler) relayToAdmins(user *tgbotapi.User, orderID, text string) bool {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	saved, err := h.storage.AddSupportMessage(ctx, models.SupportMessage{OrderID: orderID, UserID: user.ID, Text: text})
+	if err != nil {
+		log.Printf("Error saving support message for order %s: %v", orderID, err)
+		h.sendMessage(user.ID, "❌ Не удалось отправить сообщение. Попробуйте позже.")
+		return false
+	}
+
+	adminText := fmt.Sprintf(
+		"💬 <b>Сообщение по заказу</b> <code>%s</code>\n"+
+			"👤 %s (ID: %d)\n\n"+
+			"%s\n\n"+
+			"<i>Ответьте на это сообщение (reply), чтобы написать покупателю.</i>",
+		orderID, html.EscapeString(getUserDisplayName(user)), user.ID, html.EscapeString(text),
+	)
+	h.sendSupportCopies(h.adminChatIDs, adminText, saved.ID)
+
+	log.Printf("Support message %d for order %s relayed from user %d", saved.ID, orderID, user.ID)
+	return true
+}
+
+// replyToUser сохраняет ответ админа, отправляет его покупателю и показывает остальным админам
+func (h *Handler) replyToUser(admin *tgbotapi.User, original *models.SupportMessage, text string) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	saved, err := h.storage.AddSupportMessage(ctx, models.SupportMessage{
+		OrderID: original.OrderID,
+		UserID:  original.UserID,
+		AdminID: admin.ID,
+		Text:    text,
+	})
+	if err != nil {
+		log.Printf("Error saving support reply for order %s: %v", original.OrderID, err)
+		h.sendMessage(admin.ID, "❌ Не удалось отправить ответ. Попробуйте позже.")
+		return
+	}
+
+	if !h.sendSupportCopies([]int64{original.UserID}, fmt.Sprintf(
+		"💬 <b>Ответ по заказу</b> <code>%s</code>\n\n"+
+			"%s\n\n"+
+			"<i>Чтобы продолжить, ответьте на это сообщение (reply).</i>",
+		original.OrderID, html.EscapeString(text),
+	), saved.ID) {
+		h.sendMessage(admin.ID, "❌ Не удалось доставить ответ покупателю: возможно, он заблокировал бота.")
+		return
+	}
+
+	// Остальные админы видят ответ и могут продолжить переписку с того же места
+	var others []int64
+	for _, adminID := range h.adminChatIDs {
+		if adminID != admin.ID {
+			others = append(others, adminID)
+		}
+	}
+	h.sendSupportCopies(others, fmt.Sprintf(
+		"↪️ <b>%s ответил по заказу</b> <code>%s</code>\n\n%s",
+		html.EscapeString(getUserDisplayName(admin)), original.OrderID, html.EscapeString(text),
+	), saved.ID)
+
+	h.sendMessage(admin.ID, "✅ Ответ отправлен покупателю.")
+	log.Printf("Support reply %d for order %s sent by admin %d", saved.ID, original.OrderID, admin.ID)
+}
+
+// sendSupportCopies отправляет сообщение переписки в чаты и запоминает копии, чтобы ответ на любую
+// из них продолжал переписку. Возвращает false, если не удалось доставить ни одной копии
+func (h *Handler) sendSupportCopies(chatIDs []int64, text string, supportMessageID int64) bool {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	delivered := false
+	for _, chatID := range chatIDs {
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ParseMode = "HTML"
+
+		sent, err := h.bot.Send(msg)
+		if err != nil {
+			log.Printf("Error sending support message to %d: %v", chatID, err)
+			continue
+		}
+		delivered = true
+
+		if err := h.storage.SaveSupportRelay(ctx, chatID, sent.MessageID, supportMessageID); err != nil {
+			log.Printf("Error saving support relay: %v", err)
+		}
+	}
+	return delivered
+}
+
+// handleAdminSupportThread показывает админу переписку по заказу: /support НОМЕР_ЗАКАЗА
+func (h *Handler) handleAdminSupportThread(msg *tgbotapi.Message) {
+	if !h.isAdmin(msg.From.ID) {
+		h.sendMessage(msg.Chat.ID, "❌ У вас нет доступа к этой команде.")
+		return
+	}
+
+	orderID := strings.ToUpper(strings.TrimSpace(msg.CommandArguments()))
+	if orderID == "" {
+		h.sendMessage(msg.Chat.ID, "❌ Укажите номер заказа: /support WOW2412040012")
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	thread, err := h.storage.GetSupportThread(ctx, orderID)
+	if err != nil {
+		log.Printf("Error fetching support thread: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при загрузке переписки.")
+		return
+	}
+	if len(thread) == 0 {
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf("💬 По заказу %s переписки нет.", orderID))
+		return
+	}
+
+	text := fmt.Sprintf("💬 <b>Переписка по заказу</b> <code>%s</code>\n", orderID)
+	if len(thread) > SupportThreadLimit {
+		text += fmt.Sprintf("Последние %d из %d сообщений\n", SupportThreadLimit, len(thread))
+		thread = thread[len(thread)-SupportThreadLimit:]
+	}
+	text += "\n" + formatSupportThread(thread)
+
+	if err := h.sendHTML(msg.Chat.ID, text); err != nil {
+		log.Printf("Error sending support thread: %v", err)
+	}
+}
+
+// formatSupportThread перечисляет сообщения переписки: кто и когда написал
+func formatSupportThread(thread []models.SupportMessage) string {
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+
+	var b strings.Builder
+	for _, m := range thread {
+		author := fmt.Sprintf("👤 Покупатель %d", m.UserID)
+		if m.AdminID != 0 {
+			author = fmt.Sprintf("🛡 Админ %d", m.AdminID)
+		}
+		fmt.Fprintf(&b, "<b>%s</b>, %s\n%s\n\n",
+			author,
+			m.CreatedAt.In(moscowLocation).Format("02.01 15:04"),
+			html.EscapeString(truncateRunes(m.Text, SupportPreviewLength)),
+		)
+	}
+	return b.String()
+}
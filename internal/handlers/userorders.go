@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/models"
+	"tgwow/internal/storage"
+)
+
+// handleMyOrders обрабатывает команду /my_orders: первая страница заказов пользователя
+func (h *Handler) handleMyOrders(msg *tgbotapi.Message) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	text, keyboard, err := h.buildMyOrdersPage(ctx, msg.From.ID, 0)
+	if err != nil {
+		log.Printf("Error fetching user orders: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при загрузке заказов.")
+		return
+	}
+
+	response := tgbotapi.NewMessage(msg.Chat.ID, text)
+	response.ParseMode = "HTML"
+	if keyboard != nil {
+		response.ReplyMarkup = *keyboard
+	}
+
+	if _, err := h.bot.Send(response); err != nil {
+		log.Printf("Error sending my orders: %v", err)
+	}
+}
+
+// handleMyOrdersPage показывает другую страницу заказов в том же сообщении
+func (h *Handler) handleMyOrdersPage(query *tgbotapi.CallbackQuery, page int) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	text, keyboard, err := h.buildMyOrdersPage(ctx, query.From.ID, page)
+	if err != nil {
+		log.Printf("Error fetching user orders: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при загрузке заказов.")
+		return
+	}
+
+	h.editMyOrdersMessage(query, text, keyboard)
+}
+
+// buildMyOrdersPage формирует страницу списка заказов: по кнопке на заказ и переход между страницами.
+// Без заказов клавиатуры нет
+func (h *Handler) buildMyOrdersPage(ctx context.Context, userID int64, page int) (string, *tgbotapi.InlineKeyboardMarkup, error) {
+	if page < 0 {
+		page = 0
+	}
+
+	// Лишний заказ показывает, есть ли следующая страница
+	orders, err := h.storage.GetUserOrders(ctx, userID, page*MyOrdersPageSize, MyOrdersPageSize+1)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(orders) == 0 && page == 0 {
+		return "📦 У вас пока нет заказов.\n\nИспользуйте /products чтобы посмотреть каталог подписок.", nil, nil
+	}
+
+	hasNext := len(orders) > MyOrdersPageSize
+	if hasNext {
+		orders = orders[:MyOrdersPageSize]
+	}
+
+	// Состав всех заказов одним запросом (решение N+1 проблемы)
+	titles := h.orderTitles(ctx, orders)
+
+	text := "📋 <b>Ваши заказы</b>"
+	if page > 0 || hasNext {
+		text += fmt.Sprintf(" (страница %d)", page+1)
+	}
+	text += "\n\n"
+
+	// Load Moscow timezone once for all orders
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for i, order := range orders {
+		text += fmt.Sprintf(
+			"%s <b>Заказ №%d</b>\n"+
+				"🆔 <code>%s</code>\n"+
+				"🎮 %s\n"+
+				"💰 %s\n"+
+				"📊 Статус: %s\n"+
+				"📅 %s (МСК)\n\n",
+			StatusEmojis[order.Status],
+			page*MyOrdersPageSize+i+1,
+			order.OrderID,
+			titles[order.OrderID],
+			order.Price,
+			StatusTexts[order.Status],
+			order.CreatedAt.In(moscowLocation).Format("02.01.2006 15:04"),
+		)
+
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("%s %s - %s", StatusEmojis[order.Status], order.OrderID, order.Price),
+				fmt.Sprintf("%s:%s:%d", CallbackActionMyOrder, order.OrderID, page),
+			),
+		))
+	}
+	text += "Нажмите на заказ, чтобы открыть подробности."
+
+	var nav []tgbotapi.InlineKeyboardButton
+	if page > 0 {
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("⬅️ Новее", fmt.Sprintf("%s:%d", CallbackActionMyOrders, page-1)))
+	}
+	if hasNext {
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("Старше ➡️", fmt.Sprintf("%s:%d", CallbackActionMyOrders, page+1)))
+	}
+	if len(nav) > 0 {
+		keyboard = append(keyboard, nav)
+	}
+
+	markup := tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	return text, &markup, nil
+}
+
+// handleMyOrder показывает карточку заказа покупателя: состав, оплату и историю статусов.
+// page - страница списка, на которую вернет кнопка «Назад»
+func (h *Handler) handleMyOrder(query *tgbotapi.CallbackQuery, orderID string, page int) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, ok := h.userOrder(ctx, query, orderID)
+	if !ok {
+		return
+	}
+
+	text, keyboard := h.buildOrderCard(ctx, order, page)
+	h.editMyOrdersMessage(query, text, &keyboard)
+}
+
+// userOrder возвращает заказ, только если он принадлежит нажавшему кнопку
+func (h *Handler) userOrder(ctx context.Context, query *tgbotapi.CallbackQuery, orderID string) (*models.Order, bool) {
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil || order.UserID != query.From.ID {
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Error fetching order %s: %v", orderID, err)
+		}
+		h.sendMessage(query.Message.Chat.ID, "❌ Заказ не найден.")
+		return nil, false
+	}
+	return order, true
+}
+
+// buildOrderCard формирует карточку заказа для покупателя
+func (h *Handler) buildOrderCard(ctx context.Context, order *models.Order, page int) (string, tgbotapi.InlineKeyboardMarkup) {
+	moscowLocation, _ := time.LoadLocation("Europe/Moscow")
+
+	methodTitle := order.PaymentMethod
+	if method, ok := h.payments.Get(order.PaymentMethod); ok {
+		methodTitle = method.Title()
+	}
+
+	text := fmt.Sprintf(
+		"%s <b>Заказ</b> <code>%s</code>\n\n"+
+			"🎮 %s\n"+
+			"💰 %s%s%s\n"+
+			"💳 Оплата: %s\n"+
+			"📊 Статус: %s\n",
+		StatusEmojis[order.Status],
+		order.OrderID,
+		html.EscapeString(h.orderTitle(ctx, order)),
+		order.Price, formatPromo(order), formatBalanceUsed(order),
+		html.EscapeString(methodTitle),
+		StatusTexts[order.Status],
+	)
+	text += h.orderSubscriptionExpiry(ctx, order, moscowLocation)
+
+	history, err := h.storage.GetOrderStatusHistory(ctx, order.OrderID)
+	if err != nil {
+		log.Printf("Error fetching status history of order %s: %v", order.OrderID, err)
+	}
+	if len(history) > 0 {
+		text += "\n<b>История:</b>\n" + formatStatusTimeline(history, moscowLocation)
+	}
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	if order.Status == models.OrderStatusCreated {
+		keyboard = append(keyboard,
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("💳 Как оплатить", fmt.Sprintf("%s:%s", CallbackActionOrderPay, order.OrderID)),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("❌ Отменить заказ", fmt.Sprintf("%s:%s:%d", CallbackActionUserCancelOrder, order.OrderID, page)),
+			),
+		)
+	}
+	keyboard = append(keyboard,
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💬 Написать по заказу", fmt.Sprintf("%s:%s", CallbackActionSupport, order.OrderID)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⬅️ К заказам", fmt.Sprintf("%s:%d", CallbackActionMyOrders, page)),
+		),
+	)
+
+	return text, tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+}
+
+// formatStatusTimeline перечисляет изменения статуса заказа по одному на строку
+func formatStatusTimeline(history []models.OrderStatusChange, loc *time.Location) string {
+	var b strings.Builder
+	for _, change := range history {
+		fmt.Fprintf(&b, "%s %s %s",
+			change.CreatedAt.In(loc).Format("02.01 15:04"),
+			StatusEmojis[change.ToStatus],
+			StatusTexts[change.ToStatus],
+		)
+		if change.Reason != "" {
+			fmt.Fprintf(&b, " - %s", html.EscapeString(change.Reason))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// handleOrderPay повторно отправляет инструкцию или счет по неоплаченному заказу
+func (h *Handler) handleOrderPay(query *tgbotapi.CallbackQuery, orderID string) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, ok := h.userOrder(ctx, query, orderID)
+	if !ok {
+		return
+	}
+	if order.Status != models.OrderStatusCreated {
+		h.sendMessage(query.Message.Chat.ID, "⚠️ Заказ уже оплачен или отменен.")
+		return
+	}
+
+	h.resendCheckout(ctx, query.Message.Chat.ID, order)
+}
+
+// resendCheckout повторно отправляет инструкцию или счет по неоплаченному заказу.
+// В отличие от оформления, при ошибке заказ не отменяется
+func (h *Handler) resendCheckout(ctx context.Context, chatID int64, order *models.Order) {
+	method, ok := h.payments.Get(order.PaymentMethod)
+	if !ok {
+		h.sendMessage(chatID, "❌ Этот способ оплаты больше недоступен. Отмените заказ в /my_orders и оформите новый.")
+		return
+	}
+
+	if err := h.sendCheckout(ctx, chatID, order, h.orderTitle(ctx, order), method); err != nil {
+		log.Printf("Error resending checkout for order %s: %v", order.OrderID, err)
+		h.sendMessage(chatID, "❌ Не удалось подготовить оплату. Попробуйте позже или обратитесь к администратору.")
+	}
+}
+
+// handleUserCancelOrder отменяет неоплаченный заказ по просьбе покупателя и обновляет карточку
+func (h *Handler) handleUserCancelOrder(query *tgbotapi.CallbackQuery, orderID string, page int) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, ok := h.userOrder(ctx, query, orderID)
+	if !ok {
+		return
+	}
+
+	// Пока карточка была открыта, заказ могли оплатить или отменить по таймауту
+	err := h.storage.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusCancelled, query.From.ID, "Отменен покупателем")
+	if errors.Is(err, storage.ErrInvalidTransition) {
+		h.sendMessage(query.Message.Chat.ID, "⚠️ Заказ уже оплачен или отменен.")
+	} else if err != nil {
+		log.Printf("Error cancelling order %s: %v", order.OrderID, err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Ошибка при отмене заказа. Попробуйте позже.")
+		return
+	} else {
+		if err := h.storage.ReviewOrderReceipts(ctx, order.OrderID, models.ReceiptStatusRejected, query.From.ID); err != nil {
+			log.Printf("Error rejecting receipts: %v", err)
+		}
+
+		h.notifyAdmins(fmt.Sprintf(
+			"🚫 <b>Покупатель отменил заказ</b>\n\n"+
+				"📦 <b>Заказ №:</b> <code>%s</code>\n"+
+				"👤 <b>Пользователь:</b> @%s (ID: %d)\n"+
+				"💰 <b>Сумма:</b> %s",
+			order.OrderID, query.From.UserName, query.From.ID, order.Price,
+		))
+		log.Printf("Order %s cancelled by user %d", order.OrderID, query.From.ID)
+	}
+
+	fresh, err := h.storage.GetOrderByID(ctx, order.OrderID)
+	if err != nil {
+		log.Printf("Error fetching order %s: %v", order.OrderID, err)
+		return
+	}
+
+	text, keyboard := h.buildOrderCard(ctx, fresh, page)
+	h.editMyOrdersMessage(query, text, &keyboard)
+}
+
+// editMyOrdersMessage заменяет текст и кнопки сообщения со списком или карточкой заказа
+func (h *Handler) editMyOrdersMessage(query *tgbotapi.CallbackQuery, text string, keyboard *tgbotapi.InlineKeyboardMarkup) {
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	edit.ParseMode = "HTML"
+	edit.ReplyMarkup = keyboard
+
+	if _, err := h.bot.Send(edit); err != nil {
+		log.Printf("Error editing my orders message: %v", err)
+	}
+}
@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"tgwow/internal/fsm"
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+	"tgwow/internal/storage"
+)
+
+// Ключи данных FSM: кому и на сколько админ меняет бонусный баланс
+const (
+	stateKeyBalanceUserID = "balance_user_id"
+	stateKeyBalanceAmount = "balance_amount"
+)
+
+// balanceAdjustUsage - подсказка по команде /balance_adjust
+const balanceAdjustUsage = "Формат: <code>/balance_adjust USER_ID СУММА</code>\n\n" +
+	"СУММА - с валютой и знаком: <code>500RUB</code> начислит, <code>-500RUB</code> спишет.\n" +
+	"Причину бот спросит следующим сообщением."
+
+// offerBalance предлагает покупателю оплатить новый заказ бонусным балансом. Возвращает false, если
+// баланса в валюте заказа нет - тогда инструкцию по оплате нужно отправить сразу
+func (h *Handler) offerBalance(ctx context.Context, chatID int64, order *models.Order) bool {
+	balance, err := h.storage.GetBalance(ctx, order.UserID)
+	if err != nil {
+		log.Printf("Error fetching balance of user %d: %v", order.UserID, err)
+		return false
+	}
+
+	var available money.Money
+	for _, b := range balance {
+		if b.Currency == order.Price.Currency {
+			available = b
+		}
+	}
+	if !available.IsPositive() {
+		return false
+	}
+
+	text := fmt.Sprintf(
+		"💰 На бонусном балансе %s\n\n"+
+			"📦 Заказ №: <code>%s</code>\n"+
+			"К оплате: %s\n\n"+
+			"Списать бонусы в счет заказа?",
+		available, order.OrderID, order.Price,
+	)
+	if available.Amount >= order.Price.Amount {
+		text += "\nБаланса хватит на весь заказ."
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "HTML"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💰 Списать с баланса", CallbackActionBalanceUse+":"+order.OrderID),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💳 Оплатить без баланса", CallbackActionBalanceSkip+":"+order.OrderID),
+		),
+	)
+
+	if _, err := h.bot.Send(msg); err != nil {
+		log.Printf("Error offering balance for order %s: %v", order.OrderID, err)
+		return false
+	}
+	return true
+}
+
+// handleBalanceUse списывает бонусный баланс в счет заказа. Если баланса хватило, заказ оплачен,
+// иначе покупатель получает инструкцию на оставшуюся сумму
+func (h *Handler) handleBalanceUse(query *tgbotapi.CallbackQuery, orderID string) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, err := h.storage.ApplyBalance(ctx, orderID, query.From.ID)
+	switch {
+	case errors.Is(err, storage.ErrInsufficientBalance):
+		h.removeButtons(query)
+		h.sendMessage(query.Message.Chat.ID, "⚠️ На балансе больше нет бонусов в валюте заказа.")
+		h.continueCheckout(ctx, query, orderID)
+		return
+	case errors.Is(err, storage.ErrInvalidTransition):
+		h.removeButtons(query)
+		h.sendMessage(query.Message.Chat.ID, "⚠️ Заказ уже оплачен или отменен.")
+		return
+	case errors.Is(err, storage.ErrNotFound):
+		h.sendMessage(query.Message.Chat.ID, "❌ Заказ не найден.")
+		return
+	case err != nil:
+		log.Printf("Error applying balance to order %s: %v", orderID, err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Не удалось списать бонусы. Попробуйте позже.")
+		return
+	}
+
+	h.removeButtons(query)
+	log.Printf("Balance %s applied to order %s by user %d", order.BalanceUsed, order.OrderID, order.UserID)
+
+	if order.Status == models.OrderStatusPaid || order.Status == models.OrderStatusPreordered {
+		h.onOrderPaid(ctx, order)
+		h.notifyAdmins(fmt.Sprintf(
+			"💰 <b>Заказ оплачен с бонусного баланса</b>\n\n"+
+				"📦 <b>Заказ №:</b> <code>%s</code>\n"+
+				"👤 <b>User ID:</b> %d\n"+
+				"🎮 <b>Товар:</b> %s\n"+
+				"💰 <b>Списано:</b> %s",
+			order.OrderID, order.UserID, h.orderTitle(ctx, order), order.BalanceUsed,
+		))
+		return
+	}
+
+	h.sendMessage(query.Message.Chat.ID, fmt.Sprintf(
+		"💰 С баланса списано %s, осталось оплатить %s.",
+		order.BalanceUsed, order.Price,
+	))
+	h.sendOrderCheckout(ctx, query.Message.Chat.ID, order)
+}
+
+// handleBalanceSkip отправляет инструкцию по оплате заказа без списания бонусов
+func (h *Handler) handleBalanceSkip(query *tgbotapi.CallbackQuery, orderID string) {
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	h.removeButtons(query)
+	h.continueCheckout(ctx, query, orderID)
+}
+
+// continueCheckout отправляет инструкцию по оплате заказа, который ждал решения о бонусах
+func (h *Handler) continueCheckout(ctx context.Context, query *tgbotapi.CallbackQuery, orderID string) {
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil || order.UserID != query.From.ID {
+		h.sendMessage(query.Message.Chat.ID, "❌ Заказ не найден.")
+		return
+	}
+	if order.Status != models.OrderStatusCreated {
+		h.sendMessage(query.Message.Chat.ID, "⚠️ Заказ уже оплачен или отменен.")
+		return
+	}
+
+	h.sendOrderCheckout(ctx, query.Message.Chat.ID, order)
+}
+
+// sendOrderCheckout отправляет инструкцию по оплате уже созданного заказа его способом оплаты
+func (h *Handler) sendOrderCheckout(ctx context.Context, chatID int64, order *models.Order) {
+	method, ok := h.payments.Get(order.PaymentMethod)
+	if !ok {
+		h.sendMessage(chatID, "❌ Этот способ оплаты больше недоступен. Оформите заказ заново.")
+		if err := h.storage.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusCancelled, 0, "Способ оплаты отключен"); err != nil {
+			log.Printf("Error cancelling order %s: %v", order.OrderID, err)
+		}
+		return
+	}
+
+	h.sendCheckoutOrCancel(ctx, chatID, order, h.orderTitle(ctx, order), method)
+}
+
+// removeButtons убирает кнопки с сообщения, на котором нажали кнопку
+func (h *Handler) removeButtons(query *tgbotapi.CallbackQuery) {
+	edit := tgbotapi.NewEditMessageReplyMarkup(query.Message.Chat.ID, query.Message.MessageID,
+		tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}})
+	if _, err := h.bot.Request(edit); err != nil {
+		log.Printf("Error removing buttons: %v", err)
+	}
+}
+
+// formatBalanceUsed дописывает к сумме заказа оплату с бонусного баланса
+func formatBalanceUsed(order *models.Order) string {
+	if !order.BalanceUsed.IsPositive() {
+		return ""
+	}
+	return fmt.Sprintf(" + 💰 %s с баланса", order.BalanceUsed)
+}
+
+// handleBalance обрабатывает команду /balance: бонусный баланс и последние операции.
+// Админ может посмотреть баланс пользователя: /balance USER_ID
+func (h *Handler) handleBalance(msg *tgbotapi.Message) {
+	userID := msg.From.ID
+	if arg := strings.TrimSpace(msg.CommandArguments()); arg != "" && h.isAdmin(msg.From.ID) {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || id <= 0 {
+			h.sendMessage(msg.Chat.ID, "❌ Укажите ID пользователя: /balance USER_ID")
+			return
+		}
+		userID = id
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	balance, err := h.storage.GetBalance(ctx, userID)
+	if err != nil {
+		log.Printf("Error fetching balance: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при загрузке баланса.")
+		return
+	}
+
+	ledger, err := h.storage.GetLedger(ctx, userID, LedgerHistoryLimit)
+	if err != nil {
+		log.Printf("Error fetching ledger: %v", err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при загрузке баланса.")
+		return
+	}
+
+	text := "💰 <b>Бонусный баланс</b>"
+	if userID != msg.From.ID {
+		text += fmt.Sprintf(" пользователя %d", userID)
+	}
+	text += "\n\n" + formatRevenue(balance) + "\n\n"
+
+	if len(ledger) == 0 {
+		text += "Операций пока нет. Бонусы начисляются за приглашенных друзей (/referral) и при возвратах."
+	} else {
+		text += "<b>Последние операции:</b>\n" + formatLedger(ledger)
+		if len(balance) > 0 {
+			text += "\nБонусами можно оплатить заказ целиком или частично при оформлении."
+		}
+	}
+
+	if err := h.sendHTML(msg.Chat.ID, text); err != nil {
+		log.Printf("Error sending balance: %v", err)
+	}
+}
+
+// formatLedger перечисляет операции с балансом, по одной на строку
+func formatLedger(ledger []models.LedgerTransaction) string {
+	var b strings.Builder
+	for _, t := range ledger {
+		sign := "+"
+		if t.Amount.IsNegative() {
+			sign = ""
+		}
+
+		kind := LedgerKindTexts[t.Kind]
+		if kind == "" {
+			kind = t.Kind
+		}
+
+		fmt.Fprintf(&b, "%s %s%s - %s", t.CreatedAt.Format("02.01.2006"), sign, t.Amount, kind)
+		if t.OrderID != "" {
+			fmt.Fprintf(&b, " %s", t.OrderID)
+		}
+		if t.Reason != "" {
+			fmt.Fprintf(&b, " (%s)", html.EscapeString(t.Reason))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// handleAdminBalanceAdjust начинает ручное изменение бонусного баланса: /balance_adjust USER_ID СУММА
+func (h *Handler) handleAdminBalanceAdjust(msg *tgbotapi.Message) {
+	if !h.isAdmin(msg.From.ID) {
+		h.sendMessage(msg.Chat.ID, "❌ У вас нет доступа к этой команде.")
+		return
+	}
+
+	userID, amount, err := parseBalanceAdjustArgs(msg.CommandArguments())
+	if err != nil {
+		if err := h.sendHTML(msg.Chat.ID, fmt.Sprintf("❌ %s\n\n%s", err, balanceAdjustUsage)); err != nil {
+			log.Printf("Error sending message: %v", err)
+		}
+		return
+	}
+
+	h.fsmManager.SetState(msg.From.ID, fsm.StateWaitingForBalanceReason, 0)
+	if userState, ok := h.fsmManager.GetState(msg.From.ID); ok {
+		userState.Data[stateKeyBalanceUserID] = userID
+		userState.Data[stateKeyBalanceAmount] = amount
+	}
+
+	action := "Начисление"
+	if amount.IsNegative() {
+		action = "Списание"
+	}
+
+	if err := h.sendHTML(msg.Chat.ID, fmt.Sprintf(
+		"💰 <b>%s бонусов</b>\n\n"+
+			"👤 User ID: %d\n"+
+			"Сумма: %s\n\n"+
+			"Введите причину. Она будет отправлена пользователю и сохранится в истории баланса.\n\n"+
+			"Для отмены используйте /cancel",
+		action, userID, amount,
+	)); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
+
+// parseBalanceAdjustArgs разбирает аргументы /balance_adjust: ID пользователя и сумму со знаком и валютой
+func parseBalanceAdjustArgs(args string) (int64, money.Money, error) {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		return 0, money.Money{}, errors.New("укажите ID пользователя и сумму")
+	}
+
+	userID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || userID <= 0 {
+		return 0, money.Money{}, errors.New("неверный ID пользователя")
+	}
+
+	amount, err := parseAmountWithCurrency(fields[1])
+	if errors.Is(err, money.ErrUnknownCurrency) {
+		return 0, money.Money{}, errors.New("укажите сумму с валютой, например 500RUB")
+	}
+	if err != nil || amount.IsZero() {
+		return 0, money.Money{}, errors.New("неверная сумма")
+	}
+
+	return userID, amount, nil
+}
+
+// handleBalanceReasonInput изменяет баланс с причиной, введенной админом, и сообщает об этом пользователю
+func (h *Handler) handleBalanceReasonInput(msg *tgbotapi.Message, userState *fsm.UserState) {
+	if !h.isAdmin(msg.From.ID) {
+		return
+	}
+
+	reason, ok := h.readReason(msg)
+	if !ok {
+		return
+	}
+
+	userID, _ := userState.Data[stateKeyBalanceUserID].(int64)
+	amount, _ := userState.Data[stateKeyBalanceAmount].(money.Money)
+	h.fsmManager.ClearState(msg.From.ID)
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	t, err := h.storage.AdjustBalance(ctx, userID, amount, msg.From.ID, reason)
+	if errors.Is(err, storage.ErrNotFound) {
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf("❌ Пользователь %d не найден.", userID))
+		return
+	}
+	if errors.Is(err, storage.ErrInsufficientBalance) {
+		h.sendMessage(msg.Chat.ID, "❌ Баланс не может стать отрицательным. Проверьте баланс: /balance "+strconv.FormatInt(userID, 10))
+		return
+	}
+	if err != nil {
+		log.Printf("Error adjusting balance of user %d: %v", userID, err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при изменении баланса.")
+		return
+	}
+
+	h.sendMessage(msg.Chat.ID, fmt.Sprintf("✅ Баланс пользователя %d изменен на %s\nПричина: %s", userID, t.Amount, reason))
+
+	title := "🎁 Вам начислены бонусы"
+	if t.Amount.IsNegative() {
+		title = "💰 С бонусного баланса списано"
+	}
+	if err := h.sendHTML(userID, fmt.Sprintf(
+		"%s: %s\n\n<b>Причина:</b> %s\n\nБаланс: /balance",
+		title, t.Amount, html.EscapeString(reason),
+	)); err != nil {
+		log.Printf("Error notifying user: %v", err)
+	}
+
+	log.Printf("Balance of user %d adjusted by %s by admin %d: %s", userID, t.Amount, msg.From.ID, reason)
+}
+
+// handleAdminStartRefund начинает возврат оплаченного заказа на бонусный баланс покупателя
+func (h *Handler) handleAdminStartRefund(query *tgbotapi.CallbackQuery, orderID string) {
+	if !h.isAdmin(query.From.ID) {
+		return
+	}
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	order, err := h.storage.GetOrderByID(ctx, orderID)
+	if err != nil {
+		log.Printf("Error fetching order: %v", err)
+		h.sendMessage(query.Message.Chat.ID, "❌ Заказ не найден.")
+		return
+	}
+
+	if !models.CanTransitionOrder(order.Status, models.OrderStatusRefunded) {
+		h.sendMessage(query.Message.Chat.ID, fmt.Sprintf(
+			"⚠️ Заказ %s нельзя вернуть: текущий статус - %s.",
+			order.OrderID, StatusTexts[order.Status],
+		))
+		return
+	}
+
+	if !h.checkOrderClaim(ctx, query.Message.Chat.ID, query.From.ID, order.OrderID) {
+		return
+	}
+
+	h.fsmManager.SetOrderState(query.From.ID, fsm.StateWaitingForRefundReason, order.OrderID)
+
+	if err := h.sendHTML(query.Message.Chat.ID, fmt.Sprintf(
+		"↩️ <b>Возврат на бонусный баланс</b>\n\n"+
+			"📦 Заказ №: <code>%s</code>\n"+
+			"👤 User ID: %d\n"+
+			"💰 Вернется: %s\n\n"+
+			"Введите причину. Она будет отправлена покупателю и сохранится в истории заказа.\n\n"+
+			"Для отмены используйте /cancel",
+		order.OrderID, order.UserID, order.Price.Add(order.BalanceUsed),
+	)); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
+
+// handleRefundReasonInput возвращает заказ на бонусный баланс с причиной, введенной админом
+func (h *Handler) handleRefundReasonInput(msg *tgbotapi.Message, userState *fsm.UserState) {
+	if !h.isAdmin(msg.From.ID) {
+		return
+	}
+
+	reason, ok := h.readReason(msg)
+	if !ok {
+		return
+	}
+
+	orderID := userState.OrderID()
+	h.fsmManager.ClearState(msg.From.ID)
+
+	ctx, cancel := h.newDBContext()
+	defer cancel()
+
+	t, err := h.storage.RefundOrderToBalance(ctx, orderID, msg.From.ID, reason)
+	if errors.Is(err, storage.ErrInvalidTransition) {
+		log.Printf("Rejected refund of order %s: %v", orderID, err)
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf("⚠️ Заказ %s уже нельзя вернуть.", orderID))
+		return
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		h.sendMessage(msg.Chat.ID, "❌ Заказ не найден.")
+		return
+	}
+	if err != nil {
+		log.Printf("Error refunding order %s: %v", orderID, err)
+		h.sendMessage(msg.Chat.ID, "❌ Ошибка при возврате заказа.")
+		return
+	}
+
+	h.sendMessage(msg.Chat.ID, fmt.Sprintf("↩️ Заказ %s возвращен: %s на балансе покупателя\nПричина: %s", orderID, t.Amount, reason))
+
+	if err := h.sendHTML(t.UserID, fmt.Sprintf(
+		"↩️ <b>Заказ возвращен</b>\n\n"+
+			"📦 Заказ №: <code>%s</code>\n"+
+			"💰 %s возвращено на бонусный баланс\n\n"+
+			"<b>Причина:</b> %s\n\n"+
+			"Бонусами можно оплатить следующий заказ. Баланс: /balance",
+		orderID, t.Amount, html.EscapeString(reason),
+	)); err != nil {
+		log.Printf("Error notifying user: %v", err)
+	}
+
+	log.Printf("Order %s refunded to balance (%s) by admin %d: %s", orderID, t.Amount, msg.From.ID, reason)
+}
+
+// readReason проверяет причину, введенную админом. При ошибке просит ввести причину заново
+func (h *Handler) readReason(msg *tgbotapi.Message) (string, bool) {
+	reason := strings.TrimSpace(msg.Text)
+	if reason == "" {
+		h.sendMessage(msg.Chat.ID, "❌ Причина не может быть пустой\n\nДля отмены используйте /cancel")
+		return "", false
+	}
+	if utf8.RuneCountInString(reason) > MaxOrderReasonLength {
+		h.sendMessage(msg.Chat.ID, fmt.Sprintf(
+			"❌ Причина слишком длинная (максимум %d символов)\n\nДля отмены используйте /cancel",
+			MaxOrderReasonLength,
+		))
+		return "", false
+	}
+	return reason, true
+}
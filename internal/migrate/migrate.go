@@ -0,0 +1,350 @@
+// Package migrate применяет встроенные SQL-миграции и ведет их учет в таблице schema_migrations
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// advisoryLockKey - ключ pg_advisory_lock, чтобы два экземпляра бота не мигрировали одновременно
+	advisoryLockKey int64 = 7_142_025_001
+
+	// LegacyBaselineVersion - последняя миграция, которую применял docker-entrypoint-initdb.d.
+	// Базы, созданные до появления schema_migrations, помечаются применёнными до этой версии
+	LegacyBaselineVersion = 13
+
+	// legacyMarkerTable - таблица из миграции LegacyBaselineVersion, по которой распознаётся старая база
+	legacyMarkerTable = "broadcast_photos"
+)
+
+// migrationFilePattern разбирает имена вида 014_create_orders.sql и 014_create_orders.down.sql
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_([a-zA-Z0-9_]+?)(\.down)?\.sql$`)
+
+// Migration - одна версия схемы
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string // пустая строка, если откат не предусмотрен
+}
+
+// Status - состояние миграции в базе
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Load читает миграции из файловой системы и сортирует их по версии
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			if strings.HasSuffix(entry.Name(), ".sql") {
+				return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+			}
+			continue
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", entry.Name(), err)
+		}
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", entry.Name(), err)
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("duplicate migration version %03d: %s and %s", version, m.Name, match[2])
+		}
+
+		isDown := match[3] != ""
+		switch {
+		case isDown && m.Down != "":
+			return nil, fmt.Errorf("duplicate down migration for version %03d", version)
+		case isDown:
+			m.Down = string(content)
+		case m.Up != "":
+			return nil, fmt.Errorf("duplicate migration version %03d", version)
+		default:
+			m.Up = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %03d_%s has a down file but no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Migrator применяет миграции к PostgreSQL
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+// New загружает миграции из fsys и создает Migrator
+func New(pool *pgxpool.Pool, fsys fs.FS) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{pool: pool, migrations: migrations}, nil
+}
+
+// Up применяет все неприменённые миграции и возвращает их список
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+
+			if err := m.apply(ctx, conn, migration); err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down откатывает последние steps применённых миграций и возвращает их список
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	if steps <= 0 {
+		return nil, fmt.Errorf("steps must be positive, got %d", steps)
+	}
+
+	var reverted []Migration
+
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := done[migration.Version]; !ok {
+				continue
+			}
+
+			if migration.Down == "" {
+				return fmt.Errorf("migration %03d_%s cannot be reverted: no down file", migration.Version, migration.Name)
+			}
+
+			if err := m.revert(ctx, conn, migration); err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Status возвращает состояние всех известных миграций
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			appliedAt, ok := done[migration.Version]
+			statuses = append(statuses, Status{Migration: migration, Applied: ok, AppliedAt: appliedAt})
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// withLock выполняет fn на выделенном соединении под advisory lock.
+// Перед этим создаёт schema_migrations и переносит учёт для баз, созданных initdb-скриптами
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", advisoryLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer func() {
+		// Используем отдельный контекст: исходный мог быть уже отменён
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn.Exec(unlockCtx, "SELECT pg_advisory_unlock($1)", advisoryLockKey)
+	}()
+
+	if err := ensureTable(ctx, conn); err != nil {
+		return err
+	}
+
+	if err := m.baselineLegacy(ctx, conn); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// ensureTable создает таблицу учета миграций
+func ensureTable(ctx context.Context, conn *pgxpool.Conn) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`
+
+	if _, err := conn.Exec(ctx, query); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	return nil
+}
+
+// baselineLegacy помечает миграции 001-013 применёнными, если база была создана
+// docker-entrypoint-initdb.d и schema_migrations еще пуста. Иначе 006 пересоздала бы products
+func (m *Migrator) baselineLegacy(ctx context.Context, conn *pgxpool.Conn) error {
+	var count int
+	if err := conn.QueryRow(ctx, "SELECT COUNT(*) FROM schema_migrations").Scan(&count); err != nil {
+		return fmt.Errorf("failed to count applied migrations: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	var legacy bool
+	if err := conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", "public."+legacyMarkerTable).Scan(&legacy); err != nil {
+		return fmt.Errorf("failed to detect legacy schema: %w", err)
+	}
+	if !legacy {
+		return nil
+	}
+
+	for _, migration := range m.migrations {
+		if migration.Version > LegacyBaselineVersion {
+			break
+		}
+		if _, err := conn.Exec(ctx,
+			"INSERT INTO schema_migrations (version, name) VALUES ($1, $2) ON CONFLICT (version) DO NOTHING",
+			migration.Version, migration.Name,
+		); err != nil {
+			return fmt.Errorf("failed to baseline migration %03d: %w", migration.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// appliedVersions возвращает версии применённых миграций и время их применения
+func appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[int]time.Time, error) {
+	rows, err := conn.Query(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	done := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan migration version: %w", err)
+		}
+		done[version] = appliedAt
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return done, nil
+}
+
+// apply выполняет миграцию и записывает её версию в одной транзакции
+func (m *Migrator) apply(ctx context.Context, conn *pgxpool.Conn, migration Migration) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, migration.Up); err != nil {
+			return fmt.Errorf("failed to apply migration %03d_%s: %w", migration.Version, migration.Name, err)
+		}
+
+		if _, err := tx.Exec(ctx,
+			"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+			migration.Version, migration.Name,
+		); err != nil {
+			return fmt.Errorf("failed to record migration %03d: %w", migration.Version, err)
+		}
+
+		return nil
+	})
+}
+
+// revert откатывает миграцию и удаляет её версию в одной транзакции
+func (m *Migrator) revert(ctx context.Context, conn *pgxpool.Conn, migration Migration) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, migration.Down); err != nil {
+			return fmt.Errorf("failed to revert migration %03d_%s: %w", migration.Version, migration.Name, err)
+		}
+
+		if _, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", migration.Version); err != nil {
+			return fmt.Errorf("failed to unrecord migration %03d: %w", migration.Version, err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"tgwow/migrations"
+)
+
+func TestLoad_SortsAndPairsDownFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"002_second.sql":      {Data: []byte("CREATE TABLE b ();")},
+		"001_first.sql":       {Data: []byte("CREATE TABLE a ();")},
+		"002_second.down.sql": {Data: []byte("DROP TABLE b;")},
+		"embed.go":            {Data: []byte("package migrations")},
+	}
+
+	got, err := Load(fsys)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("Load() returned %d migrations, want 2", len(got))
+	}
+	if got[0].Version != 1 || got[0].Name != "first" || got[0].Down != "" {
+		t.Errorf("first migration = %+v", got[0])
+	}
+	if got[1].Version != 2 || got[1].Down != "DROP TABLE b;" {
+		t.Errorf("second migration = %+v", got[1])
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		wantErr string
+	}{
+		{
+			name: "Duplicate version",
+			fsys: fstest.MapFS{
+				"001_a.sql": {Data: []byte("SELECT 1;")},
+				"001_b.sql": {Data: []byte("SELECT 1;")},
+			},
+			wantErr: "duplicate migration version",
+		},
+		{
+			name: "Down without up",
+			fsys: fstest.MapFS{
+				"001_a.down.sql": {Data: []byte("SELECT 1;")},
+			},
+			wantErr: "no up file",
+		},
+		{
+			name: "Bad file name",
+			fsys: fstest.MapFS{
+				"create_users.sql": {Data: []byte("SELECT 1;")},
+			},
+			wantErr: "invalid migration file name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.fsys)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoad_EmbeddedMigrations(t *testing.T) {
+	got, err := Load(migrations.FS)
+	if err != nil {
+		t.Fatalf("Load(migrations.FS) error = %v", err)
+	}
+
+	if len(got) < LegacyBaselineVersion {
+		t.Fatalf("got %d embedded migrations, want at least %d", len(got), LegacyBaselineVersion)
+	}
+
+	// Версии должны идти подряд, без пропусков
+	for i, m := range got {
+		if m.Version != i+1 {
+			t.Fatalf("migration #%d has version %d, want %d", i, m.Version, i+1)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package models
 
 import (
+	"strconv"
 	"time"
+
+	"tgwow/internal/money"
 )
 
 type Region struct {
-	ID        int       `json:"id"`
-	Name      string    `json:"name"`
-	Code      string    `json:"code"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        int            `json:"id"`
+	Name      string         `json:"name"`
+	Code      string         `json:"code"`
+	Currency  money.Currency `json:"currency"` // валюта цен товаров региона
+	CreatedAt time.Time      `json:"created_at"`
 }
 
 type Category struct {
@@ -21,25 +25,181 @@ type Category struct {
 }
 
 type Product struct {
-	ID          int       `json:"id"`
-	Name        string    `json:"name"`
-	CategoryID  int       `json:"category_id"`
-	Price       float64   `json:"price"`
-	Description string    `json:"description"`
-	IsVisible   bool      `json:"is_visible"`
-	SortOrder   int       `json:"sort_order"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID             int         `json:"id"`
+	Name           string      `json:"name"`
+	CategoryID     int         `json:"category_id"`
+	Price          money.Money `json:"price"`
+	Description    string      `json:"description"`
+	IsVisible      bool        `json:"is_visible"`
+	SortOrder      int         `json:"sort_order"`
+	DurationMonths int         `json:"duration_months"` // Срок подписки в месяцах, 0 - не подписка
+	ReleaseAt      *time.Time  `json:"release_at"`      // Дата выхода товара предзаказа, nil - обычный товар
+	CreatedAt      time.Time   `json:"created_at"`
+}
+
+// IsPreorder сообщает, продается ли товар по предзаказу: дата выхода еще не наступила
+func (p Product) IsPreorder(now time.Time) bool {
+	return p.ReleaseAt != nil && p.ReleaseAt.After(now)
 }
 
 type Order struct {
-	OrderID   string    `json:"order_id"`
+	OrderID       string      `json:"order_id"`
+	UserID        int64       `json:"user_id"`
+	ProductID     int         `json:"product_id"` // 0 - заказ из корзины, состав в OrderItem
+	Price         money.Money `json:"price"`      // Итоговая сумма заказа
+	Status        string      `json:"status"`
+	PaymentMethod string      `json:"payment_method"` // Код способа оплаты (см. пакет payment)
+	PromoCode     string      `json:"promo_code"`     // Примененный промокод, пусто - без промокода
+	Discount      money.Money `json:"discount"`       // Скидка по промокоду, уже вычтенная из Price
+	BalanceUsed   money.Money `json:"balance_used"`   // Оплачено с бонусного баланса, уже вычтено из Price
+	AmountOffset  money.Money `json:"amount_offset"`  // Копейки к сумме перевода, по которым заказ находится в выписке банка
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+// TransferAmount - сумма перевода на карту: цена заказа с уникальными копейками
+func (o Order) TransferAmount() money.Money {
+	return o.Price.Add(o.AmountOffset)
+}
+
+// OrderFilter - условия выборки заказов в админке. Пустое поле не ограничивает выборку
+type OrderFilter struct {
+	Status   string
+	RegionID int        // Регион товаров заказа
+	From     *time.Time // Созданные не раньше
+	Until    *time.Time // Созданные раньше
+	UserID   int64
+}
+
+// OrderItem - позиция заказа. Название и цена фиксируются на момент оформления
+type OrderItem struct {
+	ID             int64       `json:"id"`
+	OrderID        string      `json:"order_id"`
+	ProductID      int         `json:"product_id"` // 0 - товар удален
+	ProductName    string      `json:"product_name"`
+	Price          money.Money `json:"price"` // Цена за единицу
+	Quantity       int         `json:"quantity"`
+	DurationMonths int         `json:"duration_months"` // Срок подписки на единицу в месяцах, 0 - не подписка
+	ExpiresAt      *time.Time  `json:"expires_at"`      // Окончание подписки, nil - заказ не выполнен или не подписка
+}
+
+// Total возвращает стоимость позиции с учетом количества
+func (i OrderItem) Total() money.Money {
+	return i.Price.Mul(int64(i.Quantity))
+}
+
+// CartItem - товар в корзине покупателя
+type CartItem struct {
 	UserID    int64     `json:"user_id"`
 	ProductID int       `json:"product_id"`
-	Price     float64   `json:"price"`
+	Quantity  int       `json:"quantity"`
+	AddedAt   time.Time `json:"added_at"`
+}
+
+// PromoCode - промокод на скидку. Область действия задается товаром, категорией или регионом,
+// нулевые поля не ограничивают
+type PromoCode struct {
+	ID                int         `json:"id"`
+	Code              string      `json:"code"`
+	Percent           int         `json:"percent"` // Скидка в процентах, 0 - фиксированная скидка Amount
+	Amount            money.Money `json:"amount"`
+	ProductID         int         `json:"product_id"`
+	CategoryID        int         `json:"category_id"`
+	RegionID          int         `json:"region_id"`
+	ValidFrom         *time.Time  `json:"valid_from"`
+	ValidUntil        *time.Time  `json:"valid_until"`
+	MaxUses           int         `json:"max_uses"`          // 0 - без ограничения
+	MaxUsesPerUser    int         `json:"max_uses_per_user"` // 0 - без ограничения
+	FirstPurchaseOnly bool        `json:"first_purchase_only"`
+	IsActive          bool        `json:"is_active"`
+	Uses              int         `json:"uses"` // Заказов с промокодом, кроме отмененных
+	CreatedAt         time.Time   `json:"created_at"`
+}
+
+// Статусы заказа
+const (
+	OrderStatusCreated    = "created"
+	OrderStatusPreordered = "preordered" // Оплачен, ждет выхода товара предзаказа
+	OrderStatusPaid       = "paid"
+	OrderStatusCompleted  = "completed"
+	OrderStatusCancelled  = "cancelled"
+	OrderStatusRefunded   = "refunded"
+)
+
+// orderTransitions - разрешенные переходы между статусами заказа.
+// cancelled и refunded - конечные статусы
+var orderTransitions = map[string][]string{
+	OrderStatusCreated:    {OrderStatusPaid, OrderStatusPreordered, OrderStatusCancelled},
+	OrderStatusPreordered: {OrderStatusPaid, OrderStatusRefunded},
+	OrderStatusPaid:       {OrderStatusCompleted, OrderStatusRefunded},
+	OrderStatusCompleted:  {OrderStatusRefunded},
+}
+
+// CanTransitionOrder сообщает, можно ли перевести заказ из статуса from в статус to
+func CanTransitionOrder(from, to string) bool {
+	for _, allowed := range orderTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderStatusChange - запись истории статусов заказа
+type OrderStatusChange struct {
+	ID         int64     `json:"id"`
+	OrderID    string    `json:"order_id"`
+	FromStatus string    `json:"from_status"` // пустая строка - создание заказа
+	ToStatus   string    `json:"to_status"`
+	ActorID    int64     `json:"actor_id"` // 0 - изменение системой
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// OrderReceipt - чек об оплате, прикрепленный покупателем к заказу
+type OrderReceipt struct {
+	ID        int64     `json:"id"`
+	OrderID   string    `json:"order_id"`
+	UserID    int64     `json:"user_id"`
+	FileID    string    `json:"file_id"`   // file_id Telegram
+	FileType  string    `json:"file_type"` // photo или document (PDF)
 	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Типы файлов чека
+const (
+	ReceiptFilePhoto    = "photo"
+	ReceiptFileDocument = "document"
+)
+
+// Статусы проверки чека
+const (
+	ReceiptStatusPending  = "pending"
+	ReceiptStatusAccepted = "accepted"
+	ReceiptStatusRejected = "rejected"
+)
+
+// ProductKey - ключ (код активации) со склада товара
+type ProductKey struct {
+	ID          int64      `json:"id"`
+	ProductID   int        `json:"product_id"`
+	Code        string     `json:"code"`
+	OrderID     string     `json:"order_id"` // пустая строка - ключ свободен
+	CreatedAt   time.Time  `json:"created_at"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+}
+
+// KeyStock - остаток ключей товара
+type KeyStock struct {
+	Available int `json:"available"`
+	Delivered int `json:"delivered"`
+}
+
+// Tracked сообщает, что товар продается ключами со склада: хотя бы один ключ был загружен
+func (s KeyStock) Tracked() bool {
+	return s.Available+s.Delivered > 0
+}
+
 type BotSettings struct {
 	ID             int       `json:"id"`
 	WelcomeMessage string    `json:"welcome_message"`
@@ -53,10 +213,127 @@ type User struct {
 	FirstName    string    `json:"first_name"`
 	LastName     string    `json:"last_name"`
 	IsBlocked    bool      `json:"is_blocked"`
+	ReferrerID   int64     `json:"referrer_id"` // Кто пригласил пользователя, 0 - пришел сам
 	CreatedAt    time.Time `json:"created_at"`
 	LastActivity time.Time `json:"last_activity"`
 }
 
+// ReferralReward - бонус пригласившему за первый оплаченный заказ приглашенного пользователя
+type ReferralReward struct {
+	ID         int         `json:"id"`
+	ReferrerID int64       `json:"referrer_id"`
+	ReferredID int64       `json:"referred_id"`
+	OrderID    string      `json:"order_id"`
+	Amount     money.Money `json:"amount"` // В валюте заказа
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+// Виды операций бонусного баланса
+const (
+	LedgerKindReferral         = "referral"          // Бонус за приглашенного пользователя
+	LedgerKindRefund           = "refund"            // Возврат оплаченного заказа на баланс
+	LedgerKindAdjustment       = "adjustment"        // Ручное изменение баланса админом
+	LedgerKindCheckout         = "checkout"          // Оплата заказа с баланса
+	LedgerKindCheckoutReversal = "checkout_reversal" // Возврат списания при отмене неоплаченного заказа
+)
+
+// Системные счета бухгалтерской книги. Счет пользователя - UserLedgerAccount
+const (
+	LedgerAccountReferrals   = "system:referrals"   // Откуда начисляются реферальные бонусы
+	LedgerAccountRefunds     = "system:refunds"     // Откуда возвращаются деньги за заказы
+	LedgerAccountAdjustments = "system:adjustments" // Ручные изменения баланса
+	LedgerAccountSales       = "system:sales"       // Куда уходит оплата заказов с баланса
+)
+
+// UserLedgerAccount возвращает счет бонусного баланса пользователя
+func UserLedgerAccount(userID int64) string {
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+// LedgerTransaction - операция бонусного баланса пользователя. Проводки операции хранятся в LedgerEntry
+type LedgerTransaction struct {
+	ID        int64       `json:"id"`
+	Kind      string      `json:"kind"`
+	UserID    int64       `json:"user_id"`
+	OrderID   string      `json:"order_id"` // Пусто - операция не связана с заказом
+	ActorID   int64       `json:"actor_id"` // Админ, 0 - автоматически
+	Reason    string      `json:"reason"`
+	Amount    money.Money `json:"amount"` // Изменение баланса пользователя: + зачисление, - списание
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// LedgerEntry - проводка: изменение одного счета в рамках операции
+type LedgerEntry struct {
+	ID            int64       `json:"id"`
+	TransactionID int64       `json:"transaction_id"`
+	Account       string      `json:"account"`
+	Amount        money.Money `json:"amount"` // + зачисление, - списание
+}
+
+// ReferralStats - реферальная статистика пользователя
+type ReferralStats struct {
+	Referrer *User         `json:"referrer"` // Кто пригласил пользователя, nil - пришел сам
+	Invited  int           `json:"invited"`  // Сколько пользователей пришло по ссылке
+	Rewarded int           `json:"rewarded"` // Сколько из них оплатили первый заказ
+	Rewards  []money.Money `json:"rewards"`  // Начисленные бонусы, по сумме на валюту
+}
+
+// SupportMessage - сообщение переписки покупателя с админами по заказу
+type SupportMessage struct {
+	ID        int64     `json:"id"`
+	OrderID   string    `json:"order_id"`
+	UserID    int64     `json:"user_id"`  // Покупатель, с которым идет переписка
+	AdminID   int64     `json:"admin_id"` // Ответивший админ, 0 - сообщение покупателя
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Subscription - подписка покупателя, срок которой подходит к концу
+type Subscription struct {
+	ItemID      int64     `json:"item_id"` // Позиция заказа с подпиской
+	OrderID     string    `json:"order_id"`
+	UserID      int64     `json:"user_id"`
+	ProductID   int       `json:"product_id"` // 0 - товар удален
+	ProductName string    `json:"product_name"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// OrderClaim - заказ, взятый админом в работу
+type OrderClaim struct {
+	OrderID   string    `json:"order_id"`
+	AdminID   int64     `json:"admin_id"`
+	AdminName string    `json:"admin_name"` // Имя на момент взятия, для уведомлений остальных админов
+	ClaimedAt time.Time `json:"claimed_at"`
+}
+
+// AdminNotification - уведомление админа о новом заказе, отправленное ботом
+type AdminNotification struct {
+	OrderID   string `json:"order_id"`
+	ChatID    int64  `json:"chat_id"`
+	MessageID int    `json:"message_id"`
+	Text      string `json:"text"` // HTML, к нему дописывается, кто взял заказ
+}
+
+// Политики ротации карт для оплаты переводом (PAYOUT_CARD_ROTATION)
+const (
+	PayoutRotationRoundRobin = "round_robin" // Карта, которую дольше всех не выдавали
+	PayoutRotationPriority   = "priority"    // Карты по порядку добавления, следующая - когда исчерпан лимит предыдущей
+)
+
+// PayoutCard - карта для оплаты заказов переводом
+type PayoutCard struct {
+	ID         int         `json:"id"`
+	Number     string      `json:"number"`
+	BankName   string      `json:"bank_name"`
+	Holder     string      `json:"holder"`
+	RegionID   int         `json:"region_id"`   // 0 - все регионы
+	DailyLimit money.Money `json:"daily_limit"` // Сумма заказов на карту за день, 0 - без лимита
+	IsActive   bool        `json:"is_active"`
+	UsedToday  money.Money `json:"used_today"` // Неотмененные заказы на карту за день в валюте лимита
+	LastUsedAt *time.Time  `json:"last_used_at"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
 // Broadcast представляет рассылку
 type Broadcast struct {
 	ID          int        `json:"id"`
@@ -0,0 +1,259 @@
+// Package money хранит денежные суммы в целых минимальных единицах (копейках, тиынах, центах)
+// вместе с кодом валюты, чтобы цены и выручка не накапливали ошибки округления float64
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Currency - код валюты ISO 4217
+type Currency string
+
+// Валюты регионов магазина
+const (
+	RUB Currency = "RUB"
+	KZT Currency = "KZT"
+	UAH Currency = "UAH"
+	EUR Currency = "EUR"
+	TRY Currency = "TRY"
+)
+
+// DefaultCurrency - валюта, в которой исторически заведены цены каталога
+const DefaultCurrency = RUB
+
+// minorDigits - количество знаков после запятой. Все валюты магазина делятся на сотые
+const minorDigits = 2
+
+// minorFactor - число минимальных единиц в одной основной
+const minorFactor = 100
+
+// nbsp - неразрывный пробел: Telegram не переносит сумму посреди числа
+const nbsp = "\u00a0"
+
+// format - правила вывода суммы в валюте
+type format struct {
+	symbol      string
+	symbolFirst bool   // €12.99 вместо 12,99 €
+	decimalSep  string // разделитель дробной части
+	groupSep    string // разделитель разрядов
+}
+
+// formats - поддерживаемые валюты и их локальная запись
+var formats = map[Currency]format{
+	RUB: {symbol: "₽", decimalSep: ",", groupSep: nbsp},
+	KZT: {symbol: "₸", decimalSep: ",", groupSep: nbsp},
+	UAH: {symbol: "₴", decimalSep: ",", groupSep: nbsp},
+	EUR: {symbol: "€", symbolFirst: true, decimalSep: ".", groupSep: ","},
+	TRY: {symbol: "₺", symbolFirst: true, decimalSep: ",", groupSep: "."},
+}
+
+// Currencies возвращает поддерживаемые валюты в порядке отображения
+func Currencies() []Currency {
+	return []Currency{RUB, KZT, UAH, EUR, TRY}
+}
+
+// ParseCurrency проверяет код валюты: "kzt" -> KZT
+func ParseCurrency(code string) (Currency, error) {
+	c := Currency(strings.ToUpper(strings.TrimSpace(code)))
+	if _, ok := formats[c]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownCurrency, code)
+	}
+	return c, nil
+}
+
+// Symbol возвращает знак валюты, для неизвестных валют - сам код
+func (c Currency) Symbol() string {
+	if f, ok := formats[c]; ok {
+		return f.symbol
+	}
+	return string(c)
+}
+
+var (
+	// ErrInvalidAmount - строка не похожа на денежную сумму
+	ErrInvalidAmount = errors.New("некорректная сумма")
+	// ErrTooPrecise - у суммы больше двух знаков после запятой
+	ErrTooPrecise = errors.New("слишком много знаков после запятой (максимум 2)")
+	// ErrUnknownCurrency - валюта не поддерживается магазином
+	ErrUnknownCurrency = errors.New("неизвестная валюта")
+)
+
+// Money - сумма в минимальных единицах валюты
+type Money struct {
+	Amount   int64    `json:"amount"`
+	Currency Currency `json:"currency"`
+}
+
+// New создает сумму из минимальных единиц: New(67050, RUB) - 670,50 ₽
+func New(amount int64, currency Currency) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// FromMajor создает сумму из целого числа основных единиц: FromMajor(670, RUB) - 670 ₽
+func FromMajor(units int64, currency Currency) Money {
+	return Money{Amount: units * minorFactor, Currency: currency}
+}
+
+// Parse разбирает ввод администратора: "2500", "2500.50", "2 500,5".
+// Пробелы между разрядами допускаются, дробная часть - не длиннее двух знаков
+func Parse(s string, currency Currency) (Money, error) {
+	s = strings.NewReplacer(" ", "", "\u00a0", "", "_", "").Replace(strings.TrimSpace(s))
+	s = strings.Replace(s, ",", ".", 1)
+
+	negative := false
+	if strings.HasPrefix(s, "-") {
+		negative = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" && (!hasFrac || frac == "") {
+		return Money{}, ErrInvalidAmount
+	}
+	if !isDigits(whole) || !isDigits(frac) {
+		return Money{}, ErrInvalidAmount
+	}
+	if len(frac) > minorDigits {
+		return Money{}, ErrTooPrecise
+	}
+
+	var units int64
+	if whole != "" {
+		var err error
+		units, err = strconv.ParseInt(whole, 10, 64)
+		if err != nil || units > math.MaxInt64/minorFactor {
+			return Money{}, ErrInvalidAmount
+		}
+	}
+
+	var minor int64
+	if frac != "" {
+		frac += strings.Repeat("0", minorDigits-len(frac))
+		minor, _ = strconv.ParseInt(frac, 10, 64)
+	}
+
+	amount := units*minorFactor + minor
+	if negative {
+		amount = -amount
+	}
+
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// isDigits проверяет, что строка состоит только из ASCII-цифр (пустая строка допустима)
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// IsZero сообщает, что сумма равна нулю
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// IsPositive сообщает, что сумма больше нуля
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+// IsNegative сообщает, что сумма меньше нуля
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// Add складывает суммы одной валюты. Нулевое значение Money{} без валюты
+// принимает валюту второго слагаемого, поэтому им удобно начинать накопление
+func (m Money) Add(other Money) Money {
+	return Money{Amount: m.Amount + other.Amount, Currency: m.sameCurrency(other)}
+}
+
+// Sub вычитает сумму той же валюты
+func (m Money) Sub(other Money) Money {
+	return Money{Amount: m.Amount - other.Amount, Currency: m.sameCurrency(other)}
+}
+
+// Mul умножает сумму на целое количество
+func (m Money) Mul(n int64) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// sameCurrency возвращает общую валюту двух сумм. Смешение валют - ошибка программиста
+func (m Money) sameCurrency(other Money) Currency {
+	switch {
+	case m.Currency == other.Currency:
+		return m.Currency
+	case m.Currency == "" && m.Amount == 0:
+		return other.Currency
+	case other.Currency == "" && other.Amount == 0:
+		return m.Currency
+	default:
+		panic(fmt.Sprintf("money: currency mismatch %s and %s", m.Currency, other.Currency))
+	}
+}
+
+// Decimal возвращает сумму в виде десятичной строки с двумя знаками: "670.50"
+func (m Money) Decimal() string {
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/minorFactor, amount%minorFactor)
+}
+
+// String возвращает сумму в локальной записи валюты: "1 900 ₽", "670,50 ₸", "€12.99".
+// Нулевые копейки не выводятся, пробелы - неразрывные
+func (m Money) String() string {
+	f, ok := formats[m.Currency]
+	if !ok {
+		f = format{symbol: string(m.Currency), decimalSep: ".", groupSep: nbsp}
+	}
+
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	number := groupDigits(strconv.FormatInt(amount/minorFactor, 10), f.groupSep)
+	if frac := amount % minorFactor; frac != 0 {
+		number += fmt.Sprintf("%s%02d", f.decimalSep, frac)
+	}
+
+	if f.symbolFirst {
+		return sign + f.symbol + number
+	}
+	return sign + number + nbsp + f.symbol
+}
+
+// groupDigits разбивает целую часть на разряды по три цифры
+func groupDigits(digits, sep string) string {
+	if len(digits) <= 3 {
+		return digits
+	}
+
+	var b strings.Builder
+	head := len(digits) % 3
+	if head > 0 {
+		b.WriteString(digits[:head])
+	}
+	for i := head; i < len(digits); i += 3 {
+		if b.Len() > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(digits[i : i+3])
+	}
+	return b.String()
+}
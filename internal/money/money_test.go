@@ -0,0 +1,100 @@
+package money
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr error
+	}{
+		{input: "2500", want: 250000},
+		{input: "2500.5", want: 250050},
+		{input: "2500,50", want: 250050},
+		{input: " 2 500 ", want: 250000},
+		{input: "0.1", want: 10},
+		{input: ".99", want: 99},
+		{input: "-10", want: -1000},
+		{input: "", wantErr: ErrInvalidAmount},
+		{input: "abc", wantErr: ErrInvalidAmount},
+		{input: "1.2.3", wantErr: ErrInvalidAmount},
+		{input: "1e3", wantErr: ErrInvalidAmount},
+		{input: "10.999", wantErr: ErrTooPrecise},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.input, RUB)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("Parse(%q) error = %v, want %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (got.Amount != tt.want || got.Currency != RUB) {
+			t.Errorf("Parse(%q) = %+v, want %d RUB", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	// 0.1 + 0.2 во float64 дает 0.30000000000000004, в копейках - ровно 30
+	var total Money
+	for _, p := range []string{"0.10", "0.20"} {
+		m, _ := Parse(p, RUB)
+		total = total.Add(m)
+	}
+	if total != New(30, RUB) {
+		t.Errorf("0.10 + 0.20 = %+v, want 30 kopecks", total)
+	}
+
+	price := FromMajor(670, RUB)
+	if got := price.Mul(3).Sub(New(1, RUB)); got.Amount != 200999 {
+		t.Errorf("670*3 - 0.01 = %d, want 200999", got.Amount)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Add() with different currencies should panic")
+		}
+	}()
+	price.Add(New(100, KZT))
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{m: New(67000, RUB), want: "670\u00a0₽"},
+		{m: New(67050, RUB), want: "670,50\u00a0₽"},
+		{m: New(5, RUB), want: "0,05\u00a0₽"},
+		{m: New(-150, RUB), want: "-1,50\u00a0₽"},
+		{m: New(336900, KZT), want: "3\u00a0369\u00a0₸"},
+		{m: New(123456789, UAH), want: "1\u00a0234\u00a0567,89\u00a0₴"},
+		{m: New(1299, EUR), want: "€12.99"},
+		{m: New(150000, EUR), want: "€1,500"},
+		{m: New(190050, TRY), want: "₺1.900,50"},
+		{m: New(100, "USD"), want: "1\u00a0USD"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("String(%d %s) = %q, want %q", tt.m.Amount, tt.m.Currency, got, tt.want)
+		}
+	}
+}
+
+func TestParseCurrency(t *testing.T) {
+	if got, err := ParseCurrency(" kzt "); err != nil || got != KZT {
+		t.Errorf("ParseCurrency(kzt) = %q, %v", got, err)
+	}
+	if _, err := ParseCurrency("USD"); !errors.Is(err, ErrUnknownCurrency) {
+		t.Errorf("ParseCurrency(USD) error = %v, want ErrUnknownCurrency", err)
+	}
+	for _, c := range Currencies() {
+		if c.Symbol() == string(c) {
+			t.Errorf("currency %s has no symbol", c)
+		}
+	}
+}
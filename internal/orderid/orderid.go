@@ -0,0 +1,112 @@
+// Package orderid формирует и проверяет человекочитаемые номера заказов.
+//
+// Формат: WOW + YYMMDD + порядковый номер за день (минимум 3 цифры) + контрольная цифра.
+// Пример: WOW2412040012 - 1-й заказ за 4 декабря 2024 года, контрольная цифра 2.
+// Контрольная цифра считается по алгоритму Луна и ловит опечатку в одной цифре
+// и большинство перестановок соседних цифр при ручном вводе номера.
+package orderid
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Prefix - префикс всех номеров заказов
+	Prefix = "WOW"
+
+	// dateLayout - дата в номере заказа (YYMMDD)
+	dateLayout = "060102"
+
+	// legacyLength - длина старых номеров WOW + YYMMDD + 3 случайные цифры (без контрольной цифры)
+	legacyLength = len(Prefix) + 6 + 3
+)
+
+var (
+	// ErrInvalidFormat - строка не похожа на номер заказа
+	ErrInvalidFormat = errors.New("неверный формат номера заказа")
+	// ErrBadCheckDigit - номер похож на настоящий, но контрольная цифра не сходится (опечатка)
+	ErrBadCheckDigit = errors.New("контрольная цифра не совпадает, проверьте номер заказа")
+)
+
+// New формирует номер заказа для дня day и порядкового номера seq (начиная с 1)
+func New(day time.Time, seq int64) string {
+	body := fmt.Sprintf("%s%03d", day.Format(dateLayout), seq)
+	return fmt.Sprintf("%s%s%d", Prefix, body, CheckDigit(body))
+}
+
+// Seq возвращает порядковый номер заказа id за день day.
+// false - номер за другой день или старый номер без контрольной цифры
+func Seq(id string, day time.Time) (int64, bool) {
+	prefix := Prefix + day.Format(dateLayout)
+	if !strings.HasPrefix(id, prefix) || len(id) <= legacyLength {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseInt(id[len(prefix):len(id)-1], 10, 64)
+	if err != nil || seq <= 0 {
+		return 0, false
+	}
+	return seq, true
+}
+
+// CheckDigit возвращает контрольную цифру Луна для строки из цифр
+func CheckDigit(digits string) int {
+	sum := 0
+	double := true // справа налево, начиная с цифры перед контрольной
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return (10 - sum%10) % 10
+}
+
+// Normalize приводит введённый пользователем номер к каноническому виду:
+// убирает пробелы и дефисы, переводит в верхний регистр
+func Normalize(input string) string {
+	replacer := strings.NewReplacer(" ", "", "-", "", "\t", "")
+	return strings.ToUpper(replacer.Replace(strings.TrimSpace(input)))
+}
+
+// Validate проверяет номер заказа. Старые номера без контрольной цифры считаются корректными
+func Validate(id string) error {
+	if !strings.HasPrefix(id, Prefix) {
+		return ErrInvalidFormat
+	}
+
+	digits := id[len(Prefix):]
+	if len(digits) < 6+3 {
+		return ErrInvalidFormat
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return ErrInvalidFormat
+		}
+	}
+
+	if _, err := time.Parse(dateLayout, digits[:6]); err != nil {
+		return ErrInvalidFormat
+	}
+
+	if len(id) == legacyLength {
+		return nil
+	}
+
+	body, check := digits[:len(digits)-1], int(digits[len(digits)-1]-'0')
+	if CheckDigit(body) != check {
+		return ErrBadCheckDigit
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package orderid
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	day := time.Date(2024, 12, 4, 15, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		seq  int64
+		want string
+	}{
+		{seq: 1, want: "WOW2412040012"},
+		{seq: 42, want: "WOW2412040426"},
+		{seq: 1234, want: "WOW24120412341"},
+	}
+
+	for _, tt := range tests {
+		got := New(day, tt.seq)
+		if got != tt.want {
+			t.Errorf("New(%d) = %s, want %s", tt.seq, got, tt.want)
+		}
+		if err := Validate(got); err != nil {
+			t.Errorf("Validate(%s) error = %v", got, err)
+		}
+	}
+}
+
+func TestSeq(t *testing.T) {
+	day := time.Date(2024, 12, 4, 15, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		id     string
+		want   int64
+		wantOK bool
+	}{
+		{id: "WOW2412040426", want: 42, wantOK: true},
+		{id: "WOW24120412341", want: 1234, wantOK: true},
+		{id: "WOW2412050012", wantOK: false}, // другой день
+		{id: "WOW241204123", wantOK: false},  // старый номер без контрольной цифры
+	}
+
+	for _, tt := range tests {
+		got, ok := Seq(tt.id, day)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("Seq(%s) = %d, %v, want %d, %v", tt.id, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		wantErr error
+	}{
+		{name: "Valid", id: "WOW2412040012", wantErr: nil},
+		{name: "Legacy without check digit", id: "WOW241204123", wantErr: nil},
+		{name: "Single digit typo", id: "WOW2412040022", wantErr: ErrBadCheckDigit},
+		{name: "Adjacent transposition", id: "WOW2412040102", wantErr: ErrBadCheckDigit},
+		{name: "Wrong prefix", id: "ABC2412040017", wantErr: ErrInvalidFormat},
+		{name: "Too short", id: "WOW2412", wantErr: ErrInvalidFormat},
+		{name: "Letters in number", id: "WOW24120400A2", wantErr: ErrInvalidFormat},
+		{name: "Bad date", id: "WOW2413400017", wantErr: ErrInvalidFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.id)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Validate(%s) error = %v, want %v", tt.id, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	if got := Normalize("  wow 241204-0012 "); got != "WOW2412040012" {
+		t.Errorf("Normalize() = %s", got)
+	}
+}
@@ -0,0 +1,77 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"html"
+
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+// ErrNoCardNumber - для заказа не выбрана карта из пула и не задан номер карты по умолчанию
+var ErrNoCardNumber = errors.New("no card number for transfer")
+
+// Card - перевод на банковскую карту, оплату подтверждает админ. Карту для заказа бот выбирает
+// из пула реквизитов (CheckoutTo), номер из PAYMENT_CARD_NUMBER - запасной
+type Card struct {
+	number string
+}
+
+// NewCard создает способ оплаты переводом на карту. number - карта по умолчанию, может быть пустым
+func NewCard(number string) *Card {
+	return &Card{number: number}
+}
+
+func (c *Card) Code() string               { return CodeCard }
+func (c *Card) Title() string              { return "💳 Перевод на карту" }
+func (c *Card) Confirmation() Confirmation { return ConfirmManual }
+
+// Supports - переводом можно оплатить цену в любой валюте
+func (c *Card) Supports(currency money.Currency) bool { return true }
+
+// Checkout готовит инструкцию с переводом на карту по умолчанию
+func (c *Card) Checkout(order models.Order, productName string) (Checkout, error) {
+	if c.number == "" {
+		return Checkout{}, ErrNoCardNumber
+	}
+
+	return c.instruction(order, productName, fmt.Sprintf("<code>%s</code>", c.number)), nil
+}
+
+// CheckoutTo готовит инструкцию с переводом на карту card, выбранную для заказа
+func (c *Card) CheckoutTo(order models.Order, productName string, card models.PayoutCard) Checkout {
+	requisites := fmt.Sprintf(
+		"<code>%s</code> (%s, получатель %s)",
+		card.Number, html.EscapeString(card.BankName), html.EscapeString(card.Holder),
+	)
+	return c.instruction(order, productName, requisites)
+}
+
+func (c *Card) instruction(order models.Order, productName, requisites string) Checkout {
+	amount := order.TransferAmount()
+
+	// Копейки надбавки отличают перевод от других заказов на ту же сумму
+	exact := ""
+	if order.AmountOffset.IsPositive() {
+		exact = "❗️ Переведите сумму точно, вместе с копейками: по ней мы найдем ваш перевод\n"
+	}
+
+	text := fmt.Sprintf(
+		"✅ <b>Заказ успешно создан!</b>\n\n"+
+			"📦 <b>Заказ №:</b> <code>%s</code>\n"+
+			"🎮 <b>Товар:</b> %s\n"+
+			"💰 <b>Сумма:</b> %s\n\n"+
+			"💳 <b>Инструкция по оплате:</b>\n"+
+			"1. Переведите %s на карту: %s\n"+
+			"%s"+
+			"2. В комментарии к переводу укажите номер заказа: <code>%s</code>\n"+
+			"3. Нажмите «📎 Прикрепить чек» и отправьте скриншот или PDF чека\n\n"+
+			"После проверки оплаты вы получите доступ к подписке.\n\n"+
+			"По всем вопросам обращайтесь к администратору.",
+		order.OrderID, productName, order.Price,
+		amount, requisites, exact, order.OrderID,
+	)
+
+	return Checkout{Text: text}
+}
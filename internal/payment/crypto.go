@@ -0,0 +1,55 @@
+package payment
+
+import (
+	"fmt"
+
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+// Crypto - перевод криптовалюты на кошелек, сумма пересчитывается по курсам CRYPTO_RATES,
+// оплату подтверждает админ
+type Crypto struct {
+	wallet string
+	asset  string // Монета и сеть для покупателя, например "USDT (TRC20)"
+	rates  Rates
+}
+
+// NewCrypto создает способ оплаты криптовалютой asset на кошелек wallet
+func NewCrypto(wallet, asset string, rates Rates) *Crypto {
+	return &Crypto{wallet: wallet, asset: asset, rates: rates}
+}
+
+func (c *Crypto) Code() string               { return CodeCrypto }
+func (c *Crypto) Title() string              { return "🪙 Криптовалюта" }
+func (c *Crypto) Confirmation() Confirmation { return ConfirmManual }
+
+// Supports - криптовалютой можно оплатить цену только в валюте с заданным курсом
+func (c *Crypto) Supports(currency money.Currency) bool {
+	_, ok := c.rates[currency]
+	return ok
+}
+
+func (c *Crypto) Checkout(order models.Order, productName string) (Checkout, error) {
+	cents, ok := c.rates.Convert(order.Price, 2)
+	if !ok {
+		return Checkout{}, fmt.Errorf("no crypto rate for %s", order.Price.Currency)
+	}
+	amount := fmt.Sprintf("%d.%02d %s", cents/100, cents%100, c.asset)
+
+	text := fmt.Sprintf(
+		"✅ <b>Заказ успешно создан!</b>\n\n"+
+			"📦 <b>Заказ №:</b> <code>%s</code>\n"+
+			"🎮 <b>Товар:</b> %s\n"+
+			"💰 <b>Сумма:</b> %s\n\n"+
+			"🪙 <b>Инструкция по оплате:</b>\n"+
+			"1. Переведите <b>%s</b> на адрес: <code>%s</code>\n"+
+			"2. Убедитесь, что выбрана нужная сеть - перевод в другой сети не вернуть\n"+
+			"3. Нажмите «📎 Прикрепить чек» и отправьте скриншот транзакции с ее хешем\n\n"+
+			"После поступления средств вы получите доступ к подписке.",
+		order.OrderID, productName, order.Price,
+		amount, c.wallet,
+	)
+
+	return Checkout{Text: text}, nil
+}
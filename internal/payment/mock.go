@@ -0,0 +1,35 @@
+package payment
+
+import (
+	"fmt"
+
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+// Mock - тестовая оплата без денег: покупатель сам нажимает «Оплатить».
+// Нужна для проверки всего процесса покупки локально, в продакшене не включается
+type Mock struct{}
+
+// NewMock создает тестовый способ оплаты
+func NewMock() *Mock {
+	return &Mock{}
+}
+
+func (m *Mock) Code() string                          { return CodeMock }
+func (m *Mock) Title() string                         { return "🧪 Тестовая оплата" }
+func (m *Mock) Confirmation() Confirmation            { return ConfirmInstant }
+func (m *Mock) Supports(currency money.Currency) bool { return true }
+
+func (m *Mock) Checkout(order models.Order, productName string) (Checkout, error) {
+	text := fmt.Sprintf(
+		"🧪 <b>Тестовый заказ</b>\n\n"+
+			"📦 <b>Заказ №:</b> <code>%s</code>\n"+
+			"🎮 <b>Товар:</b> %s\n"+
+			"💰 <b>Сумма:</b> %s\n\n"+
+			"Деньги не списываются. Нажмите кнопку ниже, чтобы имитировать успешную оплату.",
+		order.OrderID, productName, order.Price,
+	)
+
+	return Checkout{Text: text}, nil
+}
@@ -0,0 +1,140 @@
+// Package payment описывает способы оплаты заказа: перевод на карту, Telegram Payments,
+// Telegram Stars, криптовалюта и тестовый mock. Каждый способ сам формирует инструкцию
+// для покупателя и определяет, как подтверждается оплата. Registry хранит включенные
+// способы и их набор для каждого региона.
+package payment
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+// Коды способов оплаты, сохраняются в orders.payment_method
+const (
+	CodeCard     = "card"
+	CodeTelegram = "telegram"
+	CodeStars    = "stars"
+	CodeCrypto   = "crypto"
+	CodeMock     = "mock"
+)
+
+// Confirmation - как подтверждается оплата заказа
+type Confirmation int
+
+const (
+	// ConfirmManual - админ проверяет поступление денег и нажимает «Подтвердить оплату»
+	ConfirmManual Confirmation = iota
+	// ConfirmInvoice - Telegram присылает successful_payment по выставленному счету
+	ConfirmInvoice
+	// ConfirmInstant - покупатель подтверждает оплату сам кнопкой (только для тестового mock)
+	ConfirmInstant
+)
+
+// Method - способ оплаты заказа
+type Method interface {
+	// Code - код способа для callback-данных и orders.payment_method
+	Code() string
+	// Title - название на кнопке выбора способа
+	Title() string
+	// Confirmation - как подтверждается оплата
+	Confirmation() Confirmation
+	// Supports сообщает, можно ли оплатить этим способом цену в указанной валюте
+	Supports(currency money.Currency) bool
+	// Checkout готовит инструкцию или счет для созданного заказа
+	Checkout(order models.Order, productName string) (Checkout, error)
+}
+
+// Checkout - что отправить покупателю после создания заказа
+type Checkout struct {
+	Text    string   // HTML-инструкция по оплате; для счета - его описание
+	Invoice *Invoice // Счет Telegram, если способ оплачивается через sendInvoice
+}
+
+// Invoice - параметры счета sendInvoice
+type Invoice struct {
+	ProviderToken string // Токен провайдера, пустой для Telegram Stars
+	Currency      string // Код валюты ISO 4217 или XTR для Stars
+	Amount        int64  // Сумма в минимальных единицах валюты счета
+}
+
+// Registry - включенные способы оплаты и их набор по регионам
+type Registry struct {
+	methods  map[string]Method
+	defaults []string            // Способы для регионов без своего списка
+	regions  map[string][]string // Код региона -> способы
+}
+
+// NewRegistry собирает реестр. defaults и regions ссылаются на коды из methods,
+// порядок кодов задает порядок кнопок выбора
+func NewRegistry(methods []Method, defaults []string, regions map[string][]string) (*Registry, error) {
+	r := &Registry{
+		methods: make(map[string]Method, len(methods)),
+		regions: make(map[string][]string, len(regions)),
+	}
+
+	for _, m := range methods {
+		r.methods[m.Code()] = m
+	}
+
+	if len(defaults) == 0 {
+		return nil, fmt.Errorf("at least one payment method is required")
+	}
+	if err := r.checkCodes(defaults); err != nil {
+		return nil, err
+	}
+	r.defaults = defaults
+
+	for region, codes := range regions {
+		if err := r.checkCodes(codes); err != nil {
+			return nil, fmt.Errorf("region %s: %w", region, err)
+		}
+		r.regions[strings.ToUpper(region)] = codes
+	}
+
+	return r, nil
+}
+
+func (r *Registry) checkCodes(codes []string) error {
+	for _, code := range codes {
+		if _, ok := r.methods[code]; !ok {
+			return fmt.Errorf("unknown or unconfigured payment method %q", code)
+		}
+	}
+	return nil
+}
+
+// Get возвращает способ оплаты по коду
+func (r *Registry) Get(code string) (Method, bool) {
+	m, ok := r.methods[code]
+	return m, ok
+}
+
+// ForRegion возвращает способы, включенные для региона и поддерживающие валюту цены
+func (r *Registry) ForRegion(regionCode string, currency money.Currency) []Method {
+	codes, ok := r.regions[strings.ToUpper(regionCode)]
+	if !ok {
+		codes = r.defaults
+	}
+
+	var result []Method
+	for _, code := range codes {
+		if m := r.methods[code]; m.Supports(currency) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// Codes возвращает коды всех включенных способов в алфавитном порядке
+func (r *Registry) Codes() []string {
+	codes := make([]string, 0, len(r.methods))
+	for code := range r.methods {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
@@ -0,0 +1,143 @@
+package payment
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+func codes(methods []Method) string {
+	var result []string
+	for _, m := range methods {
+		result = append(result, m.Code())
+	}
+	return strings.Join(result, ",")
+}
+
+func TestRegistryForRegion(t *testing.T) {
+	methods := []Method{NewCard("0000"), NewTelegram("token"), NewStars(mustRate(t, "RUB=0.5")), NewMock()}
+
+	r, err := NewRegistry(methods, []string{CodeCard, CodeTelegram}, map[string][]string{
+		"eu": {CodeStars, CodeCard},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+
+	tests := []struct {
+		region   string
+		currency money.Currency
+		want     string
+	}{
+		{region: "KZ", currency: money.RUB, want: "card,telegram"},
+		{region: "EU", currency: money.RUB, want: "stars,card"},
+		// Для евро нет курса звезд - остается только карта
+		{region: "EU", currency: money.EUR, want: "card"},
+	}
+
+	for _, tt := range tests {
+		if got := codes(r.ForRegion(tt.region, tt.currency)); got != tt.want {
+			t.Errorf("ForRegion(%s, %s) = %s, want %s", tt.region, tt.currency, got, tt.want)
+		}
+	}
+
+	if _, ok := r.Get(CodeMock); !ok {
+		t.Error("Get(mock) = false, want configured method")
+	}
+
+	if _, err := NewRegistry(methods, []string{"paypal"}, nil); err == nil {
+		t.Error("NewRegistry() with unknown method should fail")
+	}
+	if _, err := NewRegistry(methods, nil, nil); err == nil {
+		t.Error("NewRegistry() without default methods should fail")
+	}
+}
+
+func mustRate(t *testing.T, s string) Rates {
+	t.Helper()
+
+	rates, err := ParseRates(s)
+	if err != nil {
+		t.Fatalf("ParseRates(%q) error = %v", s, err)
+	}
+	return rates
+}
+
+func TestRatesConvert(t *testing.T) {
+	rates := mustRate(t, "RUB=0.011, KZT=0.5")
+
+	tests := []struct {
+		price    money.Money
+		decimals int
+		want     int64
+	}{
+		// 670 ₽ * 0.011 = 7.37 USDT
+		{price: money.FromMajor(670, money.RUB), decimals: 2, want: 737},
+		// 670.50 ₽ * 0.011 = 7.3755, округляем вверх до 7.38
+		{price: money.New(67050, money.RUB), decimals: 2, want: 738},
+		// 3369 ₸ * 0.5 = 1684.5 звезды, округляем вверх
+		{price: money.FromMajor(3369, money.KZT), decimals: 0, want: 1685},
+	}
+
+	for _, tt := range tests {
+		got, ok := rates.Convert(tt.price, tt.decimals)
+		if !ok || got != tt.want {
+			t.Errorf("Convert(%s, %d) = %d, %v, want %d", tt.price, tt.decimals, got, ok, tt.want)
+		}
+	}
+
+	if _, ok := rates.Convert(money.FromMajor(10, money.EUR), 0); ok {
+		t.Error("Convert() without EUR rate should fail")
+	}
+
+	for _, bad := range []string{"", "RUB", "USD=1", "RUB=-1", "RUB=abc"} {
+		if _, err := ParseRates(bad); err == nil {
+			t.Errorf("ParseRates(%q) should fail", bad)
+		}
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	order := models.Order{OrderID: "WOW2412040012", Price: money.FromMajor(670, money.RUB)}
+
+	checkout, err := NewStars(mustRate(t, "RUB=1.5")).Checkout(order, "WoW Classic")
+	if err != nil {
+		t.Fatalf("Stars.Checkout() error = %v", err)
+	}
+	if inv := checkout.Invoice; inv == nil || inv.Currency != StarsCurrency || inv.Amount != 1005 || inv.ProviderToken != "" {
+		t.Errorf("Stars invoice = %+v, want 1005 XTR without provider token", checkout.Invoice)
+	}
+
+	checkout, _ = NewTelegram("token").Checkout(order, "WoW Classic")
+	if inv := checkout.Invoice; inv == nil || inv.Currency != "RUB" || inv.Amount != 67000 {
+		t.Errorf("Telegram invoice = %+v, want 67000 RUB", checkout.Invoice)
+	}
+
+	checkout, _ = NewCard("1111 2222").Checkout(order, "WoW Classic")
+	if checkout.Invoice != nil || !strings.Contains(checkout.Text, "1111 2222") || !strings.Contains(checkout.Text, order.OrderID) {
+		t.Errorf("Card checkout = %+v, want instructions with card and order number", checkout)
+	}
+
+	payout := models.PayoutCard{Number: "3333 4444", BankName: "Т-Банк", Holder: "Иван <И.>"}
+	checkout = NewCard("").CheckoutTo(order, "WoW Classic", payout)
+	if !strings.Contains(checkout.Text, "3333 4444") || !strings.Contains(checkout.Text, "получатель Иван &lt;И.&gt;") {
+		t.Errorf("Card checkout to payout card = %q, want its number and escaped holder", checkout.Text)
+	}
+	tagged := order
+	tagged.AmountOffset = money.New(37, money.RUB)
+	checkout, _ = NewCard("1111 2222").Checkout(tagged, "WoW Classic")
+	if !strings.Contains(checkout.Text, "Переведите 670,37 ₽") || !strings.Contains(checkout.Text, "вместе с копейками") {
+		t.Errorf("Card checkout with amount offset = %q, want exact transfer amount", checkout.Text)
+	}
+	if _, err := NewCard("").Checkout(order, "WoW Classic"); !errors.Is(err, ErrNoCardNumber) {
+		t.Errorf("Card.Checkout() without number error = %v, want ErrNoCardNumber", err)
+	}
+
+	checkout, _ = NewCrypto("TWallet", "USDT (TRC20)", mustRate(t, "RUB=0.011")).Checkout(order, "WoW Classic")
+	if !strings.Contains(checkout.Text, "7.37 USDT (TRC20)") || !strings.Contains(checkout.Text, "TWallet") {
+		t.Errorf("Crypto checkout text = %q, want amount and wallet", checkout.Text)
+	}
+}
@@ -0,0 +1,71 @@
+package payment
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"tgwow/internal/money"
+)
+
+// Rates - курсы пересчета цены в валюту способа оплаты:
+// сколько единиц целевой валюты стоит одна единица валюты цены (рубль, тенге, евро)
+type Rates map[money.Currency]*big.Rat
+
+// ParseRates разбирает курсы в формате "RUB=0.75,KZT=0.16"
+func ParseRates(s string) (Rates, error) {
+	rates := make(Rates)
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		code, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate %q: expected CODE=rate", pair)
+		}
+
+		currency, err := money.ParseCurrency(code)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate %q: %w", pair, err)
+		}
+
+		rate, ok := new(big.Rat).SetString(strings.TrimSpace(value))
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid rate %q: expected positive number", pair)
+		}
+
+		rates[currency] = rate
+	}
+
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("no rates given")
+	}
+
+	return rates, nil
+}
+
+// Convert пересчитывает цену в целевую валюту с decimals знаками после запятой
+// и возвращает сумму в ее минимальных единицах. Округление всегда вверх, чтобы магазин
+// не терял на курсе. false - для валюты цены курс не задан
+func (r Rates) Convert(price money.Money, decimals int) (int64, bool) {
+	rate, ok := r[price.Currency]
+	if !ok {
+		return 0, false
+	}
+
+	// price.Amount в сотых долях: amount * rate * 10^decimals / 100
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	num := new(big.Int).Mul(big.NewInt(price.Amount), rate.Num())
+	num.Mul(num, scale)
+	den := new(big.Int).Mul(rate.Denom(), big.NewInt(100))
+
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() > 0 {
+		quo.Add(quo, big.NewInt(1))
+	}
+
+	return quo.Int64(), true
+}
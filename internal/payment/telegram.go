@@ -0,0 +1,74 @@
+package payment
+
+import (
+	"fmt"
+
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+// StarsCurrency - код валюты Telegram Stars в счетах
+const StarsCurrency = "XTR"
+
+// Telegram - счет Telegram Payments через платежного провайдера из @BotFather
+type Telegram struct {
+	providerToken string
+}
+
+// NewTelegram создает способ оплаты через Telegram Payments
+func NewTelegram(providerToken string) *Telegram {
+	return &Telegram{providerToken: providerToken}
+}
+
+func (t *Telegram) Code() string               { return CodeTelegram }
+func (t *Telegram) Title() string              { return "💳 Картой в Telegram" }
+func (t *Telegram) Confirmation() Confirmation { return ConfirmInvoice }
+
+// Supports - Telegram Payments принимает все валюты регионов магазина
+func (t *Telegram) Supports(currency money.Currency) bool { return true }
+
+func (t *Telegram) Checkout(order models.Order, productName string) (Checkout, error) {
+	return Checkout{
+		Text: fmt.Sprintf("Заказ №%s: %s", order.OrderID, productName),
+		Invoice: &Invoice{
+			ProviderToken: t.providerToken,
+			Currency:      string(order.Price.Currency),
+			Amount:        order.Price.Amount,
+		},
+	}, nil
+}
+
+// Stars - счет в Telegram Stars, цена пересчитывается по курсам STARS_RATES
+type Stars struct {
+	rates Rates
+}
+
+// NewStars создает способ оплаты звездами Telegram с курсами "звезд за единицу валюты"
+func NewStars(rates Rates) *Stars {
+	return &Stars{rates: rates}
+}
+
+func (s *Stars) Code() string               { return CodeStars }
+func (s *Stars) Title() string              { return "⭐ Telegram Stars" }
+func (s *Stars) Confirmation() Confirmation { return ConfirmInvoice }
+
+// Supports - звездами можно оплатить цену только в валюте с заданным курсом
+func (s *Stars) Supports(currency money.Currency) bool {
+	_, ok := s.rates[currency]
+	return ok
+}
+
+func (s *Stars) Checkout(order models.Order, productName string) (Checkout, error) {
+	stars, ok := s.rates.Convert(order.Price, 0)
+	if !ok {
+		return Checkout{}, fmt.Errorf("no stars rate for %s", order.Price.Currency)
+	}
+
+	return Checkout{
+		Text: fmt.Sprintf("Заказ №%s: %s (%s)", order.OrderID, productName, order.Price),
+		Invoice: &Invoice{
+			Currency: StarsCurrency,
+			Amount:   stars,
+		},
+	}, nil
+}
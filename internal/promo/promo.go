@@ -0,0 +1,122 @@
+// Package promo проверяет промокоды и считает скидку по ним.
+//
+// Скидка действует только на позиции из области промокода (товар, категория или регион),
+// процент округляется вниз до минимальной единицы валюты. Заказ не может стать бесплатным:
+// после скидки к оплате остается хотя бы одна минимальная единица.
+package promo
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+var (
+	// ErrInvalidCode - строка не может быть промокодом
+	ErrInvalidCode = errors.New("промокод может содержать только латинские буквы, цифры, - и _ (до 32 символов)")
+	// ErrUnknown - такого промокода нет
+	ErrUnknown = errors.New("промокод не найден")
+	// ErrInactive - промокод выключен, еще не начал действовать или истек
+	ErrInactive = errors.New("промокод не действует")
+	// ErrNotApplicable - в заказе нет товаров, на которые распространяется промокод
+	ErrNotApplicable = errors.New("промокод не подходит к товарам заказа")
+	// ErrUsageLimit - исчерпан общий лимит использований или лимит на покупателя
+	ErrUsageLimit = errors.New("промокод больше нельзя использовать")
+	// ErrFirstPurchaseOnly - промокод только для первого заказа
+	ErrFirstPurchaseOnly = errors.New("промокод действует только на первый заказ")
+)
+
+var codePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// Normalize приводит введенный покупателем промокод к виду, в котором он хранится
+func Normalize(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if !codePattern.MatchString(code) {
+		return "", ErrInvalidCode
+	}
+	return code, nil
+}
+
+// Line - позиция заказа с данными для проверки области действия промокода
+type Line struct {
+	ProductID  int
+	CategoryID int
+	RegionID   int
+	Total      money.Money // Стоимость позиции с учетом количества
+}
+
+// Usage - сколько раз промокод уже использован
+type Usage struct {
+	Total     int  // Всеми покупателями, без отмененных заказов
+	ByUser    int  // Этим покупателем, без отмененных заказов
+	HasOrders bool // У покупателя уже есть неотмененные заказы
+}
+
+// Covers сообщает, распространяется ли промокод на позицию
+func Covers(code models.PromoCode, line Line) bool {
+	return (code.ProductID == 0 || code.ProductID == line.ProductID) &&
+		(code.CategoryID == 0 || code.CategoryID == line.CategoryID) &&
+		(code.RegionID == 0 || code.RegionID == line.RegionID)
+}
+
+// CheckUsage проверяет лимиты использований промокода и условие первого заказа
+func CheckUsage(code models.PromoCode, usage Usage) error {
+	if (code.MaxUses > 0 && usage.Total >= code.MaxUses) ||
+		(code.MaxUsesPerUser > 0 && usage.ByUser >= code.MaxUsesPerUser) {
+		return ErrUsageLimit
+	}
+	if code.FirstPurchaseOnly && usage.HasOrders {
+		return ErrFirstPurchaseOnly
+	}
+	return nil
+}
+
+// Discount проверяет, что промокод можно применить к заказу из lines, и возвращает скидку
+func Discount(code models.PromoCode, lines []Line, usage Usage, now time.Time) (money.Money, error) {
+	if !code.IsActive ||
+		(code.ValidFrom != nil && now.Before(*code.ValidFrom)) ||
+		(code.ValidUntil != nil && !now.Before(*code.ValidUntil)) {
+		return money.Money{}, ErrInactive
+	}
+	if err := CheckUsage(code, usage); err != nil {
+		return money.Money{}, err
+	}
+
+	var total, eligible money.Money
+	for _, line := range lines {
+		total = total.Add(line.Total)
+		if Covers(code, line) {
+			eligible = eligible.Add(line.Total)
+		}
+	}
+	if !eligible.IsPositive() {
+		return money.Money{}, ErrNotApplicable
+	}
+
+	var discount money.Money
+	if code.Percent > 0 {
+		discount = money.New(eligible.Amount*int64(code.Percent)/100, eligible.Currency)
+	} else {
+		// Фиксированная скидка задается в валюте, заказы в других валютах она не покрывает
+		if code.Amount.Currency != eligible.Currency {
+			return money.Money{}, ErrNotApplicable
+		}
+		discount = code.Amount
+		if discount.Amount > eligible.Amount {
+			discount = eligible
+		}
+	}
+
+	if discount.Amount >= total.Amount {
+		discount = money.New(total.Amount-1, total.Currency)
+	}
+	if !discount.IsPositive() {
+		return money.Money{}, ErrNotApplicable
+	}
+
+	return discount, nil
+}
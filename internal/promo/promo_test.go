@@ -0,0 +1,137 @@
+package promo
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: " spring-10 ", want: "SPRING-10"},
+		{in: "NEW_YEAR2025", want: "NEW_YEAR2025"},
+		{in: "ab", wantErr: true},
+		{in: "скидка", wantErr: true},
+		{in: "TWO WORDS", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := Normalize(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Normalize(%q) = %q, %v, want %q (error: %t)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDiscount(t *testing.T) {
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	yesterday := now.AddDate(0, 0, -1)
+	tomorrow := now.AddDate(0, 0, 1)
+
+	// Подписка в категории 1 региона 1 и услуга в категории 2 того же региона
+	lines := []Line{
+		{ProductID: 1, CategoryID: 1, RegionID: 1, Total: money.FromMajor(1000, money.RUB)},
+		{ProductID: 5, CategoryID: 2, RegionID: 1, Total: money.New(50050, money.RUB)},
+	}
+
+	tests := []struct {
+		name    string
+		code    models.PromoCode
+		usage   Usage
+		want    money.Money
+		wantErr error
+	}{
+		{
+			name: "Percent on whole order",
+			code: models.PromoCode{Percent: 10, IsActive: true},
+			want: money.New(15005, money.RUB),
+		},
+		{
+			name: "Percent on category only",
+			code: models.PromoCode{Percent: 15, CategoryID: 2, IsActive: true},
+			want: money.New(7507, money.RUB),
+		},
+		{
+			name: "Fixed capped by eligible items",
+			code: models.PromoCode{Amount: money.FromMajor(800, money.RUB), ProductID: 5, IsActive: true},
+			want: money.New(50050, money.RUB),
+		},
+		{
+			name: "Fixed never makes order free",
+			code: models.PromoCode{Amount: money.FromMajor(5000, money.RUB), IsActive: true},
+			want: money.New(150049, money.RUB),
+		},
+		{
+			name:    "Fixed in other currency",
+			code:    models.PromoCode{Amount: money.FromMajor(5, money.EUR), IsActive: true},
+			wantErr: ErrNotApplicable,
+		},
+		{
+			name:    "Other product",
+			code:    models.PromoCode{Percent: 10, ProductID: 3, IsActive: true},
+			wantErr: ErrNotApplicable,
+		},
+		{
+			name:    "Other region",
+			code:    models.PromoCode{Percent: 10, RegionID: 2, IsActive: true},
+			wantErr: ErrNotApplicable,
+		},
+		{
+			name:    "Disabled",
+			code:    models.PromoCode{Percent: 10},
+			wantErr: ErrInactive,
+		},
+		{
+			name:    "Not started",
+			code:    models.PromoCode{Percent: 10, ValidFrom: &tomorrow, IsActive: true},
+			wantErr: ErrInactive,
+		},
+		{
+			name:    "Expired",
+			code:    models.PromoCode{Percent: 10, ValidUntil: &yesterday, IsActive: true},
+			wantErr: ErrInactive,
+		},
+		{
+			name: "Inside validity window",
+			code: models.PromoCode{Percent: 50, ValidFrom: &yesterday, ValidUntil: &tomorrow, IsActive: true},
+			want: money.New(75025, money.RUB),
+		},
+		{
+			name:    "Global limit reached",
+			code:    models.PromoCode{Percent: 10, MaxUses: 100, IsActive: true},
+			usage:   Usage{Total: 100},
+			wantErr: ErrUsageLimit,
+		},
+		{
+			name:    "Per-user limit reached",
+			code:    models.PromoCode{Percent: 10, MaxUsesPerUser: 1, IsActive: true},
+			usage:   Usage{Total: 3, ByUser: 1},
+			wantErr: ErrUsageLimit,
+		},
+		{
+			name:    "First purchase only",
+			code:    models.PromoCode{Percent: 10, FirstPurchaseOnly: true, IsActive: true},
+			usage:   Usage{HasOrders: true},
+			wantErr: ErrFirstPurchaseOnly,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Discount(tt.code, lines, tt.usage, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Discount() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Discount() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
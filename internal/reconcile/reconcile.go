@@ -0,0 +1,369 @@
+// Package reconcile сверяет выписку банка с заказами, ожидающими оплаты переводом на карту.
+//
+// Выписка - CSV-файл из интернет-банка в UTF-8 или Windows-1251. Разделитель (";", "," или табуляция)
+// и колонки определяются по строке заголовка, строки до нее и итоги после таблицы пропускаются.
+// Из выписки берутся только поступления.
+//
+// Перевод сопоставляется с заказом по сумме перевода заказа (цена с уникальными копейками) и времени:
+// не раньше создания заказа и не позже окна сверки. Если по сумме подходит несколько заказов, выбор решает
+// номер заказа в описании операции, иначе перевод остается на ручную проверку.
+package reconcile
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+// ErrNoHeader - в файле нет строки заголовка с колонками даты и суммы
+var ErrNoHeader = errors.New("не найдена строка заголовка с колонками даты и суммы операции")
+
+// Названия колонок выписки по убыванию приоритета. Заголовок подходит, если содержит название
+var (
+	dateColumns        = []string{"дата операции", "дата и время", "дата платежа", "дата", "date"}
+	amountColumns      = []string{"сумма операции", "сумма в валюте счета", "сумма", "amount"}
+	creditColumns      = []string{"поступление", "зачисление", "приход", "кредит", "credit"}
+	currencyColumns    = []string{"валюта операции", "валюта", "currency"}
+	descriptionColumns = []string{"описание", "назначение", "комментарий", "детали", "description", "details"}
+	statusColumns      = []string{"статус", "status"}
+)
+
+// dateLayouts - форматы даты операции в выписках
+var dateLayouts = []string{
+	"02.01.2006 15:04:05", "02.01.2006 15:04", "02.01.2006",
+	"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02",
+	"02/01/2006 15:04:05", "02/01/2006 15:04", "02/01/2006",
+}
+
+// currencyAliases - обозначения валют в выписках, которые не являются кодами ISO 4217
+var currencyAliases = map[string]money.Currency{
+	"RUR":  money.RUB,
+	"РУБ":  money.RUB,
+	"РУБ.": money.RUB,
+	"₽":    money.RUB,
+	"ТГ":   money.KZT,
+	"₸":    money.KZT,
+	"ГРН":  money.UAH,
+	"₴":    money.UAH,
+	"€":    money.EUR,
+	"₺":    money.TRY,
+}
+
+// Transfer - поступление из выписки
+type Transfer struct {
+	Line        int       // Номер строки в файле
+	Time        time.Time // Время операции
+	DateOnly    bool      // В выписке только дата, время - начало дня
+	Amount      money.Money
+	Description string
+}
+
+// Match - перевод, сопоставленный с заказом
+type Match struct {
+	Transfer Transfer
+	Order    models.Order
+}
+
+// Result - итог сверки выписки
+type Result struct {
+	Matches   []Match
+	Ambiguous []Transfer // Подходит несколько заказов
+	Unmatched []Transfer // Не подходит ни один заказ
+}
+
+// columns - номера колонок выписки, -1 - колонки нет
+type columns struct {
+	date, amount, credit, currency, description, status int
+}
+
+// Parse читает поступления из CSV-выписки. currency - валюта операций, если в выписке нет колонки валюты.
+// Время без часового пояса считается временем loc
+func Parse(r io.Reader, currency money.Currency, loc *time.Location) ([]Transfer, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read statement: %w", err)
+	}
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	if !utf8.Valid(data) {
+		if data, err = charmap.Windows1251.NewDecoder().Bytes(data); err != nil {
+			return nil, fmt.Errorf("failed to decode statement: %w", err)
+		}
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = detectDelimiter(data)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	var cols *columns
+	var transfers []Transfer
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse statement: %w", err)
+		}
+
+		if cols == nil {
+			cols = findColumns(record)
+			continue
+		}
+
+		line, _ := reader.FieldPos(0)
+		if t, ok := parseTransfer(record, *cols, currency, loc); ok {
+			t.Line = line
+			transfers = append(transfers, t)
+		}
+	}
+
+	if cols == nil {
+		return nil, ErrNoHeader
+	}
+	return transfers, nil
+}
+
+// detectDelimiter выбирает разделитель, который чаще всего встречается в первых строках файла
+func detectDelimiter(data []byte) rune {
+	head := data
+	for i, n := 0, 0; i < len(data); i++ {
+		if data[i] == '\n' {
+			if n++; n == 10 {
+				head = data[:i]
+				break
+			}
+		}
+	}
+
+	best, bestCount := ',', 0
+	for _, d := range []rune{';', '\t', ','} {
+		if count := bytes.Count(head, []byte(string(d))); count > bestCount {
+			best, bestCount = d, count
+		}
+	}
+	return best
+}
+
+// findColumns распознает строку заголовка. nil - строка не заголовок
+func findColumns(record []string) *columns {
+	header := make([]string, len(record))
+	for i, field := range record {
+		header[i] = strings.ToLower(strings.TrimSpace(field))
+	}
+
+	cols := &columns{
+		date:        findColumn(header, dateColumns),
+		amount:      findColumn(header, amountColumns),
+		credit:      findColumn(header, creditColumns),
+		currency:    findColumn(header, currencyColumns),
+		description: findColumn(header, descriptionColumns),
+		status:      findColumn(header, statusColumns),
+	}
+	if cols.date < 0 || (cols.amount < 0 && cols.credit < 0) {
+		return nil
+	}
+	return cols
+}
+
+// findColumn возвращает первую колонку, заголовок которой содержит одно из названий (по приоритету названий)
+func findColumn(header, names []string) int {
+	for _, name := range names {
+		for i, field := range header {
+			if strings.Contains(field, name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// parseTransfer разбирает строку выписки. false - строка не поступление: списание, отклоненная операция,
+// операция в другой валюте или итоговая строка
+func parseTransfer(record []string, cols columns, currency money.Currency, loc *time.Location) (Transfer, bool) {
+	field := func(i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	if status := strings.ToLower(field(cols.status)); status == "failed" || strings.HasPrefix(status, "отклон") {
+		return Transfer{}, false
+	}
+
+	if code := field(cols.currency); code != "" {
+		c, ok := parseCurrency(code)
+		if !ok {
+			return Transfer{}, false
+		}
+		currency = c
+	}
+
+	raw := field(cols.credit)
+	if raw == "" {
+		raw = field(cols.amount)
+	}
+	amount, err := parseAmount(raw, currency)
+	if err != nil || !amount.IsPositive() {
+		return Transfer{}, false
+	}
+
+	at, dateOnly, ok := parseTime(field(cols.date), loc)
+	if !ok {
+		return Transfer{}, false
+	}
+
+	return Transfer{Time: at, DateOnly: dateOnly, Amount: amount, Description: field(cols.description)}, true
+}
+
+// parseCurrency распознает валюту операции: код ISO 4217 или принятое в выписках обозначение
+func parseCurrency(code string) (money.Currency, bool) {
+	if c, err := money.ParseCurrency(code); err == nil {
+		return c, true
+	}
+	c, ok := currencyAliases[strings.ToUpper(code)]
+	return c, ok
+}
+
+// parseAmount разбирает сумму операции: "1 234,56", "+670.37", "1,234.56", "-500 ₽"
+func parseAmount(s string, currency money.Currency) (money.Money, error) {
+	var b strings.Builder
+	for _, r := range s {
+		if (r >= '0' && r <= '9') || r == ',' || r == '.' || r == '-' || r == '+' {
+			b.WriteRune(r)
+		}
+	}
+	s = strings.TrimRight(b.String(), ".,")
+
+	// Последний из знаков "," и "." - десятичный разделитель, если за ним не три цифры разряда
+	lastSep := strings.LastIndexAny(s, ",.")
+	if lastSep >= 0 && (len(s)-lastSep-1 == 3 || strings.Count(s, s[lastSep:lastSep+1]) > 1) {
+		lastSep = -1
+	}
+
+	var normalized strings.Builder
+	for i, r := range s {
+		switch {
+		case i == lastSep:
+			normalized.WriteRune('.')
+		case r == ',' || r == '.':
+		default:
+			normalized.WriteRune(r)
+		}
+	}
+
+	return money.Parse(normalized.String(), currency)
+}
+
+// parseTime разбирает дату операции. dateOnly - в выписке нет времени
+func parseTime(s string, loc *time.Location) (t time.Time, dateOnly bool, ok bool) {
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, !strings.Contains(layout, "15"), true
+		}
+	}
+	return time.Time{}, false, false
+}
+
+// MatchOrders сопоставляет поступления с заказами, ожидающими оплаты. Перевод подходит заказу, если совпадает
+// сумма перевода и он сделан не раньше создания заказа и не позже window после него.
+// Каждый заказ и каждый перевод сопоставляются не больше одного раза
+func MatchOrders(transfers []Transfer, orders []models.Order, window time.Duration) Result {
+	var result Result
+	used := make(map[string]bool, len(orders))
+
+	for _, t := range transfers {
+		var candidates []models.Order
+		for _, o := range orders {
+			if !used[o.OrderID] && o.TransferAmount() == t.Amount && inWindow(t, o, window) {
+				candidates = append(candidates, o)
+			}
+		}
+
+		// Среди одинаковых сумм выбирает номер заказа в описании перевода
+		if len(candidates) > 1 {
+			if byNumber := mentioned(candidates, t.Description); len(byNumber) > 0 {
+				candidates = byNumber
+			}
+		}
+
+		// Покупатель перевел цену без копеек, но указал номер заказа
+		if len(candidates) == 0 {
+			for _, o := range mentioned(orders, t.Description) {
+				if !used[o.OrderID] && o.Price == t.Amount && inWindow(t, o, window) {
+					candidates = append(candidates, o)
+				}
+			}
+		}
+
+		switch len(candidates) {
+		case 0:
+			result.Unmatched = append(result.Unmatched, t)
+		case 1:
+			used[candidates[0].OrderID] = true
+			result.Matches = append(result.Matches, Match{Transfer: t, Order: candidates[0]})
+		default:
+			result.Ambiguous = append(result.Ambiguous, t)
+		}
+	}
+
+	return result
+}
+
+// inWindow сообщает, сделан ли перевод в окне сверки заказа. Для выписок без времени сравнивается день
+func inWindow(t Transfer, o models.Order, window time.Duration) bool {
+	created := o.CreatedAt
+	if t.DateOnly {
+		created = created.In(t.Time.Location())
+		created = time.Date(created.Year(), created.Month(), created.Day(), 0, 0, 0, 0, created.Location())
+	}
+	return !t.Time.Before(created) && !t.Time.After(o.CreatedAt.Add(window))
+}
+
+// mentioned оставляет заказы, номер которых указан в описании перевода
+func mentioned(orders []models.Order, description string) []models.Order {
+	description = strings.ToUpper(description)
+
+	var result []models.Order
+	for _, o := range orders {
+		if o.OrderID != "" && containsWord(description, strings.ToUpper(o.OrderID)) {
+			result = append(result, o)
+		}
+	}
+	return result
+}
+
+// containsWord сообщает, что word входит в s отдельным словом: по краям нет букв и цифр.
+// Иначе 100-й заказ дня WOW2503101004 нашелся бы внутри номера 1004-го заказа WOW25031010041
+func containsWord(s, word string) bool {
+	for offset := 0; ; {
+		i := strings.Index(s[offset:], word)
+		if i < 0 {
+			return false
+		}
+		start, end := offset+i, offset+i+len(word)
+
+		before, _ := utf8.DecodeLastRuneInString(s[:start])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+// isWordRune сообщает, что символ - часть слова. utf8.RuneError - край строки
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
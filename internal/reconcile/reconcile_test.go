@@ -0,0 +1,180 @@
+package reconcile
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/charmap"
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+func TestParse(t *testing.T) {
+	moscow, _ := time.LoadLocation("Europe/Moscow")
+
+	// Выгрузка в духе интернет-банка: шапка до таблицы, списание, отклоненная операция, операция
+	// в чужой валюте и строка итогов
+	statement := "Выписка по счету 40817810000000000001\n" +
+		"\n" +
+		"Дата операции;Статус;Сумма операции;Валюта операции;Описание\n" +
+		"10.03.2025 14:05:10;OK;+670,37;RUB;Перевод от Иван И.\n" +
+		"10.03.2025 15:00:00;OK;-1 200,00;RUB;Оплата в магазине\n" +
+		"10.03.2025 15:10:00;FAILED;670,12;RUB;Перевод от Петр П.\n" +
+		"10.03.2025 16:00:00;OK;25,00;USD;Перевод из-за рубежа\n" +
+		"11.03.2025 09:30;OK;1 340,05;RUB;Перевод WP2503100027\n" +
+		"Итого;;1 340,42;;\n"
+
+	transfers, err := Parse(strings.NewReader(statement), money.KZT, moscow)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(transfers) != 2 {
+		t.Fatalf("Parse returned %d transfers, want 2: %+v", len(transfers), transfers)
+	}
+
+	first := transfers[0]
+	if first.Line != 4 || first.Amount != money.New(67037, money.RUB) || first.Description != "Перевод от Иван И." {
+		t.Errorf("first transfer = %+v", first)
+	}
+	if want := time.Date(2025, 3, 10, 14, 5, 10, 0, moscow); !first.Time.Equal(want) || first.DateOnly {
+		t.Errorf("first transfer time = %v (date only: %t), want %v", first.Time, first.DateOnly, want)
+	}
+	if second := transfers[1]; second.Amount != money.New(134005, money.RUB) {
+		t.Errorf("second transfer amount = %v, want 1 340,05 ₽", second.Amount)
+	}
+}
+
+func TestParse_Windows1251CommaSeparated(t *testing.T) {
+	statement, err := charmap.Windows1251.NewEncoder().String(
+		"Дата,Приход,Расход,Назначение платежа\n" +
+			"12.03.2025,\"2 500,99\",,Пополнение\n" +
+			"12.03.2025,,500.00,Комиссия\n",
+	)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	transfers, err := Parse(strings.NewReader(statement), money.UAH, time.UTC)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(transfers) != 1 {
+		t.Fatalf("Parse returned %d transfers, want 1: %+v", len(transfers), transfers)
+	}
+	if got := transfers[0]; got.Amount != money.New(250099, money.UAH) || !got.DateOnly || got.Description != "Пополнение" {
+		t.Errorf("transfer = %+v", got)
+	}
+}
+
+func TestParse_NoHeader(t *testing.T) {
+	if _, err := Parse(strings.NewReader("a;b;c\n1;2;3\n"), money.RUB, time.UTC); err != ErrNoHeader {
+		t.Errorf("Parse error = %v, want ErrNoHeader", err)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{in: "670,37", want: 67037},
+		{in: "+670.37", want: 67037},
+		{in: "1 234,56", want: 123456},
+		{in: "1,234.56", want: 123456},
+		{in: "1.234,56", want: 123456},
+		{in: "1,234", want: 123400},
+		{in: "-500 ₽", want: -50000},
+		{in: "2500", want: 250000},
+	}
+
+	for _, tt := range tests {
+		got, err := parseAmount(tt.in, money.RUB)
+		if err != nil || got.Amount != tt.want {
+			t.Errorf("parseAmount(%q) = %v, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestMatchOrders(t *testing.T) {
+	created := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	order := func(id string, price, offset int64) models.Order {
+		return models.Order{
+			OrderID:      id,
+			Price:        money.New(price, money.RUB),
+			AmountOffset: money.New(offset, money.RUB),
+			CreatedAt:    created,
+		}
+	}
+	transfer := func(amount int64, after time.Duration, description string) Transfer {
+		return Transfer{Time: created.Add(after), Amount: money.New(amount, money.RUB), Description: description}
+	}
+
+	orders := []models.Order{
+		order("WP1", 67000, 1),
+		order("WP2", 67000, 2),
+		order("WP3", 99000, 0),
+		order("WP4", 99000, 0),
+		order("WP5", 50000, 7),
+	}
+
+	result := MatchOrders([]Transfer{
+		transfer(67002, time.Hour, ""),                 // уникальная сумма
+		transfer(67001, -time.Hour, ""),                // раньше создания заказа
+		transfer(99000, time.Hour, "оплата"),           // две одинаковые суммы без номера
+		transfer(99000, time.Hour, "заказ wp4"),        // номер заказа выбирает среди одинаковых
+		transfer(50000, 2*time.Hour, "за заказ WP5"),   // без копеек, но с номером заказа
+		transfer(67002, 2*time.Hour, "повторный"),      // заказ уже сопоставлен
+		transfer(67001, 4*24*time.Hour, "через 4 дня"), // вне окна сверки
+	}, orders, 72*time.Hour)
+
+	var matched []string
+	for _, m := range result.Matches {
+		matched = append(matched, m.Order.OrderID)
+	}
+	if got := strings.Join(matched, ","); got != "WP2,WP4,WP5" {
+		t.Errorf("matched orders = %s, want WP2,WP4,WP5", got)
+	}
+	if len(result.Ambiguous) != 1 || result.Ambiguous[0].Description != "оплата" {
+		t.Errorf("ambiguous = %+v, want the transfer without order number", result.Ambiguous)
+	}
+	if len(result.Unmatched) != 3 {
+		t.Errorf("unmatched = %d transfers, want 3: %+v", len(result.Unmatched), result.Unmatched)
+	}
+}
+
+func TestMatchOrders_OrderNumberIsWholeWord(t *testing.T) {
+	created := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	short := models.Order{OrderID: "WOW2503101004", Price: money.New(67000, money.RUB), CreatedAt: created}
+	long := models.Order{OrderID: "WOW25031010041", Price: money.New(67000, money.RUB), CreatedAt: created}
+	transfer := func(description string) Transfer {
+		return Transfer{Time: created.Add(time.Hour), Amount: money.New(67000, money.RUB), Description: description}
+	}
+
+	result := MatchOrders([]Transfer{transfer("за заказ WOW25031010041")}, []models.Order{short, long}, 72*time.Hour)
+	if len(result.Matches) != 1 || result.Matches[0].Order.OrderID != long.OrderID {
+		t.Errorf("matches = %+v, want only %s", result.Matches, long.OrderID)
+	}
+
+	result = MatchOrders([]Transfer{transfer("заказ №WOW2503101004.")}, []models.Order{short, long}, 72*time.Hour)
+	if len(result.Matches) != 1 || result.Matches[0].Order.OrderID != short.OrderID {
+		t.Errorf("matches = %+v, want only %s", result.Matches, short.OrderID)
+	}
+}
+
+func TestMatchOrders_DateOnlyStatement(t *testing.T) {
+	moscow, _ := time.LoadLocation("Europe/Moscow")
+	o := models.Order{
+		OrderID:      "WP1",
+		Price:        money.New(67000, money.RUB),
+		AmountOffset: money.New(5, money.RUB),
+		CreatedAt:    time.Date(2025, 3, 10, 18, 30, 0, 0, moscow).UTC(),
+	}
+
+	// В выписке без времени перевод в день заказа датирован полуночью
+	sameDay := Transfer{Time: time.Date(2025, 3, 10, 0, 0, 0, 0, moscow), DateOnly: true, Amount: money.New(67005, money.RUB)}
+	result := MatchOrders([]Transfer{sameDay}, []models.Order{o}, 72*time.Hour)
+	if len(result.Matches) != 1 {
+		t.Errorf("date-only transfer on the order day was not matched: %+v", result)
+	}
+}
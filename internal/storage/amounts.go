@@ -0,0 +1,17 @@
+package storage
+
+import "tgwow/internal/money"
+
+// MaxAmountOffset - наибольшая надбавка к сумме перевода в минимальных единицах валюты (0,99)
+const MaxAmountOffset = 99
+
+// pickAmountOffset выбирает наименьшую надбавку, с которой сумма перевода по цене price
+// не совпадает ни с одной из занятых taken (в минимальных единицах). Ноль - все надбавки заняты
+func pickAmountOffset(price money.Money, taken map[int64]bool) money.Money {
+	for offset := int64(1); offset <= MaxAmountOffset; offset++ {
+		if !taken[price.Amount+offset] {
+			return money.New(offset, price.Currency)
+		}
+	}
+	return money.New(0, price.Currency)
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"fmt"
+
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+	"tgwow/internal/promo"
+)
+
+// cartLine - товар корзины с актуальными данными товара
+type cartLine struct {
+	product  models.Product
+	regionID int // Регион категории товара, нужен для промокодов
+	quantity int
+}
+
+// cartOrderItems превращает корзину в позиции заказа и считает итоговую сумму.
+// Скрытые товары и товары без цены оформить нельзя, валюта всех позиций должна совпадать
+func cartOrderItems(lines []cartLine) ([]models.OrderItem, money.Money, error) {
+	if len(lines) == 0 {
+		return nil, money.Money{}, ErrCartEmpty
+	}
+
+	var total money.Money
+	items := make([]models.OrderItem, 0, len(lines))
+
+	for _, line := range lines {
+		p := line.product
+		if !p.IsVisible || !p.Price.IsPositive() {
+			return nil, money.Money{}, fmt.Errorf("%w: %s", ErrProductUnavailable, p.Name)
+		}
+		if total.Currency != "" && p.Price.Currency != total.Currency {
+			return nil, money.Money{}, fmt.Errorf("%w: %s and %s", ErrCartMixedCurrency, total.Currency, p.Price.Currency)
+		}
+
+		item := models.OrderItem{
+			ProductID:      p.ID,
+			ProductName:    p.Name,
+			Price:          p.Price,
+			Quantity:       line.quantity,
+			DurationMonths: p.DurationMonths,
+		}
+		items = append(items, item)
+		total = total.Add(item.Total())
+	}
+
+	return items, total, nil
+}
+
+// promoLines описывает позиции заказа для проверки области действия промокода
+func promoLines(lines []cartLine) []promo.Line {
+	result := make([]promo.Line, 0, len(lines))
+	for _, line := range lines {
+		result = append(result, promo.Line{
+			ProductID:  line.product.ID,
+			CategoryID: line.product.CategoryID,
+			RegionID:   line.regionID,
+			Total:      line.product.Price.Mul(int64(line.quantity)),
+		})
+	}
+	return result
+}
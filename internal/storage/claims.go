@@ -0,0 +1,13 @@
+package storage
+
+import "tgwow/internal/models"
+
+// isClaimableStatus сообщает, можно ли взять заказ в работу: ожидает оплаты, выхода товара предзаказа
+// или оплачен, но не выдан
+func isClaimableStatus(status string) bool {
+	switch status {
+	case models.OrderStatusCreated, models.OrderStatusPreordered, models.OrderStatusPaid:
+		return true
+	}
+	return false
+}
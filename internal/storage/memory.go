@@ -0,0 +1,2314 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+	"tgwow/internal/orderid"
+	"tgwow/internal/promo"
+)
+
+// systemCategoryName - категория, скрытая из пользовательского каталога
+const systemCategoryName = "Системные услуги"
+
+// defaultWelcomeMessage совпадает с сообщением из миграции 010_create_bot_settings.sql
+const defaultWelcomeMessage = "👋 Добро пожаловать, {name}!\n\n🎮 Я бот для продажи игровых подписок World of Warcraft."
+
+// MemoryStorage - потокобезопасная in-memory реализация Store.
+// Используется в тестах handlers и для локального запуска бота без PostgreSQL
+type MemoryStorage struct {
+	mu sync.RWMutex
+
+	regions         map[int]*models.Region
+	categories      map[int]*models.Category
+	products        map[int]*models.Product
+	orders          map[string]*models.Order
+	orderItems      []models.OrderItem
+	remindedItems   map[int64]bool // позиции, о продлении которых уже напомнили
+	carts           map[int64][]models.CartItem
+	statusHistory   []models.OrderStatusChange
+	orderPayments   map[string]orderPayment // order_id -> платеж Telegram Payments
+	receipts        []models.OrderReceipt
+	productKeys     []models.ProductKey
+	promoCodes      []*models.PromoCode
+	users           map[int64]*models.User
+	referralRewards []models.ReferralReward
+	ledger          []models.LedgerTransaction
+	ledgerEntries   []models.LedgerEntry
+	supportMessages []models.SupportMessage
+	supportRelays   map[supportRelay]int64 // сообщение бота -> ID сообщения переписки
+	orderClaims     map[string]models.OrderClaim
+	adminNotices    []models.AdminNotification
+	payoutCards     []*models.PayoutCard
+	orderCards      map[string]int // order_id -> выданная карта для перевода
+	broadcasts      map[int]*models.Broadcast
+	broadcastPhotos map[int][]models.BroadcastPhoto
+	settings        models.BotSettings
+	orderCounters   map[string]int64 // YYYY-MM-DD -> последний номер заказа за день
+
+	nextRegionID    int
+	nextCategoryID  int
+	nextProductID   int
+	nextBroadcastID int
+	nextPhotoID     int
+	nextChangeID    int64
+	nextReceiptID   int64
+	nextKeyID       int64
+	nextItemID      int64
+	nextPromoID     int
+	nextRewardID    int
+	nextLedgerID    int64
+	nextEntryID     int64
+	nextSupportID   int64
+	nextCardID      int
+}
+
+// supportRelay - сообщение бота в чате, доставившее сообщение переписки
+type supportRelay struct {
+	chatID    int64
+	messageID int
+}
+
+// NewMemoryStorage создает пустое хранилище с настройками бота по умолчанию
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		regions:         make(map[int]*models.Region),
+		categories:      make(map[int]*models.Category),
+		products:        make(map[int]*models.Product),
+		orders:          make(map[string]*models.Order),
+		carts:           make(map[int64][]models.CartItem),
+		orderPayments:   make(map[string]orderPayment),
+		users:           make(map[int64]*models.User),
+		broadcasts:      make(map[int]*models.Broadcast),
+		broadcastPhotos: make(map[int][]models.BroadcastPhoto),
+		orderCounters:   make(map[string]int64),
+		supportRelays:   make(map[supportRelay]int64),
+		orderClaims:     make(map[string]models.OrderClaim),
+		remindedItems:   make(map[int64]bool),
+		orderCards:      make(map[string]int),
+		settings: models.BotSettings{
+			ID:             1,
+			WelcomeMessage: defaultWelcomeMessage,
+			UpdatedAt:      time.Now(),
+		},
+	}
+}
+
+// Close ничего не делает, нужен для соответствия интерфейсу Store
+func (s *MemoryStorage) Close() {}
+
+// ==================== SEED METHODS ====================
+
+// AddRegion добавляет регион (аналог INSERT из миграций)
+func (s *MemoryStorage) AddRegion(name, code string, currency money.Currency) *models.Region {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextRegionID++
+	r := &models.Region{ID: s.nextRegionID, Name: name, Code: code, Currency: currency, CreatedAt: time.Now()}
+	s.regions[r.ID] = r
+
+	copied := *r
+	return &copied
+}
+
+// AddCategory добавляет категорию в регион
+func (s *MemoryStorage) AddCategory(regionID int, name, description string, sortOrder int) *models.Category {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextCategoryID++
+	c := &models.Category{
+		ID:          s.nextCategoryID,
+		Name:        name,
+		RegionID:    regionID,
+		Description: description,
+		SortOrder:   sortOrder,
+		CreatedAt:   time.Now(),
+	}
+	s.categories[c.ID] = c
+
+	copied := *c
+	return &copied
+}
+
+// SeedDemoData заполняет хранилище небольшим каталогом для локального запуска:
+// регионы из 007_seed_regions.sql с валютами после 015_add_region_currency.sql,
+// подписки региона KZ и системная услуга "Сменить регион"
+func (s *MemoryStorage) SeedDemoData(ctx context.Context) error {
+	regionIDs := make(map[string]int)
+	for _, r := range []struct {
+		name, code string
+		currency   money.Currency
+	}{
+		{"WoW KZ", "KZ", money.RUB}, {"WoW UA", "UA", money.UAH}, {"WoW EU", "EU", money.EUR}, {"WoW TUR", "TUR", money.TRY},
+	} {
+		regionIDs[r.code] = s.AddRegion(r.name, r.code, r.currency).ID
+	}
+
+	subscriptions := s.AddCategory(regionIDs["KZ"], "Подписка WOW", "", 1)
+	system := s.AddCategory(regionIDs["KZ"], systemCategoryName, "Специальные услуги системы", 99)
+
+	products := []struct {
+		name        string
+		categoryID  int
+		price       int64 // в валюте региона KZ
+		months      int   // срок подписки, как после 027_add_subscription_duration.sql
+		description string
+	}{
+		{"1 месяц", subscriptions.ID, 670, 1, "Игровое время World of Warcraft на 1 месяц. Доступ ко всем дополнениям."},
+		{"3 месяца", subscriptions.ID, 1900, 3, "Игровое время World of Warcraft на 3 месяца. Выгодное предложение!"},
+		{"6 месяцев", subscriptions.ID, 3369, 6, "Игровое время World of Warcraft на 6 месяцев. Максимальная выгода!"},
+		{"12 месяцев", subscriptions.ID, 6729, 12, "Игровое время World of Warcraft на 12 месяцев. Лучшая цена!"},
+		{"Сменить регион", system.ID, 1749, 0, "Смена региона аккаунта World of Warcraft."},
+	}
+
+	for _, p := range products {
+		created, err := s.CreateProduct(ctx, p.name, p.categoryID, money.FromMajor(p.price, money.RUB), p.description)
+		if err != nil {
+			return err
+		}
+		if err := s.UpdateProductDuration(ctx, created.ID, p.months); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ==================== REGIONS & CATEGORIES ====================
+
+// ListRegions возвращает все регионы
+func (s *MemoryStorage) ListRegions(ctx context.Context) ([]models.Region, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var regions []models.Region
+	for _, r := range s.regions {
+		regions = append(regions, *r)
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].ID < regions[j].ID })
+
+	return regions, nil
+}
+
+// GetRegionByID возвращает регион по ID
+func (s *MemoryStorage) GetRegionByID(ctx context.Context, regionID int) (*models.Region, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.regions[regionID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get region: %w", ErrNotFound)
+	}
+
+	copied := *r
+	return &copied, nil
+}
+
+// UpdateRegionCurrency меняет валюту региона. Цены товаров не пересчитываются
+func (s *MemoryStorage) UpdateRegionCurrency(ctx context.Context, regionID int, currency money.Currency) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.regions[regionID]; ok {
+		r.Currency = currency
+	}
+
+	return nil
+}
+
+// ListCategoriesByRegion возвращает категории для региона (без системных)
+func (s *MemoryStorage) ListCategoriesByRegion(ctx context.Context, regionID int) ([]models.Category, error) {
+	return s.filterCategories(func(c *models.Category) bool {
+		return c.RegionID == regionID && c.Name != systemCategoryName
+	}), nil
+}
+
+// ListAllCategoriesByRegion возвращает все категории для региона (включая системные)
+func (s *MemoryStorage) ListAllCategoriesByRegion(ctx context.Context, regionID int) ([]models.Category, error) {
+	return s.filterCategories(func(c *models.Category) bool {
+		return c.RegionID == regionID
+	}), nil
+}
+
+// ListAllCategories возвращает все категории
+func (s *MemoryStorage) ListAllCategories(ctx context.Context) ([]models.Category, error) {
+	return s.filterCategories(func(c *models.Category) bool { return true }), nil
+}
+
+// filterCategories возвращает отсортированные копии категорий, подходящих под условие
+func (s *MemoryStorage) filterCategories(match func(c *models.Category) bool) []models.Category {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var categories []models.Category
+	for _, c := range s.categories {
+		if match(c) {
+			categories = append(categories, *c)
+		}
+	}
+
+	sort.Slice(categories, func(i, j int) bool {
+		a, b := categories[i], categories[j]
+		if a.RegionID != b.RegionID {
+			return a.RegionID < b.RegionID
+		}
+		if a.SortOrder != b.SortOrder {
+			return a.SortOrder < b.SortOrder
+		}
+		return a.ID < b.ID
+	})
+
+	return categories
+}
+
+// GetCategoryByID возвращает категорию по ID
+func (s *MemoryStorage) GetCategoryByID(ctx context.Context, categoryID int) (*models.Category, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.categories[categoryID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get category: %w", ErrNotFound)
+	}
+
+	copied := *c
+	return &copied, nil
+}
+
+// UpdateCategory обновляет название и описание категории
+func (s *MemoryStorage) UpdateCategory(ctx context.Context, categoryID int, name string, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.categories[categoryID]; ok {
+		c.Name = name
+		c.Description = description
+	}
+
+	return nil
+}
+
+// ==================== PRODUCTS ====================
+
+// ListProductsByCategory возвращает видимые товары категории
+func (s *MemoryStorage) ListProductsByCategory(ctx context.Context, categoryID int) ([]models.Product, error) {
+	return s.filterProducts(func(p *models.Product) bool {
+		return p.CategoryID == categoryID && p.IsVisible
+	}), nil
+}
+
+// ListAllProductsByCategory возвращает все товары категории (включая скрытые)
+func (s *MemoryStorage) ListAllProductsByCategory(ctx context.Context, categoryID int) ([]models.Product, error) {
+	return s.filterProducts(func(p *models.Product) bool {
+		return p.CategoryID == categoryID
+	}), nil
+}
+
+// ListProducts возвращает все видимые товары
+func (s *MemoryStorage) ListProducts(ctx context.Context) ([]models.Product, error) {
+	return s.filterProducts(func(p *models.Product) bool { return p.IsVisible }), nil
+}
+
+// ListAllProducts возвращает все товары (включая скрытые)
+func (s *MemoryStorage) ListAllProducts(ctx context.Context) ([]models.Product, error) {
+	return s.filterProducts(func(p *models.Product) bool { return true }), nil
+}
+
+// filterProducts возвращает отсортированные копии товаров, подходящих под условие
+func (s *MemoryStorage) filterProducts(match func(p *models.Product) bool) []models.Product {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var products []models.Product
+	for _, p := range s.products {
+		if match(p) {
+			products = append(products, s.productCopy(p))
+		}
+	}
+
+	sort.Slice(products, func(i, j int) bool {
+		a, b := products[i], products[j]
+		if a.CategoryID != b.CategoryID {
+			return a.CategoryID < b.CategoryID
+		}
+		if a.SortOrder != b.SortOrder {
+			return a.SortOrder < b.SortOrder
+		}
+		return a.ID < b.ID
+	})
+
+	return products
+}
+
+// GetProductByID возвращает товар по ID
+func (s *MemoryStorage) GetProductByID(ctx context.Context, productID int) (*models.Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.products[productID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get product: %w", ErrNotFound)
+	}
+
+	copied := s.productCopy(p)
+	return &copied, nil
+}
+
+// GetProductsByIDs возвращает товары по списку ID
+func (s *MemoryStorage) GetProductsByIDs(ctx context.Context, productIDs []int) (map[int]*models.Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	products := make(map[int]*models.Product, len(productIDs))
+	for _, id := range productIDs {
+		if p, ok := s.products[id]; ok {
+			copied := s.productCopy(p)
+			products[id] = &copied
+		}
+	}
+
+	return products, nil
+}
+
+// GetChangeRegionProduct возвращает товар "Сменить регион" из категории "Системные услуги"
+func (s *MemoryStorage) GetChangeRegionProduct(ctx context.Context) (*models.Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found *models.Product
+	for _, p := range s.products {
+		c, ok := s.categories[p.CategoryID]
+		if !ok || c.Name != systemCategoryName || p.Name != "Сменить регион" {
+			continue
+		}
+		if found == nil || p.ID < found.ID {
+			found = p
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("failed to get change region product: %w", ErrNotFound)
+	}
+
+	copied := s.productCopy(found)
+	return &copied, nil
+}
+
+// CreateProduct создает новый видимый товар
+func (s *MemoryStorage) CreateProduct(ctx context.Context, name string, categoryID int, price money.Money, description string) (*models.Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.categories[categoryID]; !ok {
+		return nil, fmt.Errorf("failed to create product: category %d: %w", categoryID, ErrNotFound)
+	}
+
+	s.nextProductID++
+	p := &models.Product{
+		ID:          s.nextProductID,
+		Name:        name,
+		CategoryID:  categoryID,
+		Price:       price,
+		Description: description,
+		IsVisible:   true,
+		CreatedAt:   time.Now(),
+	}
+	s.products[p.ID] = p
+
+	copied := s.productCopy(p)
+	return &copied, nil
+}
+
+// productCopy возвращает копию товара с валютой его региона, как JOIN в PostgresStorage.
+// Вызывается под s.mu
+func (s *MemoryStorage) productCopy(p *models.Product) models.Product {
+	copied := *p
+	copied.Price.Currency = money.DefaultCurrency
+	if c, ok := s.categories[p.CategoryID]; ok {
+		if r, ok := s.regions[c.RegionID]; ok {
+			copied.Price.Currency = r.Currency
+		}
+	}
+	return copied
+}
+
+// UpdateProduct обновляет информацию о товаре
+func (s *MemoryStorage) UpdateProduct(ctx context.Context, productID int, name string, price money.Money, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.products[productID]; ok {
+		p.Name = name
+		p.Price = price
+		p.Description = description
+	}
+
+	return nil
+}
+
+// UpdateProductPrice обновляет цену товара
+func (s *MemoryStorage) UpdateProductPrice(ctx context.Context, productID int, newPrice money.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.products[productID]; ok {
+		p.Price = newPrice
+	}
+
+	return nil
+}
+
+// UpdateProductVisibility изменяет видимость товара
+func (s *MemoryStorage) UpdateProductVisibility(ctx context.Context, productID int, isVisible bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.products[productID]; ok {
+		p.IsVisible = isVisible
+	}
+
+	return nil
+}
+
+// UpdateProductDuration изменяет срок подписки товара в месяцах. 0 - товар не подписка
+func (s *MemoryStorage) UpdateProductDuration(ctx context.Context, productID int, months int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.products[productID]; ok {
+		p.DurationMonths = months
+	}
+
+	return nil
+}
+
+// UpdateProductRelease задает дату выхода товара предзаказа. nil - обычный товар
+func (s *MemoryStorage) UpdateProductRelease(ctx context.Context, productID int, releaseAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.products[productID]; ok {
+		p.ReleaseAt = releaseAt
+	}
+
+	return nil
+}
+
+// DeleteProduct удаляет товар
+func (s *MemoryStorage) DeleteProduct(ctx context.Context, productID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.products, productID)
+	return nil
+}
+
+// ==================== ORDERS ====================
+
+// CreateOrder создает заказ на один товар в статусе created
+func (s *MemoryStorage) CreateOrder(ctx context.Context, userID int64, productID int, price money.Money, paymentMethod string, promoCode string) (*models.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.products[productID]
+	if !ok {
+		return nil, fmt.Errorf("failed to create order: product %d: %w", productID, ErrNotFound)
+	}
+
+	product := s.productCopy(p)
+	product.Price = price
+	draft := models.Order{UserID: userID, ProductID: productID, Price: price, PaymentMethod: paymentMethod}
+	if err := s.applyPromoCode(&draft, promoCode, []cartLine{s.cartLine(product, 1)}); err != nil {
+		return nil, fmt.Errorf("failed to create order: %w", err)
+	}
+
+	item := models.OrderItem{
+		ProductID:      productID,
+		ProductName:    p.Name,
+		Price:          price,
+		Quantity:       1,
+		DurationMonths: p.DurationMonths,
+	}
+	o := s.insertOrder(draft, []models.OrderItem{item})
+
+	copied := *o
+	return &copied, nil
+}
+
+// CheckoutCart оформляет корзину покупателя одним заказом и очищает ее
+func (s *MemoryStorage) CheckoutCart(ctx context.Context, userID int64, paymentMethod string, promoCode string) (*models.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lines []cartLine
+	for _, c := range s.carts[userID] {
+		p, ok := s.products[c.ProductID]
+		if !ok {
+			continue
+		}
+		lines = append(lines, s.cartLine(s.productCopy(p), c.Quantity))
+	}
+
+	items, total, err := cartOrderItems(lines)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checkout cart: %w", err)
+	}
+
+	draft := models.Order{UserID: userID, Price: total, PaymentMethod: paymentMethod}
+	if err := s.applyPromoCode(&draft, promoCode, lines); err != nil {
+		return nil, fmt.Errorf("failed to checkout cart: %w", err)
+	}
+
+	o := s.insertOrder(draft, items)
+	delete(s.carts, userID)
+
+	copied := *o
+	return &copied, nil
+}
+
+// cartLine дополняет товар регионом его категории. Вызывается под s.mu
+func (s *MemoryStorage) cartLine(product models.Product, quantity int) cartLine {
+	line := cartLine{product: product, quantity: quantity}
+	if c, ok := s.categories[product.CategoryID]; ok {
+		line.regionID = c.RegionID
+	}
+	return line
+}
+
+// applyPromoCode проверяет промокод и вычитает скидку из суммы заказа. Вызывается под s.mu
+func (s *MemoryStorage) applyPromoCode(order *models.Order, code string, lines []cartLine) error {
+	if code == "" {
+		return nil
+	}
+
+	var pc *models.PromoCode
+	for _, p := range s.promoCodes {
+		if p.Code == code {
+			pc = p
+		}
+	}
+	if pc == nil {
+		return promo.ErrUnknown
+	}
+
+	usage := s.promoUsage(code, order.UserID)
+
+	discount, err := promo.Discount(*pc, promoLines(lines), usage, time.Now())
+	if err != nil {
+		return err
+	}
+
+	order.PromoCode = pc.Code
+	order.Discount = discount
+	order.Price = order.Price.Sub(discount)
+	return nil
+}
+
+// promoUsage считает использования промокода и неотмененные заказы покупателя. Вызывается под s.mu
+func (s *MemoryStorage) promoUsage(code string, userID int64) promo.Usage {
+	var usage promo.Usage
+	for _, o := range s.orders {
+		if o.Status == models.OrderStatusCancelled {
+			continue
+		}
+		if o.PromoCode == code {
+			usage.Total++
+			if o.UserID == userID {
+				usage.ByUser++
+			}
+		}
+		if o.UserID == userID {
+			usage.HasOrders = true
+		}
+	}
+	return usage
+}
+
+// insertOrder добавляет заказ с позициями и запись о создании в историю. Вызывается под s.mu.
+// Номер, статус и дату создания заказа задает хранилище
+func (s *MemoryStorage) insertOrder(draft models.Order, items []models.OrderItem) *models.Order {
+	now := time.Now()
+	day := now.Format("2006-01-02")
+	// Как и в PostgreSQL, счетчик пропускает уже занятые номера дня
+	s.orderCounters[day]++
+	for s.orders[orderid.New(now, s.orderCounters[day])] != nil {
+		s.orderCounters[day]++
+	}
+
+	o := &draft
+	o.OrderID = orderid.New(now, s.orderCounters[day])
+	o.Status = models.OrderStatusCreated
+	o.CreatedAt = now
+	o.Discount.Currency = o.Price.Currency
+	o.BalanceUsed.Currency = o.Price.Currency
+	s.orders[o.OrderID] = o
+
+	for _, item := range items {
+		s.nextItemID++
+		item.ID = s.nextItemID
+		item.OrderID = o.OrderID
+		s.orderItems = append(s.orderItems, item)
+	}
+
+	s.recordStatusChange(o.OrderID, "", models.OrderStatusCreated, o.UserID, "")
+	return o
+}
+
+// GetOrderItems возвращает позиции заказа
+func (s *MemoryStorage) GetOrderItems(ctx context.Context, orderID string) ([]models.OrderItem, error) {
+	items, _ := s.GetOrderItemsByOrderIDs(ctx, []string{orderID})
+	return items[orderID], nil
+}
+
+// GetOrderItemsByOrderIDs возвращает позиции нескольких заказов
+func (s *MemoryStorage) GetOrderItemsByOrderIDs(ctx context.Context, orderIDs []string) (map[string][]models.OrderItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	wanted := make(map[string]bool, len(orderIDs))
+	for _, id := range orderIDs {
+		wanted[id] = true
+	}
+
+	result := make(map[string][]models.OrderItem, len(orderIDs))
+	for _, item := range s.orderItems {
+		if wanted[item.OrderID] {
+			result[item.OrderID] = append(result[item.OrderID], item)
+		}
+	}
+
+	return result, nil
+}
+
+// GetOrderByID возвращает заказ по ID
+func (s *MemoryStorage) GetOrderByID(ctx context.Context, orderID string) (*models.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	o, ok := s.orders[orderID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get order: %w", ErrNotFound)
+	}
+
+	copied := *o
+	return &copied, nil
+}
+
+// GetUserOrders возвращает заказы пользователя, новые первыми: limit заказов, пропустив offset.
+// limit 0 - все заказы
+func (s *MemoryStorage) GetUserOrders(ctx context.Context, userID int64, offset, limit int) ([]models.Order, error) {
+	orders := s.sortedOrders(func(o *models.Order) bool { return o.UserID == userID }, 0)
+	if offset >= len(orders) {
+		return nil, nil
+	}
+
+	orders = orders[offset:]
+	if limit > 0 && len(orders) > limit {
+		orders = orders[:limit]
+	}
+	return orders, nil
+}
+
+// GetPendingOrders возвращает неоплаченные заказы пользователя (статус created), новые первыми
+func (s *MemoryStorage) GetPendingOrders(ctx context.Context, userID int64) ([]models.Order, error) {
+	return s.sortedOrders(func(o *models.Order) bool {
+		return o.UserID == userID && o.Status == models.OrderStatusCreated
+	}, 0), nil
+}
+
+// ListOrders возвращает заказы, подходящие под фильтр, новые первыми: limit заказов, пропустив offset.
+// limit 0 - все заказы
+func (s *MemoryStorage) ListOrders(ctx context.Context, filter models.OrderFilter, offset, limit int) ([]models.Order, error) {
+	orders := s.sortedOrders(func(o *models.Order) bool {
+		switch {
+		case filter.Status != "" && o.Status != filter.Status,
+			filter.RegionID != 0 && !s.orderInRegion(o.OrderID, filter.RegionID),
+			filter.From != nil && o.CreatedAt.Before(*filter.From),
+			filter.Until != nil && !o.CreatedAt.Before(*filter.Until),
+			filter.UserID != 0 && o.UserID != filter.UserID:
+			return false
+		}
+		return true
+	}, 0)
+	if offset >= len(orders) {
+		return nil, nil
+	}
+
+	orders = orders[offset:]
+	if limit > 0 && len(orders) > limit {
+		orders = orders[:limit]
+	}
+	return orders, nil
+}
+
+// orderInRegion сообщает, есть ли в заказе товар региона. Вызывается под s.mu
+func (s *MemoryStorage) orderInRegion(orderID string, regionID int) bool {
+	for _, item := range s.orderItems {
+		if item.OrderID != orderID {
+			continue
+		}
+		p, ok := s.products[item.ProductID]
+		if !ok {
+			continue
+		}
+		if c, ok := s.categories[p.CategoryID]; ok && c.RegionID == regionID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRecentOrders возвращает последние заказы
+func (s *MemoryStorage) GetRecentOrders(ctx context.Context, limit int) ([]models.Order, error) {
+	return s.sortedOrders(func(o *models.Order) bool { return true }, limit), nil
+}
+
+// ListUnpaidOrdersBefore возвращает заказы в статусе created, созданные раньше before (старые первыми).
+// Заказы с непроверенным чеком пропускаются: их оплату еще должен подтвердить админ
+func (s *MemoryStorage) ListUnpaidOrdersBefore(ctx context.Context, before time.Time, limit int) ([]models.Order, error) {
+	orders := s.sortedOrders(func(o *models.Order) bool {
+		return o.Status == models.OrderStatusCreated && o.CreatedAt.Before(before) && !s.hasPendingReceipt(o.OrderID)
+	}, 0)
+
+	// sortedOrders сортирует новые первыми, здесь нужен обратный порядок
+	for i, j := 0, len(orders)-1; i < j; i, j = i+1, j-1 {
+		orders[i], orders[j] = orders[j], orders[i]
+	}
+	if limit > 0 && len(orders) > limit {
+		orders = orders[:limit]
+	}
+
+	return orders, nil
+}
+
+// sortedOrders возвращает копии подходящих заказов по убыванию даты создания.
+// limit <= 0 означает "без ограничения"
+func (s *MemoryStorage) sortedOrders(match func(o *models.Order) bool, limit int) []models.Order {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var orders []models.Order
+	for _, o := range s.orders {
+		if match(o) {
+			orders = append(orders, *o)
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].CreatedAt.Equal(orders[j].CreatedAt) {
+			return orders[i].CreatedAt.After(orders[j].CreatedAt)
+		}
+		return orders[i].OrderID > orders[j].OrderID
+	})
+
+	if limit > 0 && len(orders) > limit {
+		orders = orders[:limit]
+	}
+
+	return orders
+}
+
+// paidStatus заменяет paid на preordered, если оплачивается новый заказ с товаром, который еще не вышел.
+// Вызывается под s.mu
+func (s *MemoryStorage) paidStatus(o *models.Order, status string, now time.Time) string {
+	if o.Status != models.OrderStatusCreated || status != models.OrderStatusPaid {
+		return status
+	}
+	if s.hasUnreleasedItems(o.OrderID, now) {
+		return models.OrderStatusPreordered
+	}
+	return status
+}
+
+// hasUnreleasedItems сообщает, есть ли в заказе товар, который выйдет позже now. Вызывается под s.mu
+func (s *MemoryStorage) hasUnreleasedItems(orderID string, now time.Time) bool {
+	for _, item := range s.orderItems {
+		if item.OrderID != orderID {
+			continue
+		}
+		if p, ok := s.products[item.ProductID]; ok && p.IsPreorder(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateOrderStatus переводит заказ в новый статус по тем же правилам, что и PostgresStorage
+func (s *MemoryStorage) UpdateOrderStatus(ctx context.Context, orderID string, status string, actorID int64, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[orderID]
+	if !ok {
+		return fmt.Errorf("failed to update order status: %w", ErrNotFound)
+	}
+
+	if !models.CanTransitionOrder(o.Status, status) {
+		return fmt.Errorf("failed to update order status: %w: %s -> %s", ErrInvalidTransition, o.Status, status)
+	}
+
+	status = s.paidStatus(o, status, time.Now())
+	s.recordStatusChange(orderID, o.Status, status, actorID, reason)
+	o.Status = status
+	s.updateSubscriptionExpiry(o, time.Now())
+
+	// Списанное с баланса за неоплаченный заказ возвращается покупателю
+	if status == models.OrderStatusCancelled && o.BalanceUsed.IsPositive() {
+		s.addLedgerTransaction(models.LedgerTransaction{
+			Kind:    models.LedgerKindCheckoutReversal,
+			UserID:  o.UserID,
+			OrderID: orderID,
+			ActorID: actorID,
+			Reason:  reason,
+			Amount:  o.BalanceUsed,
+		}, models.LedgerAccountSales)
+	}
+
+	return nil
+}
+
+// updateSubscriptionExpiry считает окончание подписок выполненного заказа и снимает его с возвращенного,
+// как PostgresStorage. Вызывается под s.mu
+func (s *MemoryStorage) updateSubscriptionExpiry(o *models.Order, now time.Time) {
+	for i := range s.orderItems {
+		item := &s.orderItems[i]
+		if item.OrderID != o.OrderID {
+			continue
+		}
+
+		switch o.Status {
+		case models.OrderStatusCompleted:
+			if item.DurationMonths == 0 {
+				continue
+			}
+			// Продление, выполненное до окончания, добавляет срок к действующей подписке
+			start := now
+			if prev := s.latestExpiry(o.UserID, item.ProductID, o.OrderID); prev != nil && prev.After(start) {
+				start = *prev
+			}
+			expiresAt := start.AddDate(0, item.DurationMonths*item.Quantity, 0)
+			item.ExpiresAt = &expiresAt
+		case models.OrderStatusRefunded:
+			item.ExpiresAt = nil
+		}
+	}
+}
+
+// latestExpiry возвращает самое позднее окончание подписки покупателя на товар в других заказах.
+// Вызывается под s.mu
+func (s *MemoryStorage) latestExpiry(userID int64, productID int, exceptOrderID string) *time.Time {
+	var latest *time.Time
+	for _, item := range s.orderItems {
+		if item.ProductID != productID || item.OrderID == exceptOrderID || item.ExpiresAt == nil {
+			continue
+		}
+		if o, ok := s.orders[item.OrderID]; !ok || o.UserID != userID {
+			continue
+		}
+		if latest == nil || item.ExpiresAt.After(*latest) {
+			latest = item.ExpiresAt
+		}
+	}
+	return latest
+}
+
+// orderPayment - идентификаторы платежа Telegram Payments
+type orderPayment struct {
+	telegramChargeID string
+	providerChargeID string
+}
+
+// SaveOrderPayment сохраняет идентификаторы платежа Telegram Payments для заказа
+func (s *MemoryStorage) SaveOrderPayment(ctx context.Context, orderID, telegramChargeID, providerChargeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[orderID]; !ok {
+		return fmt.Errorf("failed to save order payment: %w", ErrNotFound)
+	}
+
+	s.orderPayments[orderID] = orderPayment{telegramChargeID: telegramChargeID, providerChargeID: providerChargeID}
+	return nil
+}
+
+// AddOrderReceipt сохраняет чек об оплате заказа в статусе pending
+func (s *MemoryStorage) AddOrderReceipt(ctx context.Context, orderID string, userID int64, fileID, fileType string) (*models.OrderReceipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[orderID]; !ok {
+		return nil, fmt.Errorf("failed to add order receipt: %w", ErrNotFound)
+	}
+
+	s.nextReceiptID++
+	r := models.OrderReceipt{
+		ID:        s.nextReceiptID,
+		OrderID:   orderID,
+		UserID:    userID,
+		FileID:    fileID,
+		FileType:  fileType,
+		Status:    models.ReceiptStatusPending,
+		CreatedAt: time.Now(),
+	}
+	s.receipts = append(s.receipts, r)
+
+	return &r, nil
+}
+
+// GetOrderReceipts возвращает чеки заказа в порядке загрузки
+func (s *MemoryStorage) GetOrderReceipts(ctx context.Context, orderID string) ([]models.OrderReceipt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var receipts []models.OrderReceipt
+	for _, r := range s.receipts {
+		if r.OrderID == orderID {
+			receipts = append(receipts, r)
+		}
+	}
+
+	return receipts, nil
+}
+
+// ReviewOrderReceipts отмечает все непроверенные чеки заказа как принятые или отклоненные
+func (s *MemoryStorage) ReviewOrderReceipts(ctx context.Context, orderID string, status string, reviewerID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.receipts {
+		if s.receipts[i].OrderID == orderID && s.receipts[i].Status == models.ReceiptStatusPending {
+			s.receipts[i].Status = status
+		}
+	}
+
+	return nil
+}
+
+// hasPendingReceipt сообщает, есть ли у заказа непроверенный чек. Вызывается под s.mu
+func (s *MemoryStorage) hasPendingReceipt(orderID string) bool {
+	for _, r := range s.receipts {
+		if r.OrderID == orderID && r.Status == models.ReceiptStatusPending {
+			return true
+		}
+	}
+	return false
+}
+
+// recordStatusChange добавляет запись в историю статусов. Вызывается под s.mu
+func (s *MemoryStorage) recordStatusChange(orderID, from, to string, actorID int64, reason string) {
+	s.nextChangeID++
+	s.statusHistory = append(s.statusHistory, models.OrderStatusChange{
+		ID:         s.nextChangeID,
+		OrderID:    orderID,
+		FromStatus: from,
+		ToStatus:   to,
+		ActorID:    actorID,
+		Reason:     reason,
+		CreatedAt:  time.Now(),
+	})
+}
+
+// GetOrderStatusHistory возвращает историю статусов заказа в хронологическом порядке
+func (s *MemoryStorage) GetOrderStatusHistory(ctx context.Context, orderID string) ([]models.OrderStatusChange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var history []models.OrderStatusChange
+	for _, c := range s.statusHistory {
+		if c.OrderID == orderID {
+			history = append(history, c)
+		}
+	}
+
+	return history, nil
+}
+
+// GetOrderStats возвращает статистику заказов в том же формате, что и PostgresStorage
+func (s *MemoryStorage) GetOrderStats(ctx context.Context) (map[string]interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var totalOrders, pendingOrders, paidOrders, completedOrders, promoOrders int
+	revenueByCurrency := make(map[money.Currency]money.Money)
+	discountsByCurrency := make(map[money.Currency]money.Money)
+
+	for _, o := range s.orders {
+		totalOrders++
+		switch o.Status {
+		case models.OrderStatusCreated:
+			pendingOrders++
+			continue
+		case models.OrderStatusPreordered:
+		case models.OrderStatusPaid:
+			paidOrders++
+		case models.OrderStatusCompleted:
+			completedOrders++
+		default:
+			continue
+		}
+
+		revenueByCurrency[o.Price.Currency] = revenueByCurrency[o.Price.Currency].Add(o.Price)
+		if o.PromoCode != "" {
+			promoOrders++
+			discountsByCurrency[o.Price.Currency] = discountsByCurrency[o.Price.Currency].Add(o.Discount)
+		}
+	}
+
+	stats := map[string]interface{}{
+		"total_orders":     totalOrders,
+		"pending_orders":   pendingOrders,
+		"paid_orders":      paidOrders,
+		"completed_orders": completedOrders,
+		"revenue":          sortedByCurrency(revenueByCurrency),
+		"promo_orders":     promoOrders,
+		"discounts":        sortedByCurrency(discountsByCurrency),
+	}
+
+	return stats, nil
+}
+
+// sortedByCurrency возвращает суммы по валютам в алфавитном порядке валют, как ORDER BY currency
+func sortedByCurrency(byCurrency map[money.Currency]money.Money) []money.Money {
+	var result []money.Money
+	for _, total := range byCurrency {
+		result = append(result, total)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Currency < result[j].Currency })
+	return result
+}
+
+// ==================== CART ====================
+
+// GetCart возвращает корзину покупателя в порядке добавления товаров
+func (s *MemoryStorage) GetCart(ctx context.Context, userID int64) ([]models.CartItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]models.CartItem(nil), s.carts[userID]...), nil
+}
+
+// AddToCart добавляет товар в корзину или увеличивает его количество
+func (s *MemoryStorage) AddToCart(ctx context.Context, userID int64, productID int, quantity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.products[productID]; !ok {
+		return fmt.Errorf("failed to add to cart: %w", ErrNotFound)
+	}
+
+	cart := s.carts[userID]
+	for i := range cart {
+		if cart[i].ProductID == productID {
+			cart[i].Quantity += quantity
+			return nil
+		}
+	}
+
+	s.carts[userID] = append(cart, models.CartItem{UserID: userID, ProductID: productID, Quantity: quantity, AddedAt: time.Now()})
+	return nil
+}
+
+// SetCartItemQuantity меняет количество товара в корзине; 0 убирает товар из корзины
+func (s *MemoryStorage) SetCartItemQuantity(ctx context.Context, userID int64, productID int, quantity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cart := s.carts[userID]
+	for i := range cart {
+		if cart[i].ProductID != productID {
+			continue
+		}
+		if quantity <= 0 {
+			s.carts[userID] = append(cart[:i:i], cart[i+1:]...)
+		} else {
+			cart[i].Quantity = quantity
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// ClearCart очищает корзину покупателя
+func (s *MemoryStorage) ClearCart(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.carts, userID)
+	return nil
+}
+
+// ==================== PROMO CODES ====================
+
+// CreatePromoCode создает промокод. ErrAlreadyExists - такой код уже есть
+func (s *MemoryStorage) CreatePromoCode(ctx context.Context, code models.PromoCode) (*models.PromoCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.promoCodes {
+		if p.Code == code.Code {
+			return nil, fmt.Errorf("failed to create promo code: %w", ErrAlreadyExists)
+		}
+	}
+
+	s.nextPromoID++
+	code.ID = s.nextPromoID
+	code.IsActive = true
+	code.Uses = 0
+	code.CreatedAt = time.Now()
+	s.promoCodes = append(s.promoCodes, &code)
+
+	copied := code
+	return &copied, nil
+}
+
+// GetPromoCode возвращает промокод по коду
+func (s *MemoryStorage) GetPromoCode(ctx context.Context, code string) (*models.PromoCode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.promoCodes {
+		if p.Code == code {
+			return s.promoCodeCopy(p), nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to get promo code: %w", ErrNotFound)
+}
+
+// ListPromoCodes возвращает все промокоды, новые первыми
+func (s *MemoryStorage) ListPromoCodes(ctx context.Context) ([]models.PromoCode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	codes := make([]models.PromoCode, 0, len(s.promoCodes))
+	for i := len(s.promoCodes) - 1; i >= 0; i-- {
+		codes = append(codes, *s.promoCodeCopy(s.promoCodes[i]))
+	}
+
+	return codes, nil
+}
+
+// promoCodeCopy возвращает копию промокода с числом использований. Вызывается под s.mu
+func (s *MemoryStorage) promoCodeCopy(p *models.PromoCode) *models.PromoCode {
+	copied := *p
+	copied.Uses = 0
+	for _, o := range s.orders {
+		if o.PromoCode == p.Code && o.Status != models.OrderStatusCancelled {
+			copied.Uses++
+		}
+	}
+	return &copied
+}
+
+// SetPromoCodeActive включает или выключает промокод
+func (s *MemoryStorage) SetPromoCodeActive(ctx context.Context, promoCodeID int, isActive bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.promoCodes {
+		if p.ID == promoCodeID {
+			p.IsActive = isActive
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to update promo code: %w", ErrNotFound)
+}
+
+// HasActivePromoCodes сообщает, есть ли включенные и не истекшие промокоды
+func (s *MemoryStorage) HasActivePromoCodes(ctx context.Context) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, p := range s.promoCodes {
+		if p.IsActive && (p.ValidUntil == nil || p.ValidUntil.After(now)) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ==================== PRODUCT KEYS ====================
+
+// AddProductKeys добавляет ключи на склад товара, пропуская уже загруженные
+func (s *MemoryStorage) AddProductKeys(ctx context.Context, productID int, codes []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.products[productID]; !ok {
+		return 0, fmt.Errorf("failed to add product keys: %w", ErrNotFound)
+	}
+
+	existing := make(map[string]bool)
+	for _, k := range s.productKeys {
+		if k.ProductID == productID {
+			existing[k.Code] = true
+		}
+	}
+
+	added := 0
+	for _, code := range codes {
+		if existing[code] {
+			continue
+		}
+		existing[code] = true
+
+		s.nextKeyID++
+		s.productKeys = append(s.productKeys, models.ProductKey{
+			ID:        s.nextKeyID,
+			ProductID: productID,
+			Code:      code,
+			CreatedAt: time.Now(),
+		})
+		added++
+	}
+
+	return added, nil
+}
+
+// GetProductKeyStock возвращает число свободных и выданных ключей товара
+func (s *MemoryStorage) GetProductKeyStock(ctx context.Context, productID int) (*models.KeyStock, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var stock models.KeyStock
+	for _, k := range s.productKeys {
+		if k.ProductID != productID {
+			continue
+		}
+		if k.OrderID == "" {
+			stock.Available++
+		} else {
+			stock.Delivered++
+		}
+	}
+
+	return &stock, nil
+}
+
+// ReserveProductKeys закрепляет за заказом quantity свободных ключей товара, засчитывая
+// уже выданные ему. Если свободных ключей не хватает, ничего не закрепляет
+func (s *MemoryStorage) ReserveProductKeys(ctx context.Context, orderID string, productID int, quantity int) ([]models.ProductKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []models.ProductKey
+	var free []int
+	for i, k := range s.productKeys {
+		if k.ProductID != productID {
+			continue
+		}
+		switch k.OrderID {
+		case orderID:
+			keys = append(keys, k)
+		case "":
+			free = append(free, i)
+		}
+	}
+
+	missing := quantity - len(keys)
+	if missing <= 0 {
+		return keys[:quantity], nil
+	}
+	if len(free) < missing {
+		return nil, fmt.Errorf("failed to reserve product keys: %w", ErrOutOfStock)
+	}
+
+	now := time.Now()
+	for _, i := range free[:missing] {
+		s.productKeys[i].OrderID = orderID
+		s.productKeys[i].DeliveredAt = &now
+		keys = append(keys, s.productKeys[i])
+	}
+
+	return keys, nil
+}
+
+// ==================== BOT SETTINGS ====================
+
+// GetBotSettings возвращает настройки бота
+func (s *MemoryStorage) GetBotSettings(ctx context.Context) (*models.BotSettings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	settings := s.settings
+	return &settings, nil
+}
+
+// UpdateWelcomeMessage обновляет приветственное сообщение
+func (s *MemoryStorage) UpdateWelcomeMessage(ctx context.Context, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.settings.WelcomeMessage = message
+	s.settings.UpdatedAt = time.Now()
+	return nil
+}
+
+// ==================== USER METHODS ====================
+
+// UpsertUser создает или обновляет пользователя
+func (s *MemoryStorage) UpsertUser(ctx context.Context, userID int64, username, firstName, lastName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	u, ok := s.users[userID]
+	if !ok {
+		u = &models.User{UserID: userID, CreatedAt: now}
+		s.users[userID] = u
+	}
+
+	u.Username = username
+	u.FirstName = firstName
+	u.LastName = lastName
+	u.LastActivity = now
+
+	return nil
+}
+
+// GetActiveUsers возвращает пользователей, которые не заблокировали бота
+func (s *MemoryStorage) GetActiveUsers(ctx context.Context) ([]models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []models.User
+	for _, u := range s.users {
+		if !u.IsBlocked {
+			users = append(users, *u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserID < users[j].UserID })
+
+	return users, nil
+}
+
+// MarkUserAsBlocked помечает пользователя как заблокировавшего бота
+func (s *MemoryStorage) MarkUserAsBlocked(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok {
+		u.IsBlocked = true
+	}
+
+	return nil
+}
+
+// GetUsersCount возвращает количество активных пользователей
+func (s *MemoryStorage) GetUsersCount(ctx context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, u := range s.users {
+		if !u.IsBlocked {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// ==================== REFERRALS ====================
+
+// AddReferredUser создает пользователя, пришедшего по ссылке referrerID. Возвращает false, если
+// пользователь уже обращался к боту, пригласивший неизвестен или пользователь пригласил сам себя
+func (s *MemoryStorage) AddReferredUser(ctx context.Context, userID, referrerID int64, username, firstName, lastName string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[userID]; exists || userID == referrerID {
+		return false, nil
+	}
+	if _, ok := s.users[referrerID]; !ok {
+		return false, nil
+	}
+
+	now := time.Now()
+	s.users[userID] = &models.User{
+		UserID:       userID,
+		Username:     username,
+		FirstName:    firstName,
+		LastName:     lastName,
+		ReferrerID:   referrerID,
+		CreatedAt:    now,
+		LastActivity: now,
+	}
+
+	return true, nil
+}
+
+// CreateReferralReward начисляет пригласившему percent процентов от оплаченного заказа приглашенного.
+// Бонус дается один раз - за первый оплаченный заказ. Возвращает nil, если бонус не положен
+func (s *MemoryStorage) CreateReferralReward(ctx context.Context, orderID string, percent int) (*models.ReferralReward, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[orderID]
+	if !ok || (order.Status != models.OrderStatusPaid && order.Status != models.OrderStatusCompleted) {
+		return nil, nil
+	}
+	user, ok := s.users[order.UserID]
+	if !ok || user.ReferrerID == 0 {
+		return nil, nil
+	}
+	for _, r := range s.referralRewards {
+		if r.ReferredID == user.UserID {
+			return nil, nil
+		}
+	}
+
+	amount := referralBonus(order.Price, percent)
+	if !amount.IsPositive() {
+		return nil, nil
+	}
+
+	s.nextRewardID++
+	reward := models.ReferralReward{
+		ID:         s.nextRewardID,
+		ReferrerID: user.ReferrerID,
+		ReferredID: user.UserID,
+		OrderID:    orderID,
+		Amount:     amount,
+		CreatedAt:  time.Now(),
+	}
+	s.referralRewards = append(s.referralRewards, reward)
+
+	// Бонус зачисляется на баланс пригласившего
+	s.addLedgerTransaction(models.LedgerTransaction{
+		Kind:    models.LedgerKindReferral,
+		UserID:  reward.ReferrerID,
+		OrderID: orderID,
+		Amount:  amount,
+	}, models.LedgerAccountReferrals)
+
+	return &reward, nil
+}
+
+// GetReferralStats возвращает, кто пригласил пользователя, сколько пользователей пришло по его ссылке
+// и какие бонусы ему начислены
+func (s *MemoryStorage) GetReferralStats(ctx context.Context, userID int64) (*models.ReferralStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := &models.ReferralStats{}
+	if user, ok := s.users[userID]; ok && user.ReferrerID != 0 {
+		if referrer, ok := s.users[user.ReferrerID]; ok {
+			copied := *referrer
+			stats.Referrer = &copied
+		}
+	}
+
+	for _, u := range s.users {
+		if u.ReferrerID == userID {
+			stats.Invited++
+		}
+	}
+
+	rewards := make(map[money.Currency]money.Money)
+	for _, r := range s.referralRewards {
+		if r.ReferrerID == userID {
+			stats.Rewarded++
+			rewards[r.Amount.Currency] = rewards[r.Amount.Currency].Add(r.Amount)
+		}
+	}
+	stats.Rewards = sortedByCurrency(rewards)
+
+	return stats, nil
+}
+
+// ==================== LEDGER ====================
+
+// addLedgerTransaction записывает операцию с балансом пользователя и две проводки: t.Amount на счет
+// пользователя и обратную сумму на counterAccount. Вызывается под s.mu
+func (s *MemoryStorage) addLedgerTransaction(t models.LedgerTransaction, counterAccount string) models.LedgerTransaction {
+	s.nextLedgerID++
+	t.ID = s.nextLedgerID
+	t.CreatedAt = time.Now()
+	s.ledger = append(s.ledger, t)
+
+	for _, entry := range []models.LedgerEntry{
+		{Account: models.UserLedgerAccount(t.UserID), Amount: t.Amount},
+		{Account: counterAccount, Amount: money.New(-t.Amount.Amount, t.Amount.Currency)},
+	} {
+		s.nextEntryID++
+		entry.ID = s.nextEntryID
+		entry.TransactionID = t.ID
+		s.ledgerEntries = append(s.ledgerEntries, entry)
+	}
+
+	return t
+}
+
+// balance возвращает баланс пользователя по каждой валюте. Вызывается под s.mu
+func (s *MemoryStorage) balance(userID int64) map[money.Currency]money.Money {
+	account := models.UserLedgerAccount(userID)
+	balance := make(map[money.Currency]money.Money)
+	for _, e := range s.ledgerEntries {
+		if e.Account == account {
+			balance[e.Amount.Currency] = balance[e.Amount.Currency].Add(e.Amount)
+		}
+	}
+	return balance
+}
+
+// GetBalance возвращает ненулевой бонусный баланс пользователя по каждой валюте
+func (s *MemoryStorage) GetBalance(ctx context.Context, userID int64) ([]money.Money, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	balance := s.balance(userID)
+	for currency, total := range balance {
+		if total.IsZero() {
+			delete(balance, currency)
+		}
+	}
+
+	return sortedByCurrency(balance), nil
+}
+
+// GetLedger возвращает последние операции с балансом пользователя, новые первыми
+func (s *MemoryStorage) GetLedger(ctx context.Context, userID int64, limit int) ([]models.LedgerTransaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ledger []models.LedgerTransaction
+	for i := len(s.ledger) - 1; i >= 0 && len(ledger) < limit; i-- {
+		if s.ledger[i].UserID == userID {
+			ledger = append(ledger, s.ledger[i])
+		}
+	}
+
+	return ledger, nil
+}
+
+// AdjustBalance изменяет баланс пользователя на amount (+ начисление, - списание) от имени админа.
+// Баланс не может стать отрицательным
+func (s *MemoryStorage) AdjustBalance(ctx context.Context, userID int64, amount money.Money, actorID int64, reason string) (*models.LedgerTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, fmt.Errorf("failed to adjust balance: %w", ErrNotFound)
+	}
+	if s.balance(userID)[amount.Currency].Add(amount).IsNegative() {
+		return nil, fmt.Errorf("failed to adjust balance: %w", ErrInsufficientBalance)
+	}
+
+	t := s.addLedgerTransaction(models.LedgerTransaction{
+		Kind:    models.LedgerKindAdjustment,
+		UserID:  userID,
+		ActorID: actorID,
+		Reason:  reason,
+		Amount:  amount,
+	}, models.LedgerAccountAdjustments)
+
+	return &t, nil
+}
+
+// ApplyBalance оплачивает неоплаченный заказ покупателя бонусным балансом в валюте заказа - целиком
+// или частично. Если баланса хватило на весь заказ, заказ сразу переходит в paid
+func (s *MemoryStorage) ApplyBalance(ctx context.Context, orderID string, userID int64) (*models.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[orderID]
+	if !ok || o.UserID != userID {
+		return nil, fmt.Errorf("failed to apply balance: %w", ErrNotFound)
+	}
+	if o.Status != models.OrderStatusCreated {
+		return nil, fmt.Errorf("failed to apply balance: %w: order is %s", ErrInvalidTransition, o.Status)
+	}
+
+	used := s.balance(userID)[o.Price.Currency]
+	if !used.IsPositive() {
+		return nil, fmt.Errorf("failed to apply balance: %w", ErrInsufficientBalance)
+	}
+	if used.Amount > o.Price.Amount {
+		used = o.Price
+	}
+
+	s.addLedgerTransaction(models.LedgerTransaction{
+		Kind:    models.LedgerKindCheckout,
+		UserID:  userID,
+		OrderID: orderID,
+		Amount:  money.New(-used.Amount, used.Currency),
+	}, models.LedgerAccountSales)
+
+	o.Price = o.Price.Sub(used)
+	o.BalanceUsed = o.BalanceUsed.Add(used)
+	// Сумма перевода изменилась - надбавка выбирается заново при выдаче реквизитов
+	o.AmountOffset = money.New(0, o.Price.Currency)
+	if o.Price.IsZero() {
+		status := s.paidStatus(o, models.OrderStatusPaid, time.Now())
+		s.recordStatusChange(orderID, o.Status, status, 0, "Оплачено с бонусного баланса")
+		o.Status = status
+	}
+
+	order := *o
+	return &order, nil
+}
+
+// RefundOrderToBalance переводит оплаченный заказ в refunded и возвращает покупателю на баланс
+// всю сумму заказа: оплаченную деньгами и списанную с баланса
+func (s *MemoryStorage) RefundOrderToBalance(ctx context.Context, orderID string, actorID int64, reason string) (*models.LedgerTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[orderID]
+	if !ok {
+		return nil, fmt.Errorf("failed to refund order: %w", ErrNotFound)
+	}
+	if !models.CanTransitionOrder(o.Status, models.OrderStatusRefunded) {
+		return nil, fmt.Errorf("failed to refund order: %w: %s -> %s", ErrInvalidTransition, o.Status, models.OrderStatusRefunded)
+	}
+
+	s.recordStatusChange(orderID, o.Status, models.OrderStatusRefunded, actorID, reason)
+	o.Status = models.OrderStatusRefunded
+
+	t := s.addLedgerTransaction(models.LedgerTransaction{
+		Kind:    models.LedgerKindRefund,
+		UserID:  o.UserID,
+		OrderID: orderID,
+		ActorID: actorID,
+		Reason:  reason,
+		Amount:  o.Price.Add(o.BalanceUsed),
+	}, models.LedgerAccountRefunds)
+
+	return &t, nil
+}
+
+// ==================== SUPPORT ====================
+
+// AddSupportMessage сохраняет сообщение переписки по заказу
+func (s *MemoryStorage) AddSupportMessage(ctx context.Context, m models.SupportMessage) (*models.SupportMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orders[m.OrderID]; !ok {
+		return nil, fmt.Errorf("failed to add support message: %w", ErrNotFound)
+	}
+
+	s.nextSupportID++
+	m.ID = s.nextSupportID
+	m.CreatedAt = time.Now()
+	s.supportMessages = append(s.supportMessages, m)
+
+	return &m, nil
+}
+
+// SaveSupportRelay запоминает сообщение бота, доставившее сообщение переписки в чат
+func (s *MemoryStorage) SaveSupportRelay(ctx context.Context, chatID int64, messageID int, supportMessageID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := supportRelay{chatID: chatID, messageID: messageID}
+	if _, ok := s.supportRelays[key]; !ok {
+		s.supportRelays[key] = supportMessageID
+	}
+
+	return nil
+}
+
+// GetSupportMessageByRelay возвращает сообщение переписки, доставленное сообщением бота messageID в чат chatID.
+// ErrNotFound - это не сообщение переписки
+func (s *MemoryStorage) GetSupportMessageByRelay(ctx context.Context, chatID int64, messageID int) (*models.SupportMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.supportRelays[supportRelay{chatID: chatID, messageID: messageID}]
+	if ok {
+		for _, m := range s.supportMessages {
+			if m.ID == id {
+				return &m, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("failed to get support message: %w", ErrNotFound)
+}
+
+// GetSupportThread возвращает переписку по заказу в хронологическом порядке
+func (s *MemoryStorage) GetSupportThread(ctx context.Context, orderID string) ([]models.SupportMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var thread []models.SupportMessage
+	for _, m := range s.supportMessages {
+		if m.OrderID == orderID {
+			thread = append(thread, m)
+		}
+	}
+
+	return thread, nil
+}
+
+// ==================== ORDER CLAIMS ====================
+
+// ClaimOrder закрепляет заказ за админом, если его еще никто не взял, и возвращает действующее
+// закрепление: если заказ уже у другого админа, в ответе будет он. Закрытый заказ (завершен,
+// отменен, возвращен) взять нельзя - ErrInvalidTransition
+func (s *MemoryStorage) ClaimOrder(ctx context.Context, claim models.OrderClaim) (*models.OrderClaim, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[claim.OrderID]
+	if !ok {
+		return nil, fmt.Errorf("failed to claim order: %w", ErrNotFound)
+	}
+	if !isClaimableStatus(o.Status) {
+		return nil, fmt.Errorf("failed to claim order: %w: order is %s", ErrInvalidTransition, o.Status)
+	}
+
+	existing, ok := s.orderClaims[claim.OrderID]
+	if !ok {
+		claim.ClaimedAt = time.Now()
+		s.orderClaims[claim.OrderID] = claim
+		existing = claim
+	}
+
+	return &existing, nil
+}
+
+// GetOrderClaim возвращает админа, взявшего заказ в работу. ErrNotFound - заказ ничей
+func (s *MemoryStorage) GetOrderClaim(ctx context.Context, orderID string) (*models.OrderClaim, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.orderClaims[orderID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get order claim: %w", ErrNotFound)
+	}
+
+	return &c, nil
+}
+
+// SaveAdminNotification запоминает уведомление админа о заказе. Повторное уведомление того же админа
+// заменяет прежнее
+func (s *MemoryStorage) SaveAdminNotification(ctx context.Context, n models.AdminNotification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, existing := range s.adminNotices {
+		if existing.OrderID == n.OrderID && existing.ChatID == n.ChatID {
+			s.adminNotices[i] = n
+			return nil
+		}
+	}
+	s.adminNotices = append(s.adminNotices, n)
+
+	return nil
+}
+
+// GetAdminNotifications возвращает уведомления админов о заказе
+func (s *MemoryStorage) GetAdminNotifications(ctx context.Context, orderID string) ([]models.AdminNotification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var notifications []models.AdminNotification
+	for _, n := range s.adminNotices {
+		if n.OrderID == orderID {
+			notifications = append(notifications, n)
+		}
+	}
+
+	return notifications, nil
+}
+
+// ==================== SUBSCRIPTIONS ====================
+
+// ListExpiringSubscriptions возвращает подписки выполненных заказов, которые заканчиваются в (from, until]
+// и о которых еще не напоминали, ближайшие первыми. Подписка, продленная более поздним заказом, не попадает
+func (s *MemoryStorage) ListExpiringSubscriptions(ctx context.Context, from, until time.Time, limit int) ([]models.Subscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var subscriptions []models.Subscription
+	for _, item := range s.orderItems {
+		if item.ExpiresAt == nil || !item.ExpiresAt.After(from) || item.ExpiresAt.After(until) || s.remindedItems[item.ID] {
+			continue
+		}
+		o, ok := s.orders[item.OrderID]
+		if !ok || o.Status != models.OrderStatusCompleted {
+			continue
+		}
+		if latest := s.latestExpiry(o.UserID, item.ProductID, item.OrderID); latest != nil && latest.After(*item.ExpiresAt) {
+			continue
+		}
+
+		subscriptions = append(subscriptions, models.Subscription{
+			ItemID:      item.ID,
+			OrderID:     item.OrderID,
+			UserID:      o.UserID,
+			ProductID:   item.ProductID,
+			ProductName: item.ProductName,
+			ExpiresAt:   *item.ExpiresAt,
+		})
+	}
+
+	sort.SliceStable(subscriptions, func(i, j int) bool {
+		if !subscriptions[i].ExpiresAt.Equal(subscriptions[j].ExpiresAt) {
+			return subscriptions[i].ExpiresAt.Before(subscriptions[j].ExpiresAt)
+		}
+		return subscriptions[i].ItemID < subscriptions[j].ItemID
+	})
+	if limit > 0 && len(subscriptions) > limit {
+		subscriptions = subscriptions[:limit]
+	}
+
+	return subscriptions, nil
+}
+
+// MarkSubscriptionReminded отмечает, что покупателю напомнили о продлении подписки
+func (s *MemoryStorage) MarkSubscriptionReminded(ctx context.Context, itemID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range s.orderItems {
+		if item.ID == itemID {
+			s.remindedItems[itemID] = true
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to mark subscription reminded: %w", ErrNotFound)
+}
+
+// ==================== PREORDERS ====================
+
+// ListReleasedPreorders возвращает заказы в статусе preordered, все товары которых вышли к now (старые первыми)
+func (s *MemoryStorage) ListReleasedPreorders(ctx context.Context, now time.Time, limit int) ([]models.Order, error) {
+	orders := s.sortedOrders(func(o *models.Order) bool {
+		return o.Status == models.OrderStatusPreordered && !s.hasUnreleasedItems(o.OrderID, now)
+	}, 0)
+
+	// sortedOrders сортирует новые первыми, здесь нужен обратный порядок
+	for i, j := 0, len(orders)-1; i < j; i, j = i+1, j-1 {
+		orders[i], orders[j] = orders[j], orders[i]
+	}
+	if limit > 0 && len(orders) > limit {
+		orders = orders[:limit]
+	}
+
+	return orders, nil
+}
+
+// ==================== PAYOUT CARDS ====================
+
+// CreatePayoutCard добавляет карту для оплаты переводом
+func (s *MemoryStorage) CreatePayoutCard(ctx context.Context, card models.PayoutCard) (*models.PayoutCard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextCardID++
+	c := card
+	c.ID = s.nextCardID
+	c.IsActive = true
+	c.UsedToday = money.New(0, c.DailyLimit.Currency)
+	c.LastUsedAt = nil
+	c.CreatedAt = time.Now()
+	s.payoutCards = append(s.payoutCards, &c)
+
+	copied := c
+	return &copied, nil
+}
+
+// ListPayoutCards возвращает все карты по порядку добавления с оборотом с момента since
+func (s *MemoryStorage) ListPayoutCards(ctx context.Context, since time.Time) ([]models.PayoutCard, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cards := make([]models.PayoutCard, 0, len(s.payoutCards))
+	for _, c := range s.payoutCards {
+		cards = append(cards, s.payoutCardWithUsage(c, since))
+	}
+	return cards, nil
+}
+
+// SetPayoutCardActive включает или выключает карту
+func (s *MemoryStorage) SetPayoutCardActive(ctx context.Context, cardID int, isActive bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.payoutCards {
+		if c.ID == cardID {
+			c.IsActive = isActive
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to update payout card: %w", ErrNotFound)
+}
+
+// DeletePayoutCard удаляет карту. В заказах, оплаченных на нее, карта перестает быть известна
+func (s *MemoryStorage) DeletePayoutCard(ctx context.Context, cardID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range s.payoutCards {
+		if c.ID != cardID {
+			continue
+		}
+
+		s.payoutCards = append(s.payoutCards[:i], s.payoutCards[i+1:]...)
+		for orderID, id := range s.orderCards {
+			if id == cardID {
+				delete(s.orderCards, orderID)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("failed to delete payout card: %w", ErrNotFound)
+}
+
+// AssignPayoutCard выбирает карту для перевода по неоплаченному заказу и запоминает ее в заказе.
+// Если карта уже выдана и все еще включена, возвращается она. Иначе берется включенная карта региона
+// заказа (или карта для всех регионов) с запасом дневного лимита с момента since, по политике rotation.
+// ErrNoPayoutCard - подходящей карты нет
+func (s *MemoryStorage) AssignPayoutCard(ctx context.Context, orderID, rotation string, since time.Time) (*models.PayoutCard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[orderID]
+	if !ok {
+		return nil, fmt.Errorf("failed to assign payout card: %w", ErrNotFound)
+	}
+	if o.Status != models.OrderStatusCreated {
+		return nil, fmt.Errorf("failed to assign payout card: %w: order is %s", ErrInvalidTransition, o.Status)
+	}
+
+	if current := s.payoutCardByID(s.orderCards[orderID]); current != nil && current.IsActive {
+		card := s.payoutCardWithUsage(current, since)
+		return &card, nil
+	}
+
+	candidates := make([]*models.PayoutCard, 0, len(s.payoutCards))
+	for _, c := range s.payoutCards {
+		if c.IsActive && s.payoutCardServesOrder(c, orderID) {
+			candidates = append(candidates, c)
+		}
+	}
+	if rotation != models.PayoutRotationPriority {
+		// Дольше всех не выдававшаяся карта первой, никогда не выданные - раньше всех
+		sort.SliceStable(candidates, func(i, j int) bool {
+			a, b := candidates[i].LastUsedAt, candidates[j].LastUsedAt
+			if a == nil || b == nil {
+				return a == nil && b != nil
+			}
+			return a.Before(*b)
+		})
+	}
+
+	for _, c := range candidates {
+		card := s.payoutCardWithUsage(c, since)
+		if !payoutCardFits(card, o.Price) {
+			continue
+		}
+
+		now := time.Now()
+		c.LastUsedAt = &now
+		s.orderCards[orderID] = c.ID
+
+		card.LastUsedAt = &now
+		card.UsedToday = card.UsedToday.Add(money.New(o.Price.Amount, card.UsedToday.Currency))
+		return &card, nil
+	}
+
+	return nil, fmt.Errorf("failed to assign payout card: %w", ErrNoPayoutCard)
+}
+
+// GetOrderPayoutCard возвращает карту, выданную покупателю по заказу. ErrNotFound - карты нет или ее удалили.
+// Оборот карты не считается
+func (s *MemoryStorage) GetOrderPayoutCard(ctx context.Context, orderID string) (*models.PayoutCard, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c := s.payoutCardByID(s.orderCards[orderID])
+	if c == nil {
+		return nil, fmt.Errorf("failed to get payout card: %w", ErrNotFound)
+	}
+
+	copied := *c
+	copied.UsedToday = money.New(0, c.DailyLimit.Currency)
+	return &copied, nil
+}
+
+// payoutCardByID находит карту по ID, nil - карты нет. Вызывается под s.mu
+func (s *MemoryStorage) payoutCardByID(cardID int) *models.PayoutCard {
+	for _, c := range s.payoutCards {
+		if c.ID == cardID {
+			return c
+		}
+	}
+	return nil
+}
+
+// payoutCardWithUsage возвращает копию карты с оборотом: неотмененные заказы на карту в валюте лимита,
+// созданные не раньше since. Вызывается под s.mu
+func (s *MemoryStorage) payoutCardWithUsage(c *models.PayoutCard, since time.Time) models.PayoutCard {
+	card := *c
+	card.UsedToday = money.New(0, c.DailyLimit.Currency)
+
+	for orderID, cardID := range s.orderCards {
+		o := s.orders[orderID]
+		if cardID != c.ID || o == nil || o.Status == models.OrderStatusCancelled ||
+			o.Price.Currency != c.DailyLimit.Currency || o.CreatedAt.Before(since) {
+			continue
+		}
+		card.UsedToday.Amount += o.Price.Amount
+	}
+	return card
+}
+
+// payoutCardServesOrder сообщает, принимает ли карта оплату заказа: она для всех регионов
+// или все товары заказа из ее региона. Вызывается под s.mu
+func (s *MemoryStorage) payoutCardServesOrder(c *models.PayoutCard, orderID string) bool {
+	if c.RegionID == 0 {
+		return true
+	}
+
+	for _, item := range s.orderItems {
+		if item.OrderID != orderID {
+			continue
+		}
+		p, ok := s.products[item.ProductID]
+		if !ok {
+			continue
+		}
+		if cat, ok := s.categories[p.CategoryID]; ok && cat.RegionID != c.RegionID {
+			return false
+		}
+	}
+	return true
+}
+
+// ==================== AMOUNT OFFSETS ====================
+
+// AssignAmountOffset выдает неоплаченному заказу надбавку к сумме перевода (от 0,01 до 0,99), с которой
+// сумма не совпадает ни с одним другим заказом, ожидающим оплаты тем же способом в той же валюте.
+// Надбавки отмененных заказов, созданных после reservedSince, тоже заняты: сверка еще ищет их переводы.
+// Уже выданная надбавка не меняется. Если все надбавки заняты, заказ остается без метки
+func (s *MemoryStorage) AssignAmountOffset(ctx context.Context, orderID string, reservedSince time.Time) (*models.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[orderID]
+	if !ok {
+		return nil, fmt.Errorf("failed to assign amount offset: %w", ErrNotFound)
+	}
+	if o.Status != models.OrderStatusCreated {
+		return nil, fmt.Errorf("failed to assign amount offset: %w: order is %s", ErrInvalidTransition, o.Status)
+	}
+
+	if !o.AmountOffset.IsPositive() {
+		taken := make(map[int64]bool)
+		for _, other := range s.orders {
+			reserved := other.Status == models.OrderStatusCreated ||
+				(other.Status == models.OrderStatusCancelled && !other.CreatedAt.Before(reservedSince))
+			if other.OrderID != orderID && reserved &&
+				other.PaymentMethod == o.PaymentMethod && other.Price.Currency == o.Price.Currency {
+				taken[other.TransferAmount().Amount] = true
+			}
+		}
+		o.AmountOffset = pickAmountOffset(o.Price, taken)
+	}
+
+	order := *o
+	return &order, nil
+}
+
+// ConfirmLateTransfer переводит в paid (или preordered) заказ, отмененный системой, перевод за который нашла
+// сверка выписки, как PostgresStorage. Любой другой заказ - ErrInvalidTransition
+func (s *MemoryStorage) ConfirmLateTransfer(ctx context.Context, orderID string, actorID int64, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[orderID]
+	if !ok {
+		return fmt.Errorf("failed to confirm late transfer: %w", ErrNotFound)
+	}
+	if o.Status != models.OrderStatusCancelled || !s.payableAfterCancel(o) {
+		return fmt.Errorf("failed to confirm late transfer: %w: order is %s", ErrInvalidTransition, o.Status)
+	}
+
+	if o.PromoCode != "" {
+		for _, pc := range s.promoCodes {
+			if pc.Code != o.PromoCode {
+				continue
+			}
+			if err := promo.CheckUsage(*pc, s.promoUsage(pc.Code, o.UserID)); err != nil {
+				return fmt.Errorf("failed to confirm late transfer: %w: promo code %s: %w", ErrInvalidTransition, pc.Code, err)
+			}
+		}
+	}
+
+	status := models.OrderStatusPaid
+	if s.hasUnreleasedItems(orderID, time.Now()) {
+		status = models.OrderStatusPreordered
+	}
+	s.recordStatusChange(orderID, o.Status, status, actorID, reason)
+	o.Status = status
+
+	return nil
+}
+
+// payableAfterCancel сообщает, что отмененный заказ отменила система и за него ничего не списывалось
+// с баланса, как PostgresStorage. Вызывается под s.mu
+func (s *MemoryStorage) payableAfterCancel(o *models.Order) bool {
+	return !o.BalanceUsed.IsPositive() && s.cancelledBySystem(o.OrderID)
+}
+
+// cancelledBySystem сообщает, что заказ отменила система, а не покупатель или админ. Вызывается под s.mu
+func (s *MemoryStorage) cancelledBySystem(orderID string) bool {
+	for _, c := range s.statusHistory {
+		if c.OrderID == orderID && c.ToStatus == models.OrderStatusCancelled && c.ActorID == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ListAwaitingTransfers возвращает заказы, ожидающие оплаты способом paymentMethod (старые первыми),
+// и заказы, созданные после cancelledSince и отмененные системой: перевод мог прийти до автоотмены
+func (s *MemoryStorage) ListAwaitingTransfers(ctx context.Context, paymentMethod string, cancelledSince time.Time, limit int) ([]models.Order, error) {
+	orders := s.sortedOrders(func(o *models.Order) bool {
+		if o.PaymentMethod != paymentMethod {
+			return false
+		}
+		if o.Status == models.OrderStatusCancelled {
+			return !o.CreatedAt.Before(cancelledSince) && s.payableAfterCancel(o)
+		}
+		return o.Status == models.OrderStatusCreated
+	}, 0)
+
+	// sortedOrders сортирует новые первыми, здесь нужен обратный порядок
+	for i, j := 0, len(orders)-1; i < j; i, j = i+1, j-1 {
+		orders[i], orders[j] = orders[j], orders[i]
+	}
+	if limit > 0 && len(orders) > limit {
+		orders = orders[:limit]
+	}
+
+	return orders, nil
+}
+
+// ==================== BROADCAST METHODS ====================
+
+// CreateBroadcast создает новую рассылку (статус draft)
+func (s *MemoryStorage) CreateBroadcast(ctx context.Context, adminID int64, text string) (*models.Broadcast, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextBroadcastID++
+	b := &models.Broadcast{
+		ID:        s.nextBroadcastID,
+		AdminID:   adminID,
+		Text:      text,
+		CreatedAt: time.Now(),
+		Status:    "draft",
+	}
+	s.broadcasts[b.ID] = b
+
+	copied := *b
+	return &copied, nil
+}
+
+// SaveBroadcastPhoto сохраняет file_id фотографии для рассылки
+func (s *MemoryStorage) SaveBroadcastPhoto(ctx context.Context, broadcastID int, fileID string, sortOrder int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.broadcasts[broadcastID]; !ok {
+		return fmt.Errorf("failed to save broadcast photo: broadcast %d: %w", broadcastID, ErrNotFound)
+	}
+
+	s.nextPhotoID++
+	s.broadcastPhotos[broadcastID] = append(s.broadcastPhotos[broadcastID], models.BroadcastPhoto{
+		ID:          s.nextPhotoID,
+		BroadcastID: broadcastID,
+		FileID:      fileID,
+		SortOrder:   sortOrder,
+		CreatedAt:   time.Now(),
+	})
+
+	return nil
+}
+
+// GetBroadcastPhotos возвращает все фотографии рассылки
+func (s *MemoryStorage) GetBroadcastPhotos(ctx context.Context, broadcastID int) ([]models.BroadcastPhoto, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	photos := append([]models.BroadcastPhoto(nil), s.broadcastPhotos[broadcastID]...)
+	sort.SliceStable(photos, func(i, j int) bool { return photos[i].SortOrder < photos[j].SortOrder })
+
+	return photos, nil
+}
+
+// UpdateBroadcastStatus обновляет статус рассылки и статистику
+func (s *MemoryStorage) UpdateBroadcastStatus(ctx context.Context, broadcastID int, status string, totalUsers, sentCount, failedCount int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.broadcasts[broadcastID]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	if b.Status == "draft" && status == "sending" {
+		b.StartedAt = &now
+	}
+	if status == "completed" || status == "failed" {
+		b.CompletedAt = &now
+	}
+
+	b.Status = status
+	b.TotalUsers = totalUsers
+	b.SentCount = sentCount
+	b.FailedCount = failedCount
+
+	return nil
+}
+
+// GetBroadcastByID возвращает рассылку по ID
+func (s *MemoryStorage) GetBroadcastByID(ctx context.Context, broadcastID int) (*models.Broadcast, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.broadcasts[broadcastID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get broadcast: %w", ErrNotFound)
+	}
+
+	copied := *b
+	return &copied, nil
+}
+
+// DeleteBroadcast удаляет рассылку (только в статусе draft)
+func (s *MemoryStorage) DeleteBroadcast(ctx context.Context, broadcastID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.broadcasts[broadcastID]
+	if !ok || b.Status != "draft" {
+		return fmt.Errorf("broadcast not found or not in draft status")
+	}
+
+	delete(s.broadcasts, broadcastID)
+	delete(s.broadcastPhotos, broadcastID)
+
+	return nil
+}
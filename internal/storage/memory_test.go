@@ -0,0 +1,1023 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+	"tgwow/internal/orderid"
+	"tgwow/internal/promo"
+)
+
+func TestMemoryStorage_Catalog(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	regions, err := s.ListRegions(ctx)
+	if err != nil {
+		t.Fatalf("ListRegions() error = %v", err)
+	}
+	if len(regions) != 4 || regions[0].Code != "KZ" {
+		t.Fatalf("ListRegions() = %+v, want 4 regions starting with KZ", regions)
+	}
+
+	// Системная категория не попадает в пользовательский каталог
+	categories, _ := s.ListCategoriesByRegion(ctx, regions[0].ID)
+	allCategories, _ := s.ListAllCategoriesByRegion(ctx, regions[0].ID)
+	if len(categories) != 1 || len(allCategories) != 2 {
+		t.Errorf("got %d user categories and %d admin categories, want 1 and 2", len(categories), len(allCategories))
+	}
+
+	products, _ := s.ListProductsByCategory(ctx, categories[0].ID)
+	if len(products) != 4 {
+		t.Fatalf("ListProductsByCategory() returned %d products, want 4", len(products))
+	}
+
+	// Скрытый товар пропадает из каталога, но остается в админке
+	if err := s.UpdateProductVisibility(ctx, products[0].ID, false); err != nil {
+		t.Fatalf("UpdateProductVisibility() error = %v", err)
+	}
+	visible, _ := s.ListProductsByCategory(ctx, categories[0].ID)
+	all, _ := s.ListAllProductsByCategory(ctx, categories[0].ID)
+	if len(visible) != 3 || len(all) != 4 {
+		t.Errorf("got %d visible and %d total products, want 3 and 4", len(visible), len(all))
+	}
+
+	changeRegion, err := s.GetChangeRegionProduct(ctx)
+	if err != nil {
+		t.Fatalf("GetChangeRegionProduct() error = %v", err)
+	}
+	if changeRegion.Name != "Сменить регион" {
+		t.Errorf("GetChangeRegionProduct() = %q", changeRegion.Name)
+	}
+
+	if _, err := s.GetProductByID(ctx, 9999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetProductByID(9999) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryStorage_OrdersAndStats(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	product := products[0]
+
+	paid, err := s.CreateOrder(ctx, 42, product.ID, product.Price, "card", "")
+	if err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+	if paid.Status != "created" {
+		t.Errorf("new order status = %q, want created", paid.Status)
+	}
+	second, err := s.CreateOrder(ctx, 42, product.ID, product.Price, "card", "")
+	if err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+
+	// Номера выдаются из счетчика и не повторяются
+	if paid.OrderID == second.OrderID {
+		t.Errorf("CreateOrder() returned duplicate order ID %s", paid.OrderID)
+	}
+	for _, id := range []string{paid.OrderID, second.OrderID} {
+		if err := orderid.Validate(id); err != nil {
+			t.Errorf("orderid.Validate(%s) error = %v", id, err)
+		}
+	}
+
+	if err := s.UpdateOrderStatus(ctx, paid.OrderID, models.OrderStatusPaid, 1000, ""); err != nil {
+		t.Fatalf("UpdateOrderStatus() error = %v", err)
+	}
+
+	orders, _ := s.GetUserOrders(ctx, 42, 0, 0)
+	if len(orders) != 2 {
+		t.Fatalf("GetUserOrders() returned %d orders, want 2", len(orders))
+	}
+	if page, _ := s.GetUserOrders(ctx, 42, 1, 1); len(page) != 1 || page[0].OrderID != orders[1].OrderID {
+		t.Errorf("GetUserOrders(offset 1, limit 1) = %+v, want the older order", page)
+	}
+	if page, _ := s.GetUserOrders(ctx, 42, 2, 1); len(page) != 0 {
+		t.Errorf("GetUserOrders(offset 2) = %+v, want no orders", page)
+	}
+
+	stats, err := s.GetOrderStats(ctx)
+	if err != nil {
+		t.Fatalf("GetOrderStats() error = %v", err)
+	}
+	if stats["total_orders"] != 2 || stats["pending_orders"] != 1 || stats["paid_orders"] != 1 {
+		t.Errorf("GetOrderStats() = %v", stats)
+	}
+	revenue, _ := stats["revenue"].([]money.Money)
+	if len(revenue) != 1 || revenue[0] != product.Price {
+		t.Errorf("revenue = %v, want [%v]", stats["revenue"], product.Price)
+	}
+}
+
+func TestMemoryStorage_OrderIDConflict(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	product := products[0]
+
+	// Счетчик отстал от существующих номеров дня, как после восстановления бэкапа
+	existing, err := s.CreateOrder(ctx, 42, product.ID, product.Price, "card", "")
+	if err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+	s.orderCounters[existing.CreatedAt.Format("2006-01-02")] = 0
+
+	created, err := s.CreateOrder(ctx, 43, product.ID, product.Price, "card", "")
+	if err != nil {
+		t.Fatalf("CreateOrder() error = %v", err)
+	}
+	if want := orderid.New(existing.CreatedAt, 2); created.OrderID != want {
+		t.Errorf("CreateOrder() after counter reset = %s, want %s", created.OrderID, want)
+	}
+	if got, _ := s.GetOrderByID(ctx, existing.OrderID); got == nil || got.UserID != 42 {
+		t.Errorf("existing order was overwritten: %+v", got)
+	}
+}
+
+func TestMemoryStorage_ListOrders(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	// Товары двух разных регионов
+	products, _ := s.ListAllProducts(ctx)
+	first := products[0]
+	firstCategory, _ := s.GetCategoryByID(ctx, first.CategoryID)
+	regions, _ := s.ListRegions(ctx)
+	var otherRegion models.Region
+	for _, r := range regions {
+		if r.ID != firstCategory.RegionID {
+			otherRegion = r
+			break
+		}
+	}
+	category := s.AddCategory(otherRegion.ID, "Подписка WOW", "", 1)
+	other, _ := s.CreateProduct(ctx, "1 месяц", category.ID, money.FromMajor(100, otherRegion.Currency), "")
+
+	paid, _ := s.CreateOrder(ctx, 42, first.ID, first.Price, "card", "")
+	s.UpdateOrderStatus(ctx, paid.OrderID, models.OrderStatusPaid, 1000, "")
+	pending, _ := s.CreateOrder(ctx, 42, other.ID, other.Price, "card", "")
+	foreign, _ := s.CreateOrder(ctx, 43, first.ID, first.Price, "card", "")
+
+	ids := func(orders []models.Order) []string {
+		var result []string
+		for _, o := range orders {
+			result = append(result, o.OrderID)
+		}
+		return result
+	}
+
+	now := time.Now()
+	later := now.Add(time.Hour)
+	tests := []struct {
+		name   string
+		filter models.OrderFilter
+		want   []string
+	}{
+		{"all", models.OrderFilter{}, []string{foreign.OrderID, pending.OrderID, paid.OrderID}},
+		{"status", models.OrderFilter{Status: models.OrderStatusPaid}, []string{paid.OrderID}},
+		{"region", models.OrderFilter{RegionID: firstCategory.RegionID}, []string{foreign.OrderID, paid.OrderID}},
+		{"user", models.OrderFilter{UserID: 42}, []string{pending.OrderID, paid.OrderID}},
+		{"from", models.OrderFilter{From: &later}, nil},
+		{"until", models.OrderFilter{Until: &later, UserID: 43}, []string{foreign.OrderID}},
+	}
+	for _, tt := range tests {
+		orders, err := s.ListOrders(ctx, tt.filter, 0, 0)
+		if err != nil || !reflect.DeepEqual(ids(orders), tt.want) {
+			t.Errorf("ListOrders(%s) = %v, %v, want %v", tt.name, ids(orders), err, tt.want)
+		}
+	}
+
+	if page, _ := s.ListOrders(ctx, models.OrderFilter{}, 1, 1); len(page) != 1 || page[0].OrderID != pending.OrderID {
+		t.Errorf("ListOrders(offset 1, limit 1) = %v, want the middle order", ids(page))
+	}
+}
+
+func TestMemoryStorage_OrderStatusTransitions(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	order, _ := s.CreateOrder(ctx, 42, products[0].ID, products[0].Price, "card", "")
+
+	steps := []struct {
+		status  string
+		wantErr error
+	}{
+		{status: models.OrderStatusCompleted, wantErr: ErrInvalidTransition}, // нельзя завершить неоплаченный
+		{status: models.OrderStatusPaid},
+		{status: models.OrderStatusPaid, wantErr: ErrInvalidTransition}, // повторное подтверждение
+		{status: models.OrderStatusCancelled, wantErr: ErrInvalidTransition},
+		{status: models.OrderStatusRefunded},
+		{status: models.OrderStatusPaid, wantErr: ErrInvalidTransition}, // refunded - конечный статус
+	}
+
+	for _, step := range steps {
+		err := s.UpdateOrderStatus(ctx, order.OrderID, step.status, 1000, "test")
+		if !errors.Is(err, step.wantErr) {
+			t.Errorf("UpdateOrderStatus(%s) error = %v, want %v", step.status, err, step.wantErr)
+		}
+	}
+
+	if err := s.UpdateOrderStatus(ctx, "WOW0000000000", models.OrderStatusPaid, 0, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateOrderStatus(unknown) error = %v, want ErrNotFound", err)
+	}
+
+	// В истории только успешные переходы, начиная с создания заказа
+	history, _ := s.GetOrderStatusHistory(ctx, order.OrderID)
+	want := []struct{ from, to string }{
+		{"", models.OrderStatusCreated},
+		{models.OrderStatusCreated, models.OrderStatusPaid},
+		{models.OrderStatusPaid, models.OrderStatusRefunded},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("history has %d entries, want %d: %+v", len(history), len(want), history)
+	}
+	for i, w := range want {
+		if history[i].FromStatus != w.from || history[i].ToStatus != w.to {
+			t.Errorf("history[%d] = %s -> %s, want %s -> %s", i, history[i].FromStatus, history[i].ToStatus, w.from, w.to)
+		}
+	}
+	if history[0].ActorID != 42 || history[1].ActorID != 1000 {
+		t.Errorf("history actors = %d, %d, want 42, 1000", history[0].ActorID, history[1].ActorID)
+	}
+}
+
+func TestMemoryStorage_ProductKeys(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	productID := products[0].ID
+
+	added, err := s.AddProductKeys(ctx, productID, []string{"AAA", "BBB", "AAA"})
+	if err != nil || added != 2 {
+		t.Fatalf("AddProductKeys() = %d, %v, want 2 new keys", added, err)
+	}
+	// Повторная загрузка того же файла не создает дубликатов
+	if added, _ := s.AddProductKeys(ctx, productID, []string{"BBB", "CCC"}); added != 1 {
+		t.Errorf("AddProductKeys() with duplicates = %d, want 1", added)
+	}
+
+	first, _ := s.CreateOrder(ctx, 42, productID, products[0].Price, "card", "")
+	second, _ := s.CreateOrder(ctx, 43, productID, products[0].Price, "card", "")
+
+	keys, err := s.ReserveProductKeys(ctx, first.OrderID, productID, 1)
+	if err != nil || len(keys) != 1 || keys[0].Code != "AAA" || keys[0].OrderID != first.OrderID || keys[0].DeliveredAt == nil {
+		t.Fatalf("ReserveProductKeys() = %+v, %v, want first uploaded key", keys, err)
+	}
+	// Повторная выдача по тому же заказу возвращает тот же ключ
+	if again, _ := s.ReserveProductKeys(ctx, first.OrderID, productID, 1); len(again) != 1 || again[0].Code != "AAA" {
+		t.Errorf("ReserveProductKeys() again = %+v, want AAA", again)
+	}
+	if other, _ := s.ReserveProductKeys(ctx, second.OrderID, productID, 1); len(other) != 1 || other[0].Code != "BBB" {
+		t.Errorf("ReserveProductKeys() for second order = %+v, want BBB", other)
+	}
+
+	stock, _ := s.GetProductKeyStock(ctx, productID)
+	if stock.Available != 1 || stock.Delivered != 2 || !stock.Tracked() {
+		t.Errorf("GetProductKeyStock() = %+v, want 1 available, 2 delivered", stock)
+	}
+
+	// Ключей меньше, чем нужно заказу: ни один не резервируется
+	third, _ := s.CreateOrder(ctx, 44, productID, products[0].Price, "card", "")
+	if _, err := s.ReserveProductKeys(ctx, third.OrderID, productID, 2); !errors.Is(err, ErrOutOfStock) {
+		t.Errorf("ReserveProductKeys() beyond stock error = %v, want ErrOutOfStock", err)
+	}
+	if stock, _ := s.GetProductKeyStock(ctx, productID); stock.Available != 1 {
+		t.Errorf("GetProductKeyStock() after failed reserve = %+v, want 1 available", stock)
+	}
+
+	if stock, _ := s.GetProductKeyStock(ctx, products[1].ID); stock.Tracked() {
+		t.Errorf("product without keys is tracked: %+v", stock)
+	}
+}
+
+func TestMemoryStorage_CartCheckout(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	first, second := products[0], products[1]
+	const userID int64 = 42
+
+	if _, err := s.CheckoutCart(ctx, userID, "card", ""); !errors.Is(err, ErrCartEmpty) {
+		t.Fatalf("CheckoutCart() on empty cart error = %v, want ErrCartEmpty", err)
+	}
+
+	s.AddToCart(ctx, userID, first.ID, 1)
+	s.AddToCart(ctx, userID, second.ID, 1)
+	s.AddToCart(ctx, userID, second.ID, 2)
+	s.SetCartItemQuantity(ctx, userID, first.ID, 0)
+	s.AddToCart(ctx, userID, first.ID, 1)
+
+	cart, _ := s.GetCart(ctx, userID)
+	if len(cart) != 2 || cart[0].ProductID != second.ID || cart[0].Quantity != 3 || cart[1].Quantity != 1 {
+		t.Fatalf("GetCart() = %+v, want 3 x second and 1 x first", cart)
+	}
+
+	// Скрытый товар не оформляется, корзина остается нетронутой
+	s.UpdateProductVisibility(ctx, first.ID, false)
+	if _, err := s.CheckoutCart(ctx, userID, "card", ""); !errors.Is(err, ErrProductUnavailable) {
+		t.Fatalf("CheckoutCart() with hidden product error = %v, want ErrProductUnavailable", err)
+	}
+	if cart, _ := s.GetCart(ctx, userID); len(cart) != 2 {
+		t.Fatalf("cart after failed checkout = %+v, want unchanged", cart)
+	}
+	s.UpdateProductVisibility(ctx, first.ID, true)
+
+	order, err := s.CheckoutCart(ctx, userID, "card", "")
+	if err != nil {
+		t.Fatalf("CheckoutCart() error = %v", err)
+	}
+	want := second.Price.Mul(3).Add(first.Price)
+	if order.ProductID != 0 || order.Price != want || order.Status != models.OrderStatusCreated {
+		t.Errorf("CheckoutCart() = %+v, want cart order for %s", order, want)
+	}
+
+	items, _ := s.GetOrderItems(ctx, order.OrderID)
+	if len(items) != 2 || items[0].ProductName != second.Name || items[0].Quantity != 3 || items[0].Total() != second.Price.Mul(3) {
+		t.Errorf("GetOrderItems() = %+v, want two lines", items)
+	}
+	if cart, _ := s.GetCart(ctx, userID); len(cart) != 0 {
+		t.Errorf("cart after checkout = %+v, want empty", cart)
+	}
+
+	// У заказа на один товар тоже есть позиция
+	single, _ := s.CreateOrder(ctx, userID, first.ID, first.Price, "card", "")
+	byOrder, _ := s.GetOrderItemsByOrderIDs(ctx, []string{order.OrderID, single.OrderID})
+	if got := byOrder[single.OrderID]; len(got) != 1 || got[0].ProductID != first.ID || got[0].Quantity != 1 {
+		t.Errorf("items of single order = %+v, want one line", got)
+	}
+}
+
+func TestMemoryStorage_PromoCodes(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	product := products[0]
+
+	if active, _ := s.HasActivePromoCodes(ctx); active {
+		t.Fatal("HasActivePromoCodes() = true without codes")
+	}
+
+	code, err := s.CreatePromoCode(ctx, models.PromoCode{Code: "SPRING10", Percent: 10, MaxUsesPerUser: 1})
+	if err != nil || !code.IsActive {
+		t.Fatalf("CreatePromoCode() = %+v, %v", code, err)
+	}
+	if _, err := s.CreatePromoCode(ctx, models.PromoCode{Code: "SPRING10", Percent: 5}); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("CreatePromoCode() duplicate error = %v, want ErrAlreadyExists", err)
+	}
+	if _, err := s.CreateOrder(ctx, 42, product.ID, product.Price, "card", "WINTER"); !errors.Is(err, promo.ErrUnknown) {
+		t.Errorf("CreateOrder() with unknown code error = %v, want promo.ErrUnknown", err)
+	}
+
+	order, err := s.CreateOrder(ctx, 42, product.ID, product.Price, "card", "SPRING10")
+	discount := money.New(product.Price.Amount/10, product.Price.Currency)
+	if err != nil || order.PromoCode != "SPRING10" || order.Discount != discount || order.Price != product.Price.Sub(discount) {
+		t.Fatalf("CreateOrder() with promo = %+v, %v, want 10%% off", order, err)
+	}
+
+	// Лимит на покупателя: второй раз нельзя, пока первый заказ не отменен
+	if _, err := s.CreateOrder(ctx, 42, product.ID, product.Price, "card", "SPRING10"); !errors.Is(err, promo.ErrUsageLimit) {
+		t.Errorf("CreateOrder() over per-user limit error = %v, want promo.ErrUsageLimit", err)
+	}
+	if other, err := s.CreateOrder(ctx, 43, product.ID, product.Price, "card", "SPRING10"); err != nil || other.Discount != discount {
+		t.Errorf("CreateOrder() by another user = %+v, %v", other, err)
+	}
+	s.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusCancelled, 0, "")
+	again, err := s.CreateOrder(ctx, 42, product.ID, product.Price, "card", "SPRING10")
+	if err != nil {
+		t.Fatalf("CreateOrder() after cancelled use error = %v", err)
+	}
+
+	s.UpdateOrderStatus(ctx, again.OrderID, models.OrderStatusPaid, 0, "")
+	stats, _ := s.GetOrderStats(ctx)
+	if stats["promo_orders"] != 1 || len(stats["discounts"].([]money.Money)) != 1 || stats["discounts"].([]money.Money)[0] != discount {
+		t.Errorf("GetOrderStats() promo = %v, %v, want 1 order with %s", stats["promo_orders"], stats["discounts"], discount)
+	}
+
+	codes, _ := s.ListPromoCodes(ctx)
+	if len(codes) != 1 || codes[0].Uses != 2 {
+		t.Errorf("ListPromoCodes() = %+v, want SPRING10 used twice", codes)
+	}
+
+	s.SetPromoCodeActive(ctx, code.ID, false)
+	if active, _ := s.HasActivePromoCodes(ctx); active {
+		t.Error("HasActivePromoCodes() = true after disabling the only code")
+	}
+	if _, err := s.CreateOrder(ctx, 44, product.ID, product.Price, "card", "SPRING10"); !errors.Is(err, promo.ErrInactive) {
+		t.Errorf("CreateOrder() with disabled code error = %v, want promo.ErrInactive", err)
+	}
+}
+
+func TestMemoryStorage_Referrals(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	s.UpsertUser(ctx, 1, "referrer", "Referrer", "")
+	s.UpsertUser(ctx, 3, "old", "Old", "")
+
+	if added, _ := s.AddReferredUser(ctx, 2, 1, "friend", "Friend", ""); !added {
+		t.Fatal("AddReferredUser() = false for a new user")
+	}
+	for _, tt := range []struct{ userID, referrerID int64 }{{2, 1}, {3, 1}, {4, 4}, {5, 99}} {
+		if added, _ := s.AddReferredUser(ctx, tt.userID, tt.referrerID, "", "", ""); added {
+			t.Errorf("AddReferredUser(%d, %d) = true, want false", tt.userID, tt.referrerID)
+		}
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	product := products[0]
+	first, _ := s.CreateOrder(ctx, 2, product.ID, product.Price, "card", "")
+
+	// Пока заказ не оплачен, бонус не положен
+	if reward, err := s.CreateReferralReward(ctx, first.OrderID, 10); reward != nil || err != nil {
+		t.Errorf("CreateReferralReward() for unpaid order = %+v, %v, want nil", reward, err)
+	}
+
+	s.UpdateOrderStatus(ctx, first.OrderID, models.OrderStatusPaid, 0, "")
+	reward, err := s.CreateReferralReward(ctx, first.OrderID, 10)
+	if err != nil || reward == nil || reward.ReferrerID != 1 || reward.Amount != money.New(product.Price.Amount/10, product.Price.Currency) {
+		t.Fatalf("CreateReferralReward() = %+v, %v, want 10%% to user 1", reward, err)
+	}
+
+	second, _ := s.CreateOrder(ctx, 2, product.ID, product.Price, "card", "")
+	s.UpdateOrderStatus(ctx, second.OrderID, models.OrderStatusPaid, 0, "")
+	if again, _ := s.CreateReferralReward(ctx, second.OrderID, 10); again != nil {
+		t.Errorf("CreateReferralReward() for second order = %+v, want nil", again)
+	}
+
+	stats, _ := s.GetReferralStats(ctx, 1)
+	if stats.Invited != 1 || stats.Rewarded != 1 || len(stats.Rewards) != 1 || stats.Rewards[0] != reward.Amount {
+		t.Errorf("GetReferralStats(referrer) = %+v", stats)
+	}
+	if stats, _ := s.GetReferralStats(ctx, 2); stats.Referrer == nil || stats.Referrer.UserID != 1 {
+		t.Errorf("GetReferralStats(referred) = %+v, want referrer 1", stats)
+	}
+}
+
+func TestMemoryStorage_Ledger(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	product := products[0]
+	currency := product.Price.Currency
+	const adminID = 1000
+	s.UpsertUser(ctx, 2, "buyer", "Buyer", "")
+
+	if _, err := s.AdjustBalance(ctx, 99, money.New(100, currency), adminID, "бонус"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("AdjustBalance(unknown user) error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.AdjustBalance(ctx, 2, money.New(-100, currency), adminID, "штраф"); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("AdjustBalance() below zero error = %v, want ErrInsufficientBalance", err)
+	}
+
+	// Баланса хватает на часть заказа
+	half := money.New(product.Price.Amount/2, currency)
+	if _, err := s.AdjustBalance(ctx, 2, half, adminID, "компенсация"); err != nil {
+		t.Fatalf("AdjustBalance() error = %v", err)
+	}
+
+	partial, _ := s.CreateOrder(ctx, 2, product.ID, product.Price, "card", "")
+	if _, err := s.ApplyBalance(ctx, partial.OrderID, 3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ApplyBalance(other user) error = %v, want ErrNotFound", err)
+	}
+	applied, err := s.ApplyBalance(ctx, partial.OrderID, 2)
+	if err != nil {
+		t.Fatalf("ApplyBalance() error = %v", err)
+	}
+	if applied.Status != models.OrderStatusCreated || applied.BalanceUsed != half || applied.Price != product.Price.Sub(half) {
+		t.Errorf("ApplyBalance() partial = %s, price %s, used %s", applied.Status, applied.Price, applied.BalanceUsed)
+	}
+	if _, err := s.ApplyBalance(ctx, partial.OrderID, 2); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("ApplyBalance() with empty balance error = %v, want ErrInsufficientBalance", err)
+	}
+
+	// Отмена неоплаченного заказа возвращает списанные бонусы
+	s.UpdateOrderStatus(ctx, partial.OrderID, models.OrderStatusCancelled, 0, "Истек срок оплаты")
+	if balance, _ := s.GetBalance(ctx, 2); len(balance) != 1 || balance[0] != half {
+		t.Errorf("GetBalance() after cancel = %v, want %s", balance, half)
+	}
+
+	// Баланса хватает на весь заказ - заказ сразу оплачен
+	s.AdjustBalance(ctx, 2, product.Price, adminID, "компенсация")
+	full, _ := s.CreateOrder(ctx, 2, product.ID, product.Price, "card", "")
+	paid, err := s.ApplyBalance(ctx, full.OrderID, 2)
+	if err != nil || paid.Status != models.OrderStatusPaid || !paid.Price.IsZero() || paid.BalanceUsed != product.Price {
+		t.Fatalf("ApplyBalance() full = %+v, %v", paid, err)
+	}
+	if _, err := s.ApplyBalance(ctx, full.OrderID, 2); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("ApplyBalance(paid order) error = %v, want ErrInvalidTransition", err)
+	}
+
+	// Возврат оплаченного заказа зачисляет на баланс всю его сумму
+	refund, err := s.RefundOrderToBalance(ctx, full.OrderID, adminID, "Не подошел регион")
+	if err != nil || refund.Amount != product.Price || refund.UserID != 2 {
+		t.Fatalf("RefundOrderToBalance() = %+v, %v", refund, err)
+	}
+	if _, err := s.RefundOrderToBalance(ctx, full.OrderID, adminID, "еще раз"); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("RefundOrderToBalance() twice error = %v, want ErrInvalidTransition", err)
+	}
+
+	want := half.Add(product.Price)
+	if balance, _ := s.GetBalance(ctx, 2); len(balance) != 1 || balance[0] != want {
+		t.Errorf("GetBalance() = %v, want %s", balance, want)
+	}
+
+	ledger, _ := s.GetLedger(ctx, 2, 3)
+	if len(ledger) != 3 || ledger[0].Kind != models.LedgerKindRefund || ledger[1].Kind != models.LedgerKindCheckout {
+		t.Errorf("GetLedger() = %+v, want refund and checkout first", ledger)
+	}
+
+	// Каждая операция - две проводки с нулевой суммой
+	sums := make(map[int64]int64)
+	entries := make(map[int64]int)
+	for _, e := range s.ledgerEntries {
+		sums[e.TransactionID] += e.Amount.Amount
+		entries[e.TransactionID]++
+	}
+	for id, sum := range sums {
+		if sum != 0 || entries[id] != 2 {
+			t.Errorf("transaction %d: %d entries, sum %d, want 2 entries summing to 0", id, entries[id], sum)
+		}
+	}
+}
+
+func TestMemoryStorage_Support(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	if _, err := s.AddSupportMessage(ctx, models.SupportMessage{OrderID: "WOW0000000000", UserID: 42, Text: "?"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("AddSupportMessage(unknown order) error = %v, want ErrNotFound", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	order, _ := s.CreateOrder(ctx, 42, products[0].ID, products[0].Price, "card", "")
+
+	question, _ := s.AddSupportMessage(ctx, models.SupportMessage{OrderID: order.OrderID, UserID: 42, Text: "Где ключ?"})
+	answer, _ := s.AddSupportMessage(ctx, models.SupportMessage{OrderID: order.OrderID, UserID: 42, AdminID: 1000, Text: "Уже в пути"})
+
+	// Повторное сохранение той же копии не перепривязывает ее
+	s.SaveSupportRelay(ctx, 1000, 7, question.ID)
+	s.SaveSupportRelay(ctx, 1000, 7, answer.ID)
+
+	if got, err := s.GetSupportMessageByRelay(ctx, 1000, 7); err != nil || got.ID != question.ID {
+		t.Errorf("GetSupportMessageByRelay() = %+v, %v, want question", got, err)
+	}
+	if _, err := s.GetSupportMessageByRelay(ctx, 42, 7); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetSupportMessageByRelay(other chat) error = %v, want ErrNotFound", err)
+	}
+
+	thread, _ := s.GetSupportThread(ctx, order.OrderID)
+	if len(thread) != 2 || thread[0].ID != question.ID || thread[1].AdminID != 1000 {
+		t.Errorf("GetSupportThread() = %+v, want question then answer", thread)
+	}
+}
+
+func TestMemoryStorage_OrderClaims(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	order, _ := s.CreateOrder(ctx, 42, products[0].ID, products[0].Price, "card", "")
+
+	if _, err := s.GetOrderClaim(ctx, order.OrderID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetOrderClaim(unclaimed) error = %v, want ErrNotFound", err)
+	}
+
+	first, err := s.ClaimOrder(ctx, models.OrderClaim{OrderID: order.OrderID, AdminID: 1000, AdminName: "@first"})
+	if err != nil || first.AdminID != 1000 {
+		t.Fatalf("ClaimOrder() = %+v, %v", first, err)
+	}
+
+	// Второй админ получает действующее закрепление, а не свое
+	if second, err := s.ClaimOrder(ctx, models.OrderClaim{OrderID: order.OrderID, AdminID: 1001, AdminName: "@second"}); err != nil || second.AdminID != 1000 {
+		t.Errorf("ClaimOrder(second admin) = %+v, %v, want the first admin", second, err)
+	}
+
+	closed, _ := s.CreateOrder(ctx, 42, products[0].ID, products[0].Price, "card", "")
+	s.UpdateOrderStatus(ctx, closed.OrderID, models.OrderStatusCancelled, 1000, "")
+	if _, err := s.ClaimOrder(ctx, models.OrderClaim{OrderID: closed.OrderID, AdminID: 1000}); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("ClaimOrder(cancelled) error = %v, want ErrInvalidTransition", err)
+	}
+
+	// Повторное уведомление того же админа заменяет прежнее
+	s.SaveAdminNotification(ctx, models.AdminNotification{OrderID: order.OrderID, ChatID: 1000, MessageID: 1, Text: "old"})
+	s.SaveAdminNotification(ctx, models.AdminNotification{OrderID: order.OrderID, ChatID: 1000, MessageID: 2, Text: "new"})
+	s.SaveAdminNotification(ctx, models.AdminNotification{OrderID: order.OrderID, ChatID: 1001, MessageID: 3, Text: "new"})
+	if notifications, _ := s.GetAdminNotifications(ctx, order.OrderID); len(notifications) != 2 || notifications[0].MessageID != 2 {
+		t.Errorf("GetAdminNotifications() = %+v, want 2 notifications with the latest message", notifications)
+	}
+}
+
+func TestMemoryStorage_SubscriptionExpiry(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	monthly := products[0]
+	if monthly.DurationMonths != 1 {
+		t.Fatalf("DurationMonths of %q = %d, want 1", monthly.Name, monthly.DurationMonths)
+	}
+
+	complete := func(orderID string) *time.Time {
+		t.Helper()
+		s.UpdateOrderStatus(ctx, orderID, models.OrderStatusPaid, 1000, "")
+		if err := s.UpdateOrderStatus(ctx, orderID, models.OrderStatusCompleted, 1000, ""); err != nil {
+			t.Fatalf("UpdateOrderStatus(completed) error = %v", err)
+		}
+		items, _ := s.GetOrderItems(ctx, orderID)
+		return items[0].ExpiresAt
+	}
+
+	before := time.Now()
+	first, _ := s.CreateOrder(ctx, 42, monthly.ID, monthly.Price, "card", "")
+	firstExpiry := complete(first.OrderID)
+	if firstExpiry == nil || firstExpiry.Before(before.AddDate(0, 1, 0)) || firstExpiry.After(time.Now().AddDate(0, 1, 0)) {
+		t.Fatalf("expiry = %v, want a month from now", firstExpiry)
+	}
+
+	// Продление до окончания добавляет месяц к действующей подписке
+	renewal, _ := s.CreateOrder(ctx, 42, monthly.ID, monthly.Price, "card", "")
+	renewalExpiry := complete(renewal.OrderID)
+	if renewalExpiry == nil || !renewalExpiry.Equal(firstExpiry.AddDate(0, 1, 0)) {
+		t.Errorf("renewal expiry = %v, want %v", renewalExpiry, firstExpiry.AddDate(0, 1, 0))
+	}
+
+	// Продленная подписка не попадает в напоминания, напоминание о последней - один раз
+	far := time.Now().AddDate(1, 0, 0)
+	subs, _ := s.ListExpiringSubscriptions(ctx, time.Now(), far, 0)
+	if len(subs) != 1 || subs[0].OrderID != renewal.OrderID || subs[0].UserID != 42 || subs[0].ProductID != monthly.ID {
+		t.Fatalf("ListExpiringSubscriptions() = %+v, want only the renewal", subs)
+	}
+	if err := s.MarkSubscriptionReminded(ctx, subs[0].ItemID); err != nil {
+		t.Fatalf("MarkSubscriptionReminded() error = %v", err)
+	}
+	if subs, _ := s.ListExpiringSubscriptions(ctx, time.Now(), far, 0); len(subs) != 0 {
+		t.Errorf("ListExpiringSubscriptions() after reminder = %+v, want none", subs)
+	}
+
+	// Возврат снимает окончание подписки
+	s.UpdateOrderStatus(ctx, renewal.OrderID, models.OrderStatusRefunded, 1000, "")
+	if items, _ := s.GetOrderItems(ctx, renewal.OrderID); items[0].ExpiresAt != nil {
+		t.Errorf("refunded expiry = %v, want nil", items[0].ExpiresAt)
+	}
+
+	// Товар без срока не подписка
+	s.UpdateProductDuration(ctx, monthly.ID, 0)
+	service, _ := s.CreateOrder(ctx, 42, monthly.ID, monthly.Price, "card", "")
+	if expiry := complete(service.OrderID); expiry != nil {
+		t.Errorf("expiry without duration = %v, want nil", expiry)
+	}
+}
+
+func TestMemoryStorage_Preorders(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	preorder, regular := products[0], products[1]
+	releaseAt := time.Now().Add(24 * time.Hour)
+	s.UpdateProductRelease(ctx, preorder.ID, &releaseAt)
+
+	paid, _ := s.CreateOrder(ctx, 42, regular.ID, regular.Price, "card", "")
+	waiting, _ := s.CreateOrder(ctx, 42, preorder.ID, preorder.Price, "card", "")
+	refunded, _ := s.CreateOrder(ctx, 42, preorder.ID, preorder.Price, "card", "")
+	for _, o := range []*models.Order{paid, waiting, refunded} {
+		if err := s.UpdateOrderStatus(ctx, o.OrderID, models.OrderStatusPaid, 1000, ""); err != nil {
+			t.Fatalf("UpdateOrderStatus(paid) error = %v", err)
+		}
+	}
+
+	if got, _ := s.GetOrderByID(ctx, paid.OrderID); got.Status != models.OrderStatusPaid {
+		t.Errorf("regular order status = %q, want paid", got.Status)
+	}
+	if got, _ := s.GetOrderByID(ctx, waiting.OrderID); got.Status != models.OrderStatusPreordered {
+		t.Errorf("preorder status = %q, want preordered", got.Status)
+	}
+	if err := s.UpdateOrderStatus(ctx, refunded.OrderID, models.OrderStatusRefunded, 1000, ""); err != nil {
+		t.Errorf("refund of preorder error = %v", err)
+	}
+
+	if released, _ := s.ListReleasedPreorders(ctx, time.Now(), 0); len(released) != 0 {
+		t.Errorf("ListReleasedPreorders(before release) = %+v, want none", released)
+	}
+	released, _ := s.ListReleasedPreorders(ctx, releaseAt.Add(time.Second), 0)
+	if len(released) != 1 || released[0].OrderID != waiting.OrderID {
+		t.Fatalf("ListReleasedPreorders(after release) = %+v, want the waiting preorder", released)
+	}
+	if err := s.UpdateOrderStatus(ctx, waiting.OrderID, models.OrderStatusPaid, 0, ""); err != nil {
+		t.Errorf("release error = %v", err)
+	}
+}
+
+func TestMemoryStorage_PayoutCards(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	regions, _ := s.ListRegions(ctx)
+	kz, eu := regions[0], regions[2]
+	products, _ := s.ListAllProducts(ctx)
+	product := products[0]
+	since := time.Now().Add(-time.Hour)
+
+	limit := product.Price.Mul(2)
+	first, _ := s.CreatePayoutCard(ctx, models.PayoutCard{Number: "1", BankName: "A", Holder: "X", RegionID: kz.ID, DailyLimit: limit})
+	s.CreatePayoutCard(ctx, models.PayoutCard{Number: "2", BankName: "B", Holder: "Y", RegionID: eu.ID})
+	second, _ := s.CreatePayoutCard(ctx, models.PayoutCard{Number: "3", BankName: "C", Holder: "Z"})
+
+	assign := func() (*models.Order, *models.PayoutCard, error) {
+		order, _ := s.CreateOrder(ctx, 42, product.ID, product.Price, "card", "")
+		card, err := s.AssignPayoutCard(ctx, order.OrderID, models.PayoutRotationPriority, since)
+		return order, card, err
+	}
+
+	// По приоритету первая карта региона берется, пока не исчерпан ее лимит; карта EU не подходит заказу KZ
+	o1, card, err := assign()
+	if err != nil || card.ID != first.ID {
+		t.Fatalf("AssignPayoutCard() = %+v, %v, want first card", card, err)
+	}
+	if again, _ := s.AssignPayoutCard(ctx, o1.OrderID, models.PayoutRotationPriority, since); again.ID != first.ID {
+		t.Errorf("repeated AssignPayoutCard() = %+v, want the same card", again)
+	}
+	if _, card, _ = assign(); card.ID != first.ID || card.UsedToday != limit {
+		t.Errorf("second AssignPayoutCard() = %+v, want first card filled to limit", card)
+	}
+	o3, card, _ := assign()
+	if card.ID != second.ID {
+		t.Errorf("third AssignPayoutCard() = %+v, want card for all regions", card)
+	}
+
+	// Отмененный заказ освобождает лимит
+	s.UpdateOrderStatus(ctx, o1.OrderID, models.OrderStatusCancelled, 0, "")
+	if _, card, _ = assign(); card.ID != first.ID {
+		t.Errorf("AssignPayoutCard() after cancel = %+v, want first card", card)
+	}
+
+	// Выключенная карта заменяется при следующей выдаче, удаленная пропадает из заказа
+	s.SetPayoutCardActive(ctx, second.ID, false)
+	s.SetPayoutCardActive(ctx, first.ID, false)
+	if _, err := s.AssignPayoutCard(ctx, o3.OrderID, models.PayoutRotationRoundRobin, since); !errors.Is(err, ErrNoPayoutCard) {
+		t.Errorf("AssignPayoutCard() without active cards error = %v, want ErrNoPayoutCard", err)
+	}
+	if err := s.DeletePayoutCard(ctx, second.ID); err != nil {
+		t.Fatalf("DeletePayoutCard() error = %v", err)
+	}
+	if _, err := s.GetOrderPayoutCard(ctx, o3.OrderID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetOrderPayoutCard() after delete error = %v, want ErrNotFound", err)
+	}
+
+	s.UpdateOrderStatus(ctx, o3.OrderID, models.OrderStatusPaid, 1000, "")
+	if _, err := s.AssignPayoutCard(ctx, o3.OrderID, models.PayoutRotationRoundRobin, since); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("AssignPayoutCard() for paid order error = %v, want ErrInvalidTransition", err)
+	}
+}
+
+func TestMemoryStorage_RegionCurrency(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	regions, _ := s.ListRegions(ctx)
+	kz, eu := regions[0], regions[2]
+
+	// Товар получает валюту своего региона
+	category := s.AddCategory(eu.ID, "Подписка WOW", "", 1)
+	euProduct, err := s.CreateProduct(ctx, "1 месяц", category.ID, money.New(1299, money.EUR), "")
+	if err != nil {
+		t.Fatalf("CreateProduct() error = %v", err)
+	}
+	if euProduct.Price.Currency != money.EUR {
+		t.Errorf("EU product currency = %s, want EUR", euProduct.Price.Currency)
+	}
+
+	kzProducts, _ := s.ListAllProducts(ctx)
+	kzProduct := kzProducts[0]
+
+	for _, p := range []*models.Product{euProduct, &kzProduct} {
+		order, err := s.CreateOrder(ctx, 42, p.ID, p.Price, "card", "")
+		if err != nil {
+			t.Fatalf("CreateOrder() error = %v", err)
+		}
+		if order.Price.Currency != p.Price.Currency {
+			t.Errorf("order currency = %s, want %s", order.Price.Currency, p.Price.Currency)
+		}
+		_ = s.UpdateOrderStatus(ctx, order.OrderID, models.OrderStatusPaid, 0, "")
+	}
+
+	// Выручка не смешивает валюты
+	stats, _ := s.GetOrderStats(ctx)
+	revenue, _ := stats["revenue"].([]money.Money)
+	want := []money.Money{money.New(1299, money.EUR), kzProduct.Price}
+	if len(revenue) != 2 || revenue[0] != want[0] || revenue[1] != want[1] {
+		t.Errorf("revenue = %v, want %v", revenue, want)
+	}
+
+	// Смена валюты региона меняет валюту его товаров
+	if err := s.UpdateRegionCurrency(ctx, kz.ID, money.KZT); err != nil {
+		t.Fatalf("UpdateRegionCurrency() error = %v", err)
+	}
+	got, _ := s.GetProductByID(ctx, kzProduct.ID)
+	if got.Price.Currency != money.KZT || got.Price.Amount != kzProduct.Price.Amount {
+		t.Errorf("product price after currency change = %+v", got.Price)
+	}
+}
+
+func TestMemoryStorage_Broadcasts(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+
+	_ = s.UpsertUser(ctx, 1, "alice", "Alice", "")
+	_ = s.UpsertUser(ctx, 2, "bob", "Bob", "")
+	_ = s.MarkUserAsBlocked(ctx, 2)
+
+	if count, _ := s.GetUsersCount(ctx); count != 1 {
+		t.Errorf("GetUsersCount() = %d, want 1", count)
+	}
+
+	b, err := s.CreateBroadcast(ctx, 100, "hello")
+	if err != nil {
+		t.Fatalf("CreateBroadcast() error = %v", err)
+	}
+	if err := s.SaveBroadcastPhoto(ctx, b.ID, "file", 0); err != nil {
+		t.Fatalf("SaveBroadcastPhoto() error = %v", err)
+	}
+
+	if err := s.UpdateBroadcastStatus(ctx, b.ID, "sending", 1, 0, 0); err != nil {
+		t.Fatalf("UpdateBroadcastStatus() error = %v", err)
+	}
+
+	// Удалять можно только черновики
+	if err := s.DeleteBroadcast(ctx, b.ID); err == nil {
+		t.Error("DeleteBroadcast() should fail for a broadcast that is already sending")
+	}
+
+	got, _ := s.GetBroadcastByID(ctx, b.ID)
+	if got.StartedAt == nil || got.CompletedAt != nil {
+		t.Errorf("broadcast timestamps: started=%v completed=%v", got.StartedAt, got.CompletedAt)
+	}
+}
+
+func TestMemoryStorage_AssignAmountOffset(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	if err := s.SeedDemoData(ctx); err != nil {
+		t.Fatalf("SeedDemoData() error = %v", err)
+	}
+
+	products, _ := s.ListAllProducts(ctx)
+	product := products[0]
+	cents := func(n int64) money.Money { return money.New(n, product.Price.Currency) }
+
+	create := func(userID int64, method string) *models.Order {
+		order, err := s.CreateOrder(ctx, userID, product.ID, product.Price, method, "")
+		if err != nil {
+			t.Fatalf("CreateOrder() error = %v", err)
+		}
+		return order
+	}
+
+	// Отмененные заказы держат надбавку, пока сверка может найти их перевод
+	reservedSince := time.Now().Add(-time.Hour)
+
+	// Заказы на одинаковую сумму получают разные копейки, повторный вызов надбавку не меняет
+	o1, o2 := create(41, "card"), create(42, "card")
+	first, err := s.AssignAmountOffset(ctx, o1.OrderID, reservedSince)
+	if err != nil || first.AmountOffset != cents(1) {
+		t.Fatalf("AssignAmountOffset() = %+v, %v, want +0.01", first, err)
+	}
+	if second, _ := s.AssignAmountOffset(ctx, o2.OrderID, reservedSince); second.AmountOffset != cents(2) || second.TransferAmount() != product.Price.Add(cents(2)) {
+		t.Errorf("second AssignAmountOffset() = %+v, want +0.02", second)
+	}
+	if again, _ := s.AssignAmountOffset(ctx, o1.OrderID, reservedSince); again.AmountOffset != cents(1) {
+		t.Errorf("repeated AssignAmountOffset() = %+v, want the same offset", again)
+	}
+
+	// Заказы другим способом оплаты суммы не занимают
+	other := create(43, "crypto")
+	if got, _ := s.AssignAmountOffset(ctx, other.OrderID, reservedSince); got.AmountOffset != cents(1) {
+		t.Errorf("AssignAmountOffset() for other method = %+v, want +0.01", got)
+	}
+
+	// Надбавка заказа, отмененного по сроку, освобождается только после окна сверки
+	if err := s.UpdateOrderStatus(ctx, o1.OrderID, models.OrderStatusCancelled, 0, "Не оплачен за 24 ч"); err != nil {
+		t.Fatalf("UpdateOrderStatus() error = %v", err)
+	}
+	if got, _ := s.AssignAmountOffset(ctx, create(44, "card").OrderID, reservedSince); got.AmountOffset != cents(3) {
+		t.Errorf("AssignAmountOffset() after expiry = %+v, want +0.03", got)
+	}
+	if got, _ := s.AssignAmountOffset(ctx, create(45, "card").OrderID, time.Now().Add(time.Hour)); got.AmountOffset != cents(1) {
+		t.Errorf("AssignAmountOffset() after reconcile window = %+v, want freed +0.01", got)
+	}
+
+	// Заказ, отмененный покупателем, сверка не ищет
+	if err := s.UpdateOrderStatus(ctx, o2.OrderID, models.OrderStatusCancelled, 42, "Отменен покупателем"); err != nil {
+		t.Fatalf("UpdateOrderStatus() error = %v", err)
+	}
+
+	awaiting, _ := s.ListAwaitingTransfers(ctx, "card", reservedSince, 0)
+	if len(awaiting) != 3 || awaiting[0].OrderID != o1.OrderID {
+		t.Errorf("ListAwaitingTransfers() = %+v, want the expired order and two new card orders, oldest first", awaiting)
+	}
+	if later, _ := s.ListAwaitingTransfers(ctx, "card", time.Now().Add(time.Hour), 0); len(later) != 2 {
+		t.Errorf("ListAwaitingTransfers() after reconcile window = %+v, want only unpaid orders", later)
+	}
+
+	if _, err := s.AssignAmountOffset(ctx, o1.OrderID, reservedSince); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("AssignAmountOffset() for cancelled order error = %v, want ErrInvalidTransition", err)
+	}
+
+	// Обычное подтверждение оплаты отмененный заказ не принимает
+	if err := s.UpdateOrderStatus(ctx, o1.OrderID, models.OrderStatusPaid, 1000, ""); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("UpdateOrderStatus(expired -> paid) error = %v, want ErrInvalidTransition", err)
+	}
+
+	// Перевод, найденный сверкой, подтверждает заказ, отмененный по сроку, но не отмененный покупателем
+	if err := s.ConfirmLateTransfer(ctx, o1.OrderID, 1000, ""); err != nil {
+		t.Errorf("ConfirmLateTransfer(expired) error = %v", err)
+	}
+	if got, _ := s.GetOrderByID(ctx, o1.OrderID); got.Status != models.OrderStatusPaid {
+		t.Errorf("expired order status after late transfer = %s, want paid", got.Status)
+	}
+	if err := s.ConfirmLateTransfer(ctx, o2.OrderID, 1000, ""); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("ConfirmLateTransfer(cancelled by user) error = %v, want ErrInvalidTransition", err)
+	}
+	if err := s.ConfirmLateTransfer(ctx, o1.OrderID, 1000, ""); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("repeated ConfirmLateTransfer() error = %v, want ErrInvalidTransition", err)
+	}
+
+	// Пока заказ был отменен, последнее использование промокода досталось другому заказу
+	if _, err := s.CreatePromoCode(ctx, models.PromoCode{Code: "ONCE", Percent: 10, MaxUses: 1}); err != nil {
+		t.Fatalf("CreatePromoCode() error = %v", err)
+	}
+	withPromo, err := s.CreateOrder(ctx, 46, product.ID, product.Price, "card", "ONCE")
+	if err != nil {
+		t.Fatalf("CreateOrder() with promo error = %v", err)
+	}
+	s.UpdateOrderStatus(ctx, withPromo.OrderID, models.OrderStatusCancelled, 0, "Не оплачен за 24 ч")
+	if _, err := s.CreateOrder(ctx, 47, product.ID, product.Price, "card", "ONCE"); err != nil {
+		t.Fatalf("CreateOrder() with freed promo error = %v", err)
+	}
+	if err := s.ConfirmLateTransfer(ctx, withPromo.OrderID, 1000, ""); !errors.Is(err, ErrInvalidTransition) || !errors.Is(err, promo.ErrUsageLimit) {
+		t.Errorf("ConfirmLateTransfer() over promo limit error = %v, want ErrInvalidTransition and promo.ErrUsageLimit", err)
+	}
+}
@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+// payoutCardFits сообщает, примет ли карта заказ на сумму price, не превысив дневной лимит.
+// Карта с лимитом принимает только заказы в валюте лимита
+func payoutCardFits(card models.PayoutCard, price money.Money) bool {
+	if card.DailyLimit.IsZero() {
+		return true
+	}
+	if price.Currency != card.DailyLimit.Currency {
+		return false
+	}
+	return card.UsedToday.Amount+price.Amount <= card.DailyLimit.Amount
+}
@@ -2,13 +2,19 @@ package storage
 
 import (
 	"context"
-	"crypto/rand"
+	"errors"
 	"fmt"
-	"math/big"
+	"sort"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"tgwow/internal/models"
+	"tgwow/internal/money"
+	"tgwow/internal/orderid"
+	"tgwow/internal/promo"
 )
 
 type PostgresStorage struct {
@@ -37,28 +43,88 @@ func (s *PostgresStorage) Close() {
 	s.pool.Close()
 }
 
-// generateOrderID генерирует короткий номер заказа формата: WOW + YYMMDD + 3 цифры
-// Пример: WOW241204123
-// Использует crypto/rand для криптографически стойкой генерации случайных чисел
-func generateOrderID() string {
-	now := time.Now()
-	dateStr := now.Format("060102") // YYMMDD
+// Pool возвращает пул соединений (нужен для применения миграций)
+func (s *PostgresStorage) Pool() *pgxpool.Pool {
+	return s.pool
+}
+
+// maxOrderIDAttempts - сколько раз повторять создание заказа при конфликте номера.
+// Конфликт возможен только если счетчик order_counters был сброшен (например, восстановлением бэкапа)
+const maxOrderIDAttempts = 3
+
+// ordersPrimaryKey - ограничение первичного ключа orders, нарушение которого означает занятый номер заказа
+const ordersPrimaryKey = "orders_pkey"
+
+// nextOrderSeq атомарно увеличивает счетчик заказов за день и возвращает новое значение
+func nextOrderSeq(ctx context.Context, tx pgx.Tx, day time.Time) (int64, error) {
+	query := `
+		INSERT INTO order_counters (day, last_value)
+		VALUES ($1, 1)
+		ON CONFLICT (day) DO UPDATE SET last_value = order_counters.last_value + 1
+		RETURNING last_value
+	`
+
+	var seq int64
+	if err := tx.QueryRow(ctx, query, day.Format("2006-01-02")).Scan(&seq); err != nil {
+		return 0, fmt.Errorf("failed to increment order counter: %w", err)
+	}
 
-	// Генерируем случайное число от 0 до 999 используя crypto/rand
-	randomBig, err := rand.Int(rand.Reader, big.NewInt(1000))
+	return seq, nil
+}
+
+// isUniqueViolation проверяет, что ошибка - нарушение уникальности (SQLSTATE 23505)
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// isOrderIDConflict проверяет, что ошибка - занятый номер заказа, а не другое нарушение уникальности
+func isOrderIDConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == ordersPrimaryKey
+}
+
+// advanceOrderCounter переводит счетчик заказов за день за последний существующий номер этого дня.
+// Выполняется вне транзакции создания заказа: ее откат отменил бы и сдвиг счетчика
+func (s *PostgresStorage) advanceOrderCounter(ctx context.Context, day time.Time) error {
+	rows, err := s.pool.Query(ctx, `SELECT order_id FROM orders WHERE order_id LIKE $1`, orderid.Prefix+day.Format("060102")+"%")
 	if err != nil {
-		// Fallback на timestamp если crypto/rand недоступен (крайне маловероятно)
-		randomNum := now.UnixNano() % 1000
-		return fmt.Sprintf("WOW%s%03d", dateStr, randomNum)
+		return fmt.Errorf("failed to query order ids: %w", err)
+	}
+	defer rows.Close()
+
+	var last int64
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("failed to scan order id: %w", err)
+		}
+		if seq, ok := orderid.Seq(id, day); ok && seq > last {
+			last = seq
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("rows error: %w", err)
+	}
+
+	query := `
+		INSERT INTO order_counters (day, last_value)
+		VALUES ($1, $2)
+		ON CONFLICT (day) DO UPDATE SET last_value = GREATEST(order_counters.last_value, EXCLUDED.last_value)
+	`
+
+	if _, err := s.pool.Exec(ctx, query, day.Format("2006-01-02"), last); err != nil {
+		return fmt.Errorf("failed to advance order counter: %w", err)
 	}
 
-	return fmt.Sprintf("WOW%s%03d", dateStr, randomBig.Int64())
+	return nil
 }
 
 // ListRegions возвращает все регионы
 func (s *PostgresStorage) ListRegions(ctx context.Context) ([]models.Region, error) {
 	query := `
-		SELECT id, name, code, created_at
+		SELECT id, name, code, currency, created_at
 		FROM regions
 		ORDER BY id ASC
 	`
@@ -72,7 +138,7 @@ func (s *PostgresStorage) ListRegions(ctx context.Context) ([]models.Region, err
 	var regions []models.Region
 	for rows.Next() {
 		var r models.Region
-		if err := rows.Scan(&r.ID, &r.Name, &r.Code, &r.CreatedAt); err != nil {
+		if err := rows.Scan(&r.ID, &r.Name, &r.Code, &r.Currency, &r.CreatedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan region: %w", err)
 		}
 		regions = append(regions, r)
@@ -88,20 +154,36 @@ func (s *PostgresStorage) ListRegions(ctx context.Context) ([]models.Region, err
 // GetRegionByID возвращает регион по ID
 func (s *PostgresStorage) GetRegionByID(ctx context.Context, regionID int) (*models.Region, error) {
 	query := `
-		SELECT id, name, code, created_at
+		SELECT id, name, code, currency, created_at
 		FROM regions
 		WHERE id = $1
 	`
 
 	var r models.Region
-	err := s.pool.QueryRow(ctx, query, regionID).Scan(&r.ID, &r.Name, &r.Code, &r.CreatedAt)
+	err := s.pool.QueryRow(ctx, query, regionID).Scan(&r.ID, &r.Name, &r.Code, &r.Currency, &r.CreatedAt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get region: %w", err)
+		return nil, fmt.Errorf("failed to get region: %w", notFound(err))
 	}
 
 	return &r, nil
 }
 
+// UpdateRegionCurrency меняет валюту региона. Цены товаров не пересчитываются
+func (s *PostgresStorage) UpdateRegionCurrency(ctx context.Context, regionID int, currency money.Currency) error {
+	query := `
+		UPDATE regions
+		SET currency = $1
+		WHERE id = $2
+	`
+
+	_, err := s.pool.Exec(ctx, query, currency, regionID)
+	if err != nil {
+		return fmt.Errorf("failed to update region currency: %w", err)
+	}
+
+	return nil
+}
+
 // ListCategoriesByRegion возвращает категории для региона
 func (s *PostgresStorage) ListCategoriesByRegion(ctx context.Context, regionID int) ([]models.Category, error) {
 	query := `
@@ -207,7 +289,7 @@ func (s *PostgresStorage) GetCategoryByID(ctx context.Context, categoryID int) (
 		&c.ID, &c.Name, &c.RegionID, &c.Description, &c.SortOrder, &c.CreatedAt,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get category: %w", err)
+		return nil, fmt.Errorf("failed to get category: %w", notFound(err))
 	}
 
 	return &c, nil
@@ -216,10 +298,12 @@ func (s *PostgresStorage) GetCategoryByID(ctx context.Context, categoryID int) (
 // ListProductsByCategory возвращает товары для категории
 func (s *PostgresStorage) ListProductsByCategory(ctx context.Context, categoryID int) ([]models.Product, error) {
 	query := `
-		SELECT id, name, category_id, price, description, is_visible, sort_order, created_at
-		FROM products
-		WHERE category_id = $1 AND is_visible = true
-		ORDER BY sort_order ASC, id ASC
+		SELECT p.id, p.name, p.category_id, p.price, r.currency, p.description, p.is_visible, p.sort_order, COALESCE(p.duration_months, 0), p.release_at, p.created_at
+		FROM products p
+		JOIN categories c ON c.id = p.category_id
+		JOIN regions r ON r.id = c.region_id
+		WHERE p.category_id = $1 AND p.is_visible = true
+		ORDER BY p.sort_order ASC, p.id ASC
 	`
 
 	rows, err := s.pool.Query(ctx, query, categoryID)
@@ -230,8 +314,8 @@ func (s *PostgresStorage) ListProductsByCategory(ctx context.Context, categoryID
 
 	var products []models.Product
 	for rows.Next() {
-		var p models.Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.CategoryID, &p.Price, &p.Description, &p.IsVisible, &p.SortOrder, &p.CreatedAt); err != nil {
+		p, err := scanProduct(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan product: %w", err)
 		}
 		products = append(products, p)
@@ -247,10 +331,12 @@ func (s *PostgresStorage) ListProductsByCategory(ctx context.Context, categoryID
 // ListAllProductsByCategory возвращает все товары для категории (включая скрытые) - для админа
 func (s *PostgresStorage) ListAllProductsByCategory(ctx context.Context, categoryID int) ([]models.Product, error) {
 	query := `
-		SELECT id, name, category_id, price, description, is_visible, sort_order, created_at
-		FROM products
-		WHERE category_id = $1
-		ORDER BY sort_order ASC, id ASC
+		SELECT p.id, p.name, p.category_id, p.price, r.currency, p.description, p.is_visible, p.sort_order, COALESCE(p.duration_months, 0), p.release_at, p.created_at
+		FROM products p
+		JOIN categories c ON c.id = p.category_id
+		JOIN regions r ON r.id = c.region_id
+		WHERE p.category_id = $1
+		ORDER BY p.sort_order ASC, p.id ASC
 	`
 
 	rows, err := s.pool.Query(ctx, query, categoryID)
@@ -261,8 +347,8 @@ func (s *PostgresStorage) ListAllProductsByCategory(ctx context.Context, categor
 
 	var products []models.Product
 	for rows.Next() {
-		var p models.Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.CategoryID, &p.Price, &p.Description, &p.IsVisible, &p.SortOrder, &p.CreatedAt); err != nil {
+		p, err := scanProduct(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan product: %w", err)
 		}
 		products = append(products, p)
@@ -278,10 +364,12 @@ func (s *PostgresStorage) ListAllProductsByCategory(ctx context.Context, categor
 // ListProducts возвращает все видимые товары (для совместимости)
 func (s *PostgresStorage) ListProducts(ctx context.Context) ([]models.Product, error) {
 	query := `
-		SELECT id, name, category_id, price, description, is_visible, sort_order, created_at
-		FROM products
-		WHERE is_visible = true
-		ORDER BY sort_order ASC
+		SELECT p.id, p.name, p.category_id, p.price, r.currency, p.description, p.is_visible, p.sort_order, COALESCE(p.duration_months, 0), p.release_at, p.created_at
+		FROM products p
+		JOIN categories c ON c.id = p.category_id
+		JOIN regions r ON r.id = c.region_id
+		WHERE p.is_visible = true
+		ORDER BY p.sort_order ASC
 	`
 
 	rows, err := s.pool.Query(ctx, query)
@@ -292,8 +380,8 @@ func (s *PostgresStorage) ListProducts(ctx context.Context) ([]models.Product, e
 
 	var products []models.Product
 	for rows.Next() {
-		var p models.Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.CategoryID, &p.Price, &p.Description, &p.IsVisible, &p.SortOrder, &p.CreatedAt); err != nil {
+		p, err := scanProduct(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan product: %w", err)
 		}
 		products = append(products, p)
@@ -308,17 +396,16 @@ func (s *PostgresStorage) ListProducts(ctx context.Context) ([]models.Product, e
 
 func (s *PostgresStorage) GetProductByID(ctx context.Context, productID int) (*models.Product, error) {
 	query := `
-		SELECT id, name, category_id, price, description, is_visible, sort_order, created_at
-		FROM products
-		WHERE id = $1
+		SELECT p.id, p.name, p.category_id, p.price, r.currency, p.description, p.is_visible, p.sort_order, COALESCE(p.duration_months, 0), p.release_at, p.created_at
+		FROM products p
+		JOIN categories c ON c.id = p.category_id
+		JOIN regions r ON r.id = c.region_id
+		WHERE p.id = $1
 	`
 
-	var p models.Product
-	err := s.pool.QueryRow(ctx, query, productID).Scan(
-		&p.ID, &p.Name, &p.CategoryID, &p.Price, &p.Description, &p.IsVisible, &p.SortOrder, &p.CreatedAt,
-	)
+	p, err := scanProduct(s.pool.QueryRow(ctx, query, productID))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get product: %w", err)
+		return nil, fmt.Errorf("failed to get product: %w", notFound(err))
 	}
 
 	return &p, nil
@@ -331,9 +418,11 @@ func (s *PostgresStorage) GetProductsByIDs(ctx context.Context, productIDs []int
 	}
 
 	query := `
-		SELECT id, name, category_id, price, description, is_visible, sort_order, created_at
-		FROM products
-		WHERE id = ANY($1)
+		SELECT p.id, p.name, p.category_id, p.price, r.currency, p.description, p.is_visible, p.sort_order, COALESCE(p.duration_months, 0), p.release_at, p.created_at
+		FROM products p
+		JOIN categories c ON c.id = p.category_id
+		JOIN regions r ON r.id = c.region_id
+		WHERE p.id = ANY($1)
 	`
 
 	rows, err := s.pool.Query(ctx, query, productIDs)
@@ -344,8 +433,8 @@ func (s *PostgresStorage) GetProductsByIDs(ctx context.Context, productIDs []int
 
 	products := make(map[int]*models.Product, len(productIDs))
 	for rows.Next() {
-		var p models.Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.CategoryID, &p.Price, &p.Description, &p.IsVisible, &p.SortOrder, &p.CreatedAt); err != nil {
+		p, err := scanProduct(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan product: %w", err)
 		}
 		products[p.ID] = &p
@@ -358,24 +447,54 @@ func (s *PostgresStorage) GetProductsByIDs(ctx context.Context, productIDs []int
 	return products, nil
 }
 
-func (s *PostgresStorage) CreateOrder(ctx context.Context, userID int64, productID int, price float64) (*models.Order, error) {
-	orderID := generateOrderID()
-	createdAt := time.Now()
+// CreateOrder создает заказ на один товар: номер берется из счетчика дня,
+// в историю статусов пишется создание, в order_items - позиция с названием товара.
+// Непустой promoCode применяется к заказу, ошибки проверки - из пакета promo
+func (s *PostgresStorage) CreateOrder(ctx context.Context, userID int64, productID int, price money.Money, paymentMethod string, promoCode string) (*models.Order, error) {
+	var order models.Order
 
-	query := `
-		INSERT INTO orders (order_id, user_id, product_id, price, status, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING order_id, user_id, product_id, price, status, created_at
-	`
+	err := s.inOrderTx(ctx, func(tx pgx.Tx, orderID string, createdAt time.Time) error {
+		line := cartLine{quantity: 1}
+		line.product.ID = productID
+		line.product.Price = price
+
+		query := `
+			SELECT p.name, p.category_id, COALESCE(p.duration_months, 0), c.region_id
+			FROM products p
+			JOIN categories c ON c.id = p.category_id
+			WHERE p.id = $1
+		`
+		err := tx.QueryRow(ctx, query, productID).Scan(&line.product.Name, &line.product.CategoryID, &line.product.DurationMonths, &line.regionID)
+		if err != nil {
+			return notFound(err)
+		}
 
-	var order models.Order
-	err := s.pool.QueryRow(
-		ctx, query,
-		orderID, userID, productID, price, "created", createdAt,
-	).Scan(
-		&order.OrderID, &order.UserID, &order.ProductID,
-		&order.Price, &order.Status, &order.CreatedAt,
-	)
+		draft := models.Order{
+			OrderID:       orderID,
+			UserID:        userID,
+			ProductID:     productID,
+			Price:         price,
+			PaymentMethod: paymentMethod,
+			CreatedAt:     createdAt,
+		}
+		if err := applyPromoCode(ctx, tx, &draft, promoCode, []cartLine{line}); err != nil {
+			return err
+		}
+
+		order, err = insertOrder(ctx, tx, draft)
+		if err != nil {
+			return err
+		}
+
+		item := models.OrderItem{
+			ProductID:      productID,
+			ProductName:    line.product.Name,
+			Price:          price,
+			Quantity:       1,
+			DurationMonths: line.product.DurationMonths,
+		}
+		return insertOrderItems(ctx, tx, order.OrderID, []models.OrderItem{item})
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create order: %w", err)
 	}
@@ -383,91 +502,231 @@ func (s *PostgresStorage) CreateOrder(ctx context.Context, userID int64, product
 	return &order, nil
 }
 
-// GetUserOrders возвращает заказы пользователя
-func (s *PostgresStorage) GetUserOrders(ctx context.Context, userID int64) ([]models.Order, error) {
+// CheckoutCart оформляет корзину покупателя одним заказом и очищает ее. Цены и названия
+// берутся из товаров на момент оформления. ErrCartEmpty - корзина пуста,
+// ErrProductUnavailable - в корзине скрытый товар или товар без цены, ErrCartMixedCurrency - разные валюты
+func (s *PostgresStorage) CheckoutCart(ctx context.Context, userID int64, paymentMethod string, promoCode string) (*models.Order, error) {
+	var order models.Order
+
+	err := s.inOrderTx(ctx, func(tx pgx.Tx, orderID string, createdAt time.Time) error {
+		lines, err := lockCartLines(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+
+		items, total, err := cartOrderItems(lines)
+		if err != nil {
+			return err
+		}
+
+		draft := models.Order{
+			OrderID:       orderID,
+			UserID:        userID,
+			Price:         total,
+			PaymentMethod: paymentMethod,
+			CreatedAt:     createdAt,
+		}
+		if err := applyPromoCode(ctx, tx, &draft, promoCode, lines); err != nil {
+			return err
+		}
+
+		order, err = insertOrder(ctx, tx, draft)
+		if err != nil {
+			return err
+		}
+
+		if err := insertOrderItems(ctx, tx, order.OrderID, items); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, "DELETE FROM cart_items WHERE user_id = $1", userID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to checkout cart: %w", err)
+	}
+
+	return &order, nil
+}
+
+// applyPromoCode проверяет промокод и вычитает скидку из суммы заказа. Строка промокода
+// блокируется до конца транзакции, чтобы параллельные заказы не превысили лимит использований
+func applyPromoCode(ctx context.Context, tx pgx.Tx, order *models.Order, code string, lines []cartLine) error {
+	if code == "" {
+		return nil
+	}
+
+	pc, err := scanPromoCode(tx.QueryRow(ctx, "SELECT "+promoCodeColumns+" FROM promo_codes WHERE code = $1 FOR UPDATE", code))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return promo.ErrUnknown
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get promo code: %w", err)
+	}
+
+	usage, err := promoUsage(ctx, tx, code, order.UserID)
+	if err != nil {
+		return err
+	}
+
+	discount, err := promo.Discount(pc, promoLines(lines), usage, time.Now())
+	if err != nil {
+		return err
+	}
+
+	order.PromoCode = pc.Code
+	order.Discount = discount
+	order.Price = order.Price.Sub(discount)
+	return nil
+}
+
+// promoUsage считает использования промокода и неотмененные заказы покупателя
+func promoUsage(ctx context.Context, tx pgx.Tx, code string, userID int64) (promo.Usage, error) {
 	query := `
-		SELECT order_id, user_id, product_id, price, status, created_at
+		SELECT
+			COUNT(*) FILTER (WHERE promo_code = $1),
+			COUNT(*) FILTER (WHERE promo_code = $1 AND user_id = $2),
+			COUNT(*) FILTER (WHERE user_id = $2) > 0
 		FROM orders
-		WHERE user_id = $1
-		ORDER BY created_at DESC
+		WHERE status <> 'cancelled' AND (promo_code = $1 OR user_id = $2)
 	`
 
-	rows, err := s.pool.Query(ctx, query, userID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query user orders: %w", err)
+	var usage promo.Usage
+	if err := tx.QueryRow(ctx, query, code, userID).Scan(&usage.Total, &usage.ByUser, &usage.HasOrders); err != nil {
+		return promo.Usage{}, fmt.Errorf("failed to count promo code usage: %w", err)
 	}
-	defer rows.Close()
 
-	var orders []models.Order
-	for rows.Next() {
-		var o models.Order
-		if err := rows.Scan(&o.OrderID, &o.UserID, &o.ProductID, &o.Price, &o.Status, &o.CreatedAt); err != nil {
-			return nil, fmt.Errorf("failed to scan order: %w", err)
+	return usage, nil
+}
+
+// inOrderTx выполняет fn в транзакции с новым номером заказа из счетчика дня.
+// При конфликте номера счетчик сдвигается за существующие номера дня и транзакция повторяется
+func (s *PostgresStorage) inOrderTx(ctx context.Context, fn func(tx pgx.Tx, orderID string, createdAt time.Time) error) error {
+	var err error
+
+	for attempt := 1; attempt <= maxOrderIDAttempts; attempt++ {
+		createdAt := time.Now()
+
+		err = pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+			seq, err := nextOrderSeq(ctx, tx, createdAt)
+			if err != nil {
+				return err
+			}
+
+			return fn(tx, orderid.New(createdAt, seq), createdAt)
+		})
+
+		if err == nil || !isOrderIDConflict(err) {
+			break
+		}
+		if advanceErr := s.advanceOrderCounter(ctx, createdAt); advanceErr != nil {
+			return advanceErr
 		}
-		orders = append(orders, o)
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("rows error: %w", err)
+	return err
+}
+
+// insertOrder добавляет заказ в статусе created и запись о создании в историю статусов.
+// ProductID = 0 - заказ из корзины
+func insertOrder(ctx context.Context, tx pgx.Tx, draft models.Order) (models.Order, error) {
+	query := `
+		INSERT INTO orders (order_id, user_id, product_id, price, currency, status, payment_method, promo_code, discount, created_at)
+		VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6, $7, NULLIF($8, ''), $9, $10)
+		RETURNING order_id, user_id, COALESCE(product_id, 0), price, currency, status, payment_method, COALESCE(promo_code, ''), discount, balance_used, amount_offset, created_at
+	`
+
+	order, err := scanOrder(tx.QueryRow(
+		ctx, query,
+		draft.OrderID, draft.UserID, draft.ProductID, numericFromMoney(draft.Price), draft.Price.Currency,
+		models.OrderStatusCreated, draft.PaymentMethod, draft.PromoCode, numericFromMoney(draft.Discount), draft.CreatedAt,
+	))
+	if err != nil {
+		return order, err
 	}
 
-	return orders, nil
+	return order, insertStatusChange(ctx, tx, order.OrderID, "", models.OrderStatusCreated, draft.UserID, "")
 }
 
-// GetOrderByID возвращает заказ по ID
-func (s *PostgresStorage) GetOrderByID(ctx context.Context, orderID string) (*models.Order, error) {
+// insertOrderItems сохраняет позиции заказа в рамках транзакции
+func insertOrderItems(ctx context.Context, tx pgx.Tx, orderID string, items []models.OrderItem) error {
 	query := `
-		SELECT order_id, user_id, product_id, price, status, created_at
-		FROM orders
-		WHERE order_id = $1
+		INSERT INTO order_items (order_id, product_id, product_name, price, quantity, duration_months)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5, NULLIF($6, 0))
 	`
 
-	var o models.Order
-	err := s.pool.QueryRow(ctx, query, orderID).Scan(
-		&o.OrderID, &o.UserID, &o.ProductID, &o.Price, &o.Status, &o.CreatedAt,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get order: %w", err)
+	for _, item := range items {
+		_, err := tx.Exec(ctx, query, orderID, item.ProductID, item.ProductName, numericFromMoney(item.Price), item.Quantity, item.DurationMonths)
+		if err != nil {
+			return fmt.Errorf("failed to insert order item: %w", err)
+		}
 	}
 
-	return &o, nil
+	return nil
 }
 
-// UpdateOrderStatus обновляет статус заказа
-func (s *PostgresStorage) UpdateOrderStatus(ctx context.Context, orderID string, status string) error {
+// lockCartLines читает корзину с актуальными данными товаров и блокирует ее строки до конца транзакции
+func lockCartLines(ctx context.Context, tx pgx.Tx, userID int64) ([]cartLine, error) {
 	query := `
-		UPDATE orders
-		SET status = $1, updated_at = $2
-		WHERE order_id = $3
+		SELECT p.id, p.name, p.category_id, p.price, r.currency, p.description, p.is_visible, p.sort_order, COALESCE(p.duration_months, 0), p.release_at, p.created_at, r.id, c.quantity
+		FROM cart_items c
+		JOIN products p ON p.id = c.product_id
+		JOIN categories cat ON cat.id = p.category_id
+		JOIN regions r ON r.id = cat.region_id
+		WHERE c.user_id = $1
+		ORDER BY c.added_at, c.product_id
+		FOR UPDATE OF c
 	`
 
-	_, err := s.pool.Exec(ctx, query, status, time.Now(), orderID)
+	rows, err := tx.Query(ctx, query, userID)
 	if err != nil {
-		return fmt.Errorf("failed to update order status: %w", err)
+		return nil, fmt.Errorf("failed to query cart: %w", err)
+	}
+	defer rows.Close()
+
+	var lines []cartLine
+	for rows.Next() {
+		var line cartLine
+		var price pgtype.Numeric
+		var currency money.Currency
+
+		p := &line.product
+		err := rows.Scan(&p.ID, &p.Name, &p.CategoryID, &price, &currency, &p.Description, &p.IsVisible, &p.SortOrder,
+			&p.DurationMonths, &p.ReleaseAt, &p.CreatedAt, &line.regionID, &line.quantity)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan cart item: %w", err)
+		}
+		if p.Price, err = moneyFromNumeric(price, currency); err != nil {
+			return nil, fmt.Errorf("failed to scan cart item: %w", err)
+		}
+		lines = append(lines, line)
 	}
 
-	return nil
+	return lines, rows.Err()
 }
 
-// GetRecentOrders возвращает последние заказы (для админа)
-func (s *PostgresStorage) GetRecentOrders(ctx context.Context, limit int) ([]models.Order, error) {
+// GetUserOrders возвращает заказы пользователя, новые первыми: limit заказов, пропустив offset.
+// limit 0 - все заказы
+func (s *PostgresStorage) GetUserOrders(ctx context.Context, userID int64, offset, limit int) ([]models.Order, error) {
 	query := `
-		SELECT order_id, user_id, product_id, price, status, created_at
+		SELECT order_id, user_id, COALESCE(product_id, 0), price, currency, status, payment_method, COALESCE(promo_code, ''), discount, balance_used, amount_offset, created_at
 		FROM orders
-		ORDER BY created_at DESC
-		LIMIT $1
+		WHERE user_id = $1
+		ORDER BY created_at DESC, order_id DESC
+		OFFSET $2
+		LIMIT NULLIF($3, 0)
 	`
 
-	rows, err := s.pool.Query(ctx, query, limit)
+	rows, err := s.pool.Query(ctx, query, userID, offset, limit)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query recent orders: %w", err)
+		return nil, fmt.Errorf("failed to query user orders: %w", err)
 	}
 	defer rows.Close()
 
 	var orders []models.Order
 	for rows.Next() {
-		var o models.Order
-		if err := rows.Scan(&o.OrderID, &o.UserID, &o.ProductID, &o.Price, &o.Status, &o.CreatedAt); err != nil {
+		o, err := scanOrder(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan order: %w", err)
 		}
 		orders = append(orders, o)
@@ -480,303 +739,2316 @@ func (s *PostgresStorage) GetRecentOrders(ctx context.Context, limit int) ([]mod
 	return orders, nil
 }
 
-// GetOrderStats возвращает статистику заказов
-func (s *PostgresStorage) GetOrderStats(ctx context.Context) (map[string]interface{}, error) {
+// GetOrderByID возвращает заказ по ID
+func (s *PostgresStorage) GetOrderByID(ctx context.Context, orderID string) (*models.Order, error) {
 	query := `
-		SELECT
-			COUNT(*) as total_orders,
-			COUNT(CASE WHEN status = 'created' THEN 1 END) as pending_orders,
-			COUNT(CASE WHEN status = 'paid' THEN 1 END) as paid_orders,
-			COUNT(CASE WHEN status = 'completed' THEN 1 END) as completed_orders,
-			COALESCE(SUM(CASE WHEN status IN ('paid', 'completed') THEN price ELSE 0 END), 0) as total_revenue
+		SELECT order_id, user_id, COALESCE(product_id, 0), price, currency, status, payment_method, COALESCE(promo_code, ''), discount, balance_used, amount_offset, created_at
 		FROM orders
+		WHERE order_id = $1
 	`
 
-	var totalOrders, pendingOrders, paidOrders, completedOrders int
-	var totalRevenue float64
-
-	err := s.pool.QueryRow(ctx, query).Scan(
-		&totalOrders, &pendingOrders, &paidOrders, &completedOrders, &totalRevenue,
-	)
+	o, err := scanOrder(s.pool.QueryRow(ctx, query, orderID))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get order stats: %w", err)
-	}
-
-	stats := map[string]interface{}{
-		"total_orders":     totalOrders,
-		"pending_orders":   pendingOrders,
-		"paid_orders":      paidOrders,
-		"completed_orders": completedOrders,
-		"total_revenue":    totalRevenue,
+		return nil, fmt.Errorf("failed to get order: %w", notFound(err))
 	}
 
-	return stats, nil
+	return &o, nil
 }
 
-// Admin methods for managing catalog
+// UpdateOrderStatus переводит заказ в новый статус, если переход разрешен models.CanTransitionOrder,
+// и записывает изменение в order_status_history. actorID = 0 означает изменение системой.
+// Оплаченный заказ с товаром, который еще не вышел, переходит в preordered вместо paid
+func (s *PostgresStorage) UpdateOrderStatus(ctx context.Context, orderID string, status string, actorID int64, reason string) error {
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		var current string
+		var userID int64
+		var balanceUsed pgtype.Numeric
+		var currency money.Currency
+		err := tx.QueryRow(ctx,
+			"SELECT status, user_id, balance_used, currency FROM orders WHERE order_id = $1 FOR UPDATE", orderID,
+		).Scan(&current, &userID, &balanceUsed, &currency)
+		if err != nil {
+			return notFound(err)
+		}
 
-// UpdateProductPrice обновляет цену товара
-func (s *PostgresStorage) UpdateProductPrice(ctx context.Context, productID int, newPrice float64) error {
-	query := `
-		UPDATE products
-		SET price = $1
-		WHERE id = $2
-	`
+		if status, err = paidStatus(ctx, tx, orderID, current, status); err != nil {
+			return err
+		}
 
-	_, err := s.pool.Exec(ctx, query, newPrice, productID)
-	if err != nil {
-		return fmt.Errorf("failed to update product price: %w", err)
-	}
+		if !models.CanTransitionOrder(current, status) {
+			return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, current, status)
+		}
 
-	return nil
-}
+		query := `
+			UPDATE orders
+			SET status = $1, updated_at = $2
+			WHERE order_id = $3
+		`
 
-// UpdateProductVisibility изменяет видимость товара
-func (s *PostgresStorage) UpdateProductVisibility(ctx context.Context, productID int, isVisible bool) error {
-	query := `
-		UPDATE products
-		SET is_visible = $1
-		WHERE id = $2
-	`
+		if _, err := tx.Exec(ctx, query, status, time.Now(), orderID); err != nil {
+			return err
+		}
 
-	_, err := s.pool.Exec(ctx, query, isVisible, productID)
+		if err := insertStatusChange(ctx, tx, orderID, current, status, actorID, reason); err != nil {
+			return err
+		}
+
+		if err := updateSubscriptionExpiry(ctx, tx, orderID, userID, status); err != nil {
+			return err
+		}
+
+		// Списанное с баланса за неоплаченный заказ возвращается покупателю
+		used, err := moneyFromNumeric(balanceUsed, currency)
+		if err != nil {
+			return err
+		}
+		if status != models.OrderStatusCancelled || !used.IsPositive() {
+			return nil
+		}
+
+		reversal := models.LedgerTransaction{
+			Kind:    models.LedgerKindCheckoutReversal,
+			UserID:  userID,
+			OrderID: orderID,
+			ActorID: actorID,
+			Reason:  reason,
+			Amount:  used,
+		}
+		return insertLedgerTransaction(ctx, tx, &reversal, models.LedgerAccountSales)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to update product visibility: %w", err)
+		return fmt.Errorf("failed to update order status: %w", err)
 	}
 
 	return nil
 }
 
-// CreateProduct создает новый товар
-func (s *PostgresStorage) CreateProduct(ctx context.Context, name string, categoryID int, price float64, description string) (*models.Product, error) {
+// paidStatus заменяет paid на preordered, если оплачивается новый заказ с товаром, который еще не вышел.
+// Остальные статусы возвращает без изменений
+func paidStatus(ctx context.Context, tx pgx.Tx, orderID, current, status string) (string, error) {
+	if current != models.OrderStatusCreated || status != models.OrderStatusPaid {
+		return status, nil
+	}
+
 	query := `
-		INSERT INTO products (name, category_id, price, description, is_visible, sort_order)
-		VALUES ($1, $2, $3, $4, true, 0)
-		RETURNING id, name, category_id, price, description, is_visible, sort_order, created_at
+		SELECT EXISTS (
+			SELECT 1
+			FROM order_items i
+			JOIN products p ON p.id = i.product_id
+			WHERE i.order_id = $1 AND p.release_at > NOW()
+		)
 	`
 
-	var p models.Product
-	err := s.pool.QueryRow(ctx, query, name, categoryID, price, description).Scan(
-		&p.ID, &p.Name, &p.CategoryID, &p.Price, &p.Description, &p.IsVisible, &p.SortOrder, &p.CreatedAt,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create product: %w", err)
+	var preorder bool
+	if err := tx.QueryRow(ctx, query, orderID).Scan(&preorder); err != nil {
+		return "", fmt.Errorf("failed to check preorder items: %w", err)
+	}
+	if preorder {
+		return models.OrderStatusPreordered, nil
 	}
 
-	return &p, nil
+	return status, nil
 }
 
-// DeleteProduct удаляет товар
-func (s *PostgresStorage) DeleteProduct(ctx context.Context, productID int) error {
-	query := `
-		DELETE FROM products
-		WHERE id = $1
-	`
-
-	_, err := s.pool.Exec(ctx, query, productID)
+// updateSubscriptionExpiry считает окончание подписок выполненного заказа и снимает его с возвращенного.
+// Продление, выполненное до окончания, добавляет срок к действующей подписке на тот же товар
+func updateSubscriptionExpiry(ctx context.Context, tx pgx.Tx, orderID string, userID int64, status string) error {
+	var err error
+	switch status {
+	case models.OrderStatusCompleted:
+		_, err = tx.Exec(ctx, `
+			UPDATE order_items i
+			SET expires_at = GREATEST(NOW()::timestamp, COALESCE((
+				SELECT MAX(prev.expires_at)
+				FROM order_items prev
+				JOIN orders po ON po.order_id = prev.order_id
+				WHERE po.user_id = $2 AND prev.product_id = i.product_id AND prev.order_id <> i.order_id
+			), NOW()::timestamp)) + make_interval(months => i.duration_months * i.quantity)
+			WHERE i.order_id = $1 AND i.duration_months IS NOT NULL
+		`, orderID, userID)
+	case models.OrderStatusRefunded:
+		_, err = tx.Exec(ctx, "UPDATE order_items SET expires_at = NULL WHERE order_id = $1", orderID)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to delete product: %w", err)
+		return fmt.Errorf("failed to update subscription expiry: %w", err)
 	}
 
 	return nil
 }
 
-// UpdateProduct обновляет информацию о товаре
-func (s *PostgresStorage) UpdateProduct(ctx context.Context, productID int, name string, price float64, description string) error {
+// SaveOrderPayment сохраняет идентификаторы платежа Telegram Payments для заказа
+func (s *PostgresStorage) SaveOrderPayment(ctx context.Context, orderID, telegramChargeID, providerChargeID string) error {
 	query := `
-		UPDATE products
-		SET name = $1, price = $2, description = $3
-		WHERE id = $4
+		UPDATE orders
+		SET telegram_payment_charge_id = $1, provider_payment_charge_id = $2, updated_at = $3
+		WHERE order_id = $4
 	`
 
-	_, err := s.pool.Exec(ctx, query, name, price, description, productID)
+	tag, err := s.pool.Exec(ctx, query, telegramChargeID, providerChargeID, time.Now(), orderID)
 	if err != nil {
-		return fmt.Errorf("failed to update product: %w", err)
+		return fmt.Errorf("failed to save order payment: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("failed to save order payment: %w", ErrNotFound)
 	}
 
 	return nil
 }
 
-// UpdateCategory обновляет название и описание категории
-func (s *PostgresStorage) UpdateCategory(ctx context.Context, categoryID int, name string, description string) error {
+// insertStatusChange добавляет запись в историю статусов в рамках транзакции
+func insertStatusChange(ctx context.Context, tx pgx.Tx, orderID, from, to string, actorID int64, reason string) error {
 	query := `
-		UPDATE categories
-		SET name = $1, description = $2
-		WHERE id = $3
+		INSERT INTO order_status_history (order_id, from_status, to_status, actor_id, reason)
+		VALUES ($1, NULLIF($2, ''), $3, NULLIF($4, 0), $5)
 	`
 
-	_, err := s.pool.Exec(ctx, query, name, description, categoryID)
-	if err != nil {
-		return fmt.Errorf("failed to update category: %w", err)
+	if _, err := tx.Exec(ctx, query, orderID, from, to, actorID, reason); err != nil {
+		return fmt.Errorf("failed to record status change: %w", err)
 	}
 
 	return nil
 }
 
-// ListAllProducts возвращает все товары (включая скрытые) для админа
-func (s *PostgresStorage) ListAllProducts(ctx context.Context) ([]models.Product, error) {
+// GetOrderStatusHistory возвращает историю статусов заказа в хронологическом порядке
+func (s *PostgresStorage) GetOrderStatusHistory(ctx context.Context, orderID string) ([]models.OrderStatusChange, error) {
 	query := `
-		SELECT id, name, category_id, price, description, is_visible, sort_order, created_at
-		FROM products
-		ORDER BY category_id ASC, sort_order ASC
+		SELECT id, order_id, COALESCE(from_status, ''), to_status, COALESCE(actor_id, 0), reason, created_at
+		FROM order_status_history
+		WHERE order_id = $1
+		ORDER BY created_at ASC, id ASC
 	`
 
-	rows, err := s.pool.Query(ctx, query)
+	rows, err := s.pool.Query(ctx, query, orderID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query all products: %w", err)
+		return nil, fmt.Errorf("failed to query order status history: %w", err)
 	}
 	defer rows.Close()
 
-	var products []models.Product
+	var history []models.OrderStatusChange
 	for rows.Next() {
-		var p models.Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.CategoryID, &p.Price, &p.Description, &p.IsVisible, &p.SortOrder, &p.CreatedAt); err != nil {
-			return nil, fmt.Errorf("failed to scan product: %w", err)
+		var c models.OrderStatusChange
+		if err := rows.Scan(&c.ID, &c.OrderID, &c.FromStatus, &c.ToStatus, &c.ActorID, &c.Reason, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan order status change: %w", err)
 		}
-		products = append(products, p)
+		history = append(history, c)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("rows error: %w", err)
 	}
 
-	return products, nil
+	return history, nil
 }
 
-// Bot settings methods
-
-// GetBotSettings возвращает настройки бота
-func (s *PostgresStorage) GetBotSettings(ctx context.Context) (*models.BotSettings, error) {
+// AddOrderReceipt сохраняет чек об оплате заказа в статусе pending
+func (s *PostgresStorage) AddOrderReceipt(ctx context.Context, orderID string, userID int64, fileID, fileType string) (*models.OrderReceipt, error) {
 	query := `
-		SELECT id, welcome_message, updated_at
-		FROM bot_settings
-		WHERE id = 1
+		INSERT INTO order_receipts (order_id, user_id, file_id, file_type)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, order_id, user_id, file_id, file_type, status, created_at
 	`
 
-	var settings models.BotSettings
+	var r models.OrderReceipt
+	err := s.pool.QueryRow(ctx, query, orderID, userID, fileID, fileType).Scan(
+		&r.ID, &r.OrderID, &r.UserID, &r.FileID, &r.FileType, &r.Status, &r.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add order receipt: %w", err)
+	}
+
+	return &r, nil
+}
+
+// GetOrderReceipts возвращает чеки заказа в порядке загрузки
+func (s *PostgresStorage) GetOrderReceipts(ctx context.Context, orderID string) ([]models.OrderReceipt, error) {
+	query := `
+		SELECT id, order_id, user_id, file_id, file_type, status, created_at
+		FROM order_receipts
+		WHERE order_id = $1
+		ORDER BY created_at ASC, id ASC
+	`
+
+	rows, err := s.pool.Query(ctx, query, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query order receipts: %w", err)
+	}
+	defer rows.Close()
+
+	var receipts []models.OrderReceipt
+	for rows.Next() {
+		var r models.OrderReceipt
+		if err := rows.Scan(&r.ID, &r.OrderID, &r.UserID, &r.FileID, &r.FileType, &r.Status, &r.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan order receipt: %w", err)
+		}
+		receipts = append(receipts, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return receipts, nil
+}
+
+// ReviewOrderReceipts отмечает все непроверенные чеки заказа как принятые или отклоненные
+func (s *PostgresStorage) ReviewOrderReceipts(ctx context.Context, orderID string, status string, reviewerID int64) error {
+	query := `
+		UPDATE order_receipts
+		SET status = $1, reviewed_by = $2, reviewed_at = $3
+		WHERE order_id = $4 AND status = 'pending'
+	`
+
+	if _, err := s.pool.Exec(ctx, query, status, reviewerID, time.Now(), orderID); err != nil {
+		return fmt.Errorf("failed to review order receipts: %w", err)
+	}
+
+	return nil
+}
+
+// AddProductKeys добавляет ключи на склад товара и возвращает число добавленных.
+// Ключи, которые уже есть у товара, пропускаются
+func (s *PostgresStorage) AddProductKeys(ctx context.Context, productID int, codes []string) (int, error) {
+	query := `
+		INSERT INTO product_keys (product_id, code)
+		SELECT $1, code FROM unnest($2::text[]) AS code
+		ON CONFLICT (product_id, code) DO NOTHING
+	`
+
+	tag, err := s.pool.Exec(ctx, query, productID, codes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add product keys: %w", err)
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+// GetProductKeyStock возвращает число свободных и выданных ключей товара
+func (s *PostgresStorage) GetProductKeyStock(ctx context.Context, productID int) (*models.KeyStock, error) {
+	query := `
+		SELECT COUNT(*) FILTER (WHERE order_id IS NULL), COUNT(*) FILTER (WHERE order_id IS NOT NULL)
+		FROM product_keys
+		WHERE product_id = $1
+	`
+
+	var stock models.KeyStock
+	if err := s.pool.QueryRow(ctx, query, productID).Scan(&stock.Available, &stock.Delivered); err != nil {
+		return nil, fmt.Errorf("failed to get product key stock: %w", err)
+	}
+
+	return &stock, nil
+}
+
+// ReserveProductKeys закрепляет за заказом quantity свободных ключей товара в порядке загрузки.
+// Параллельные выдачи не ждут друг друга и не получают один ключ (SKIP LOCKED). Ключи, уже
+// выданные заказу, засчитываются и возвращаются повторно. ErrOutOfStock - свободных ключей
+// не хватает, тогда ничего не закрепляется
+func (s *PostgresStorage) ReserveProductKeys(ctx context.Context, orderID string, productID int, quantity int) ([]models.ProductKey, error) {
+	var keys []models.ProductKey
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			SELECT id, product_id, code, order_id, created_at, delivered_at
+			FROM product_keys
+			WHERE order_id = $1 AND product_id = $2
+			ORDER BY id
+		`, orderID, productID)
+		if err != nil {
+			return err
+		}
+		keys, err = collectProductKeys(rows)
+		if err != nil {
+			return err
+		}
+
+		missing := quantity - len(keys)
+		if missing <= 0 {
+			keys = keys[:quantity]
+			return nil
+		}
+
+		rows, err = tx.Query(ctx, `
+			UPDATE product_keys
+			SET order_id = $1, delivered_at = $2
+			WHERE id IN (
+				SELECT id FROM product_keys
+				WHERE product_id = $3 AND order_id IS NULL
+				ORDER BY id
+				LIMIT $4
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, product_id, code, order_id, created_at, delivered_at
+		`, orderID, time.Now(), productID, missing)
+		if err != nil {
+			return err
+		}
+		reserved, err := collectProductKeys(rows)
+		if err != nil {
+			return err
+		}
+		if len(reserved) < missing {
+			return ErrOutOfStock
+		}
+
+		sort.Slice(reserved, func(i, j int) bool { return reserved[i].ID < reserved[j].ID })
+		keys = append(keys, reserved...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve product keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// collectProductKeys читает все строки с ключами и закрывает rows
+func collectProductKeys(rows pgx.Rows) ([]models.ProductKey, error) {
+	defer rows.Close()
+
+	var keys []models.ProductKey
+	for rows.Next() {
+		k, err := scanProductKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan product key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// GetOrderItems возвращает позиции заказа
+func (s *PostgresStorage) GetOrderItems(ctx context.Context, orderID string) ([]models.OrderItem, error) {
+	items, err := s.GetOrderItemsByOrderIDs(ctx, []string{orderID})
+	if err != nil {
+		return nil, err
+	}
+
+	return items[orderID], nil
+}
+
+// GetOrderItemsByOrderIDs возвращает позиции нескольких заказов одним запросом (для списков заказов)
+func (s *PostgresStorage) GetOrderItemsByOrderIDs(ctx context.Context, orderIDs []string) (map[string][]models.OrderItem, error) {
+	result := make(map[string][]models.OrderItem, len(orderIDs))
+	if len(orderIDs) == 0 {
+		return result, nil
+	}
+
+	query := `
+		SELECT i.id, i.order_id, COALESCE(i.product_id, 0), i.product_name, i.price, o.currency, i.quantity,
+			COALESCE(i.duration_months, 0), i.expires_at
+		FROM order_items i
+		JOIN orders o ON o.order_id = i.order_id
+		WHERE i.order_id = ANY($1)
+		ORDER BY i.order_id, i.id
+	`
+
+	rows, err := s.pool.Query(ctx, query, orderIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query order items: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.OrderItem
+		var price pgtype.Numeric
+		var currency money.Currency
+
+		err := rows.Scan(&item.ID, &item.OrderID, &item.ProductID, &item.ProductName, &price, &currency, &item.Quantity,
+			&item.DurationMonths, &item.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan order item: %w", err)
+		}
+		if item.Price, err = moneyFromNumeric(price, currency); err != nil {
+			return nil, fmt.Errorf("failed to scan order item: %w", err)
+		}
+		result[item.OrderID] = append(result[item.OrderID], item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return result, nil
+}
+
+// GetCart возвращает корзину покупателя в порядке добавления товаров
+func (s *PostgresStorage) GetCart(ctx context.Context, userID int64) ([]models.CartItem, error) {
+	query := `
+		SELECT user_id, product_id, quantity, added_at
+		FROM cart_items
+		WHERE user_id = $1
+		ORDER BY added_at, product_id
+	`
+
+	rows, err := s.pool.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cart: %w", err)
+	}
+	defer rows.Close()
+
+	var items []models.CartItem
+	for rows.Next() {
+		var item models.CartItem
+		if err := rows.Scan(&item.UserID, &item.ProductID, &item.Quantity, &item.AddedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan cart item: %w", err)
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return items, nil
+}
+
+// AddToCart добавляет товар в корзину или увеличивает его количество
+func (s *PostgresStorage) AddToCart(ctx context.Context, userID int64, productID int, quantity int) error {
+	query := `
+		INSERT INTO cart_items (user_id, product_id, quantity)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, product_id) DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity
+	`
+
+	if _, err := s.pool.Exec(ctx, query, userID, productID, quantity); err != nil {
+		return fmt.Errorf("failed to add to cart: %w", err)
+	}
+
+	return nil
+}
+
+// SetCartItemQuantity меняет количество товара в корзине; 0 убирает товар из корзины
+func (s *PostgresStorage) SetCartItemQuantity(ctx context.Context, userID int64, productID int, quantity int) error {
+	var err error
+	if quantity <= 0 {
+		_, err = s.pool.Exec(ctx, "DELETE FROM cart_items WHERE user_id = $1 AND product_id = $2", userID, productID)
+	} else {
+		_, err = s.pool.Exec(ctx, "UPDATE cart_items SET quantity = $3 WHERE user_id = $1 AND product_id = $2", userID, productID, quantity)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update cart item: %w", err)
+	}
+
+	return nil
+}
+
+// ClearCart очищает корзину покупателя
+func (s *PostgresStorage) ClearCart(ctx context.Context, userID int64) error {
+	if _, err := s.pool.Exec(ctx, "DELETE FROM cart_items WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("failed to clear cart: %w", err)
+	}
+
+	return nil
+}
+
+// promoCodeColumns - колонки промокода для scanPromoCode; uses считает неотмененные заказы с промокодом
+const promoCodeColumns = `
+	id, code, percent, amount, currency, COALESCE(product_id, 0), COALESCE(category_id, 0), COALESCE(region_id, 0),
+	valid_from, valid_until, max_uses, max_uses_per_user, first_purchase_only, is_active,
+	(SELECT COUNT(*) FROM orders o WHERE o.promo_code = promo_codes.code AND o.status <> 'cancelled'),
+	created_at`
+
+// CreatePromoCode создает промокод. ErrAlreadyExists - такой код уже есть
+func (s *PostgresStorage) CreatePromoCode(ctx context.Context, code models.PromoCode) (*models.PromoCode, error) {
+	query := `
+		INSERT INTO promo_codes (code, percent, amount, currency, product_id, category_id, region_id,
+			valid_from, valid_until, max_uses, max_uses_per_user, first_purchase_only)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), NULLIF($6, 0), NULLIF($7, 0), $8, $9, $10, $11, $12)
+		RETURNING ` + promoCodeColumns
+
+	created, err := scanPromoCode(s.pool.QueryRow(
+		ctx, query,
+		code.Code, code.Percent, numericFromMoney(code.Amount), code.Amount.Currency, code.ProductID, code.CategoryID, code.RegionID,
+		code.ValidFrom, code.ValidUntil, code.MaxUses, code.MaxUsesPerUser, code.FirstPurchaseOnly,
+	))
+	if isUniqueViolation(err) {
+		return nil, fmt.Errorf("failed to create promo code: %w", ErrAlreadyExists)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create promo code: %w", err)
+	}
+
+	return &created, nil
+}
+
+// GetPromoCode возвращает промокод по коду
+func (s *PostgresStorage) GetPromoCode(ctx context.Context, code string) (*models.PromoCode, error) {
+	pc, err := scanPromoCode(s.pool.QueryRow(ctx, "SELECT "+promoCodeColumns+" FROM promo_codes WHERE code = $1", code))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get promo code: %w", notFound(err))
+	}
+
+	return &pc, nil
+}
+
+// ListPromoCodes возвращает все промокоды, новые первыми
+func (s *PostgresStorage) ListPromoCodes(ctx context.Context) ([]models.PromoCode, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+promoCodeColumns+" FROM promo_codes ORDER BY created_at DESC, id DESC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query promo codes: %w", err)
+	}
+	defer rows.Close()
+
+	var codes []models.PromoCode
+	for rows.Next() {
+		pc, err := scanPromoCode(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan promo code: %w", err)
+		}
+		codes = append(codes, pc)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return codes, nil
+}
+
+// SetPromoCodeActive включает или выключает промокод
+func (s *PostgresStorage) SetPromoCodeActive(ctx context.Context, promoCodeID int, isActive bool) error {
+	tag, err := s.pool.Exec(ctx, "UPDATE promo_codes SET is_active = $1 WHERE id = $2", isActive, promoCodeID)
+	if err != nil {
+		return fmt.Errorf("failed to update promo code: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("failed to update promo code: %w", ErrNotFound)
+	}
+
+	return nil
+}
+
+// HasActivePromoCodes сообщает, есть ли включенные и не истекшие промокоды.
+// Если их нет, покупателя не спрашивают о промокоде при оформлении
+func (s *PostgresStorage) HasActivePromoCodes(ctx context.Context) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM promo_codes
+			WHERE is_active AND (valid_until IS NULL OR valid_until > NOW())
+		)
+	`
+
+	var exists bool
+	if err := s.pool.QueryRow(ctx, query).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check promo codes: %w", err)
+	}
+
+	return exists, nil
+}
+
+// GetRecentOrders возвращает последние заказы (для админа)
+func (s *PostgresStorage) GetRecentOrders(ctx context.Context, limit int) ([]models.Order, error) {
+	query := `
+		SELECT order_id, user_id, COALESCE(product_id, 0), price, currency, status, payment_method, COALESCE(promo_code, ''), discount, balance_used, amount_offset, created_at
+		FROM orders
+		ORDER BY created_at DESC
+		LIMIT $1
+	`
+
+	rows, err := s.pool.Query(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query recent orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, o)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return orders, nil
+}
+
+// ListUnpaidOrdersBefore возвращает заказы в статусе created, созданные раньше before (старые первыми).
+// Заказы с непроверенным чеком пропускаются: их оплату еще должен подтвердить админ
+func (s *PostgresStorage) ListUnpaidOrdersBefore(ctx context.Context, before time.Time, limit int) ([]models.Order, error) {
+	query := `
+		SELECT order_id, user_id, COALESCE(product_id, 0), price, currency, status, payment_method, COALESCE(promo_code, ''), discount, balance_used, amount_offset, created_at
+		FROM orders o
+		WHERE o.status = $1 AND o.created_at < $2
+			AND NOT EXISTS (SELECT 1 FROM order_receipts r WHERE r.order_id = o.order_id AND r.status = $4)
+		ORDER BY o.created_at ASC
+		LIMIT $3
+	`
+
+	rows, err := s.pool.Query(ctx, query, models.OrderStatusCreated, before, limit, models.ReceiptStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unpaid orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, o)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return orders, nil
+}
+
+// GetPendingOrders возвращает неоплаченные заказы пользователя (статус created), новые первыми
+func (s *PostgresStorage) GetPendingOrders(ctx context.Context, userID int64) ([]models.Order, error) {
+	query := `
+		SELECT order_id, user_id, COALESCE(product_id, 0), price, currency, status, payment_method, COALESCE(promo_code, ''), discount, balance_used, amount_offset, created_at
+		FROM orders
+		WHERE user_id = $1 AND status = $2
+		ORDER BY created_at DESC, order_id DESC
+	`
+
+	rows, err := s.pool.Query(ctx, query, userID, models.OrderStatusCreated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, o)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return orders, nil
+}
+
+// ListOrders возвращает заказы, подходящие под фильтр, новые первыми: limit заказов, пропустив offset.
+// limit 0 - все заказы
+func (s *PostgresStorage) ListOrders(ctx context.Context, filter models.OrderFilter, offset, limit int) ([]models.Order, error) {
+	query := `
+		SELECT order_id, user_id, COALESCE(product_id, 0), price, currency, status, payment_method, COALESCE(promo_code, ''), discount, balance_used, amount_offset, created_at
+		FROM orders o
+		WHERE ($1 = '' OR status = $1)
+		  AND ($2 = 0 OR EXISTS (
+			SELECT 1
+			FROM order_items i
+			JOIN products p ON p.id = i.product_id
+			JOIN categories c ON c.id = p.category_id
+			WHERE i.order_id = o.order_id AND c.region_id = $2
+		  ))
+		  AND ($3::timestamp IS NULL OR created_at >= $3)
+		  AND ($4::timestamp IS NULL OR created_at < $4)
+		  AND ($5 = 0 OR user_id = $5)
+		ORDER BY created_at DESC, order_id DESC
+		OFFSET $6
+		LIMIT NULLIF($7, 0)
+	`
+
+	rows, err := s.pool.Query(ctx, query, filter.Status, filter.RegionID, filter.From, filter.Until, filter.UserID, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, o)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return orders, nil
+}
+
+// GetOrderStats возвращает статистику заказов.
+// Выручка считается отдельно по каждой валюте: складывать тенге с рублями нельзя
+func (s *PostgresStorage) GetOrderStats(ctx context.Context) (map[string]interface{}, error) {
+	query := `
+		SELECT
+			COUNT(*) as total_orders,
+			COUNT(CASE WHEN status = 'created' THEN 1 END) as pending_orders,
+			COUNT(CASE WHEN status = 'paid' THEN 1 END) as paid_orders,
+			COUNT(CASE WHEN status = 'completed' THEN 1 END) as completed_orders
+		FROM orders
+	`
+
+	var totalOrders, pendingOrders, paidOrders, completedOrders int
+
+	err := s.pool.QueryRow(ctx, query).Scan(
+		&totalOrders, &pendingOrders, &paidOrders, &completedOrders,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order stats: %w", err)
+	}
+
+	revenueQuery := `
+		SELECT currency, SUM(price)
+		FROM orders
+		WHERE status IN ('preordered', 'paid', 'completed')
+		GROUP BY currency
+		ORDER BY currency ASC
+	`
+
+	rows, err := s.pool.Query(ctx, revenueQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revenue: %w", err)
+	}
+	defer rows.Close()
+
+	var revenue []money.Money
+	for rows.Next() {
+		var currency money.Currency
+		var sum pgtype.Numeric
+		if err := rows.Scan(&currency, &sum); err != nil {
+			return nil, fmt.Errorf("failed to scan revenue: %w", err)
+		}
+
+		total, err := moneyFromNumeric(sum, currency)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan revenue: %w", err)
+		}
+		revenue = append(revenue, total)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	promoOrders, discounts, err := s.promoStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := map[string]interface{}{
+		"total_orders":     totalOrders,
+		"pending_orders":   pendingOrders,
+		"paid_orders":      paidOrders,
+		"completed_orders": completedOrders,
+		"revenue":          revenue,
+		"promo_orders":     promoOrders,
+		"discounts":        discounts,
+	}
+
+	return stats, nil
+}
+
+// promoStats возвращает число оплаченных заказов с промокодом и сумму скидок по каждой валюте
+func (s *PostgresStorage) promoStats(ctx context.Context) (int, []money.Money, error) {
+	query := `
+		SELECT currency, COUNT(*), SUM(discount)
+		FROM orders
+		WHERE status IN ('preordered', 'paid', 'completed') AND promo_code IS NOT NULL
+		GROUP BY currency
+		ORDER BY currency ASC
+	`
+
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to query discounts: %w", err)
+	}
+	defer rows.Close()
+
+	var orders int
+	var discounts []money.Money
+	for rows.Next() {
+		var currency money.Currency
+		var count int
+		var sum pgtype.Numeric
+		if err := rows.Scan(&currency, &count, &sum); err != nil {
+			return 0, nil, fmt.Errorf("failed to scan discounts: %w", err)
+		}
+
+		total, err := moneyFromNumeric(sum, currency)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to scan discounts: %w", err)
+		}
+		orders += count
+		discounts = append(discounts, total)
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return orders, discounts, nil
+}
+
+// Admin methods for managing catalog
+
+// UpdateProductPrice обновляет цену товара
+func (s *PostgresStorage) UpdateProductPrice(ctx context.Context, productID int, newPrice money.Money) error {
+	query := `
+		UPDATE products
+		SET price = $1
+		WHERE id = $2
+	`
+
+	_, err := s.pool.Exec(ctx, query, numericFromMoney(newPrice), productID)
+	if err != nil {
+		return fmt.Errorf("failed to update product price: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateProductDuration изменяет срок подписки товара в месяцах. 0 - товар не подписка
+func (s *PostgresStorage) UpdateProductDuration(ctx context.Context, productID int, months int) error {
+	query := `
+		UPDATE products
+		SET duration_months = NULLIF($1, 0)
+		WHERE id = $2
+	`
+
+	_, err := s.pool.Exec(ctx, query, months, productID)
+	if err != nil {
+		return fmt.Errorf("failed to update product duration: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateProductRelease задает дату выхода товара предзаказа. nil - обычный товар
+func (s *PostgresStorage) UpdateProductRelease(ctx context.Context, productID int, releaseAt *time.Time) error {
+	// Колонка без часового пояса хранит UTC, как и остальные даты
+	if releaseAt != nil {
+		utc := releaseAt.UTC()
+		releaseAt = &utc
+	}
+
+	query := `
+		UPDATE products
+		SET release_at = $1
+		WHERE id = $2
+	`
+
+	_, err := s.pool.Exec(ctx, query, releaseAt, productID)
+	if err != nil {
+		return fmt.Errorf("failed to update product release: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateProductVisibility изменяет видимость товара
+func (s *PostgresStorage) UpdateProductVisibility(ctx context.Context, productID int, isVisible bool) error {
+	query := `
+		UPDATE products
+		SET is_visible = $1
+		WHERE id = $2
+	`
+
+	_, err := s.pool.Exec(ctx, query, isVisible, productID)
+	if err != nil {
+		return fmt.Errorf("failed to update product visibility: %w", err)
+	}
+
+	return nil
+}
+
+// CreateProduct создает новый товар
+func (s *PostgresStorage) CreateProduct(ctx context.Context, name string, categoryID int, price money.Money, description string) (*models.Product, error) {
+	query := `
+		WITH p AS (
+			INSERT INTO products (name, category_id, price, description, is_visible, sort_order)
+			VALUES ($1, $2, $3, $4, true, 0)
+			RETURNING id, name, category_id, price, description, is_visible, sort_order, duration_months, release_at, created_at
+		)
+		SELECT p.id, p.name, p.category_id, p.price, r.currency, p.description, p.is_visible, p.sort_order, COALESCE(p.duration_months, 0), p.release_at, p.created_at
+		FROM p
+		JOIN categories c ON c.id = p.category_id
+		JOIN regions r ON r.id = c.region_id
+	`
+
+	p, err := scanProduct(s.pool.QueryRow(ctx, query, name, categoryID, price, description))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create product: %w", err)
+	}
+
+	return &p, nil
+}
+
+// DeleteProduct удаляет товар
+func (s *PostgresStorage) DeleteProduct(ctx context.Context, productID int) error {
+	query := `
+		DELETE FROM products
+		WHERE id = $1
+	`
+
+	_, err := s.pool.Exec(ctx, query, productID)
+	if err != nil {
+		return fmt.Errorf("failed to delete product: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateProduct обновляет информацию о товаре
+func (s *PostgresStorage) UpdateProduct(ctx context.Context, productID int, name string, price money.Money, description string) error {
+	query := `
+		UPDATE products
+		SET name = $1, price = $2, description = $3
+		WHERE id = $4
+	`
+
+	_, err := s.pool.Exec(ctx, query, name, numericFromMoney(price), description, productID)
+	if err != nil {
+		return fmt.Errorf("failed to update product: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateCategory обновляет название и описание категории
+func (s *PostgresStorage) UpdateCategory(ctx context.Context, categoryID int, name string, description string) error {
+	query := `
+		UPDATE categories
+		SET name = $1, description = $2
+		WHERE id = $3
+	`
+
+	_, err := s.pool.Exec(ctx, query, name, description, categoryID)
+	if err != nil {
+		return fmt.Errorf("failed to update category: %w", err)
+	}
+
+	return nil
+}
+
+// ListAllProducts возвращает все товары (включая скрытые) для админа
+func (s *PostgresStorage) ListAllProducts(ctx context.Context) ([]models.Product, error) {
+	query := `
+		SELECT p.id, p.name, p.category_id, p.price, r.currency, p.description, p.is_visible, p.sort_order, COALESCE(p.duration_months, 0), p.release_at, p.created_at
+		FROM products p
+		JOIN categories c ON c.id = p.category_id
+		JOIN regions r ON r.id = c.region_id
+		ORDER BY p.category_id ASC, p.sort_order ASC
+	`
+
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query all products: %w", err)
+	}
+	defer rows.Close()
+
+	var products []models.Product
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan product: %w", err)
+		}
+		products = append(products, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return products, nil
+}
+
+// Bot settings methods
+
+// GetBotSettings возвращает настройки бота
+func (s *PostgresStorage) GetBotSettings(ctx context.Context) (*models.BotSettings, error) {
+	query := `
+		SELECT id, welcome_message, updated_at
+		FROM bot_settings
+		WHERE id = 1
+	`
+
+	var settings models.BotSettings
 	err := s.pool.QueryRow(ctx, query).Scan(
 		&settings.ID, &settings.WelcomeMessage, &settings.UpdatedAt,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get bot settings: %w", err)
+		return nil, fmt.Errorf("failed to get bot settings: %w", notFound(err))
+	}
+
+	return &settings, nil
+}
+
+// UpdateWelcomeMessage обновляет приветственное сообщение
+func (s *PostgresStorage) UpdateWelcomeMessage(ctx context.Context, message string) error {
+	query := `
+		UPDATE bot_settings
+		SET welcome_message = $1, updated_at = $2
+		WHERE id = 1
+	`
+
+	_, err := s.pool.Exec(ctx, query, message, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to update welcome message: %w", err)
+	}
+
+	return nil
+}
+
+// GetChangeRegionProduct возвращает товар "Сменить регион" из категории "Системные услуги"
+func (s *PostgresStorage) GetChangeRegionProduct(ctx context.Context) (*models.Product, error) {
+	query := `
+		SELECT p.id, p.name, p.category_id, p.price, r.currency, p.description, p.is_visible, p.sort_order, COALESCE(p.duration_months, 0), p.release_at, p.created_at
+		FROM products p
+		JOIN categories c ON c.id = p.category_id
+		JOIN regions r ON r.id = c.region_id
+		WHERE c.name = 'Системные услуги' AND p.name = 'Сменить регион'
+		LIMIT 1
+	`
+
+	p, err := scanProduct(s.pool.QueryRow(ctx, query))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get change region product: %w", notFound(err))
+	}
+
+	return &p, nil
+}
+
+// ==================== USER METHODS ====================
+
+// UpsertUser создает или обновляет пользователя
+func (s *PostgresStorage) UpsertUser(ctx context.Context, userID int64, username, firstName, lastName string) error {
+	query := `
+		INSERT INTO users (user_id, username, first_name, last_name, last_activity)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET
+			username = EXCLUDED.username,
+			first_name = EXCLUDED.first_name,
+			last_name = EXCLUDED.last_name,
+			last_activity = EXCLUDED.last_activity
+	`
+
+	_, err := s.pool.Exec(ctx, query, userID, username, firstName, lastName, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to upsert user: %w", err)
+	}
+
+	return nil
+}
+
+// GetActiveUsers возвращает всех пользователей, которые не заблокировали бота
+func (s *PostgresStorage) GetActiveUsers(ctx context.Context) ([]models.User, error) {
+	query := `
+		SELECT user_id, username, first_name, last_name, is_blocked, created_at, last_activity
+		FROM users
+		WHERE is_blocked = false
+		ORDER BY user_id ASC
+	`
+
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query active users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.UserID, &u.Username, &u.FirstName, &u.LastName, &u.IsBlocked, &u.CreatedAt, &u.LastActivity); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return users, nil
+}
+
+// MarkUserAsBlocked помечает пользователя как заблокировавшего бота
+func (s *PostgresStorage) MarkUserAsBlocked(ctx context.Context, userID int64) error {
+	query := `UPDATE users SET is_blocked = true WHERE user_id = $1`
+
+	_, err := s.pool.Exec(ctx, query, userID)
+	if err != nil {
+		return fmt.Errorf("failed to mark user as blocked: %w", err)
+	}
+
+	return nil
+}
+
+// GetUsersCount возвращает количество активных пользователей
+func (s *PostgresStorage) GetUsersCount(ctx context.Context) (int, error) {
+	query := `SELECT COUNT(*) FROM users WHERE is_blocked = false`
+
+	var count int
+	err := s.pool.QueryRow(ctx, query).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get users count: %w", err)
+	}
+
+	return count, nil
+}
+
+// ==================== REFERRALS ====================
+
+// AddReferredUser создает пользователя, пришедшего по ссылке referrerID. Возвращает false, если
+// пользователь уже обращался к боту, пригласивший неизвестен или пользователь пригласил сам себя
+func (s *PostgresStorage) AddReferredUser(ctx context.Context, userID, referrerID int64, username, firstName, lastName string) (bool, error) {
+	query := `
+		INSERT INTO users (user_id, username, first_name, last_name, referrer_id, last_activity)
+		SELECT $1, $2, $3, $4, user_id, $5
+		FROM users
+		WHERE user_id = $6 AND user_id <> $1
+		ON CONFLICT (user_id) DO NOTHING
+	`
+
+	tag, err := s.pool.Exec(ctx, query, userID, username, firstName, lastName, time.Now(), referrerID)
+	if err != nil {
+		return false, fmt.Errorf("failed to add referred user: %w", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// CreateReferralReward начисляет пригласившему percent процентов от оплаченного заказа приглашенного.
+// Бонус дается один раз - за первый оплаченный заказ. Возвращает nil, если бонус не положен
+func (s *PostgresStorage) CreateReferralReward(ctx context.Context, orderID string, percent int) (*models.ReferralReward, error) {
+	reward := models.ReferralReward{OrderID: orderID}
+	var price pgtype.Numeric
+	var currency money.Currency
+
+	query := `
+		SELECT u.referrer_id, o.user_id, o.price, o.currency
+		FROM orders o
+		JOIN users u ON u.user_id = o.user_id
+		WHERE o.order_id = $1 AND o.status IN ('paid', 'completed') AND u.referrer_id IS NOT NULL
+	`
+
+	err := s.pool.QueryRow(ctx, query, orderID).Scan(&reward.ReferrerID, &reward.ReferredID, &price, &currency)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get referral order: %w", err)
+	}
+
+	total, err := moneyFromNumeric(price, currency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get referral order: %w", err)
+	}
+	reward.Amount = referralBonus(total, percent)
+	if !reward.Amount.IsPositive() {
+		return nil, nil
+	}
+
+	insert := `
+		INSERT INTO referral_rewards (referrer_id, referred_id, order_id, amount, currency)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (referred_id) DO NOTHING
+		RETURNING id, created_at
+	`
+
+	created := false
+	err = pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, insert,
+			reward.ReferrerID, reward.ReferredID, orderID, numericFromMoney(reward.Amount), reward.Amount.Currency,
+		).Scan(&reward.ID, &reward.CreatedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Бонус за этого пользователя уже начислен
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		created = true
+
+		// Бонус зачисляется на баланс пригласившего
+		credit := models.LedgerTransaction{
+			Kind:    models.LedgerKindReferral,
+			UserID:  reward.ReferrerID,
+			OrderID: orderID,
+			Amount:  reward.Amount,
+		}
+		return insertLedgerTransaction(ctx, tx, &credit, models.LedgerAccountReferrals)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create referral reward: %w", err)
+	}
+	if !created {
+		return nil, nil
+	}
+
+	return &reward, nil
+}
+
+// GetReferralStats возвращает, кто пригласил пользователя, сколько пользователей пришло по его ссылке
+// и какие бонусы ему начислены
+func (s *PostgresStorage) GetReferralStats(ctx context.Context, userID int64) (*models.ReferralStats, error) {
+	stats := &models.ReferralStats{}
+
+	var referrer models.User
+	query := `
+		SELECT r.user_id, COALESCE(r.username, ''), COALESCE(r.first_name, '')
+		FROM users u
+		JOIN users r ON r.user_id = u.referrer_id
+		WHERE u.user_id = $1
+	`
+	err := s.pool.QueryRow(ctx, query, userID).Scan(&referrer.UserID, &referrer.Username, &referrer.FirstName)
+	switch {
+	case err == nil:
+		stats.Referrer = &referrer
+	case !errors.Is(err, pgx.ErrNoRows):
+		return nil, fmt.Errorf("failed to get referrer: %w", err)
+	}
+
+	countQuery := `
+		SELECT COUNT(*), COUNT(rr.id)
+		FROM users u
+		LEFT JOIN referral_rewards rr ON rr.referred_id = u.user_id
+		WHERE u.referrer_id = $1
+	`
+	if err := s.pool.QueryRow(ctx, countQuery, userID).Scan(&stats.Invited, &stats.Rewarded); err != nil {
+		return nil, fmt.Errorf("failed to count referrals: %w", err)
+	}
+
+	rewardsQuery := `
+		SELECT currency, SUM(amount)
+		FROM referral_rewards
+		WHERE referrer_id = $1
+		GROUP BY currency
+		ORDER BY currency ASC
+	`
+
+	rows, err := s.pool.Query(ctx, rewardsQuery, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query referral rewards: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var currency money.Currency
+		var sum pgtype.Numeric
+		if err := rows.Scan(&currency, &sum); err != nil {
+			return nil, fmt.Errorf("failed to scan referral rewards: %w", err)
+		}
+
+		total, err := moneyFromNumeric(sum, currency)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan referral rewards: %w", err)
+		}
+		stats.Rewards = append(stats.Rewards, total)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return stats, nil
+}
+
+// ==================== LEDGER ====================
+
+// insertLedgerTransaction записывает операцию с балансом пользователя и две проводки: t.Amount на счет
+// пользователя и обратную сумму на counterAccount. Заполняет t.ID и t.CreatedAt
+func insertLedgerTransaction(ctx context.Context, tx pgx.Tx, t *models.LedgerTransaction, counterAccount string) error {
+	query := `
+		INSERT INTO ledger_transactions (kind, user_id, order_id, actor_id, reason)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, 0), $5)
+		RETURNING id, created_at
+	`
+
+	err := tx.QueryRow(ctx, query, t.Kind, t.UserID, t.OrderID, t.ActorID, t.Reason).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert ledger transaction: %w", err)
+	}
+
+	entries := `
+		INSERT INTO ledger_entries (transaction_id, account, amount, currency)
+		VALUES ($1, $2, $3, $5), ($1, $4, -$3::NUMERIC, $5)
+	`
+
+	_, err = tx.Exec(ctx, entries,
+		t.ID, models.UserLedgerAccount(t.UserID), numericFromMoney(t.Amount), counterAccount, t.Amount.Currency,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert ledger entries: %w", err)
+	}
+
+	return nil
+}
+
+// lockBalance блокирует строку пользователя до конца транзакции, чтобы операции с его балансом
+// шли по очереди, и возвращает баланс в валюте currency
+func lockBalance(ctx context.Context, tx pgx.Tx, userID int64, currency money.Currency) (money.Money, error) {
+	var locked int64
+	err := tx.QueryRow(ctx, "SELECT user_id FROM users WHERE user_id = $1 FOR UPDATE", userID).Scan(&locked)
+	if err != nil {
+		return money.Money{}, notFound(err)
+	}
+
+	var sum pgtype.Numeric
+	query := `
+		SELECT COALESCE(SUM(amount), 0)
+		FROM ledger_entries
+		WHERE account = $1 AND currency = $2
+	`
+	if err := tx.QueryRow(ctx, query, models.UserLedgerAccount(userID), currency).Scan(&sum); err != nil {
+		return money.Money{}, err
+	}
+
+	return moneyFromNumeric(sum, currency)
+}
+
+// GetBalance возвращает ненулевой бонусный баланс пользователя по каждой валюте
+func (s *PostgresStorage) GetBalance(ctx context.Context, userID int64) ([]money.Money, error) {
+	query := `
+		SELECT currency, SUM(amount)
+		FROM ledger_entries
+		WHERE account = $1
+		GROUP BY currency
+		HAVING SUM(amount) <> 0
+		ORDER BY currency ASC
+	`
+
+	rows, err := s.pool.Query(ctx, query, models.UserLedgerAccount(userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query balance: %w", err)
+	}
+	defer rows.Close()
+
+	var balance []money.Money
+	for rows.Next() {
+		var currency money.Currency
+		var sum pgtype.Numeric
+		if err := rows.Scan(&currency, &sum); err != nil {
+			return nil, fmt.Errorf("failed to scan balance: %w", err)
+		}
+
+		total, err := moneyFromNumeric(sum, currency)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan balance: %w", err)
+		}
+		balance = append(balance, total)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return balance, nil
+}
+
+// GetLedger возвращает последние операции с балансом пользователя, новые первыми
+func (s *PostgresStorage) GetLedger(ctx context.Context, userID int64, limit int) ([]models.LedgerTransaction, error) {
+	query := `
+		SELECT t.id, t.kind, t.user_id, COALESCE(t.order_id, ''), COALESCE(t.actor_id, 0), t.reason,
+			e.amount, e.currency, t.created_at
+		FROM ledger_transactions t
+		JOIN ledger_entries e ON e.transaction_id = t.id AND e.account = $2
+		WHERE t.user_id = $1
+		ORDER BY t.id DESC
+		LIMIT $3
+	`
+
+	rows, err := s.pool.Query(ctx, query, userID, models.UserLedgerAccount(userID), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ledger: %w", err)
+	}
+	defer rows.Close()
+
+	var ledger []models.LedgerTransaction
+	for rows.Next() {
+		var t models.LedgerTransaction
+		var amount pgtype.Numeric
+		var currency money.Currency
+		if err := rows.Scan(&t.ID, &t.Kind, &t.UserID, &t.OrderID, &t.ActorID, &t.Reason, &amount, &currency, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan ledger: %w", err)
+		}
+		if t.Amount, err = moneyFromNumeric(amount, currency); err != nil {
+			return nil, fmt.Errorf("failed to scan ledger: %w", err)
+		}
+		ledger = append(ledger, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return ledger, nil
+}
+
+// AdjustBalance изменяет баланс пользователя на amount (+ начисление, - списание) от имени админа.
+// Баланс не может стать отрицательным
+func (s *PostgresStorage) AdjustBalance(ctx context.Context, userID int64, amount money.Money, actorID int64, reason string) (*models.LedgerTransaction, error) {
+	t := models.LedgerTransaction{
+		Kind:    models.LedgerKindAdjustment,
+		UserID:  userID,
+		ActorID: actorID,
+		Reason:  reason,
+		Amount:  amount,
+	}
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		balance, err := lockBalance(ctx, tx, userID, amount.Currency)
+		if err != nil {
+			return err
+		}
+		if balance.Add(amount).IsNegative() {
+			return ErrInsufficientBalance
+		}
+
+		return insertLedgerTransaction(ctx, tx, &t, models.LedgerAccountAdjustments)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to adjust balance: %w", err)
+	}
+
+	return &t, nil
+}
+
+// ApplyBalance оплачивает неоплаченный заказ покупателя бонусным балансом в валюте заказа - целиком
+// или частично. Если баланса хватило на весь заказ, заказ сразу переходит в paid
+func (s *PostgresStorage) ApplyBalance(ctx context.Context, orderID string, userID int64) (*models.Order, error) {
+	var order models.Order
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		query := `
+			SELECT order_id, user_id, COALESCE(product_id, 0), price, currency, status, payment_method, COALESCE(promo_code, ''), discount, balance_used, amount_offset, created_at
+			FROM orders
+			WHERE order_id = $1
+			FOR UPDATE
+		`
+
+		var err error
+		order, err = scanOrder(tx.QueryRow(ctx, query, orderID))
+		if err != nil {
+			return notFound(err)
+		}
+		if order.UserID != userID {
+			return ErrNotFound
+		}
+		if order.Status != models.OrderStatusCreated {
+			return fmt.Errorf("%w: order is %s", ErrInvalidTransition, order.Status)
+		}
+
+		balance, err := lockBalance(ctx, tx, userID, order.Price.Currency)
+		if err != nil {
+			return err
+		}
+		if !balance.IsPositive() {
+			return ErrInsufficientBalance
+		}
+
+		used := balance
+		if used.Amount > order.Price.Amount {
+			used = order.Price
+		}
+
+		debit := models.LedgerTransaction{
+			Kind:    models.LedgerKindCheckout,
+			UserID:  userID,
+			OrderID: orderID,
+			Amount:  money.New(-used.Amount, used.Currency),
+		}
+		if err := insertLedgerTransaction(ctx, tx, &debit, models.LedgerAccountSales); err != nil {
+			return err
+		}
+
+		order.Price = order.Price.Sub(used)
+		order.BalanceUsed = order.BalanceUsed.Add(used)
+		// Сумма перевода изменилась - надбавка выбирается заново при выдаче реквизитов
+		order.AmountOffset = money.New(0, order.Price.Currency)
+
+		status := order.Status
+		if order.Price.IsZero() {
+			if status, err = paidStatus(ctx, tx, orderID, order.Status, models.OrderStatusPaid); err != nil {
+				return err
+			}
+		}
+
+		update := `
+			UPDATE orders
+			SET price = $1, balance_used = $2, amount_offset = 0, status = $3, updated_at = $4
+			WHERE order_id = $5
+		`
+		if _, err := tx.Exec(ctx, update, numericFromMoney(order.Price), numericFromMoney(order.BalanceUsed), status, time.Now(), orderID); err != nil {
+			return err
+		}
+
+		if status != order.Status {
+			if err := insertStatusChange(ctx, tx, orderID, order.Status, status, 0, "Оплачено с бонусного баланса"); err != nil {
+				return err
+			}
+			order.Status = status
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply balance: %w", err)
+	}
+
+	return &order, nil
+}
+
+// RefundOrderToBalance переводит оплаченный заказ в refunded и возвращает покупателю на баланс
+// всю сумму заказа: оплаченную деньгами и списанную с баланса
+func (s *PostgresStorage) RefundOrderToBalance(ctx context.Context, orderID string, actorID int64, reason string) (*models.LedgerTransaction, error) {
+	t := models.LedgerTransaction{
+		Kind:    models.LedgerKindRefund,
+		OrderID: orderID,
+		ActorID: actorID,
+		Reason:  reason,
+	}
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		var current string
+		var price, balanceUsed pgtype.Numeric
+		var currency money.Currency
+		err := tx.QueryRow(ctx,
+			"SELECT status, user_id, price, balance_used, currency FROM orders WHERE order_id = $1 FOR UPDATE", orderID,
+		).Scan(&current, &t.UserID, &price, &balanceUsed, &currency)
+		if err != nil {
+			return notFound(err)
+		}
+
+		if !models.CanTransitionOrder(current, models.OrderStatusRefunded) {
+			return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, current, models.OrderStatusRefunded)
+		}
+
+		paid, err := moneyFromNumeric(price, currency)
+		if err != nil {
+			return err
+		}
+		used, err := moneyFromNumeric(balanceUsed, currency)
+		if err != nil {
+			return err
+		}
+		t.Amount = paid.Add(used)
+
+		if _, err := lockBalance(ctx, tx, t.UserID, currency); err != nil {
+			return err
+		}
+
+		query := `
+			UPDATE orders
+			SET status = $1, updated_at = $2
+			WHERE order_id = $3
+		`
+		if _, err := tx.Exec(ctx, query, models.OrderStatusRefunded, time.Now(), orderID); err != nil {
+			return err
+		}
+		if err := insertStatusChange(ctx, tx, orderID, current, models.OrderStatusRefunded, actorID, reason); err != nil {
+			return err
+		}
+
+		return insertLedgerTransaction(ctx, tx, &t, models.LedgerAccountRefunds)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to refund order: %w", err)
+	}
+
+	return &t, nil
+}
+
+// ==================== SUPPORT ====================
+
+// AddSupportMessage сохраняет сообщение переписки по заказу
+func (s *PostgresStorage) AddSupportMessage(ctx context.Context, m models.SupportMessage) (*models.SupportMessage, error) {
+	query := `
+		INSERT INTO support_messages (order_id, user_id, admin_id, text)
+		VALUES ($1, $2, NULLIF($3, 0), $4)
+		RETURNING id, created_at
+	`
+
+	if err := s.pool.QueryRow(ctx, query, m.OrderID, m.UserID, m.AdminID, m.Text).Scan(&m.ID, &m.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to add support message: %w", notFound(err))
+	}
+
+	return &m, nil
+}
+
+// SaveSupportRelay запоминает сообщение бота, доставившее сообщение переписки в чат
+func (s *PostgresStorage) SaveSupportRelay(ctx context.Context, chatID int64, messageID int, supportMessageID int64) error {
+	query := `
+		INSERT INTO support_relays (chat_id, message_id, support_message_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (chat_id, message_id) DO NOTHING
+	`
+
+	if _, err := s.pool.Exec(ctx, query, chatID, messageID, supportMessageID); err != nil {
+		return fmt.Errorf("failed to save support relay: %w", err)
+	}
+
+	return nil
+}
+
+// GetSupportMessageByRelay возвращает сообщение переписки, доставленное сообщением бота messageID в чат chatID.
+// ErrNotFound - это не сообщение переписки
+func (s *PostgresStorage) GetSupportMessageByRelay(ctx context.Context, chatID int64, messageID int) (*models.SupportMessage, error) {
+	query := `
+		SELECT m.id, m.order_id, m.user_id, COALESCE(m.admin_id, 0), m.text, m.created_at
+		FROM support_relays r
+		JOIN support_messages m ON m.id = r.support_message_id
+		WHERE r.chat_id = $1 AND r.message_id = $2
+	`
+
+	var m models.SupportMessage
+	err := s.pool.QueryRow(ctx, query, chatID, messageID).Scan(&m.ID, &m.OrderID, &m.UserID, &m.AdminID, &m.Text, &m.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get support message: %w", notFound(err))
 	}
 
-	return &settings, nil
+	return &m, nil
 }
 
-// UpdateWelcomeMessage обновляет приветственное сообщение
-func (s *PostgresStorage) UpdateWelcomeMessage(ctx context.Context, message string) error {
+// GetSupportThread возвращает переписку по заказу в хронологическом порядке
+func (s *PostgresStorage) GetSupportThread(ctx context.Context, orderID string) ([]models.SupportMessage, error) {
 	query := `
-		UPDATE bot_settings
-		SET welcome_message = $1, updated_at = $2
-		WHERE id = 1
+		SELECT id, order_id, user_id, COALESCE(admin_id, 0), text, created_at
+		FROM support_messages
+		WHERE order_id = $1
+		ORDER BY created_at ASC, id ASC
 	`
 
-	_, err := s.pool.Exec(ctx, query, message, time.Now())
+	rows, err := s.pool.Query(ctx, query, orderID)
 	if err != nil {
-		return fmt.Errorf("failed to update welcome message: %w", err)
+		return nil, fmt.Errorf("failed to query support thread: %w", err)
+	}
+	defer rows.Close()
+
+	var thread []models.SupportMessage
+	for rows.Next() {
+		var m models.SupportMessage
+		if err := rows.Scan(&m.ID, &m.OrderID, &m.UserID, &m.AdminID, &m.Text, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan support message: %w", err)
+		}
+		thread = append(thread, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return thread, nil
+}
+
+// ==================== ORDER CLAIMS ====================
+
+// ClaimOrder закрепляет заказ за админом, если его еще никто не взял, и возвращает действующее
+// закрепление: если заказ уже у другого админа, в ответе будет он. Закрытый заказ (завершен,
+// отменен, возвращен) взять нельзя - ErrInvalidTransition
+func (s *PostgresStorage) ClaimOrder(ctx context.Context, claim models.OrderClaim) (*models.OrderClaim, error) {
+	var result models.OrderClaim
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		var status string
+		err := tx.QueryRow(ctx, "SELECT status FROM orders WHERE order_id = $1 FOR UPDATE", claim.OrderID).Scan(&status)
+		if err != nil {
+			return notFound(err)
+		}
+
+		if !isClaimableStatus(status) {
+			return fmt.Errorf("%w: order is %s", ErrInvalidTransition, status)
+		}
+
+		_, err = tx.Exec(ctx, `
+			INSERT INTO order_claims (order_id, admin_id, admin_name)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (order_id) DO NOTHING
+		`, claim.OrderID, claim.AdminID, claim.AdminName)
+		if err != nil {
+			return err
+		}
+
+		return tx.QueryRow(ctx,
+			"SELECT order_id, admin_id, admin_name, claimed_at FROM order_claims WHERE order_id = $1", claim.OrderID,
+		).Scan(&result.OrderID, &result.AdminID, &result.AdminName, &result.ClaimedAt)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim order: %w", err)
+	}
+
+	return &result, nil
+}
+
+// GetOrderClaim возвращает админа, взявшего заказ в работу. ErrNotFound - заказ ничей
+func (s *PostgresStorage) GetOrderClaim(ctx context.Context, orderID string) (*models.OrderClaim, error) {
+	query := `
+		SELECT order_id, admin_id, admin_name, claimed_at
+		FROM order_claims
+		WHERE order_id = $1
+	`
+
+	var c models.OrderClaim
+	if err := s.pool.QueryRow(ctx, query, orderID).Scan(&c.OrderID, &c.AdminID, &c.AdminName, &c.ClaimedAt); err != nil {
+		return nil, fmt.Errorf("failed to get order claim: %w", notFound(err))
+	}
+
+	return &c, nil
+}
+
+// SaveAdminNotification запоминает уведомление админа о заказе. Повторное уведомление того же админа
+// заменяет прежнее
+func (s *PostgresStorage) SaveAdminNotification(ctx context.Context, n models.AdminNotification) error {
+	query := `
+		INSERT INTO admin_notifications (order_id, chat_id, message_id, text)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (order_id, chat_id) DO UPDATE SET message_id = EXCLUDED.message_id, text = EXCLUDED.text
+	`
+
+	if _, err := s.pool.Exec(ctx, query, n.OrderID, n.ChatID, n.MessageID, n.Text); err != nil {
+		return fmt.Errorf("failed to save admin notification: %w", err)
 	}
 
 	return nil
 }
 
-// GetChangeRegionProduct возвращает товар "Сменить регион" из категории "Системные услуги"
-func (s *PostgresStorage) GetChangeRegionProduct(ctx context.Context) (*models.Product, error) {
+// GetAdminNotifications возвращает уведомления админов о заказе
+func (s *PostgresStorage) GetAdminNotifications(ctx context.Context, orderID string) ([]models.AdminNotification, error) {
 	query := `
-		SELECT p.id, p.name, p.category_id, p.price, p.description, p.is_visible, p.sort_order, p.created_at
-		FROM products p
-		JOIN categories c ON p.category_id = c.id
-		WHERE c.name = 'Системные услуги' AND p.name = 'Сменить регион'
-		LIMIT 1
+		SELECT order_id, chat_id, message_id, text
+		FROM admin_notifications
+		WHERE order_id = $1
+		ORDER BY chat_id
 	`
 
-	var p models.Product
-	err := s.pool.QueryRow(ctx, query).Scan(
-		&p.ID, &p.Name, &p.CategoryID, &p.Price, &p.Description, &p.IsVisible, &p.SortOrder, &p.CreatedAt,
-	)
+	rows, err := s.pool.Query(ctx, query, orderID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get change region product: %w", err)
+		return nil, fmt.Errorf("failed to query admin notifications: %w", err)
 	}
+	defer rows.Close()
 
-	return &p, nil
+	var notifications []models.AdminNotification
+	for rows.Next() {
+		var n models.AdminNotification
+		if err := rows.Scan(&n.OrderID, &n.ChatID, &n.MessageID, &n.Text); err != nil {
+			return nil, fmt.Errorf("failed to scan admin notification: %w", err)
+		}
+		notifications = append(notifications, n)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return notifications, nil
 }
 
-// ==================== USER METHODS ====================
+// ==================== SUBSCRIPTIONS ====================
 
-// UpsertUser создает или обновляет пользователя
-func (s *PostgresStorage) UpsertUser(ctx context.Context, userID int64, username, firstName, lastName string) error {
+// ListExpiringSubscriptions возвращает подписки выполненных заказов, которые заканчиваются в (from, until]
+// и о которых еще не напоминали, ближайшие первыми. Подписка, продленная более поздним заказом, не попадает
+func (s *PostgresStorage) ListExpiringSubscriptions(ctx context.Context, from, until time.Time, limit int) ([]models.Subscription, error) {
 	query := `
-		INSERT INTO users (user_id, username, first_name, last_name, last_activity)
-		VALUES ($1, $2, $3, $4, $5)
-		ON CONFLICT (user_id) DO UPDATE SET
-			username = EXCLUDED.username,
-			first_name = EXCLUDED.first_name,
-			last_name = EXCLUDED.last_name,
-			last_activity = EXCLUDED.last_activity
+		SELECT i.id, i.order_id, o.user_id, COALESCE(i.product_id, 0), i.product_name, i.expires_at
+		FROM order_items i
+		JOIN orders o ON o.order_id = i.order_id
+		WHERE o.status = 'completed'
+			AND i.expires_at > $1 AND i.expires_at <= $2
+			AND i.reminded_at IS NULL
+			AND NOT EXISTS (
+				SELECT 1
+				FROM order_items newer
+				JOIN orders no ON no.order_id = newer.order_id
+				WHERE no.user_id = o.user_id
+					AND newer.product_id = i.product_id
+					AND newer.expires_at > i.expires_at
+			)
+		ORDER BY i.expires_at, i.id
+		LIMIT $3
 	`
 
-	_, err := s.pool.Exec(ctx, query, userID, username, firstName, lastName, time.Now())
+	rows, err := s.pool.Query(ctx, query, from, until, limit)
 	if err != nil {
-		return fmt.Errorf("failed to upsert user: %w", err)
+		return nil, fmt.Errorf("failed to query expiring subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subscriptions []models.Subscription
+	for rows.Next() {
+		var sub models.Subscription
+		err := rows.Scan(&sub.ItemID, &sub.OrderID, &sub.UserID, &sub.ProductID, &sub.ProductName, &sub.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return subscriptions, nil
+}
+
+// MarkSubscriptionReminded отмечает, что покупателю напомнили о продлении подписки
+func (s *PostgresStorage) MarkSubscriptionReminded(ctx context.Context, itemID int64) error {
+	tag, err := s.pool.Exec(ctx, "UPDATE order_items SET reminded_at = NOW() WHERE id = $1", itemID)
+	if err != nil {
+		return fmt.Errorf("failed to mark subscription reminded: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("failed to mark subscription reminded: %w", ErrNotFound)
 	}
 
 	return nil
 }
 
-// GetActiveUsers возвращает всех пользователей, которые не заблокировали бота
-func (s *PostgresStorage) GetActiveUsers(ctx context.Context) ([]models.User, error) {
+// ==================== PREORDERS ====================
+
+// ListReleasedPreorders возвращает заказы в статусе preordered, все товары которых вышли к now (старые первыми)
+func (s *PostgresStorage) ListReleasedPreorders(ctx context.Context, now time.Time, limit int) ([]models.Order, error) {
 	query := `
-		SELECT user_id, username, first_name, last_name, is_blocked, created_at, last_activity
-		FROM users
-		WHERE is_blocked = false
-		ORDER BY user_id ASC
+		SELECT o.order_id, o.user_id, COALESCE(o.product_id, 0), o.price, o.currency, o.status, o.payment_method,
+			COALESCE(o.promo_code, ''), o.discount, o.balance_used, o.amount_offset, o.created_at
+		FROM orders o
+		WHERE o.status = $1
+			AND NOT EXISTS (
+				SELECT 1
+				FROM order_items i
+				JOIN products p ON p.id = i.product_id
+				WHERE i.order_id = o.order_id AND p.release_at > $2
+			)
+		ORDER BY o.created_at ASC
+		LIMIT $3
 	`
 
-	rows, err := s.pool.Query(ctx, query)
+	rows, err := s.pool.Query(ctx, query, models.OrderStatusPreordered, now, limit)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query active users: %w", err)
+		return nil, fmt.Errorf("failed to query released preorders: %w", err)
 	}
 	defer rows.Close()
 
-	var users []models.User
+	var orders []models.Order
 	for rows.Next() {
-		var u models.User
-		if err := rows.Scan(&u.UserID, &u.Username, &u.FirstName, &u.LastName, &u.IsBlocked, &u.CreatedAt, &u.LastActivity); err != nil {
-			return nil, fmt.Errorf("failed to scan user: %w", err)
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
 		}
-		users = append(users, u)
+		orders = append(orders, o)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("rows error: %w", err)
 	}
 
-	return users, nil
+	return orders, nil
 }
 
-// MarkUserAsBlocked помечает пользователя как заблокировавшего бота
-func (s *PostgresStorage) MarkUserAsBlocked(ctx context.Context, userID int64) error {
-	query := `UPDATE users SET is_blocked = true WHERE user_id = $1`
+// ==================== PAYOUT CARDS ====================
 
-	_, err := s.pool.Exec(ctx, query, userID)
+// payoutCardColumns - колонки карты c для scanPayoutCard. Дневной оборот - неотмененные заказы на карту
+// в валюте лимита, созданные не раньше $1
+const payoutCardColumns = `
+	c.id, c.number, c.bank_name, c.holder, COALESCE(c.region_id, 0), c.daily_limit, c.currency, c.is_active,
+	(SELECT COALESCE(SUM(o.price), 0) FROM orders o
+		WHERE o.payout_card_id = c.id AND o.status <> 'cancelled' AND o.currency = c.currency AND o.created_at >= $1),
+	c.last_used_at, c.created_at`
+
+// CreatePayoutCard добавляет карту для оплаты переводом
+func (s *PostgresStorage) CreatePayoutCard(ctx context.Context, card models.PayoutCard) (*models.PayoutCard, error) {
+	query := `
+		INSERT INTO payout_cards AS c (number, bank_name, holder, region_id, daily_limit, currency)
+		VALUES ($2, $3, $4, NULLIF($5, 0), $6, $7)
+		RETURNING ` + payoutCardColumns
+
+	created, err := scanPayoutCard(s.pool.QueryRow(
+		ctx, query, time.Now().UTC(),
+		card.Number, card.BankName, card.Holder, card.RegionID, numericFromMoney(card.DailyLimit), card.DailyLimit.Currency,
+	))
 	if err != nil {
-		return fmt.Errorf("failed to mark user as blocked: %w", err)
+		return nil, fmt.Errorf("failed to create payout card: %w", err)
+	}
+
+	return &created, nil
+}
+
+// ListPayoutCards возвращает все карты по порядку добавления с оборотом с момента since
+func (s *PostgresStorage) ListPayoutCards(ctx context.Context, since time.Time) ([]models.PayoutCard, error) {
+	rows, err := s.pool.Query(ctx, "SELECT "+payoutCardColumns+" FROM payout_cards c ORDER BY c.id", since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query payout cards: %w", err)
+	}
+	defer rows.Close()
+
+	var cards []models.PayoutCard
+	for rows.Next() {
+		card, err := scanPayoutCard(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan payout card: %w", err)
+		}
+		cards = append(cards, card)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return cards, nil
+}
+
+// SetPayoutCardActive включает или выключает карту
+func (s *PostgresStorage) SetPayoutCardActive(ctx context.Context, cardID int, isActive bool) error {
+	tag, err := s.pool.Exec(ctx, "UPDATE payout_cards SET is_active = $1 WHERE id = $2", isActive, cardID)
+	if err != nil {
+		return fmt.Errorf("failed to update payout card: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("failed to update payout card: %w", ErrNotFound)
 	}
 
 	return nil
 }
 
-// GetUsersCount возвращает количество активных пользователей
-func (s *PostgresStorage) GetUsersCount(ctx context.Context) (int, error) {
-	query := `SELECT COUNT(*) FROM users WHERE is_blocked = false`
+// DeletePayoutCard удаляет карту. В заказах, оплаченных на нее, карта перестает быть известна
+func (s *PostgresStorage) DeletePayoutCard(ctx context.Context, cardID int) error {
+	tag, err := s.pool.Exec(ctx, "DELETE FROM payout_cards WHERE id = $1", cardID)
+	if err != nil {
+		return fmt.Errorf("failed to delete payout card: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("failed to delete payout card: %w", ErrNotFound)
+	}
 
-	var count int
-	err := s.pool.QueryRow(ctx, query).Scan(&count)
+	return nil
+}
+
+// AssignPayoutCard выбирает карту для перевода по неоплаченному заказу и запоминает ее в заказе.
+// Если карта уже выдана и все еще включена, возвращается она. Иначе берется включенная карта региона
+// заказа (или карта для всех регионов) с запасом дневного лимита с момента since, по политике rotation.
+// ErrNoPayoutCard - подходящей карты нет
+func (s *PostgresStorage) AssignPayoutCard(ctx context.Context, orderID, rotation string, since time.Time) (*models.PayoutCard, error) {
+	var result models.PayoutCard
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		var status string
+		var amount pgtype.Numeric
+		var currency money.Currency
+		var currentID *int
+		err := tx.QueryRow(ctx,
+			"SELECT status, price, currency, payout_card_id FROM orders WHERE order_id = $1 FOR UPDATE", orderID,
+		).Scan(&status, &amount, &currency, &currentID)
+		if err != nil {
+			return notFound(err)
+		}
+		if status != models.OrderStatusCreated {
+			return fmt.Errorf("%w: order is %s", ErrInvalidTransition, status)
+		}
+
+		if currentID != nil {
+			card, err := scanPayoutCard(tx.QueryRow(ctx,
+				"SELECT "+payoutCardColumns+" FROM payout_cards c WHERE c.id = $2 AND c.is_active", since.UTC(), *currentID))
+			if err == nil {
+				result = card
+				return nil
+			}
+			if !errors.Is(err, pgx.ErrNoRows) {
+				return err
+			}
+		}
+
+		price, err := moneyFromNumeric(amount, currency)
+		if err != nil {
+			return err
+		}
+
+		// Блокировка включенных карт выстраивает параллельные выдачи в очередь, чтобы они не превысили лимит
+		if _, err := tx.Exec(ctx, "SELECT id FROM payout_cards WHERE is_active FOR UPDATE"); err != nil {
+			return err
+		}
+
+		order := "c.last_used_at NULLS FIRST, c.id"
+		if rotation == models.PayoutRotationPriority {
+			order = "c.id"
+		}
+
+		rows, err := tx.Query(ctx, `
+			SELECT `+payoutCardColumns+`
+			FROM payout_cards c
+			WHERE c.is_active
+				AND (c.region_id IS NULL OR NOT EXISTS (
+					SELECT 1
+					FROM order_items i
+					JOIN products p ON p.id = i.product_id
+					JOIN categories cat ON cat.id = p.category_id
+					WHERE i.order_id = $2 AND cat.region_id <> c.region_id
+				))
+			ORDER BY `+order, since.UTC(), orderID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var candidates []models.PayoutCard
+		for rows.Next() {
+			card, err := scanPayoutCard(rows)
+			if err != nil {
+				return err
+			}
+			candidates = append(candidates, card)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		for _, card := range candidates {
+			if !payoutCardFits(card, price) {
+				continue
+			}
+
+			if _, err := tx.Exec(ctx, "UPDATE orders SET payout_card_id = $1 WHERE order_id = $2", card.ID, orderID); err != nil {
+				return err
+			}
+			if err := tx.QueryRow(ctx,
+				"UPDATE payout_cards SET last_used_at = NOW() WHERE id = $1 RETURNING last_used_at", card.ID,
+			).Scan(&card.LastUsedAt); err != nil {
+				return err
+			}
+			card.UsedToday = card.UsedToday.Add(money.New(price.Amount, card.UsedToday.Currency))
+			result = card
+			return nil
+		}
+
+		return ErrNoPayoutCard
+	})
 	if err != nil {
-		return 0, fmt.Errorf("failed to get users count: %w", err)
+		return nil, fmt.Errorf("failed to assign payout card: %w", err)
 	}
 
-	return count, nil
+	return &result, nil
+}
+
+// GetOrderPayoutCard возвращает карту, выданную покупателю по заказу. ErrNotFound - карты нет или ее удалили.
+// Оборот карты не считается
+func (s *PostgresStorage) GetOrderPayoutCard(ctx context.Context, orderID string) (*models.PayoutCard, error) {
+	query := `
+		SELECT ` + payoutCardColumns + `
+		FROM payout_cards c
+		JOIN orders ord ON ord.payout_card_id = c.id
+		WHERE ord.order_id = $2
+	`
+
+	card, err := scanPayoutCard(s.pool.QueryRow(ctx, query, time.Now().UTC(), orderID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payout card: %w", notFound(err))
+	}
+
+	return &card, nil
+}
+
+// ==================== AMOUNT OFFSETS ====================
+
+// amountOffsetLockKey - ключ pg_advisory_xact_lock: надбавки выбираются по очереди, чтобы два заказа
+// не получили одинаковую сумму перевода
+const amountOffsetLockKey int64 = 7_142_025_030
+
+// AssignAmountOffset выдает неоплаченному заказу надбавку к сумме перевода (от 0,01 до 0,99), с которой
+// сумма не совпадает ни с одним другим заказом, ожидающим оплаты тем же способом в той же валюте.
+// Надбавки отмененных заказов, созданных после reservedSince, тоже заняты: сверка еще ищет их переводы.
+// Уже выданная надбавка не меняется. Если все надбавки заняты, заказ остается без метки
+func (s *PostgresStorage) AssignAmountOffset(ctx context.Context, orderID string, reservedSince time.Time) (*models.Order, error) {
+	var order models.Order
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", amountOffsetLockKey); err != nil {
+			return err
+		}
+
+		query := `
+			SELECT order_id, user_id, COALESCE(product_id, 0), price, currency, status, payment_method, COALESCE(promo_code, ''), discount, balance_used, amount_offset, created_at
+			FROM orders
+			WHERE order_id = $1
+			FOR UPDATE
+		`
+
+		var err error
+		order, err = scanOrder(tx.QueryRow(ctx, query, orderID))
+		if err != nil {
+			return notFound(err)
+		}
+		if order.Status != models.OrderStatusCreated {
+			return fmt.Errorf("%w: order is %s", ErrInvalidTransition, order.Status)
+		}
+		if order.AmountOffset.IsPositive() {
+			return nil
+		}
+
+		rows, err := tx.Query(ctx, `
+			SELECT price + amount_offset
+			FROM orders
+			WHERE (status = $1 OR (status = $7 AND created_at >= $8))
+				AND payment_method = $2 AND currency = $3 AND order_id <> $4
+				AND price + amount_offset > $5 AND price + amount_offset <= $6
+		`,
+			models.OrderStatusCreated, order.PaymentMethod, order.Price.Currency, orderID,
+			numericFromMoney(order.Price), numericFromMoney(order.Price.Add(money.New(MaxAmountOffset, order.Price.Currency))),
+			models.OrderStatusCancelled, reservedSince.UTC(),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		taken := make(map[int64]bool)
+		for rows.Next() {
+			var amount pgtype.Numeric
+			if err := rows.Scan(&amount); err != nil {
+				return err
+			}
+			transfer, err := moneyFromNumeric(amount, order.Price.Currency)
+			if err != nil {
+				return err
+			}
+			taken[transfer.Amount] = true
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		order.AmountOffset = pickAmountOffset(order.Price, taken)
+		if order.AmountOffset.IsZero() {
+			return nil
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE orders SET amount_offset = $1 WHERE order_id = $2", numericFromMoney(order.AmountOffset), orderID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to assign amount offset: %w", err)
+	}
+
+	return &order, nil
+}
+
+// ConfirmLateTransfer переводит в paid (или preordered) заказ, отмененный системой, перевод за который нашла
+// сверка выписки. Промокод заказа снова проверяется по лимитам использований: пока заказ был отменен,
+// промокод могли использовать другие. Любой другой заказ - ErrInvalidTransition
+func (s *PostgresStorage) ConfirmLateTransfer(ctx context.Context, orderID string, actorID int64, reason string) error {
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		var current, promoCode string
+		var userID int64
+		var balanceUsed pgtype.Numeric
+		var currency money.Currency
+		err := tx.QueryRow(ctx,
+			"SELECT status, user_id, balance_used, currency, COALESCE(promo_code, '') FROM orders WHERE order_id = $1 FOR UPDATE", orderID,
+		).Scan(&current, &userID, &balanceUsed, &currency, &promoCode)
+		if err != nil {
+			return notFound(err)
+		}
+
+		if current != models.OrderStatusCancelled {
+			return fmt.Errorf("%w: order is %s", ErrInvalidTransition, current)
+		}
+		payable, err := payableAfterCancel(ctx, tx, orderID, balanceUsed, currency)
+		if err != nil {
+			return err
+		}
+		if !payable {
+			return fmt.Errorf("%w: order was not cancelled by the system", ErrInvalidTransition)
+		}
+
+		if promoCode != "" {
+			pc, err := scanPromoCode(tx.QueryRow(ctx, "SELECT "+promoCodeColumns+" FROM promo_codes WHERE code = $1 FOR UPDATE", promoCode))
+			if err != nil {
+				return fmt.Errorf("failed to get promo code: %w", err)
+			}
+			usage, err := promoUsage(ctx, tx, promoCode, userID)
+			if err != nil {
+				return err
+			}
+			if err := promo.CheckUsage(pc, usage); err != nil {
+				return fmt.Errorf("%w: promo code %s: %w", ErrInvalidTransition, promoCode, err)
+			}
+		}
+
+		status, err := paidStatus(ctx, tx, orderID, models.OrderStatusCreated, models.OrderStatusPaid)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, "UPDATE orders SET status = $1, updated_at = $2 WHERE order_id = $3", status, time.Now(), orderID); err != nil {
+			return err
+		}
+
+		return insertStatusChange(ctx, tx, orderID, current, status, actorID, reason)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to confirm late transfer: %w", err)
+	}
+
+	return nil
+}
+
+// payableAfterCancel сообщает, можно ли принять оплату отмененного заказа: его отменила система
+// (по сроку оплаты или при отключении способа оплаты), а не покупатель или админ, и за него ничего
+// не списывалось с баланса - списание уже вернулось покупателю при отмене
+func payableAfterCancel(ctx context.Context, tx pgx.Tx, orderID string, balanceUsed pgtype.Numeric, currency money.Currency) (bool, error) {
+	used, err := moneyFromNumeric(balanceUsed, currency)
+	if err != nil {
+		return false, err
+	}
+	if used.IsPositive() {
+		return false, nil
+	}
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM order_status_history
+			WHERE order_id = $1 AND to_status = $2 AND actor_id IS NULL
+		)
+	`
+
+	var bySystem bool
+	if err := tx.QueryRow(ctx, query, orderID, models.OrderStatusCancelled).Scan(&bySystem); err != nil {
+		return false, fmt.Errorf("failed to check order cancellation: %w", err)
+	}
+
+	return bySystem, nil
+}
+
+// ListAwaitingTransfers возвращает заказы, ожидающие оплаты способом paymentMethod (старые первыми),
+// и заказы, созданные после cancelledSince и отмененные системой: перевод мог прийти до автоотмены
+func (s *PostgresStorage) ListAwaitingTransfers(ctx context.Context, paymentMethod string, cancelledSince time.Time, limit int) ([]models.Order, error) {
+	query := `
+		SELECT o.order_id, o.user_id, COALESCE(o.product_id, 0), o.price, o.currency, o.status, o.payment_method, COALESCE(o.promo_code, ''), o.discount, o.balance_used, o.amount_offset, o.created_at
+		FROM orders o
+		WHERE o.payment_method = $2 AND (o.status = $1 OR (
+			o.status = $4 AND o.created_at >= $5 AND o.balance_used = 0
+			AND EXISTS (SELECT 1 FROM order_status_history h WHERE h.order_id = o.order_id AND h.to_status = $4 AND h.actor_id IS NULL)
+		))
+		ORDER BY o.created_at ASC
+		LIMIT $3
+	`
+
+	rows, err := s.pool.Query(ctx, query, models.OrderStatusCreated, paymentMethod, limit, models.OrderStatusCancelled, cancelledSince.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query awaiting transfers: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, o)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return orders, nil
 }
 
 // ==================== BROADCAST METHODS ====================
@@ -876,7 +3148,7 @@ func (s *PostgresStorage) GetBroadcastByID(ctx context.Context, broadcastID int)
 		&b.Status, &b.TotalUsers, &b.SentCount, &b.FailedCount,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get broadcast: %w", err)
+		return nil, fmt.Errorf("failed to get broadcast: %w", notFound(err))
 	}
 
 	return &b, nil
@@ -0,0 +1,8 @@
+package storage
+
+import "tgwow/internal/money"
+
+// referralBonus считает бонус пригласившему: percent процентов от суммы заказа с округлением вниз
+func referralBonus(total money.Money, percent int) money.Money {
+	return money.New(total.Amount*int64(percent)/100, total.Currency)
+}
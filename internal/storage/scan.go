@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+// rowScanner - общий интерфейс pgx.Row и pgx.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// moneyFromNumeric переводит NUMERIC в копейки без промежуточного float64
+func moneyFromNumeric(n pgtype.Numeric, currency money.Currency) (money.Money, error) {
+	if !n.Valid {
+		return money.New(0, currency), nil
+	}
+	if n.NaN || n.InfinityModifier != pgtype.Finite {
+		return money.Money{}, fmt.Errorf("non-finite money value")
+	}
+
+	// n = Int * 10^Exp, нужны сотые доли: Int * 10^(Exp+2)
+	minor := new(big.Int).Set(n.Int)
+	shift := int64(n.Exp) + 2
+	if shift >= 0 {
+		minor.Mul(minor, new(big.Int).Exp(big.NewInt(10), big.NewInt(shift), nil))
+	} else {
+		var rem big.Int
+		minor.QuoRem(minor, new(big.Int).Exp(big.NewInt(10), big.NewInt(-shift), nil), &rem)
+		if rem.Sign() != 0 {
+			return money.Money{}, fmt.Errorf("money value has more than 2 fractional digits")
+		}
+	}
+
+	if !minor.IsInt64() {
+		return money.Money{}, fmt.Errorf("money value out of range")
+	}
+
+	return money.New(minor.Int64(), currency), nil
+}
+
+// numericFromMoney готовит сумму к записи в колонку NUMERIC(10,2)
+func numericFromMoney(m money.Money) pgtype.Numeric {
+	return pgtype.Numeric{Int: big.NewInt(m.Amount), Exp: -2, Valid: true}
+}
+
+// scanProduct читает строку с колонками id, name, category_id, price, currency, description, is_visible, sort_order,
+// duration_months, release_at, created_at.
+// Валюта товара берется из его региона
+func scanProduct(row rowScanner) (models.Product, error) {
+	var p models.Product
+	var price pgtype.Numeric
+	var currency money.Currency
+
+	err := row.Scan(&p.ID, &p.Name, &p.CategoryID, &price, &currency, &p.Description, &p.IsVisible, &p.SortOrder,
+		&p.DurationMonths, &p.ReleaseAt, &p.CreatedAt)
+	if err != nil {
+		return p, err
+	}
+
+	p.Price, err = moneyFromNumeric(price, currency)
+	return p, err
+}
+
+// scanOrder читает строку с колонками order_id, user_id, product_id, price, currency, status, payment_method,
+// promo_code, discount, balance_used, amount_offset, created_at
+func scanOrder(row rowScanner) (models.Order, error) {
+	var o models.Order
+	var price, discount, balanceUsed, amountOffset pgtype.Numeric
+	var currency money.Currency
+
+	err := row.Scan(
+		&o.OrderID, &o.UserID, &o.ProductID, &price, &currency, &o.Status, &o.PaymentMethod,
+		&o.PromoCode, &discount, &balanceUsed, &amountOffset, &o.CreatedAt,
+	)
+	if err != nil {
+		return o, err
+	}
+
+	if o.Price, err = moneyFromNumeric(price, currency); err != nil {
+		return o, err
+	}
+	if o.Discount, err = moneyFromNumeric(discount, currency); err != nil {
+		return o, err
+	}
+	if o.BalanceUsed, err = moneyFromNumeric(balanceUsed, currency); err != nil {
+		return o, err
+	}
+	o.AmountOffset, err = moneyFromNumeric(amountOffset, currency)
+	return o, err
+}
+
+// scanProductKey читает строку с колонками id, product_id, code, order_id, created_at, delivered_at
+func scanProductKey(row rowScanner) (models.ProductKey, error) {
+	var k models.ProductKey
+	err := row.Scan(&k.ID, &k.ProductID, &k.Code, &k.OrderID, &k.CreatedAt, &k.DeliveredAt)
+	return k, err
+}
+
+// scanPromoCode читает строку с колонками promoCodeColumns
+func scanPromoCode(row rowScanner) (models.PromoCode, error) {
+	var pc models.PromoCode
+	var amount pgtype.Numeric
+	var currency money.Currency
+
+	err := row.Scan(
+		&pc.ID, &pc.Code, &pc.Percent, &amount, &currency, &pc.ProductID, &pc.CategoryID, &pc.RegionID,
+		&pc.ValidFrom, &pc.ValidUntil, &pc.MaxUses, &pc.MaxUsesPerUser, &pc.FirstPurchaseOnly, &pc.IsActive,
+		&pc.Uses, &pc.CreatedAt,
+	)
+	if err != nil {
+		return pc, err
+	}
+
+	if pc.Percent == 0 {
+		pc.Amount, err = moneyFromNumeric(amount, currency)
+	}
+	return pc, err
+}
+
+// scanPayoutCard читает строку с колонками payoutCardColumns
+func scanPayoutCard(row rowScanner) (models.PayoutCard, error) {
+	var c models.PayoutCard
+	var limit, used pgtype.Numeric
+	var currency money.Currency
+
+	err := row.Scan(
+		&c.ID, &c.Number, &c.BankName, &c.Holder, &c.RegionID, &limit, &currency, &c.IsActive,
+		&used, &c.LastUsedAt, &c.CreatedAt,
+	)
+	if err != nil {
+		return c, err
+	}
+
+	if c.DailyLimit, err = moneyFromNumeric(limit, currency); err != nil {
+		return c, err
+	}
+	c.UsedToday, err = moneyFromNumeric(used, currency)
+	return c, err
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"tgwow/internal/money"
+)
+
+func TestMoneyFromNumeric(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       pgtype.Numeric
+		want    int64
+		wantErr bool
+	}{
+		{name: "NUMERIC(10,2)", n: pgtype.Numeric{Int: big.NewInt(67050), Exp: -2, Valid: true}, want: 67050},
+		{name: "Integer", n: pgtype.Numeric{Int: big.NewInt(1749), Exp: 0, Valid: true}, want: 174900},
+		{name: "Trailing zeros", n: pgtype.Numeric{Int: big.NewInt(1), Exp: 3, Valid: true}, want: 100000},
+		{name: "Extra scale without remainder", n: pgtype.Numeric{Int: big.NewInt(12300), Exp: -4, Valid: true}, want: 123},
+		{name: "NULL", n: pgtype.Numeric{}, want: 0},
+		{name: "Sub-kopeck", n: pgtype.Numeric{Int: big.NewInt(1), Exp: -3, Valid: true}, wantErr: true},
+		{name: "NaN", n: pgtype.Numeric{NaN: true, Valid: true}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := moneyFromNumeric(tt.n, money.RUB)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("moneyFromNumeric() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != money.New(tt.want, money.RUB) {
+				t.Errorf("moneyFromNumeric() = %+v, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// Запись и чтение дают ту же сумму
+	m := money.New(-199, money.RUB)
+	if got, _ := moneyFromNumeric(numericFromMoney(m), money.RUB); got != m {
+		t.Errorf("round trip = %+v, want %+v", got, m)
+	}
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"tgwow/internal/models"
+	"tgwow/internal/money"
+)
+
+var (
+	// ErrNotFound возвращается, когда запрошенная запись не существует
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidTransition возвращается при недопустимой смене статуса заказа
+	ErrInvalidTransition = errors.New("invalid order status transition")
+	// ErrOutOfStock возвращается, когда у товара не осталось свободных ключей
+	ErrOutOfStock = errors.New("out of stock")
+	// ErrCartEmpty возвращается при оформлении пустой корзины
+	ErrCartEmpty = errors.New("cart is empty")
+	// ErrCartMixedCurrency возвращается, если в корзине товары в разных валютах
+	ErrCartMixedCurrency = errors.New("cart has items in different currencies")
+	// ErrProductUnavailable возвращается, если товар скрыт или без цены
+	ErrProductUnavailable = errors.New("product is unavailable")
+	// ErrAlreadyExists возвращается при создании записи с уже занятым уникальным значением
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrInsufficientBalance возвращается, если бонусного баланса не хватает на списание
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	// ErrNoPayoutCard возвращается, если для заказа нет подходящей карты с запасом дневного лимита
+	ErrNoPayoutCard = errors.New("no payout card available")
+)
+
+// Store описывает все операции с данными, которые используют handlers.
+// Реализации: PostgresStorage (production) и MemoryStorage (тесты, локальный запуск)
+type Store interface {
+	Close()
+
+	// Регионы и категории
+	ListRegions(ctx context.Context) ([]models.Region, error)
+	GetRegionByID(ctx context.Context, regionID int) (*models.Region, error)
+	UpdateRegionCurrency(ctx context.Context, regionID int, currency money.Currency) error
+	ListCategoriesByRegion(ctx context.Context, regionID int) ([]models.Category, error)
+	ListAllCategoriesByRegion(ctx context.Context, regionID int) ([]models.Category, error)
+	ListAllCategories(ctx context.Context) ([]models.Category, error)
+	GetCategoryByID(ctx context.Context, categoryID int) (*models.Category, error)
+	UpdateCategory(ctx context.Context, categoryID int, name string, description string) error
+
+	// Товары
+	ListProductsByCategory(ctx context.Context, categoryID int) ([]models.Product, error)
+	ListAllProductsByCategory(ctx context.Context, categoryID int) ([]models.Product, error)
+	ListProducts(ctx context.Context) ([]models.Product, error)
+	ListAllProducts(ctx context.Context) ([]models.Product, error)
+	GetProductByID(ctx context.Context, productID int) (*models.Product, error)
+	GetProductsByIDs(ctx context.Context, productIDs []int) (map[int]*models.Product, error)
+	GetChangeRegionProduct(ctx context.Context) (*models.Product, error)
+	CreateProduct(ctx context.Context, name string, categoryID int, price money.Money, description string) (*models.Product, error)
+	UpdateProduct(ctx context.Context, productID int, name string, price money.Money, description string) error
+	UpdateProductPrice(ctx context.Context, productID int, newPrice money.Money) error
+	UpdateProductVisibility(ctx context.Context, productID int, isVisible bool) error
+	UpdateProductDuration(ctx context.Context, productID int, months int) error
+	UpdateProductRelease(ctx context.Context, productID int, releaseAt *time.Time) error
+	DeleteProduct(ctx context.Context, productID int) error
+
+	// Заказы
+	CreateOrder(ctx context.Context, userID int64, productID int, price money.Money, paymentMethod string, promoCode string) (*models.Order, error)
+	GetOrderByID(ctx context.Context, orderID string) (*models.Order, error)
+	GetUserOrders(ctx context.Context, userID int64, offset, limit int) ([]models.Order, error)
+	GetRecentOrders(ctx context.Context, limit int) ([]models.Order, error)
+	ListUnpaidOrdersBefore(ctx context.Context, before time.Time, limit int) ([]models.Order, error)
+	GetPendingOrders(ctx context.Context, userID int64) ([]models.Order, error)
+	ListOrders(ctx context.Context, filter models.OrderFilter, offset, limit int) ([]models.Order, error)
+	UpdateOrderStatus(ctx context.Context, orderID string, status string, actorID int64, reason string) error
+	SaveOrderPayment(ctx context.Context, orderID, telegramChargeID, providerChargeID string) error
+	GetOrderStatusHistory(ctx context.Context, orderID string) ([]models.OrderStatusChange, error)
+	GetOrderStats(ctx context.Context) (map[string]interface{}, error)
+	GetOrderItems(ctx context.Context, orderID string) ([]models.OrderItem, error)
+	GetOrderItemsByOrderIDs(ctx context.Context, orderIDs []string) (map[string][]models.OrderItem, error)
+
+	// Корзина
+	GetCart(ctx context.Context, userID int64) ([]models.CartItem, error)
+	AddToCart(ctx context.Context, userID int64, productID int, quantity int) error
+	SetCartItemQuantity(ctx context.Context, userID int64, productID int, quantity int) error
+	ClearCart(ctx context.Context, userID int64) error
+	CheckoutCart(ctx context.Context, userID int64, paymentMethod string, promoCode string) (*models.Order, error)
+
+	// Промокоды
+	CreatePromoCode(ctx context.Context, code models.PromoCode) (*models.PromoCode, error)
+	GetPromoCode(ctx context.Context, code string) (*models.PromoCode, error)
+	ListPromoCodes(ctx context.Context) ([]models.PromoCode, error)
+	SetPromoCodeActive(ctx context.Context, promoCodeID int, isActive bool) error
+	HasActivePromoCodes(ctx context.Context) (bool, error)
+
+	// Чеки об оплате
+	AddOrderReceipt(ctx context.Context, orderID string, userID int64, fileID, fileType string) (*models.OrderReceipt, error)
+	GetOrderReceipts(ctx context.Context, orderID string) ([]models.OrderReceipt, error)
+	ReviewOrderReceipts(ctx context.Context, orderID string, status string, reviewerID int64) error
+
+	// Ключи товаров
+	AddProductKeys(ctx context.Context, productID int, codes []string) (int, error)
+	GetProductKeyStock(ctx context.Context, productID int) (*models.KeyStock, error)
+	ReserveProductKeys(ctx context.Context, orderID string, productID int, quantity int) ([]models.ProductKey, error)
+
+	// Настройки бота
+	GetBotSettings(ctx context.Context) (*models.BotSettings, error)
+	UpdateWelcomeMessage(ctx context.Context, message string) error
+
+	// Пользователи
+	UpsertUser(ctx context.Context, userID int64, username, firstName, lastName string) error
+	GetActiveUsers(ctx context.Context) ([]models.User, error)
+	MarkUserAsBlocked(ctx context.Context, userID int64) error
+	GetUsersCount(ctx context.Context) (int, error)
+
+	// Реферальная программа
+	AddReferredUser(ctx context.Context, userID, referrerID int64, username, firstName, lastName string) (bool, error)
+	CreateReferralReward(ctx context.Context, orderID string, percent int) (*models.ReferralReward, error)
+	GetReferralStats(ctx context.Context, userID int64) (*models.ReferralStats, error)
+
+	// Бонусный баланс
+	GetBalance(ctx context.Context, userID int64) ([]money.Money, error)
+	GetLedger(ctx context.Context, userID int64, limit int) ([]models.LedgerTransaction, error)
+	AdjustBalance(ctx context.Context, userID int64, amount money.Money, actorID int64, reason string) (*models.LedgerTransaction, error)
+	ApplyBalance(ctx context.Context, orderID string, userID int64) (*models.Order, error)
+	RefundOrderToBalance(ctx context.Context, orderID string, actorID int64, reason string) (*models.LedgerTransaction, error)
+
+	// Переписка по заказам
+	AddSupportMessage(ctx context.Context, m models.SupportMessage) (*models.SupportMessage, error)
+	SaveSupportRelay(ctx context.Context, chatID int64, messageID int, supportMessageID int64) error
+	GetSupportMessageByRelay(ctx context.Context, chatID int64, messageID int) (*models.SupportMessage, error)
+	GetSupportThread(ctx context.Context, orderID string) ([]models.SupportMessage, error)
+
+	// Заказы в работе у админов
+	ClaimOrder(ctx context.Context, claim models.OrderClaim) (*models.OrderClaim, error)
+	GetOrderClaim(ctx context.Context, orderID string) (*models.OrderClaim, error)
+	SaveAdminNotification(ctx context.Context, n models.AdminNotification) error
+	GetAdminNotifications(ctx context.Context, orderID string) ([]models.AdminNotification, error)
+
+	// Подписки и напоминания о продлении
+	ListExpiringSubscriptions(ctx context.Context, from, until time.Time, limit int) ([]models.Subscription, error)
+	MarkSubscriptionReminded(ctx context.Context, itemID int64) error
+
+	// Предзаказы
+	ListReleasedPreorders(ctx context.Context, now time.Time, limit int) ([]models.Order, error)
+
+	// Карты для оплаты переводом
+	CreatePayoutCard(ctx context.Context, card models.PayoutCard) (*models.PayoutCard, error)
+	ListPayoutCards(ctx context.Context, since time.Time) ([]models.PayoutCard, error)
+	SetPayoutCardActive(ctx context.Context, cardID int, isActive bool) error
+	DeletePayoutCard(ctx context.Context, cardID int) error
+	AssignPayoutCard(ctx context.Context, orderID, rotation string, since time.Time) (*models.PayoutCard, error)
+	GetOrderPayoutCard(ctx context.Context, orderID string) (*models.PayoutCard, error)
+
+	// Уникальные суммы переводов и сверка с выпиской
+	AssignAmountOffset(ctx context.Context, orderID string, reservedSince time.Time) (*models.Order, error)
+	ListAwaitingTransfers(ctx context.Context, paymentMethod string, cancelledSince time.Time, limit int) ([]models.Order, error)
+	ConfirmLateTransfer(ctx context.Context, orderID string, actorID int64, reason string) error
+
+	// Рассылки
+	CreateBroadcast(ctx context.Context, adminID int64, text string) (*models.Broadcast, error)
+	SaveBroadcastPhoto(ctx context.Context, broadcastID int, fileID string, sortOrder int) error
+	GetBroadcastPhotos(ctx context.Context, broadcastID int) ([]models.BroadcastPhoto, error)
+	UpdateBroadcastStatus(ctx context.Context, broadcastID int, status string, totalUsers, sentCount, failedCount int) error
+	GetBroadcastByID(ctx context.Context, broadcastID int) (*models.Broadcast, error)
+	DeleteBroadcast(ctx context.Context, broadcastID int) error
+}
+
+// Проверки на этапе компиляции, что обе реализации удовлетворяют интерфейсу
+var (
+	_ Store = (*PostgresStorage)(nil)
+	_ Store = (*MemoryStorage)(nil)
+)
+
+// notFound превращает pgx.ErrNoRows в ErrNotFound, остальные ошибки возвращает как есть
+func notFound(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
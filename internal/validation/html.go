@@ -4,15 +4,28 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+
+	"tgwow/internal/money"
 )
 
 const (
-	// MaxPrice - максимальная разумная цена для товара (100,000 руб)
-	MaxPrice = 100000.0
-	// MinPrice - минимальная цена для товара
-	MinPrice = 0.0
+	// MaxPrice - максимальная разумная цена для товара в минимальных единицах валюты (100 000),
+	// если для валюты нет своего предела в maxPrices
+	MaxPrice int64 = 100000_00
+	// MinPrice - минимальная цена для товара в минимальных единицах валюты
+	MinPrice int64 = 0
 )
 
+// maxPrices - максимальная разумная цена в минимальных единицах валюты, примерно 100 000 руб.
+// в каждой валюте регионов
+var maxPrices = map[money.Currency]int64{
+	money.RUB: 100000_00,
+	money.KZT: 1000000_00,
+	money.UAH: 50000_00,
+	money.EUR: 2000_00,
+	money.TRY: 50000_00,
+}
+
 // Telegram поддерживает ограниченный набор HTML-тегов
 var allowedTags = map[string]bool{
 	"b":      true,
@@ -159,14 +172,22 @@ func SanitizeHTML(html string) string {
 	return html
 }
 
-// ValidatePrice проверяет корректность цены товара
-func ValidatePrice(price float64) error {
-	if price < MinPrice {
+// maxPriceFor возвращает максимальную цену товара в валюте currency (в минимальных единицах)
+func maxPriceFor(currency money.Currency) int64 {
+	if maxPrice, ok := maxPrices[currency]; ok {
+		return maxPrice
+	}
+	return MaxPrice
+}
+
+// ValidatePrice проверяет корректность цены товара в валюте цены
+func ValidatePrice(price money.Money) error {
+	if price.Amount < MinPrice {
 		return fmt.Errorf("цена не может быть отрицательной")
 	}
 
-	if price > MaxPrice {
-		return fmt.Errorf("цена слишком велика (максимум %.2f руб). Возможно, вы допустили опечатку?", MaxPrice)
+	if maxPrice := maxPriceFor(price.Currency); price.Amount > maxPrice {
+		return fmt.Errorf("цена слишком велика (максимум %s). Возможно, вы допустили опечатку?", money.New(maxPrice, price.Currency))
 	}
 
 	return nil
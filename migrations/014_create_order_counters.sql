@@ -0,0 +1,10 @@
+-- Счетчик заказов по дням для номеров WOW + YYMMDD + порядковый номер + контрольная цифра
+CREATE TABLE IF NOT EXISTS order_counters (
+    day DATE PRIMARY KEY,
+    last_value INTEGER NOT NULL
+);
+
+-- Новые номера длиннее старых (WOW241204123), расширяем колонку с запасом
+ALTER TABLE orders ALTER COLUMN order_id TYPE VARCHAR(32);
+
+COMMENT ON TABLE order_counters IS 'Последний выданный порядковый номер заказа за день';
@@ -0,0 +1,22 @@
+-- Валюта региона: цены товаров региона указываются в ней
+ALTER TABLE regions ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'RUB'
+    CHECK (currency IN ('RUB', 'KZT', 'UAH', 'EUR', 'TRY'));
+
+-- Регионам без заполненных цен сразу ставим их родную валюту.
+-- Регион с уже введенными ценами (KZ) остается в рублях, пока админ не пересчитает цены
+UPDATE regions r
+SET currency = v.currency
+FROM (VALUES ('KZ', 'KZT'), ('UA', 'UAH'), ('EU', 'EUR'), ('TUR', 'TRY')) AS v(code, currency)
+WHERE r.code = v.code
+  AND NOT EXISTS (
+      SELECT 1
+      FROM products p
+      JOIN categories c ON c.id = p.category_id
+      WHERE c.region_id = r.id AND p.price > 0
+  );
+
+-- Валюта заказа фиксируется при создании, как и цена. Все старые заказы были в рублях
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'RUB';
+
+COMMENT ON COLUMN regions.currency IS 'Код валюты ISO 4217 для цен товаров региона';
+COMMENT ON COLUMN orders.currency IS 'Валюта цены заказа на момент создания';
@@ -0,0 +1,21 @@
+-- История статусов заказа: кто, когда и почему менял статус
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    order_id VARCHAR(32) NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    from_status VARCHAR(50),
+    to_status VARCHAR(50) NOT NULL,
+    actor_id BIGINT,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history(order_id, created_at);
+
+-- Для существующих заказов фиксируем текущий статус как отправную точку
+INSERT INTO order_status_history (order_id, from_status, to_status, reason, created_at)
+SELECT order_id, NULL, status, 'Статус на момент включения истории', COALESCE(updated_at, created_at)
+FROM orders;
+
+COMMENT ON TABLE order_status_history IS 'Журнал смены статусов заказов';
+COMMENT ON COLUMN order_status_history.from_status IS 'NULL - создание заказа';
+COMMENT ON COLUMN order_status_history.actor_id IS 'Telegram ID пользователя или админа, NULL - система';
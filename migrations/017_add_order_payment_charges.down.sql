@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_orders_telegram_payment_charge_id;
+
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS provider_payment_charge_id,
+    DROP COLUMN IF EXISTS telegram_payment_charge_id;
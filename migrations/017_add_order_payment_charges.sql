@@ -0,0 +1,9 @@
+-- Идентификаторы платежа Telegram Payments: charge id Telegram и платежного провайдера.
+-- Нужны для сверки с провайдером и возвратов, у заказов с оплатой переводом остаются NULL
+ALTER TABLE orders
+    ADD COLUMN IF NOT EXISTS telegram_payment_charge_id VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS provider_payment_charge_id VARCHAR(255);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_telegram_payment_charge_id
+    ON orders(telegram_payment_charge_id)
+    WHERE telegram_payment_charge_id IS NOT NULL;
@@ -0,0 +1,5 @@
+-- Способ оплаты, выбранный покупателем (код из пакета payment: card, telegram, stars, crypto, mock).
+-- До появления выбора все заказы оплачивались переводом на карту
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_method VARCHAR(20) NOT NULL DEFAULT 'card';
+
+COMMENT ON COLUMN orders.payment_method IS 'Код способа оплаты заказа';
@@ -0,0 +1,18 @@
+-- Чеки об оплате, прикрепленные покупателем к заказу (фото или PDF, хранится file_id Telegram)
+CREATE TABLE IF NOT EXISTS order_receipts (
+    id BIGSERIAL PRIMARY KEY,
+    order_id VARCHAR(32) NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL,
+    file_id TEXT NOT NULL,
+    file_type VARCHAR(10) NOT NULL CHECK (file_type IN ('photo', 'document')),
+    status VARCHAR(10) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'rejected')),
+    reviewed_by BIGINT,
+    reviewed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_receipts_order_id ON order_receipts(order_id, created_at);
+
+COMMENT ON TABLE order_receipts IS 'Чеки об оплате заказов';
+COMMENT ON COLUMN order_receipts.status IS 'pending - ждет проверки, accepted - оплата подтверждена, rejected - чек отклонен';
+COMMENT ON COLUMN order_receipts.reviewed_by IS 'Telegram ID админа, проверившего чек';
@@ -0,0 +1,18 @@
+-- Склад ключей (кодов активации) товаров. Ключ закрепляется за заказом при выдаче
+CREATE TABLE IF NOT EXISTS product_keys (
+    id BIGSERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    code TEXT NOT NULL,
+    order_id VARCHAR(32) REFERENCES orders(order_id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP,
+    UNIQUE (product_id, code)
+);
+
+-- Свободные ключи выдаются в порядке загрузки
+CREATE INDEX IF NOT EXISTS idx_product_keys_available ON product_keys(product_id, id) WHERE order_id IS NULL;
+-- Один ключ на заказ
+CREATE UNIQUE INDEX IF NOT EXISTS idx_product_keys_order_id ON product_keys(order_id) WHERE order_id IS NOT NULL;
+
+COMMENT ON TABLE product_keys IS 'Ключи товаров для автоматической выдачи после оплаты';
+COMMENT ON COLUMN product_keys.order_id IS 'Заказ, которому выдан ключ; NULL - ключ свободен';
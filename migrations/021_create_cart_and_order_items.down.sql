@@ -0,0 +1,9 @@
+-- Заказы из корзины нельзя представить одним товаром
+DELETE FROM orders WHERE product_id IS NULL;
+ALTER TABLE orders ALTER COLUMN product_id SET NOT NULL;
+
+DROP INDEX IF EXISTS idx_product_keys_order_id;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_product_keys_order_id ON product_keys(order_id) WHERE order_id IS NOT NULL;
+
+DROP TABLE IF EXISTS order_items;
+DROP TABLE IF EXISTS cart_items;
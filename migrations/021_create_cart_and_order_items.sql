@@ -0,0 +1,39 @@
+-- Корзина покупателя: товар и количество, одна строка на товар
+CREATE TABLE IF NOT EXISTS cart_items (
+    user_id BIGINT NOT NULL,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    added_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, product_id)
+);
+
+-- Позиции заказа. Название и цена за единицу фиксируются при оформлении,
+-- валюта - orders.currency (корзина в одной валюте)
+CREATE TABLE IF NOT EXISTS order_items (
+    id BIGSERIAL PRIMARY KEY,
+    order_id VARCHAR(32) NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    product_id INTEGER REFERENCES products(id) ON DELETE SET NULL,
+    product_name VARCHAR(255) NOT NULL,
+    price NUMERIC(10, 2) NOT NULL,
+    quantity INTEGER NOT NULL DEFAULT 1 CHECK (quantity > 0)
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON order_items(order_id);
+
+-- Существующие заказы - одна позиция с товаром заказа
+INSERT INTO order_items (order_id, product_id, product_name, price, quantity)
+SELECT o.order_id, o.product_id, COALESCE(p.name, 'Товар'), o.price, 1
+FROM orders o
+LEFT JOIN products p ON p.id = o.product_id
+WHERE NOT EXISTS (SELECT 1 FROM order_items i WHERE i.order_id = o.order_id);
+
+-- У заказа из корзины нет единственного товара
+ALTER TABLE orders ALTER COLUMN product_id DROP NOT NULL;
+
+-- Заказ из корзины может получить несколько ключей
+DROP INDEX IF EXISTS idx_product_keys_order_id;
+CREATE INDEX IF NOT EXISTS idx_product_keys_order_id ON product_keys(order_id, product_id) WHERE order_id IS NOT NULL;
+
+COMMENT ON TABLE cart_items IS 'Корзина покупателя';
+COMMENT ON TABLE order_items IS 'Позиции заказа';
+COMMENT ON COLUMN orders.product_id IS 'Товар заказа; NULL - заказ из корзины, состав в order_items';
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_orders_promo_code;
+ALTER TABLE orders DROP COLUMN IF EXISTS discount;
+ALTER TABLE orders DROP COLUMN IF EXISTS promo_code;
+
+DROP TABLE IF EXISTS promo_codes;
@@ -0,0 +1,31 @@
+-- Промокоды. Скидка в процентах (percent) или фиксированная (amount в валюте currency).
+-- Область действия - товар, категория или регион; NULL не ограничивает
+CREATE TABLE IF NOT EXISTS promo_codes (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(32) NOT NULL UNIQUE,
+    percent INTEGER NOT NULL DEFAULT 0 CHECK (percent BETWEEN 0 AND 99),
+    amount NUMERIC(10, 2) NOT NULL DEFAULT 0 CHECK (amount >= 0),
+    currency VARCHAR(3) NOT NULL DEFAULT '',
+    product_id INTEGER REFERENCES products(id) ON DELETE CASCADE,
+    category_id INTEGER REFERENCES categories(id) ON DELETE CASCADE,
+    region_id INTEGER REFERENCES regions(id) ON DELETE CASCADE,
+    valid_from TIMESTAMP,
+    valid_until TIMESTAMP,
+    max_uses INTEGER NOT NULL DEFAULT 0 CHECK (max_uses >= 0),
+    max_uses_per_user INTEGER NOT NULL DEFAULT 0 CHECK (max_uses_per_user >= 0),
+    first_purchase_only BOOLEAN NOT NULL DEFAULT FALSE,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((percent > 0) <> (amount > 0))
+);
+
+-- Промокод и скидка заказа. price - сумма к оплате, уже со скидкой
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS promo_code VARCHAR(32) REFERENCES promo_codes(code);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS discount NUMERIC(10, 2) NOT NULL DEFAULT 0;
+
+-- Использования промокода считаются по заказам
+CREATE INDEX IF NOT EXISTS idx_orders_promo_code ON orders(promo_code, user_id) WHERE promo_code IS NOT NULL;
+
+COMMENT ON TABLE promo_codes IS 'Промокоды на скидку';
+COMMENT ON COLUMN orders.promo_code IS 'Примененный промокод';
+COMMENT ON COLUMN orders.discount IS 'Скидка по промокоду в валюте заказа';
@@ -0,0 +1,21 @@
+-- Реферальная программа. Пригласивший записывается один раз - при первом обращении пользователя к боту
+ALTER TABLE users ADD COLUMN IF NOT EXISTS referrer_id BIGINT REFERENCES users(user_id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_users_referrer_id ON users(referrer_id) WHERE referrer_id IS NOT NULL;
+
+-- Бонус пригласившему за первый оплаченный заказ приглашенного (не больше одного на приглашенного)
+CREATE TABLE IF NOT EXISTS referral_rewards (
+    id SERIAL PRIMARY KEY,
+    referrer_id BIGINT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    referred_id BIGINT NOT NULL UNIQUE REFERENCES users(user_id) ON DELETE CASCADE,
+    order_id VARCHAR(32) NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    amount NUMERIC(10, 2) NOT NULL CHECK (amount > 0),
+    currency VARCHAR(3) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_referral_rewards_referrer_id ON referral_rewards(referrer_id);
+
+COMMENT ON COLUMN users.referrer_id IS 'Пользователь, по чьей ссылке пришел этот пользователь';
+COMMENT ON TABLE referral_rewards IS 'Бонусы за первые оплаченные заказы приглашенных пользователей';
+COMMENT ON COLUMN referral_rewards.amount IS 'Бонус в валюте заказа';
@@ -0,0 +1,4 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS balance_used;
+
+DROP TABLE IF EXISTS ledger_entries;
+DROP TABLE IF EXISTS ledger_transactions;
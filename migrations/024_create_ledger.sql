@@ -0,0 +1,36 @@
+-- Бонусный баланс покупателей в виде бухгалтерской книги. Каждая операция - транзакция из проводок,
+-- сумма которых по валюте равна нулю: зачисление на один счет и списание с другого.
+-- Счет пользователя - user:<user_id>, остальные счета системные (system:referrals, system:sales, ...)
+CREATE TABLE IF NOT EXISTS ledger_transactions (
+    id BIGSERIAL PRIMARY KEY,
+    kind VARCHAR(32) NOT NULL,
+    user_id BIGINT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    order_id VARCHAR(32) REFERENCES orders(order_id) ON DELETE SET NULL,
+    actor_id BIGINT,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id BIGSERIAL PRIMARY KEY,
+    transaction_id BIGINT NOT NULL REFERENCES ledger_transactions(id) ON DELETE CASCADE,
+    account VARCHAR(64) NOT NULL,
+    amount NUMERIC(12, 2) NOT NULL CHECK (amount <> 0),
+    currency VARCHAR(3) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_ledger_transactions_user_id ON ledger_transactions(user_id, id DESC);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_account ON ledger_entries(account, currency);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_transaction_id ON ledger_entries(transaction_id);
+
+-- Возврат на баланс и возврат списания по заказу делаются не больше одного раза
+CREATE UNIQUE INDEX IF NOT EXISTS idx_ledger_transactions_order_kind ON ledger_transactions(order_id, kind)
+    WHERE order_id IS NOT NULL AND kind IN ('refund', 'checkout_reversal', 'referral');
+
+-- Часть заказа, оплаченная с баланса. price - остаток к оплате
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS balance_used NUMERIC(10, 2) NOT NULL DEFAULT 0;
+
+COMMENT ON TABLE ledger_transactions IS 'Операции бонусного баланса: referral, refund, adjustment, checkout, checkout_reversal';
+COMMENT ON TABLE ledger_entries IS 'Проводки операций: + зачисление на счет, - списание со счета';
+COMMENT ON COLUMN ledger_transactions.actor_id IS 'Админ, выполнивший операцию; NULL - автоматически';
+COMMENT ON COLUMN orders.balance_used IS 'Оплачено с бонусного баланса в валюте заказа';
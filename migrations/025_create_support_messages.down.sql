@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS support_relays;
+DROP TABLE IF EXISTS support_messages;
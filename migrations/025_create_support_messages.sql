@@ -0,0 +1,24 @@
+-- Переписка покупателя с админами по заказу
+CREATE TABLE IF NOT EXISTS support_messages (
+    id BIGSERIAL PRIMARY KEY,
+    order_id VARCHAR(32) NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL,
+    admin_id BIGINT,
+    text TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_support_messages_order_id ON support_messages(order_id, created_at);
+
+-- Копии сообщений переписки в чатах Telegram: ответ (reply) на копию продолжает переписку
+CREATE TABLE IF NOT EXISTS support_relays (
+    chat_id BIGINT NOT NULL,
+    message_id INTEGER NOT NULL,
+    support_message_id BIGINT NOT NULL REFERENCES support_messages(id) ON DELETE CASCADE,
+    PRIMARY KEY (chat_id, message_id)
+);
+
+COMMENT ON TABLE support_messages IS 'Сообщения покупателей и ответы админов по заказам';
+COMMENT ON COLUMN support_messages.user_id IS 'Покупатель, с которым идет переписка';
+COMMENT ON COLUMN support_messages.admin_id IS 'Telegram ID ответившего админа, NULL - сообщение покупателя';
+COMMENT ON TABLE support_relays IS 'Сообщения бота, доставившие сообщение переписки в чат админа или покупателя';
@@ -0,0 +1,21 @@
+-- Заказ, взятый админом в работу: пока заказ закреплен, остальные админы не меняют его статус
+CREATE TABLE IF NOT EXISTS order_claims (
+    order_id VARCHAR(32) PRIMARY KEY REFERENCES orders(order_id) ON DELETE CASCADE,
+    admin_id BIGINT NOT NULL,
+    admin_name VARCHAR(255) NOT NULL,
+    claimed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Уведомления админов о новом заказе: когда заказ берут в работу, все копии правятся
+CREATE TABLE IF NOT EXISTS admin_notifications (
+    order_id VARCHAR(32) NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    chat_id BIGINT NOT NULL,
+    message_id INTEGER NOT NULL,
+    text TEXT NOT NULL,
+    PRIMARY KEY (order_id, chat_id)
+);
+
+COMMENT ON TABLE order_claims IS 'Заказы, взятые админами в работу';
+COMMENT ON COLUMN order_claims.admin_name IS 'Имя админа на момент взятия, для уведомлений остальных админов';
+COMMENT ON TABLE admin_notifications IS 'Сообщения бота с уведомлением админа о новом заказе';
+COMMENT ON COLUMN admin_notifications.text IS 'Текст уведомления (HTML), к нему дописывается, кто взял заказ';
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_order_items_expires_at;
+ALTER TABLE order_items DROP COLUMN IF EXISTS reminded_at;
+ALTER TABLE order_items DROP COLUMN IF EXISTS expires_at;
+ALTER TABLE order_items DROP COLUMN IF EXISTS duration_months;
+ALTER TABLE products DROP COLUMN IF EXISTS duration_months;
@@ -0,0 +1,19 @@
+-- Срок подписки товара в месяцах. NULL - товар не подписка (услуга, дополнение)
+ALTER TABLE products ADD COLUMN IF NOT EXISTS duration_months INTEGER CHECK (duration_months > 0);
+
+-- Подписки из каталога называются по сроку: "1 месяц", "3 месяца", "12 месяцев"
+UPDATE products
+SET duration_months = substring(name FROM '^(\d+) мес')::INTEGER
+WHERE duration_months IS NULL AND name ~ '^\d+ мес';
+
+-- Срок фиксируется в позиции при оформлении, окончание считается при выполнении заказа
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS duration_months INTEGER;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS reminded_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_order_items_expires_at ON order_items(expires_at) WHERE reminded_at IS NULL;
+
+COMMENT ON COLUMN products.duration_months IS 'Срок подписки в месяцах, NULL - не подписка';
+COMMENT ON COLUMN order_items.duration_months IS 'Срок подписки на единицу товара на момент оформления';
+COMMENT ON COLUMN order_items.expires_at IS 'Окончание подписки, считается при выполнении заказа';
+COMMENT ON COLUMN order_items.reminded_at IS 'Когда покупателю напомнили о продлении';
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_orders_preordered;
+DROP INDEX IF EXISTS idx_products_release_at;
+ALTER TABLE products DROP COLUMN IF EXISTS release_at;
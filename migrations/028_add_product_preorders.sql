@@ -0,0 +1,8 @@
+-- Дата выхода товара. Пока она не наступила, товар продается по предзаказу:
+-- оплаченные заказы ждут выхода в статусе preordered. NULL - обычный товар
+ALTER TABLE products ADD COLUMN IF NOT EXISTS release_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_products_release_at ON products(release_at) WHERE release_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_orders_preordered ON orders(created_at) WHERE status = 'preordered';
+
+COMMENT ON COLUMN products.release_at IS 'Дата выхода товара предзаказа, NULL - обычный товар';
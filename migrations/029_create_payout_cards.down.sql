@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_orders_payout_card;
+ALTER TABLE orders DROP COLUMN IF EXISTS payout_card_id;
+
+DROP TABLE IF EXISTS payout_cards;
@@ -0,0 +1,25 @@
+-- Карты для приема переводов. Бот выбирает карту для каждого заказа по региону и политике ротации.
+-- region_id NULL - карта для всех регионов; daily_limit 0 - без дневного лимита
+CREATE TABLE IF NOT EXISTS payout_cards (
+    id SERIAL PRIMARY KEY,
+    number VARCHAR(32) NOT NULL,
+    bank_name VARCHAR(64) NOT NULL,
+    holder VARCHAR(128) NOT NULL,
+    region_id INTEGER REFERENCES regions(id) ON DELETE CASCADE,
+    daily_limit NUMERIC(10, 2) NOT NULL DEFAULT 0 CHECK (daily_limit >= 0),
+    currency VARCHAR(3) NOT NULL DEFAULT '',
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    last_used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Карта, реквизиты которой получил покупатель
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payout_card_id INTEGER REFERENCES payout_cards(id) ON DELETE SET NULL;
+
+-- Дневной оборот карты считается по ее заказам
+CREATE INDEX IF NOT EXISTS idx_orders_payout_card ON orders(payout_card_id, created_at) WHERE payout_card_id IS NOT NULL;
+
+COMMENT ON TABLE payout_cards IS 'Карты для оплаты заказов переводом';
+COMMENT ON COLUMN payout_cards.daily_limit IS 'Сумма заказов на карту за день (МСК) в валюте currency, 0 - без лимита';
+COMMENT ON COLUMN payout_cards.last_used_at IS 'Когда карту последний раз выдали покупателю, для ротации';
+COMMENT ON COLUMN orders.payout_card_id IS 'Карта для перевода, выданная покупателю';
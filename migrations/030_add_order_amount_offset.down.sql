@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_orders_created_amount;
+ALTER TABLE orders DROP COLUMN IF EXISTS amount_offset;
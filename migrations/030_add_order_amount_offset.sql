@@ -0,0 +1,8 @@
+-- Уникальные копейки к сумме перевода на карту: по сумме заказ находится в выписке банка,
+-- даже если покупатель не указал номер заказа в комментарии. 0 - без метки
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS amount_offset NUMERIC(10, 2) NOT NULL DEFAULT 0 CHECK (amount_offset >= 0);
+
+-- Занятые суммы ищутся среди заказов, ожидающих оплаты
+CREATE INDEX IF NOT EXISTS idx_orders_created_amount ON orders(currency, price) WHERE status = 'created';
+
+COMMENT ON COLUMN orders.amount_offset IS 'Надбавка к сумме перевода, уникальная среди неоплаченных заказов в валюте заказа';
@@ -0,0 +1,11 @@
+// Package migrations встраивает SQL-миграции в бинарник бота.
+//
+// Файлы именуются NNN_name.sql (применение) и NNN_name.down.sql (откат, опционально).
+package migrations
+
+import "embed"
+
+// FS содержит все SQL-файлы миграций
+//
+//go:embed *.sql
+var FS embed.FS